@@ -0,0 +1,156 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"iter"
+	"os"
+	"time"
+)
+
+// Signature computes the block signature of the basis r using DefaultBlockSize.
+func Signature(r io.Reader) (*HashInfo, error) {
+	return GetReaderHashInfo(r, nil)
+}
+
+// Delta compares r with the basis described by sig and writes the delta frames to w.
+func Delta(sig *HashInfo, r io.Reader, w io.Writer) error {
+	return analyseReader(sig, r, func(info *AnalyseInfo) error {
+		return info.Write(w)
+	})
+}
+
+// DeltaCompress is Delta with literal frames compressed by c (CompressZstd or CompressGzip).
+func DeltaCompress(sig *HashInfo, r io.Reader, w io.Writer, c uint8) error {
+	cw := NewCompressWriter(w, c)
+	return analyseReader(sig, r, cw.Write)
+}
+
+// DeltaIter ranges over the delta frames of r against sig, see FileHashInfo.AnalyseIter
+func DeltaIter(sig *HashInfo, r io.Reader) iter.Seq2[*AnalyseInfo, error] {
+	return analyseIter(func(fn func(info *AnalyseInfo) error) error {
+		return analyseReader(sig, r, fn)
+	})
+}
+
+// DeltaAppend is DeltaCompress for growing files, when the basis is a prefix of r
+// only the appended tail is sent as data
+func DeltaAppend(sig *HashInfo, r io.Reader, w io.Writer, c uint8) error {
+	cw := NewCompressWriter(w, c)
+	return analyseReader(sig, r, cw.Write, appendOnly)
+}
+
+func appendOnly(fh *FileHashInfo) {
+	fh.Append = true
+}
+
+// analyseReader runs Analyse over r, readers that can't seek are read into memory first,
+// setup adjusts the options before the analyse
+func analyseReader(sig *HashInfo, r io.Reader, fn func(info *AnalyseInfo) error, setup ...func(fh *FileHashInfo)) error {
+	if sig == nil {
+		return ErrNoSignature
+	}
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		dat, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		rs = bytes.NewReader(dat)
+	}
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fh := NewFileHashInfo("", sig)
+	fh.Reader = rs
+	fh.setSize(size)
+	if f, ok := r.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			fh.Meta = NewFileMeta(fi)
+		}
+	}
+	for _, f := range setup {
+		f(fh)
+	}
+	return fh.analyse(context.Background(), rs, fn)
+}
+
+// Patch applies the delta to basis and writes the rebuilt file to out,
+// frame failures are *FrameError
+func Patch(basis io.ReaderAt, delta io.Reader, out io.Writer) error {
+	return mergeFrames(NewStreamMerger(basis, out), delta)
+}
+
+// PatchAt is Patch writing the rebuilt file at its offsets of out
+func PatchAt(basis io.ReaderAt, delta io.Reader, out io.WriterAt) error {
+	return mergeFrames(NewStreamMergerAt(basis, out), delta)
+}
+
+// SyncFile rebuilds dstPath from srcPath, the signature of dstPath, the delta and the merge
+// run over a pipe, opts set the signature block size and hashes and the merge hooks
+func SyncFile(srcPath string, dstPath string, opts ...Option) (Stats, error) {
+	now := time.Now()
+	st := Stats{}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return st, err
+	}
+	defer src.Close()
+	args := make([]interface{}, len(opts))
+	for i, v := range opts {
+		args[i] = v
+	}
+	sig, err := GetFileHashInfo(dstPath, nil, args...)
+	if err != nil {
+		return st, err
+	}
+	st.SignatureSize = signatureSize(sig)
+	m := NewFileMerger(dstPath, sig, opts...)
+	if err := m.Open(); err != nil {
+		return st, err
+	}
+	defer m.Close()
+	pr, pw := io.Pipe()
+	cw := &countWriter{w: pw}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		pw.CloseWithError(analyseReader(sig, src, st.countFrames(func(info *AnalyseInfo) error {
+			return info.Write(cw)
+		})))
+	}()
+	err = mergeFrames(m, pr)
+	pr.CloseWithError(errors.New("merge done"))
+	<-done
+	st.DeltaSize = cw.n
+	st.Files = 1
+	st.Duration = time.Since(now)
+	return st, err
+}
+
+// frameWriter merges frames, FileMerger and StreamMerger
+type frameWriter interface {
+	Write(info *AnalyseInfo) error
+}
+
+// mergeFrames writes the frames of delta into m until the close frame
+func mergeFrames(m frameWriter, delta io.Reader) error {
+	for {
+		info := &AnalyseInfo{}
+		if err := info.Read(delta); err != nil {
+			return err
+		}
+		if err := m.Write(info); err != nil {
+			return err
+		}
+		if info.IsClose() {
+			return nil
+		}
+	}
+}
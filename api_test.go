@@ -0,0 +1,154 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignatureDeltaPatch(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	basis := make([]byte, DefaultBlockSize*8+100)
+	rnd.Read(basis)
+	src := append([]byte{}, basis[:DefaultBlockSize*3]...)
+	src = append(src, []byte("inserted data")...)
+	src = append(src, basis[DefaultBlockSize*3+7:]...)
+
+	sig, err := Signature(bytes.NewReader(basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := &bytes.Buffer{}
+	if err := Delta(sig, bytes.NewReader(src), delta); err != nil {
+		t.Fatal(err)
+	}
+	if delta.Len() >= len(src) {
+		t.Errorf("delta size %d not smaller than source %d", delta.Len(), len(src))
+	}
+	out := &bytes.Buffer{}
+	if err := Patch(bytes.NewReader(basis), delta, out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), src) {
+		t.Error("patch result error")
+	}
+}
+
+func TestShortBlockDelta(t *testing.T) {
+	basis := bytes.Repeat([]byte("abcdefghijklmnopqrstuvwxyz"), 100)
+	sig, err := Signature(bytes.NewReader(basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb := sig.ShortBlock(); sb == nil || int(sb.Len) != len(basis)%DefaultBlockSize {
+		t.Fatal("short block error")
+	}
+	delta := &bytes.Buffer{}
+	if err := Delta(sig, bytes.NewReader(basis), delta); err != nil {
+		t.Fatal(err)
+	}
+	literal := 0
+	out := &bytes.Buffer{}
+	tee := io.TeeReader(delta, out)
+	for {
+		info := &AnalyseInfo{}
+		if err := info.Read(tee); err != nil {
+			t.Fatal(err)
+		}
+		literal += len(info.Data)
+		if info.IsClose() {
+			break
+		}
+	}
+	if literal != 0 {
+		t.Error("literal data in delta", literal)
+	}
+	res := &bytes.Buffer{}
+	if err := Patch(bytes.NewReader(basis), out, res); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res.Bytes(), basis) {
+		t.Error("patch result error")
+	}
+}
+
+func TestDeltaIter(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	basis := make([]byte, DefaultBlockSize*8+100)
+	rnd.Read(basis)
+	src := append([]byte("head"), basis...)
+	sig, err := Signature(bytes.NewReader(basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := &bytes.Buffer{}
+	for info, err := range DeltaIter(sig, bytes.NewReader(src)) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := info.Write(delta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := &bytes.Buffer{}
+	if err := Patch(bytes.NewReader(basis), delta, out); err != nil || !bytes.Equal(out.Bytes(), src) {
+		t.Fatal("patch error", err)
+	}
+	//breaking stops the analyse
+	n := 0
+	for info := range DeltaIter(sig, bytes.NewReader(src)) {
+		if n++; !info.IsOpen() {
+			t.Error("first frame not open")
+		}
+		break
+	}
+	if n != 1 {
+		t.Error("frames after break", n)
+	}
+	for info, err := range DeltaIter(nil, bytes.NewReader(src)) {
+		if info != nil || !errors.Is(err, ErrNoSignature) {
+			t.Error("error not yielded", err)
+		}
+	}
+}
+
+func TestSyncFile(t *testing.T) {
+	dir := t.TempDir()
+	rnd := rand.New(rand.NewSource(3))
+	basis := make([]byte, 512*40)
+	rnd.Read(basis)
+	src, dst := filepath.Join(dir, "src.bin"), filepath.Join(dir, "dst.bin")
+	if err := os.WriteFile(src, basis, 0644); err != nil {
+		t.Fatal(err)
+	}
+	//missing destination
+	st, err := SyncFile(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(dst); err != nil || !bytes.Equal(got, basis) || st.Literal != int64(len(basis)) {
+		t.Fatal("create error", err, st.Literal)
+	}
+	changed := append([]byte("head"), basis...)
+	if err := os.WriteFile(src, changed, 0644); err != nil {
+		t.Fatal(err)
+	}
+	done := 0
+	hooks := &Hooks{OnFileComplete: func(path string, size int64, hash []byte) {
+		done++
+	}}
+	st, err = SyncFile(src, dst, WithBlockSize(512), WithStrongHash(SHA256Hasher), WithHooks(hooks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(dst); err != nil || !bytes.Equal(got, changed) {
+		t.Fatal("update error", err)
+	}
+	if st.Blocks != 40 || st.Literal != 4 || st.Files != 1 || st.DeltaSize == 0 || done != 1 {
+		t.Error("stats error", st.String(), done)
+	}
+}
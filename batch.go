@@ -0,0 +1,281 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const BatchMagic = "RSBT"
+
+// batch entry types, each but the end is followed by the path len(2)+path
+const (
+	batchEnd     = 0
+	batchDelta   = 1 //delta frames to the close frame
+	batchRemove  = 2
+	batchSymlink = 3 //target len(2)+target
+	batchLink    = 4 //target len(2)+target
+)
+
+// ErrBatchBroken is returned by a BatchWriter after an entry failed half written
+var ErrBatchBroken = errors.New("batch broken")
+
+// BatchWriter is the Transport recording the changes of a sync against Basis into a batch,
+// ReadBatch replays it on destinations holding the same files as Basis like rsync --read-batch
+type BatchWriter struct {
+	Basis Transport //answers signatures and lists
+	//also apply the changes to Basis like --write-batch, false only records them like --only-write-batch
+	Update bool
+	w      *bufio.Writer
+	mu     sync.Mutex
+	broken bool
+}
+
+// NewBatchWriter writes the batch header to w, Close writes the end of the batch
+func NewBatchWriter(w io.Writer, basis Transport) (*BatchWriter, error) {
+	bw := bufio.NewWriter(w)
+	if err := writeHeader(bw, BatchMagic); err != nil {
+		return nil, err
+	}
+	return &BatchWriter{Basis: basis, w: bw}, nil
+}
+
+func (this *BatchWriter) Signature(ctx context.Context, path string) (*HashInfo, error) {
+	return this.Basis.Signature(ctx, path)
+}
+
+// entry writes the entry head, fn writes the rest, a failed fn breaks the batch
+func (this *BatchWriter) entry(typ byte, path string, fn func(w io.Writer) error) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.broken {
+		return ErrBatchBroken
+	}
+	if len(path) > 0xFFFF {
+		return fmt.Errorf("batch path %s too long", path)
+	}
+	this.w.WriteByte(typ)
+	this.w.Write(tobyte16(uint16(len(path))))
+	this.w.WriteString(path)
+	if err := fn(this.w); err != nil {
+		this.broken = true
+		return err
+	}
+	return nil
+}
+
+// Apply records the delta and applies it to Basis when Update is set
+func (this *BatchWriter) Apply(ctx context.Context, path string, delta io.Reader) error {
+	return this.entry(batchDelta, path, func(w io.Writer) error {
+		if !this.Update {
+			_, err := copyDelta(w, delta)
+			return err
+		}
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			done <- this.Basis.Apply(ctx, path, pr)
+			pr.CloseWithError(errors.New("apply done"))
+		}()
+		_, err := copyDelta(io.MultiWriter(w, pw), delta)
+		pw.CloseWithError(err)
+		if aerr := <-done; err == nil {
+			err = aerr
+		}
+		return err
+	})
+}
+
+// copyDelta copies the frames of one delta up to its close frame
+func copyDelta(w io.Writer, delta io.Reader) (int64, error) {
+	cw := &countWriter{w: w}
+	for {
+		info := &AnalyseInfo{}
+		if err := info.Read(delta); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return cw.n, err
+		}
+		if err := info.Write(cw); err != nil {
+			return cw.n, err
+		}
+		if info.IsClose() {
+			return cw.n, nil
+		}
+	}
+}
+
+func (this *BatchWriter) List(ctx context.Context, dir string) ([]FileEntry, error) {
+	l, ok := this.Basis.(Lister)
+	if !ok {
+		return nil, errors.New("batch basis can't list files")
+	}
+	return l.List(ctx, dir)
+}
+
+func (this *BatchWriter) Remove(ctx context.Context, path string) error {
+	return this.change(ctx, batchRemove, path, "", func() error {
+		r, ok := this.Basis.(Remover)
+		if !ok {
+			return errors.New("batch basis can't remove files")
+		}
+		return r.Remove(ctx, path)
+	})
+}
+
+func (this *BatchWriter) Symlink(ctx context.Context, target string, path string) error {
+	return this.change(ctx, batchSymlink, path, target, func() error {
+		s, ok := this.Basis.(Symlinker)
+		if !ok {
+			return errors.New("batch basis can't create symlinks")
+		}
+		return s.Symlink(ctx, target, path)
+	})
+}
+
+func (this *BatchWriter) Link(ctx context.Context, target string, path string) error {
+	return this.change(ctx, batchLink, path, target, func() error {
+		h, ok := this.Basis.(HardLinker)
+		if !ok {
+			return errors.New("batch basis can't create hard links")
+		}
+		return h.Link(ctx, target, path)
+	})
+}
+
+// change records a remove or link entry after update applied it to Basis
+func (this *BatchWriter) change(ctx context.Context, typ byte, path string, target string, update func() error) error {
+	if len(target) > 0xFFFF {
+		return fmt.Errorf("batch link target %s too long", target)
+	}
+	if this.Update {
+		if err := update(); err != nil {
+			return err
+		}
+	}
+	return this.entry(typ, path, func(w io.Writer) error {
+		if typ == batchRemove {
+			return nil
+		}
+		w.Write(tobyte16(uint16(len(target))))
+		_, err := io.WriteString(w, target)
+		return err
+	})
+}
+
+// Close ends the batch and flushes it, Basis is left open
+func (this *BatchWriter) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.broken {
+		return ErrBatchBroken
+	}
+	this.broken = true
+	if err := this.w.WriteByte(batchEnd); err != nil {
+		return err
+	}
+	return this.w.Flush()
+}
+
+// batchDeltaReader reads one delta of the batch up to its close frame
+type batchDeltaReader struct {
+	r    io.Reader
+	buf  bytes.Buffer
+	done bool
+	err  error //the batch can't be read on
+}
+
+func (this *batchDeltaReader) Read(p []byte) (int, error) {
+	for this.buf.Len() == 0 {
+		if this.done {
+			return 0, io.EOF
+		}
+		info := &AnalyseInfo{}
+		if err := info.Read(this.r); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			this.err = err
+			return 0, err
+		}
+		this.done = info.IsClose()
+		if err := info.Write(&this.buf); err != nil {
+			this.err = err
+			return 0, err
+		}
+	}
+	return this.buf.Read(p)
+}
+
+// ReadBatch applies the batch written by a BatchWriter to t, the destination must hold the
+// same files as the basis the batch was written against, the merges check the result hashes
+func ReadBatch(ctx context.Context, r io.Reader, t Transport) error {
+	br := bufio.NewReader(r)
+	if err := readHeader(br, BatchMagic); err != nil {
+		return err
+	}
+	for {
+		typ, err := br.ReadByte()
+		if err != nil {
+			return fmt.Errorf("read batch: %w", err)
+		}
+		if typ == batchEnd {
+			return nil
+		}
+		path, err := readString16(br)
+		if err != nil {
+			return fmt.Errorf("read batch: %w", err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := readBatchEntry(ctx, br, t, typ, path); err != nil {
+			return fmt.Errorf("batch %s: %w", path, err)
+		}
+	}
+}
+
+func readBatchEntry(ctx context.Context, br *bufio.Reader, t Transport, typ byte, path string) error {
+	switch typ {
+	case batchDelta:
+		dr := &batchDeltaReader{r: br}
+		err := t.Apply(ctx, path, dr)
+		if dr.err != nil {
+			return dr.err
+		}
+		//the rest of a failed delta, the next entry follows it
+		if _, derr := io.Copy(io.Discard, dr); derr != nil {
+			return derr
+		}
+		return err
+	case batchRemove:
+		rm, ok := t.(Remover)
+		if !ok {
+			return errors.New("transport can't remove files")
+		}
+		return rm.Remove(ctx, path)
+	case batchSymlink, batchLink:
+		target, err := readString16(br)
+		if err != nil {
+			return err
+		}
+		if typ == batchLink {
+			h, ok := t.(HardLinker)
+			if !ok {
+				return errors.New("transport can't create hard links")
+			}
+			return h.Link(ctx, target, path)
+		}
+		s, ok := t.(Symlinker)
+		if !ok {
+			return errors.New("transport can't create symlinks")
+		}
+		return s.Symlink(ctx, target, path)
+	}
+	return fmt.Errorf("batch entry type %d error", typ)
+}
@@ -0,0 +1,83 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	big := strings.Repeat("0123456789", 2000)
+	old := map[string]string{"a.txt": "old a", "b/c.txt": big, "gone.txt": "gone"}
+	src := t.TempDir()
+	testWriteFiles(t, src, map[string]string{"a.txt": "new a", "b/c.txt": "head " + big, "d/e.txt": "e"})
+	if err := os.Symlink("a.txt", filepath.Join(src, "l.txt")); err != nil {
+		t.Skip(err)
+	}
+	basis, dst := t.TempDir(), t.TempDir()
+	testWriteFiles(t, basis, old)
+	testWriteFiles(t, dst, old)
+	ctx := context.Background()
+	batch := &bytes.Buffer{}
+	bw, err := NewBatchWriter(batch, NewLocalStore(basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewDirSyncer(src, bw, "")
+	s.Delete = true
+	if err := s.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//only written, the basis is left alone
+	testCheckFiles(t, basis, old)
+	if batch.Len() >= len(big) {
+		t.Fatalf("batch size %d", batch.Len())
+	}
+	if err := ReadBatch(ctx, bytes.NewReader(batch.Bytes()), NewLocalStore(dst)); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a.txt": "new a", "b/c.txt": "head " + big, "d/e.txt": "e", "l.txt": "new a"}
+	testCheckFiles(t, dst, want)
+	if _, err := os.Stat(filepath.Join(dst, "gone.txt")); !os.IsNotExist(err) {
+		t.Error("removed file kept")
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "l.txt")); err != nil || link != "a.txt" {
+		t.Error("symlink error", err)
+	}
+	//a destination other than the basis fails the merge hash
+	other := t.TempDir()
+	testWriteFiles(t, other, map[string]string{"a.txt": "old a", "b/c.txt": strings.ToUpper(big)})
+	if err := ReadBatch(ctx, bytes.NewReader(batch.Bytes()), NewLocalStore(other)); err == nil {
+		t.Error("batch applied to another basis")
+	}
+	//update mode writes the same batch while syncing the basis
+	batch2 := &bytes.Buffer{}
+	bw, err = NewBatchWriter(batch2, NewLocalStore(basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bw.Update = true
+	s.Dst = bw
+	if err := s.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, basis, want)
+	if _, err := os.Stat(filepath.Join(basis, "gone.txt")); !os.IsNotExist(err) {
+		t.Error("update kept removed file")
+	}
+	if err := bw.Apply(ctx, "x.txt", bytes.NewReader(nil)); err != ErrBatchBroken {
+		t.Error("write after close", err)
+	}
+	if err := ReadBatch(ctx, bytes.NewReader(batch.Bytes()[:batch.Len()-1]), NewLocalStore(t.TempDir())); err == nil {
+		t.Error("truncated batch accepted")
+	}
+}
@@ -0,0 +1,223 @@
+package rsync
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+)
+
+const BundleMagic = "RSBN"
+
+// bundle entry types, a file is followed by
+//
+//	path len(2) path size(8) flags(1) [meta(20) when meta] [signature when sig]
+const (
+	bundleEnd  = 0
+	bundleFile = 1
+)
+
+// bundle entry flags
+const (
+	bundleFlagMeta = 1 << 0
+	bundleFlagSig  = 1 << 1
+)
+
+// BundleEntry is one file of a signature bundle
+type BundleEntry struct {
+	Path string
+	Size int64
+	Meta *FileMeta //nil when unknown
+	Sig  *HashInfo //nil when the file has no signature
+}
+
+// BundleWriter writes the signatures of many files into one stream, a dir worth of signatures
+// is sent in one round trip and read back with a BundleReader
+type BundleWriter struct {
+	w      *bufio.Writer
+	closed bool
+}
+
+// NewBundleWriter writes the bundle header to w, Close writes the end of the bundle
+func NewBundleWriter(w io.Writer) (*BundleWriter, error) {
+	bw := bufio.NewWriter(w)
+	if err := writeHeader(bw, BundleMagic); err != nil {
+		return nil, err
+	}
+	return &BundleWriter{w: bw}, nil
+}
+
+// Add writes one entry
+func (this *BundleWriter) Add(e *BundleEntry) error {
+	if this.closed {
+		return errors.New("bundle closed")
+	}
+	if len(e.Path) > 0xFFFF {
+		return fmt.Errorf("bundle path %s too long", e.Path)
+	}
+	if e.Size < 0 {
+		return fmt.Errorf("bundle %s size %d error", e.Path, e.Size)
+	}
+	flags := byte(0)
+	if e.Meta != nil {
+		flags |= bundleFlagMeta
+	}
+	//a signature without hash writes nothing
+	if e.Sig != nil && e.Sig.MD5 != nil {
+		flags |= bundleFlagSig
+	}
+	this.w.WriteByte(bundleFile)
+	this.w.Write(tobyte16(uint16(len(e.Path))))
+	this.w.WriteString(e.Path)
+	this.w.Write(tobyte64(uint64(e.Size)))
+	if err := this.w.WriteByte(flags); err != nil {
+		return err
+	}
+	if e.Meta != nil {
+		if err := e.Meta.Write(this.w); err != nil {
+			return err
+		}
+	}
+	if flags&bundleFlagSig != 0 {
+		return e.Sig.Write(this.w)
+	}
+	return nil
+}
+
+// Close ends the bundle and flushes it
+func (this *BundleWriter) Close() error {
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+	if err := this.w.WriteByte(bundleEnd); err != nil {
+		return err
+	}
+	return this.w.Flush()
+}
+
+// BundleReader reads the entries of a bundle in the order they were added
+type BundleReader struct {
+	r    *bufio.Reader
+	done bool
+}
+
+// NewBundleReader reads the bundle header from r
+func NewBundleReader(r io.Reader) (*BundleReader, error) {
+	br := bufio.NewReader(r)
+	if err := readHeader(br, BundleMagic); err != nil {
+		return nil, err
+	}
+	return &BundleReader{r: br}, nil
+}
+
+// Next returns the next entry, io.EOF after the end of the bundle
+func (this *BundleReader) Next() (*BundleEntry, error) {
+	if this.done {
+		return nil, io.EOF
+	}
+	typ, err := this.r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("read bundle: %w", noEOF(err))
+	}
+	switch typ {
+	case bundleEnd:
+		this.done = true
+		return nil, io.EOF
+	case bundleFile:
+	default:
+		return nil, fmt.Errorf("%w: bundle entry type %d", ErrMalformed, typ)
+	}
+	e := &BundleEntry{}
+	if e.Path, err = readString16(this.r); err != nil {
+		return nil, fmt.Errorf("read bundle: %w", noEOF(err))
+	}
+	b9 := make([]byte, 9)
+	if _, err := io.ReadFull(this.r, b9); err != nil {
+		return nil, fmt.Errorf("bundle %s: %w", e.Path, noEOF(err))
+	}
+	size, err := toint64(b9[:8])
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("%w: bundle %s size %d", ErrMalformed, e.Path, size)
+	}
+	e.Size = size
+	flags := b9[8]
+	if flags&^(bundleFlagMeta|bundleFlagSig) != 0 {
+		return nil, fmt.Errorf("%w: bundle %s flags %x", ErrMalformed, e.Path, flags)
+	}
+	if flags&bundleFlagMeta != 0 {
+		e.Meta = &FileMeta{}
+		if err := e.Meta.Read(this.r); err != nil {
+			return nil, fmt.Errorf("bundle %s: %w", e.Path, noEOF(err))
+		}
+	}
+	if flags&bundleFlagSig != 0 {
+		e.Sig = NewHashInfo()
+		if err := e.Sig.Read(this.r); err != nil {
+			return nil, fmt.Errorf("bundle %s: %w", e.Path, noEOF(err))
+		}
+	}
+	return e, nil
+}
+
+// ReadBundle reads all entries of a bundle
+func ReadBundle(r io.Reader) ([]*BundleEntry, error) {
+	br, err := NewBundleReader(r)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*BundleEntry{}
+	for {
+		e, err := br.Next()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, e)
+	}
+}
+
+// WriteDirBundle writes the signatures of the regular files under dir of t, listed by its Lister,
+// entry paths are relative to dir
+func WriteDirBundle(ctx context.Context, w io.Writer, t Transport, dir string) error {
+	l, ok := t.(Lister)
+	if !ok {
+		return errors.New("transport can't list files")
+	}
+	list, err := l.List(ctx, dir)
+	if err != nil {
+		return err
+	}
+	bw, err := NewBundleWriter(w)
+	if err != nil {
+		return err
+	}
+	for _, v := range list {
+		if !v.IsRegular() {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		file := v.Path
+		if dir != "" {
+			file = path.Join(dir, v.Path)
+		}
+		sig, err := t.Signature(ctx, file)
+		if err != nil {
+			return fmt.Errorf("signature %s: %w", v.Path, err)
+		}
+		meta := &FileMeta{Mode: v.Mode.Perm(), ModTime: v.ModTime, Uid: -1, Gid: -1}
+		if err := bw.Add(&BundleEntry{Path: v.Path, Size: v.Size, Meta: meta, Sig: sig}); err != nil {
+			return err
+		}
+	}
+	return bw.Close()
+}
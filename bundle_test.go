@@ -0,0 +1,71 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBundle(t *testing.T) {
+	ctx := context.Background()
+	big := strings.Repeat("bundle data ", 500)
+	root := t.TempDir()
+	testWriteFiles(t, root, map[string]string{"top.txt": "top", "sub/a.txt": big, "sub/b/c.txt": "c"})
+	store := NewLocalStore(root)
+	buf := &bytes.Buffer{}
+	if err := WriteDirBundle(ctx, buf, store, "sub"); err != nil {
+		t.Fatal(err)
+	}
+	list, err := ReadBundle(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Path != "a.txt" || list[1].Path != "b/c.txt" {
+		t.Fatal("bundle entries error", list)
+	}
+	if list[0].Size != int64(len(big)) || list[0].Meta == nil || list[0].Meta.Uid != -1 {
+		t.Error("bundle entry error", list[0])
+	}
+	//a delta made against the bundled signature applies to the file
+	delta := &bytes.Buffer{}
+	if err := Delta(list[0].Sig, strings.NewReader(big+"tail"), delta); err != nil {
+		t.Fatal(err)
+	}
+	if delta.Len() >= len(big) {
+		t.Error("bundled signature unused", delta.Len())
+	}
+	if err := store.Apply(ctx, "sub/a.txt", delta); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, root, map[string]string{"sub/a.txt": big + "tail"})
+	//entries without meta or signature
+	buf.Reset()
+	bw, err := NewBundleWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.Add(&BundleEntry{Path: "x", Size: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	br, err := NewBundleReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := br.Next(); err != nil || e.Path != "x" || e.Size != 3 || e.Meta != nil || e.Sig != nil {
+		t.Error("bare entry error", e, err)
+	}
+	if _, err := br.Next(); err != io.EOF {
+		t.Error("bundle end error", err)
+	}
+	//a cut bundle is not taken for a complete one
+	dat := buf.Bytes()
+	if _, err := ReadBundle(bytes.NewReader(dat[:len(dat)-1])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("cut bundle error", err)
+	}
+}
@@ -0,0 +1,135 @@
+package rsync
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket of Rate bytes per second like rsync --bwlimit, waits also
+// take tokens from Parent so per connection limiters can share one global limit
+type Limiter struct {
+	Rate   int64 //bytes per second, <= 0 unlimited
+	Burst  int64 //bucket size, Rate when 0
+	Parent *Limiter
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{Rate: rate}
+}
+
+// take n tokens and return how long to wait for them
+func (this *Limiter) reserve(n int64) time.Duration {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	burst := this.Burst
+	if burst <= 0 {
+		burst = this.Rate
+	}
+	now := time.Now()
+	if this.last.IsZero() {
+		this.tokens = float64(burst)
+	} else {
+		this.tokens += now.Sub(this.last).Seconds() * float64(this.Rate)
+		if this.tokens > float64(burst) {
+			this.tokens = float64(burst)
+		}
+	}
+	this.last = now
+	this.tokens -= float64(n)
+	if this.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-this.tokens / float64(this.Rate) * float64(time.Second))
+}
+
+// WaitN blocks until n bytes may be sent, a nil limiter never waits
+func (this *Limiter) WaitN(ctx context.Context, n int) error {
+	if this == nil || n <= 0 {
+		return nil
+	}
+	if this.Rate > 0 {
+		if wait := this.reserve(int64(n)); wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return this.Parent.WaitN(ctx, n)
+}
+
+// wait for the literal data of a frame
+func (this *Limiter) waitFrame(ctx context.Context, info *AnalyseInfo) error {
+	if !info.IsData() {
+		return nil
+	}
+	return this.WaitN(ctx, len(info.Data))
+}
+
+// LimitReader throttles everything read through it with Limit, the wait follows each read
+type LimitReader struct {
+	R     io.Reader
+	Limit *Limiter        //nil never waits
+	ctx   context.Context //nil in literals, the waits are never canceled
+}
+
+// NewLimitReader stops waiting with ctx.Err() when ctx is done
+func NewLimitReader(ctx context.Context, r io.Reader, l *Limiter) *LimitReader {
+	return &LimitReader{R: r, Limit: l, ctx: ctx}
+}
+
+func (this *LimitReader) Read(p []byte) (int, error) {
+	n, err := this.R.Read(p)
+	if werr := this.Limit.WaitN(orBackground(this.ctx), n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+// orBackground is ctx, the background context for nil
+func orBackground(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// limitChunk is the most bytes a LimitWriter sends after one wait
+const limitChunk = 32 << 10
+
+// LimitWriter throttles everything written through it with Limit, large writes are sent in
+// chunks after their wait
+type LimitWriter struct {
+	W     io.Writer
+	Limit *Limiter        //nil never waits
+	ctx   context.Context //nil in literals, the waits are never canceled
+}
+
+// NewLimitWriter stops waiting with ctx.Err() when ctx is done
+func NewLimitWriter(ctx context.Context, w io.Writer, l *Limiter) *LimitWriter {
+	return &LimitWriter{W: w, Limit: l, ctx: ctx}
+}
+
+func (this *LimitWriter) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		b := p[n:min(n+limitChunk, len(p))]
+		if err := this.Limit.WaitN(orBackground(this.ctx), len(b)); err != nil {
+			return n, err
+		}
+		m, err := this.W.Write(b)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,102 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	global := &Limiter{Rate: 1 << 20, Burst: 1 << 16}
+	conn := &Limiter{Parent: global}
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := conn.WaitN(ctx, 1<<15); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//320k at 1M/s with a 64k burst
+	if d := time.Since(start); d < 200*time.Millisecond || d > 2*time.Second {
+		t.Error("limit duration error", d)
+	}
+	var none *Limiter
+	if err := none.WaitN(ctx, 1<<30); err != nil {
+		t.Error(err)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := NewLimiter(1).WaitN(cctx, 1<<20); err != context.Canceled {
+		t.Error("cancel error", err)
+	}
+}
+
+func TestTCPLimit(t *testing.T) {
+	srv := NewTCPServer(t.TempDir())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+	ctx := context.Background()
+	c, err := DialTCP(ctx, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Limit = &Limiter{Rate: 1 << 20, Burst: 1 << 16}
+	dat := make([]byte, 300<<10)
+	rand.New(rand.NewSource(1)).Read(dat)
+	start := time.Now()
+	if err := Push(ctx, c, bytes.NewReader(dat), "a.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Error("literal data not throttled", d)
+	}
+}
+
+func TestLimitReaderWriter(t *testing.T) {
+	ctx := context.Background()
+	dat := make([]byte, 1<<17)
+	rand.Read(dat)
+	l := &Limiter{Rate: 1 << 20, Burst: 1 << 15}
+	start := time.Now()
+	out := &bytes.Buffer{}
+	w := NewLimitWriter(ctx, out, l)
+	if _, err := io.Copy(w, NewLimitReader(ctx, bytes.NewReader(dat), nil)); err != nil {
+		t.Fatal(err)
+	}
+	//the burst is free, the rest takes 3/32 s
+	if d := time.Since(start); d < 80*time.Millisecond || !bytes.Equal(out.Bytes(), dat) {
+		t.Error("limit writer error", d)
+	}
+	start = time.Now()
+	got, err := io.ReadAll(NewLimitReader(ctx, bytes.NewReader(dat), &Limiter{Rate: 1 << 20, Burst: 1 << 15}))
+	if err != nil || !bytes.Equal(got, dat) {
+		t.Fatal("limit reader error", err)
+	}
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Error("limit reader not throttled", d)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := NewLimitWriter(cctx, out, &Limiter{Rate: 1, Burst: 1}).Write(dat); err != context.Canceled {
+		t.Error("canceled write error", err)
+	}
+	//literals without the constructors never stop waiting
+	lit := &Limiter{Rate: 1 << 30, Burst: 1 << 20}
+	got, err = io.ReadAll(&LimitReader{R: bytes.NewReader(dat), Limit: lit})
+	if err != nil || !bytes.Equal(got, dat) {
+		t.Error("literal reader error", err)
+	}
+	out.Reset()
+	if _, err := (&LimitWriter{W: out, Limit: lit}).Write(dat); err != nil || !bytes.Equal(out.Bytes(), dat) {
+		t.Error("literal writer error", err)
+	}
+}
@@ -0,0 +1,337 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ChunkKV keeps the chunks of a ChunkStore by key
+type ChunkKV interface {
+	// Get returns the chunk of key, a missing chunk fails with fs.ErrNotExist
+	Get(key string) ([]byte, error)
+	Put(key string, data []byte) error
+	Has(key string) (bool, error)
+}
+
+// DirKV keeps every chunk in a file of Root, named by its key under a dir of the first two key chars
+type DirKV struct {
+	Root string
+}
+
+func NewDirKV(root string) *DirKV {
+	return &DirKV{Root: root}
+}
+
+func (this *DirKV) file(key string) (string, error) {
+	if len(key) < 3 || filepath.Base(key) != key {
+		return "", fmt.Errorf("chunk key %q error", key)
+	}
+	return filepath.Join(this.Root, key[:2], key), nil
+}
+
+func (this *DirKV) Get(key string) ([]byte, error) {
+	file, err := this.file(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(file)
+}
+
+// Put writes a temp file and renames it, readers never see a partial chunk
+func (this *DirKV) Put(key string, data []byte) error {
+	file, err := this.file(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	fd, err := os.CreateTemp(filepath.Dir(file), key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(data)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), file)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+	}
+	return err
+}
+
+func (this *DirKV) Has(key string) (bool, error) {
+	file, err := this.file(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// MemKV keeps the chunks in memory
+type MemKV struct {
+	mu     sync.RWMutex
+	chunks map[string][]byte
+}
+
+func NewMemKV() *MemKV {
+	return &MemKV{chunks: map[string][]byte{}}
+}
+
+func (this *MemKV) Get(key string) ([]byte, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	dat, ok := this.chunks[key]
+	if !ok {
+		return nil, fmt.Errorf("chunk %s: %w", key, fs.ErrNotExist)
+	}
+	return dat, nil
+}
+
+func (this *MemKV) Put(key string, data []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.chunks[key] = bytes.Clone(data)
+	return nil
+}
+
+func (this *MemKV) Has(key string) (bool, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	_, ok := this.chunks[key]
+	return ok, nil
+}
+
+// ChunkStore dedups the blocks of many files in KV keyed by their strong hash. Ingest returns
+// the recipe of a file, its unseeded keep all signature, and the recipe rebuilds the file. A recipe
+// is also the signature to sync a new version against, with ReaderAt as the basis of the delta
+type ChunkStore struct {
+	KV        ChunkKV
+	BlockSize uint16
+	Hasher    StrongHasher
+	Weak      WeakHasher
+	mu        sync.Mutex
+	Stored    int64 //chunks put by Ingest
+	Deduped   int64 //chunks Ingest found in KV
+}
+
+// NewChunkStore takes WithBlockSize, WithStrongHash and WithWeakHash, the defaults are
+// DefaultBlockSize, md5 and adler32
+func NewChunkStore(kv ChunkKV, opts ...Option) *ChunkStore {
+	o := newOptions(opts)
+	ret := &ChunkStore{KV: kv, BlockSize: DefaultBlockSize, Hasher: MD5Hasher, Weak: Adler32Hasher}
+	if o.blockSize > 0 {
+		ret.BlockSize = o.blockSize
+	}
+	if o.strong != nil {
+		ret.Hasher = o.strong
+	}
+	if o.weak != nil {
+		ret.Weak = o.weak
+	}
+	return ret
+}
+
+// chunkKey is the hex strong hash of a block
+func chunkKey(b HashBlock) string {
+	return hex.EncodeToString(b.H3)
+}
+
+// Ingest stores the blocks of r KV lacks and returns the recipe of r
+func (this *ChunkStore) Ingest(ctx context.Context, r io.Reader) (*HashInfo, error) {
+	if this.BlockSize == 0 {
+		return nil, errors.New("block size error")
+	}
+	fh := this.Hasher.New()
+	hi := &HashInfo{
+		Blocks:    []HashBlock{},
+		BlockSize: this.BlockSize,
+		Strong:    this.Hasher.ID(),
+		Weak:      this.Weak.ID(),
+	}
+	pb := getBuffer(int(this.BlockSize))
+	defer putBuffer(pb)
+	buf := (*pb)[:this.BlockSize]
+	for off := uint64(0); ; {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		dat := buf[:n]
+		fh.Write(dat)
+		hb := NewHashBlock(this.Weak, this.Hasher, dat, uint32(len(hi.Blocks)), off)
+		if n < len(buf) {
+			hb.Len = uint16(n)
+		}
+		if err := this.put(hb, dat); err != nil {
+			return nil, err
+		}
+		hi.Blocks = append(hi.Blocks, hb)
+		off += uint64(n)
+		if n < len(buf) {
+			break
+		}
+	}
+	hi.MD5 = fh.Sum(nil)
+	return hi, nil
+}
+
+// put stores a block unless KV has it
+func (this *ChunkStore) put(hb HashBlock, dat []byte) error {
+	key := chunkKey(hb)
+	ok, err := this.KV.Has(key)
+	if err != nil {
+		return err
+	}
+	this.mu.Lock()
+	if ok {
+		this.Deduped++
+	} else {
+		this.Stored++
+	}
+	this.mu.Unlock()
+	if ok {
+		return nil
+	}
+	return this.KV.Put(key, dat)
+}
+
+// IngestFile is Ingest of the file at path
+func (this *ChunkStore) IngestFile(ctx context.Context, path string) (*HashInfo, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return this.Ingest(ctx, fd)
+}
+
+// check rejects recipes made with other options than the store
+func (this *ChunkStore) check(recipe *HashInfo) error {
+	if recipe.BlockSize != this.BlockSize || recipe.Strong != this.Hasher.ID() || recipe.Seed != 0 {
+		return errors.New("recipe not made by this chunk store")
+	}
+	return nil
+}
+
+// chunk reads the block of the recipe and checks its hash
+func (this *ChunkStore) chunk(hb HashBlock) ([]byte, error) {
+	dat, err := this.KV.Get(chunkKey(hb))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(strongSum(this.Hasher, dat), hb.H3) {
+		return nil, fmt.Errorf("%w: chunk %s", ErrHashMismatch, chunkKey(hb))
+	}
+	return dat, nil
+}
+
+// Reconstruct writes the file of recipe to w and checks its hash
+func (this *ChunkStore) Reconstruct(ctx context.Context, recipe *HashInfo, w io.Writer) error {
+	if err := this.check(recipe); err != nil {
+		return err
+	}
+	blocks := recipeBlocks(recipe)
+	fh := this.Hasher.New()
+	mw := io.MultiWriter(w, fh)
+	off := uint64(0)
+	for _, hb := range blocks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if hb.Off != off {
+			return fmt.Errorf("%w: recipe gap at %d, made with dedup", ErrMalformed, off)
+		}
+		dat, err := this.chunk(hb)
+		if err != nil {
+			return err
+		}
+		if _, err := mw.Write(dat); err != nil {
+			return err
+		}
+		off += uint64(len(dat))
+	}
+	if !bytes.Equal(fh.Sum(nil), recipe.MD5) {
+		return fmt.Errorf("%w: reconstructed file", ErrHashMismatch)
+	}
+	return nil
+}
+
+// recipeBlocks are the blocks of recipe by offset
+func recipeBlocks(recipe *HashInfo) []HashBlock {
+	blocks := append([]HashBlock{}, recipe.Blocks...)
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Off < blocks[j].Off
+	})
+	return blocks
+}
+
+// ReaderAt reads the file of recipe from the chunks, it is the basis to patch a delta made
+// against the recipe
+func (this *ChunkStore) ReaderAt(recipe *HashInfo) (io.ReaderAt, error) {
+	if err := this.check(recipe); err != nil {
+		return nil, err
+	}
+	return &chunkReader{store: this, blocks: recipeBlocks(recipe), bs: int64(recipe.BlockSize)}, nil
+}
+
+// chunkReader reads the chunks of a recipe, the last chunk read is kept
+type chunkReader struct {
+	store  *ChunkStore
+	blocks []HashBlock
+	bs     int64
+	mu     sync.Mutex
+	idx    int //block of dat
+	dat    []byte
+}
+
+func (this *chunkReader) ReadAt(p []byte, off int64) (int, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		i := int(pos / this.bs)
+		if pos < 0 || i >= len(this.blocks) {
+			return n, io.EOF
+		}
+		if this.dat == nil || this.idx != i {
+			if int64(this.blocks[i].Off) != int64(i)*this.bs {
+				return n, fmt.Errorf("%w: recipe gap at %d, made with dedup", ErrMalformed, int64(i)*this.bs)
+			}
+			dat, err := this.store.chunk(this.blocks[i])
+			if err != nil {
+				return n, err
+			}
+			this.idx, this.dat = i, dat
+		}
+		in := pos - int64(i)*this.bs
+		if in >= int64(len(this.dat)) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], this.dat[in:])
+	}
+	return n, nil
+}
@@ -0,0 +1,79 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunkStore(t *testing.T) {
+	ctx := context.Background()
+	rnd := rand.New(rand.NewSource(9))
+	a := make([]byte, DefaultBlockSize*20+33)
+	rnd.Read(a)
+	//shares all but its first blocks with a
+	b := append(make([]byte, DefaultBlockSize*2), a[DefaultBlockSize*2:]...)
+	for _, kv := range []ChunkKV{NewMemKV(), NewDirKV(t.TempDir())} {
+		cs := NewChunkStore(kv)
+		ra, err := cs.Ingest(ctx, bytes.NewReader(a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rb, err := cs.Ingest(ctx, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		//the zero blocks are one chunk
+		if cs.Stored != 22 || cs.Deduped != 20 {
+			t.Error("dedup error", cs.Stored, cs.Deduped)
+		}
+		for _, v := range []struct {
+			recipe *HashInfo
+			dat    []byte
+		}{{ra, a}, {rb, b}} {
+			out := &bytes.Buffer{}
+			if err := cs.Reconstruct(ctx, v.recipe, out); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), v.dat) {
+				t.Error("reconstruct error")
+			}
+		}
+		//the recipe is the signature of a sync against the stored file
+		src := append(append([]byte{}, b...), "appended"...)
+		delta := &bytes.Buffer{}
+		if err := Delta(rb, bytes.NewReader(src), delta); err != nil {
+			t.Fatal(err)
+		}
+		basis, err := cs.ReaderAt(rb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := &bytes.Buffer{}
+		if err := Patch(basis, delta, out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), src) {
+			t.Error("patch from chunks error")
+		}
+	}
+	//a corrupted chunk is found
+	dir := t.TempDir()
+	cs := NewChunkStore(NewDirKV(dir))
+	recipe, err := cs.Ingest(ctx, bytes.NewReader(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := chunkKey(recipe.Blocks[3])
+	os.WriteFile(filepath.Join(dir, key[:2], key), []byte("bad"), 0644)
+	if err := cs.Reconstruct(ctx, recipe, &bytes.Buffer{}); !errors.Is(err, ErrHashMismatch) {
+		t.Error("corrupt chunk error", err)
+	}
+	if err := NewChunkStore(NewMemKV(), WithBlockSize(512)).Reconstruct(ctx, recipe, &bytes.Buffer{}); err == nil {
+		t.Error("foreign recipe accepted")
+	}
+}
@@ -0,0 +1,820 @@
+// Command rsync computes signatures, deltas and patches and syncs files over the rsync transports.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"rsync"
+)
+
+const usage = `usage: rsync <command> [flags] args
+
+commands:
+  signature [-block n] [-strong md5|sha256|blake3] [-weak adler32|buzhash|rabin|crc32c] [-keep-dups] [-workers n] [-checkpoint FILE] BASIS SIG
+  delta [-compress none|zstd|gzip] [-append] SIG NEW DELTA
+  patch BASIS DELTA OUT   (a missing BASIS takes whole file deltas)
+  dump-delta DELTA
+  pull [-sig SIG] URL BASIS OUT
+  sync [flags] SRC DST
+  manifest [-sigs] DIR OUT
+  serve-stdio ROOT
+  read-batch [flags] BATCH DST
+  daemon -config FILE
+
+files may be - for stdin or stdout, DST of sync is a local path or
+rsync://host/module/path, tcp://, tls://, quic://, grpc://, http://, https://, ssh://host/path
+or s3://bucket/prefix with the AWS_ environment credentials
+`
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := run(ctx, os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "rsync:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	switch args[0] {
+	case "signature":
+		return signature(args[1:], stdin, stdout)
+	case "delta":
+		return delta(args[1:], stdin, stdout)
+	case "patch":
+		return patch(args[1:], stdin, stdout)
+	case "dump-delta":
+		return dumpDelta(args[1:], stdin, stdout)
+	case "sync":
+		return syncCmd(ctx, args[1:], stdout)
+	case "pull":
+		return pull(ctx, args[1:], stdout)
+	case "manifest":
+		return manifest(ctx, args[1:], stdout)
+	case "serve-stdio":
+		if len(args) != 2 {
+			return errors.New("usage: rsync serve-stdio ROOT")
+		}
+		rsync.ServeStdio(args[1], stdin, stdout)
+		return nil
+	case "daemon":
+		return daemon(ctx, args[1:])
+	case "read-batch":
+		return readBatch(ctx, args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+}
+
+func readBatch(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("read-batch", flag.ContinueOnError)
+	opt := newSyncOptions(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: rsync read-batch [flags] BATCH DST")
+	}
+	in, err := openIn(fs.Arg(0), nil)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	t, dir, err := dial(ctx, fs.Arg(1), opt)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	if dir != "" {
+		return errors.New("read-batch DST is the root the batch was written against")
+	}
+	return rsync.ReadBatch(ctx, in, t)
+}
+
+func daemon(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	config := fs.String("config", "rsyncd.conf", "config file")
+	listen := fs.String("listen", "", "listen address, overrides the config")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	conf, err := rsync.LoadDaemonConfig(*config)
+	if err != nil {
+		return err
+	}
+	if *listen != "" {
+		conf.Listen = *listen
+	}
+	d, err := rsync.NewDaemon(conf)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		d.Close()
+	}()
+	if err := d.ListenAndServe(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// openIn opens name for reading, - is stdin
+func openIn(name string, stdin io.Reader) (io.ReadCloser, error) {
+	if name == "-" {
+		return io.NopCloser(stdin), nil
+	}
+	return os.Open(name)
+}
+
+// createOut runs fn with name opened for writing, - is stdout
+func createOut(name string, stdout io.Writer, fn func(w io.Writer) error) error {
+	if name == "-" {
+		bw := bufio.NewWriter(stdout)
+		if err := fn(bw); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+	fd, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(fd)
+	err = fn(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func strongHasher(name string) (rsync.StrongHasher, error) {
+	for _, h := range []rsync.StrongHasher{rsync.MD5Hasher, rsync.SHA256Hasher, rsync.BLAKE3Hasher} {
+		if h.Name() == name {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown strong hash %q", name)
+}
+
+func compressID(name string) (uint8, error) {
+	switch name {
+	case "none", "":
+		return rsync.CompressNone, nil
+	case "zstd":
+		return rsync.CompressZstd, nil
+	case "gzip":
+		return rsync.CompressGzip, nil
+	}
+	return 0, fmt.Errorf("unknown compress %q", name)
+}
+
+func weakHasher(name string) (rsync.WeakHasher, error) {
+	for _, h := range []rsync.WeakHasher{rsync.Adler32Hasher, rsync.BuzHasher, rsync.RabinHasher, rsync.CRC32CHasher} {
+		if h.Name() == name {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown weak hash %q", name)
+}
+
+func signature(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("signature", flag.ContinueOnError)
+	block := fs.Int("block", rsync.DefaultBlockSize, "block size")
+	strong := fs.String("strong", "md5", "strong hash")
+	weak := fs.String("weak", "adler32", "rolling weak hash")
+	keepDups := fs.Bool("keep-dups", false, "keep every block equal to an earlier block")
+	workers := fs.Int("workers", 1, "goroutines hashing blocks")
+	checkpoint := fs.String("checkpoint", "", "keep the hashing progress of a BASIS file here to continue an interrupted run")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: rsync signature [-block n] [-strong md5|sha256|blake3] [-weak adler32|buzhash|rabin|crc32c] [-keep-dups] [-workers n] [-checkpoint FILE] BASIS SIG")
+	}
+	if *block <= 0 || *block > 0xFFFF {
+		return fmt.Errorf("block size %d error", *block)
+	}
+	sh, err := strongHasher(*strong)
+	if err != nil {
+		return err
+	}
+	wh, err := weakHasher(*weak)
+	if err != nil {
+		return err
+	}
+	dups := rsync.DupDedup
+	if *keepDups {
+		dups = rsync.DupKeepAll
+	}
+	opts := []interface{}{rsync.WithBlockSize(uint16(*block)), rsync.WithStrongHash(sh), rsync.WithWeakHash(wh), rsync.WithDups(dups), rsync.WithWorkers(*workers)}
+	var sig *rsync.HashInfo
+	if *checkpoint != "" {
+		if fs.Arg(0) == "-" {
+			return errors.New("-checkpoint needs a BASIS file")
+		}
+		sig, err = rsync.GetFileHashInfo(fs.Arg(0), nil, append(opts, rsync.WithFillCheckpoint(*checkpoint))...)
+	} else {
+		in, oerr := openIn(fs.Arg(0), stdin)
+		if oerr != nil {
+			return oerr
+		}
+		defer in.Close()
+		sig, err = rsync.GetReaderHashInfo(bufio.NewReader(in), nil, opts...)
+	}
+	if err != nil {
+		return err
+	}
+	return createOut(fs.Arg(1), stdout, func(w io.Writer) error {
+		_, err := sig.WriteTo(w)
+		return err
+	})
+}
+
+func readSignature(name string, stdin io.Reader) (*rsync.HashInfo, error) {
+	in, err := openIn(name, stdin)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	sig := rsync.NewHashInfo()
+	if _, err := sig.ReadFrom(bufio.NewReader(in)); err != nil {
+		return nil, fmt.Errorf("read signature %s: %w", name, err)
+	}
+	return sig, nil
+}
+
+func delta(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("delta", flag.ContinueOnError)
+	compress := fs.String("compress", "none", "literal compress")
+	appendOnly := fs.Bool("append", false, "send only the appended tail when the basis is a prefix of NEW")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 3 {
+		return errors.New("usage: rsync delta [-compress none|zstd|gzip] [-append] SIG NEW DELTA")
+	}
+	c, err := compressID(*compress)
+	if err != nil {
+		return err
+	}
+	sig, err := readSignature(fs.Arg(0), stdin)
+	if err != nil {
+		return err
+	}
+	in, err := openIn(fs.Arg(1), stdin)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return createOut(fs.Arg(2), stdout, func(w io.Writer) error {
+		if *appendOnly {
+			return rsync.DeltaAppend(sig, in, w, c)
+		}
+		return rsync.DeltaCompress(sig, in, w, c)
+	})
+}
+
+func patch(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("patch", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 3 {
+		return errors.New("usage: rsync patch BASIS DELTA OUT")
+	}
+	//a missing basis takes whole file deltas, OUT - streams the file to pipes
+	var basis io.ReaderAt = strings.NewReader("")
+	if fd, err := os.Open(fs.Arg(0)); err == nil {
+		defer fd.Close()
+		basis = fd
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	in, err := openIn(fs.Arg(1), stdin)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return createOut(fs.Arg(2), stdout, func(w io.Writer) error {
+		return rsync.Patch(basis, bufio.NewReader(in), w)
+	})
+}
+
+// dumpDelta prints the ops of DELTA
+func dumpDelta(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("dump-delta", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: rsync dump-delta DELTA")
+	}
+	in, err := openIn(fs.Arg(0), stdin)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return rsync.DumpDelta(bufio.NewReader(in), stdout)
+}
+
+// manifest writes the manifest of DIR for sync -manifest
+func manifest(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("manifest", flag.ContinueOnError)
+	sigs := fs.Bool("sigs", false, "keep the file signatures too")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: rsync manifest [-sigs] DIR OUT")
+	}
+	m, err := rsync.NewManifest(ctx, fs.Arg(0), nil, *sigs)
+	if err != nil {
+		return err
+	}
+	return createOut(fs.Arg(1), stdout, m.Write)
+}
+
+// pull rebuilds the file served at URL from BASIS and the ranges BASIS lacks, a missing BASIS
+// fetches everything
+func pull(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("pull", flag.ContinueOnError)
+	sigName := fs.String("sig", "", "signature file or url of the new file, URL.sig when empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 3 {
+		return errors.New("usage: rsync pull [-sig SIG] URL BASIS OUT")
+	}
+	if fs.Arg(1) == fs.Arg(2) {
+		return errors.New("OUT must not be BASIS, it is read while OUT is written")
+	}
+	src := fs.Arg(0)
+	if *sigName == "" {
+		*sigName = src + ".sig"
+	}
+	sig := rsync.NewHashInfo()
+	if strings.HasPrefix(*sigName, "http://") || strings.HasPrefix(*sigName, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, *sigName, nil)
+		if err != nil {
+			return err
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("get %s: %s", *sigName, res.Status)
+		}
+		if _, err := sig.ReadFrom(bufio.NewReader(res.Body)); err != nil {
+			return err
+		}
+	} else {
+		fd, err := os.Open(*sigName)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		if _, err := sig.ReadFrom(bufio.NewReader(fd)); err != nil {
+			return err
+		}
+	}
+	var basis io.ReaderAt = strings.NewReader("")
+	size := int64(0)
+	if fd, err := os.Open(fs.Arg(1)); err == nil {
+		defer fd.Close()
+		fi, err := fd.Stat()
+		if err != nil {
+			return err
+		}
+		basis, size = fd, fi.Size()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return createOut(fs.Arg(2), stdout, func(w io.Writer) error {
+		_, err := rsync.Pull(ctx, sig, basis, size, rsync.HTTPFetcher(nil, src), w)
+		return err
+	})
+}
+
+// listFlag collects a repeated flag
+type listFlag []string
+
+func (this *listFlag) String() string {
+	return strings.Join(*this, ",")
+}
+
+func (this *listFlag) Set(v string) error {
+	*this = append(*this, v)
+	return nil
+}
+
+type syncOptions struct {
+	secret   string
+	ca       string
+	cert     string
+	key      string
+	bwlimit  int64
+	sshArgs  string
+	sshCmd   string
+	insecure bool
+	retries  int
+	timeout  time.Duration
+}
+
+// newSyncOptions registers the transport flags on fs
+func newSyncOptions(fs *flag.FlagSet) *syncOptions {
+	opt := &syncOptions{}
+	fs.StringVar(&opt.secret, "secret", "", "shared secret authenticating tcp, quic and ssh messages")
+	fs.StringVar(&opt.ca, "ca", "", "server ca file for tls, quic and https")
+	fs.StringVar(&opt.cert, "cert", "", "client certificate file")
+	fs.StringVar(&opt.key, "key", "", "client key file")
+	fs.BoolVar(&opt.insecure, "insecure", false, "skip server certificate verification")
+	fs.Int64Var(&opt.bwlimit, "bwlimit", 0, "literal data bytes per second, 0 unlimited")
+	fs.StringVar(&opt.sshArgs, "ssh-args", "", "extra ssh arguments")
+	fs.StringVar(&opt.sshCmd, "ssh-command", "rsync", "remote rsync command for ssh")
+	fs.DurationVar(&opt.timeout, "timeout", 0, "fail when tcp, quic or ssh peers don't answer in time, 0 default, < 0 never")
+	fs.IntVar(&opt.retries, "retries", 0, "retry failed signature fetches and listings with backoff")
+	return opt
+}
+
+func (this *syncOptions) tlsConfig() (*tls.Config, error) {
+	conf, err := rsync.ClientTLSConfig(this.cert, this.key, this.ca)
+	if err != nil {
+		return nil, err
+	}
+	conf.InsecureSkipVerify = this.insecure
+	return conf, nil
+}
+
+func (this *syncOptions) timeouts() rsync.Timeouts {
+	return rsync.Timeouts{Read: this.timeout, Write: this.timeout}
+}
+
+// dial opens the transport for dst and returns the destination path on it
+func dial(ctx context.Context, dst string, opt *syncOptions) (rsync.Transport, string, error) {
+	u, err := url.Parse(dst)
+	if err != nil || u.Scheme == "" || len(u.Scheme) == 1 {
+		//a local path, windows drive letters parse as schemes
+		return rsync.NewLocalStore(dst), "", nil
+	}
+	limit := (*rsync.Limiter)(nil)
+	if opt.bwlimit > 0 {
+		limit = rsync.NewLimiter(opt.bwlimit)
+	}
+	dir := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "file":
+		return rsync.Dial(ctx, dst)
+	case "tcp", "tls", "rsync":
+		var c *rsync.TCPClient
+		if u.Scheme == "rsync" && u.Port() == "" {
+			//a daemon on the default port, paths start with the module
+			u.Host = net.JoinHostPort(u.Hostname(), strings.TrimPrefix(rsync.DefaultDaemonAddr, ":"))
+		}
+		if u.Scheme == "tls" {
+			conf, err := opt.tlsConfig()
+			if err != nil {
+				return nil, "", err
+			}
+			c, err = rsync.DialTLS(ctx, u.Host, conf)
+		} else {
+			c, err = rsync.DialTCP(ctx, u.Host)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		c.Secret = []byte(opt.secret)
+		c.Limit = limit
+		c.Timeouts = opt.timeouts()
+		return c, dir, nil
+	case "quic":
+		conf, err := opt.tlsConfig()
+		if err != nil {
+			return nil, "", err
+		}
+		c, err := rsync.DialQUIC(ctx, u.Host, conf)
+		if err != nil {
+			return nil, "", err
+		}
+		c.Secret = []byte(opt.secret)
+		c.Limit = limit
+		c.Timeouts = opt.timeouts()
+		return c, dir, nil
+	case "s3":
+		//credentials and region of the aws cli environment
+		region := os.Getenv("AWS_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		endpoint := os.Getenv("AWS_ENDPOINT_URL")
+		if endpoint == "" {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+		s := rsync.NewS3Store(endpoint, u.Host, region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+		s.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		return s, dir, nil
+	case "grpc", "grpcs":
+		var c *rsync.GRPCClient
+		if u.Scheme == "grpcs" {
+			conf, err := opt.tlsConfig()
+			if err != nil {
+				return nil, "", err
+			}
+			c, err = rsync.DialGRPCTLS(u.Host, conf)
+		} else {
+			c, err = rsync.DialGRPC(u.Host)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		c.Limit = limit
+		return c, dir, nil
+	case "http", "https":
+		var conf *tls.Config
+		if u.Scheme == "https" {
+			if conf, err = opt.tlsConfig(); err != nil {
+				return nil, "", err
+			}
+		}
+		c := rsync.NewHTTPClient(u.Scheme+"://"+u.Host, conf)
+		c.Limit = limit
+		return c, dir, nil
+	case "ssh":
+		host := u.Host
+		if u.User != nil {
+			host = u.User.Username() + "@" + host
+		}
+		//relative to the remote home, ssh://host//abs for absolute paths
+		root := strings.TrimPrefix(u.Path, "/")
+		if root == "" {
+			root = "."
+		}
+		c, err := rsync.DialSSH(ctx, host, opt.sshCmd+" serve-stdio "+root, strings.Fields(opt.sshArgs)...)
+		if err != nil {
+			return nil, "", err
+		}
+		c.Secret = []byte(opt.secret)
+		c.Limit = limit
+		c.Timeouts = opt.timeouts()
+		return c, "", nil
+	}
+	return nil, "", fmt.Errorf("unknown destination scheme %q", u.Scheme)
+}
+
+func syncCmd(ctx context.Context, args []string, stdout io.Writer) (err error) {
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	opt := newSyncOptions(fs)
+	del := fs.Bool("delete", false, "delete destination files missing in the source")
+	maxDel := fs.Int("max-delete", 0, "refuse to delete more entries, 0 unlimited")
+	dry := fs.Bool("dry-run", false, "report the changes without writing")
+	links := fs.String("links", "keep", "symlinks: keep, follow or skip")
+	hard := fs.Bool("hard-links", false, "preserve hard links")
+	fuzzy := fs.Bool("fuzzy", false, "missing files use a similarly named destination file as basis")
+	appendOnly := fs.Bool("append", false, "send only the appended tail of grown files")
+	checksum := fs.Bool("checksum", false, "skip files whose whole-file strong hash matches the destination")
+	quick := fs.Bool("quick-check", false, "skip files of the same size and mtime on DST")
+	window := fs.Duration("modify-window", 0, "largest mtime difference quick-check takes as equal, 0 whole seconds")
+	stats := fs.Bool("stats", false, "print transfer stats")
+	itemize := fs.Bool("itemize-changes", false, "print a change line per updated entry like rsync -i")
+	jsonOut := fs.Bool("json", false, "print line delimited json progress, file and done events instead of text")
+	watch := fs.Bool("watch", false, "keep running and sync the files changed in the SRC dir")
+	writeBatch := fs.String("write-batch", "", "also record the changes into a batch file for read-batch")
+	onlyBatch := fs.String("only-write-batch", "", "record the changes into a batch file without changing DST")
+	filterFile := fs.String("filter-file", "", "read include/exclude rules from file")
+	manifestFile := fs.String("manifest", "", "skip files matching this manifest of the DST dir and use its signatures")
+	var includes, excludes listFlag
+	fs.Var(&includes, "include", "include pattern, repeatable, checked before excludes")
+	fs.Var(&excludes, "exclude", "exclude pattern, repeatable")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: rsync sync [flags] SRC DST")
+	}
+	src, dst := fs.Arg(0), fs.Arg(1)
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	t, dir, err := dial(ctx, dst, opt)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	if ls, ok := t.(*rsync.LocalStore); ok {
+		ls.Fuzzy = *fuzzy
+	}
+	name := dir
+	if !fi.IsDir() {
+		name = fileTarget(t, src, dir)
+	}
+	if opt.retries > 0 {
+		t = rsync.NewRetryTransport(t, rsync.NewRetryPolicy(opt.retries, time.Second/2))
+	}
+	if *writeBatch != "" && *onlyBatch != "" {
+		return errors.New("write-batch and only-write-batch exclude each other")
+	}
+	if file := *writeBatch + *onlyBatch; file != "" {
+		fd, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		bw, err := rsync.NewBatchWriter(fd, t)
+		if err != nil {
+			return err
+		}
+		bw.Update = *writeBatch != ""
+		//ends the batch before the file is closed
+		defer func() {
+			if cerr := bw.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		t = bw
+	}
+	if !fi.IsDir() {
+		if *watch {
+			return errors.New("watch needs a SRC dir")
+		}
+		var ev *rsync.EventWriter
+		if *jsonOut {
+			ev = rsync.NewEventWriter(stdout)
+		}
+		return syncFile(ctx, t, src, name, stdout, *stats, *appendOnly, ev)
+	}
+	s := rsync.NewDirSyncer(src, t, dir)
+	s.Delete = *del
+	s.MaxDelete = *maxDel
+	s.HardLinks = *hard
+	s.Fuzzy = *fuzzy
+	s.Append = *appendOnly
+	s.Checksum = *checksum
+	s.QuickCheck = *quick
+	s.ModifyWindow = *window
+	if *manifestFile != "" {
+		fd, err := os.Open(*manifestFile)
+		if err != nil {
+			return err
+		}
+		s.Manifest, err = rsync.NewManifestWithBuf(bufio.NewReader(fd))
+		fd.Close()
+		if err != nil {
+			return fmt.Errorf("manifest %s: %w", *manifestFile, err)
+		}
+	}
+	switch *links {
+	case "keep":
+		s.Symlinks = rsync.SymlinkKeep
+	case "follow":
+		s.Symlinks = rsync.SymlinkFollow
+	case "skip":
+		s.Symlinks = rsync.SymlinkSkip
+	default:
+		return fmt.Errorf("unknown links mode %q", *links)
+	}
+	if len(includes) > 0 || len(excludes) > 0 || *filterFile != "" {
+		f := rsync.NewFilter()
+		if err := f.Include(includes...); err != nil {
+			return err
+		}
+		if err := f.Exclude(excludes...); err != nil {
+			return err
+		}
+		if *filterFile != "" {
+			fd, err := os.Open(*filterFile)
+			if err != nil {
+				return err
+			}
+			_, err = f.ReadFrom(fd)
+			fd.Close()
+			if err != nil {
+				return err
+			}
+		}
+		s.Filter = f
+	}
+	var ev *rsync.EventWriter
+	if *jsonOut {
+		if *dry {
+			return errors.New("json and dry-run exclude each other")
+		}
+		ev = rsync.NewEventWriter(stdout)
+		ev.Attach(s)
+	} else if *itemize {
+		s.OnItem = func(item rsync.ItemChange) {
+			if item.Kind != rsync.ItemSkipped {
+				fmt.Fprintln(stdout, item.String())
+			}
+		}
+	}
+	if *watch {
+		if *dry {
+			return errors.New("watch and dry-run exclude each other")
+		}
+		w := rsync.NewWatcher(s)
+		if ev != nil {
+			w.OnSync = func(paths []string, err error) {
+				ev.Done(&s.Stats, err)
+			}
+		} else if *stats {
+			w.OnSync = func(paths []string, err error) {
+				fmt.Fprintln(stdout, s.Stats.String())
+			}
+		}
+		if err := w.Run(ctx); err != nil && ctx.Err() == nil {
+			return err
+		}
+		return nil
+	}
+	if *dry {
+		rp, err := s.DryRun(ctx)
+		if err != nil {
+			return err
+		}
+		for _, v := range rp.Changed() {
+			fmt.Fprintf(stdout, "%s %s\n", v.Action, v.Path)
+		}
+		fmt.Fprintf(stdout, "estimated %d bytes\n", rp.Bytes)
+		return nil
+	}
+	err = s.Sync(ctx)
+	if ev != nil {
+		ev.Done(&s.Stats, err)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if *stats {
+		fmt.Fprintln(stdout, s.Stats.String())
+	}
+	return nil
+}
+
+// fileTarget is the destination path of the file src, a local destination or an empty remote path
+// takes the source name
+func fileTarget(t rsync.Transport, src string, dir string) string {
+	if ls, ok := t.(*rsync.LocalStore); ok {
+		if fi, err := os.Stat(ls.Root); err == nil && fi.IsDir() {
+			return filepath.Base(src)
+		}
+		name := filepath.Base(ls.Root)
+		ls.Root = filepath.Dir(ls.Root)
+		return name
+	}
+	if dir == "" || strings.HasSuffix(dir, "/") {
+		return path.Join(dir, filepath.Base(src))
+	}
+	return dir
+}
+
+// syncFile pushes the file src to name
+func syncFile(ctx context.Context, t rsync.Transport, src string, name string, stdout io.Writer, stats bool, appendOnly bool, ev *rsync.EventWriter) error {
+	fd, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	push := rsync.PushStats
+	if appendOnly {
+		push = rsync.PushAppend
+	}
+	st, err := push(ctx, t, fd, name)
+	if ev != nil {
+		ev.Done(st, err)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if stats {
+		fmt.Fprintln(stdout, st.String())
+	}
+	return nil
+}
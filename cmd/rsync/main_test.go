@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rsync"
+)
+
+func TestSignatureDeltaPatch(t *testing.T) {
+	dir := t.TempDir()
+	basis := filepath.Join(dir, "basis")
+	newer := filepath.Join(dir, "new")
+	old := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	dat := append(append([]byte("head"), old[:30000]...), old[40000:]...)
+	if err := os.WriteFile(basis, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(newer, dat, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	sig := filepath.Join(dir, "sig")
+	if err := run(ctx, []string{"signature", "-block", "1024", "-strong", "sha256", "-weak", "crc32c", basis, sig}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	//delta to stdout, patch from stdin
+	delta := &bytes.Buffer{}
+	if err := run(ctx, []string{"delta", "-compress", "zstd", sig, newer, "-"}, nil, delta); err != nil {
+		t.Fatal(err)
+	}
+	if delta.Len() >= len(dat)/2 {
+		t.Fatalf("delta size %d", delta.Len())
+	}
+	out := filepath.Join(dir, "out")
+	if err := run(ctx, []string{"patch", basis, "-", out}, delta, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dat) {
+		t.Fatal("patch result error")
+	}
+	//a missing basis takes a whole file delta, streamed to stdout
+	empty := filepath.Join(dir, "empty.sig")
+	os.WriteFile(filepath.Join(dir, "empty"), nil, 0644)
+	if err := run(ctx, []string{"signature", filepath.Join(dir, "empty"), empty}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	delta.Reset()
+	if err := run(ctx, []string{"delta", empty, newer, "-"}, nil, delta); err != nil {
+		t.Fatal(err)
+	}
+	stream := &bytes.Buffer{}
+	if err := run(ctx, []string{"patch", filepath.Join(dir, "missing"), "-", "-"}, delta, stream); err != nil || !bytes.Equal(stream.Bytes(), dat) {
+		t.Fatal("stream patch error", err)
+	}
+	//the ops of a whole file delta
+	if err := run(ctx, []string{"delta", empty, newer, filepath.Join(dir, "delta")}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	stream.Reset()
+	if err := run(ctx, []string{"dump-delta", filepath.Join(dir, "delta")}, nil, stream); err != nil ||
+		!strings.Contains(stream.String(), " whole ") || !strings.Contains(stream.String(), "data  out 0 len ") {
+		t.Fatalf("dump delta error %v %q", err, stream.String())
+	}
+	if err := run(ctx, []string{"signature", "-strong", "crc", basis, sig}, nil, nil); err == nil {
+		t.Fatal("unknown hash accepted")
+	}
+	if err := run(ctx, []string{"signature", "-weak", "crc", basis, sig}, nil, nil); err == nil {
+		t.Fatal("unknown weak hash accepted")
+	}
+	if err := run(ctx, []string{"nothing"}, nil, nil); err == nil {
+		t.Fatal("unknown command accepted")
+	}
+}
+
+func TestSync(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	files := map[string]string{
+		"a.txt":     "aaaaaaaa",
+		"sub/b.txt": "bbbbbbbb",
+		"sub/c.log": "cccccccc",
+	}
+	for k, v := range files {
+		p := filepath.Join(src, k)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dst, "old.txt"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	out := &bytes.Buffer{}
+	if err := run(ctx, []string{"sync", "-dry-run", "-delete", src, dst}, nil, out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "old.txt") {
+		t.Fatalf("dry run output %q", out.String())
+	}
+	if _, err := os.Stat(filepath.Join(dst, "a.txt")); err == nil {
+		t.Fatal("dry run wrote files")
+	}
+	if err := run(ctx, []string{"sync", "-delete", "-exclude", "*.log", src, dst}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range files {
+		got, err := os.ReadFile(filepath.Join(dst, k))
+		if strings.HasSuffix(k, ".log") {
+			if err == nil {
+				t.Fatalf("%s not excluded", k)
+			}
+			continue
+		}
+		if err != nil || string(got) != v {
+			t.Fatalf("%s error %v", k, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "old.txt")); err == nil {
+		t.Fatal("old.txt not deleted")
+	}
+	//a single file to a new local name
+	if err := run(ctx, []string{"sync", filepath.Join(src, "a.txt"), filepath.Join(dst, "copy.txt")}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dst, "copy.txt")); err != nil || string(got) != files["a.txt"] {
+		t.Fatal("file sync error", err)
+	}
+	//a manifest of dst skips the unchanged files
+	manifest := filepath.Join(t.TempDir(), "manifest")
+	if err := run(ctx, []string{"manifest", "-sigs", dst, manifest}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(src, "a.txt"), []byte("aaaaaaab"), 0644)
+	if err := run(ctx, []string{"sync", "-manifest", manifest, "-exclude", "*.log", src, dst}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dst, "a.txt")); err != nil || string(got) != "aaaaaaab" {
+		t.Fatal("manifest sync error", err)
+	}
+	//json events, a file line per entry and the done line
+	out.Reset()
+	if err := run(ctx, []string{"sync", "-json", "-itemize-changes", src, dst}, nil, out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if strings.Count(out.String(), `"type":"file"`) != 3 || !strings.Contains(out.String(), `"item":">f+++++++++ sub/c.log"`) ||
+		!strings.Contains(lines[len(lines)-1], `"type":"done"`) {
+		t.Fatalf("json output %q", out.String())
+	}
+}
+
+func TestSyncTCP(t *testing.T) {
+	root := t.TempDir()
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("hello tcp"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := rsync.NewTCPServer(root)
+	srv.Secret = []byte("key")
+	go srv.Serve(l)
+	defer srv.Close()
+	ctx := context.Background()
+	out := &bytes.Buffer{}
+	addr := "tcp://" + l.Addr().String()
+	if err := run(ctx, []string{"sync", "-secret", "key", "-stats", src, addr + "/dir"}, nil, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() == 0 {
+		t.Fatal("stats not printed")
+	}
+	if err := run(ctx, []string{"sync", "-secret", "key", filepath.Join(src, "a.txt"), addr + "/"}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"dir/a.txt", "a.txt"} {
+		if got, err := os.ReadFile(filepath.Join(root, p)); err != nil || string(got) != "hello tcp" {
+			t.Fatalf("%s error %v", p, err)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	src, basis, dst := t.TempDir(), t.TempDir(), t.TempDir()
+	old := strings.Repeat("batch data ", 1000)
+	for _, dir := range []string{basis, dst} {
+		if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte(old), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("new "+old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	batch := filepath.Join(t.TempDir(), "batch")
+	if err := run(ctx, []string{"sync", "-only-write-batch", batch, src, basis}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(basis, "a.txt")); string(got) != old {
+		t.Fatal("only-write-batch changed the destination")
+	}
+	if err := run(ctx, []string{"read-batch", batch, dst}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst, "a.txt")); string(got) != "new "+old {
+		t.Fatal("read-batch error")
+	}
+}
@@ -0,0 +1,146 @@
+package rsync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// literal compression ids, carried by the delta open frame
+const (
+	CompressNone = 0
+	CompressZstd = 1
+	CompressGzip = 2
+)
+
+// DefaultCompressThreshold literal frames shorter than this are sent raw
+const DefaultCompressThreshold = 64
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+	zstdErr  error
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEnc, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if zstdErr != nil {
+			return
+		}
+		//a data frame never inflates past MaxLiteralSize
+		zstdDec, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(MaxLiteralSize))
+	})
+	return zstdEnc, zstdDec, zstdErr
+}
+
+func compressData(c uint8, dat []byte) ([]byte, error) {
+	switch c {
+	case CompressZstd:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(dat, nil), nil
+	case CompressGzip:
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(dat); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("compress %d not support", c)
+}
+
+func decompressData(c uint8, dat []byte) ([]byte, error) {
+	switch c {
+	case CompressZstd:
+		_, dec, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return dec.DecodeAll(dat, nil)
+	case CompressGzip:
+		r, err := gzip.NewReader(bytes.NewReader(dat))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		out, err := io.ReadAll(io.LimitReader(r, MaxLiteralSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > MaxLiteralSize {
+			return nil, errors.New("compressed data too large")
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("compress %d not support", c)
+}
+
+// CompressData replaces Data with its compressed form when that is smaller
+func (this *AnalyseInfo) CompressData(c uint8) error {
+	if !this.IsData() || this.IsCompressed() || c == CompressNone {
+		return nil
+	}
+	dat, err := compressData(c, this.Data)
+	if err != nil {
+		return err
+	}
+	if len(dat) >= len(this.Data) {
+		return nil
+	}
+	this.Data = dat
+	this.Type |= AnalyseTypeCompressed
+	return nil
+}
+
+// DecompressData restores Data of a compressed literal frame, c comes from the open frame
+func (this *AnalyseInfo) DecompressData(c uint8) error {
+	if !this.IsCompressed() {
+		return nil
+	}
+	if c == CompressNone {
+		return errors.New("delta not compressed")
+	}
+	dat, err := decompressData(c, this.Data)
+	if err != nil {
+		return err
+	}
+	this.Data = dat
+	this.Type &^= AnalyseTypeCompressed
+	return nil
+}
+
+// CompressWriter writes delta frames with literal data compressed
+type CompressWriter struct {
+	W         io.Writer
+	Compress  uint8
+	Threshold int //literal frames below this size stay raw
+}
+
+func NewCompressWriter(w io.Writer, c uint8) *CompressWriter {
+	return &CompressWriter{W: w, Compress: c, Threshold: DefaultCompressThreshold}
+}
+
+func (this *CompressWriter) Write(info *AnalyseInfo) error {
+	if info.IsOpen() {
+		info.Compress = this.Compress
+	}
+	if info.IsData() && len(info.Data) >= this.Threshold {
+		if err := info.CompressData(this.Compress); err != nil {
+			return err
+		}
+	}
+	return info.Write(this.W)
+}
@@ -0,0 +1,73 @@
+package rsync
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestDeltaCompress(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	basis := make([]byte, DefaultBlockSize*4)
+	rnd.Read(basis)
+	src := append([]byte{}, basis[:DefaultBlockSize*2]...)
+	src = append(src, []byte(strings.Repeat("compressible literal ", 500))...)
+	src = append(src, basis[DefaultBlockSize*2:]...)
+	sig, err := Signature(bytes.NewReader(basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := &bytes.Buffer{}
+	if err := Delta(sig, bytes.NewReader(src), raw); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []uint8{CompressZstd, CompressGzip} {
+		delta := &bytes.Buffer{}
+		if err := DeltaCompress(sig, bytes.NewReader(src), delta, c); err != nil {
+			t.Fatal(err)
+		}
+		if delta.Len() >= raw.Len()/2 {
+			t.Errorf("compress %d delta size %d raw %d", c, delta.Len(), raw.Len())
+		}
+		out := &bytes.Buffer{}
+		if err := Patch(bytes.NewReader(basis), delta, out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), src) {
+			t.Error("patch result error", c)
+		}
+	}
+}
+
+func TestCompressThreshold(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewCompressWriter(buf, CompressZstd)
+	small := &AnalyseInfo{Type: AnalyseTypeData, Data: bytes.Repeat([]byte("a"), DefaultCompressThreshold-1)}
+	if err := w.Write(small); err != nil {
+		t.Fatal(err)
+	}
+	if small.IsCompressed() {
+		t.Error("small frame compressed")
+	}
+	//incompressible data stays raw
+	dat := make([]byte, 1000)
+	rand.New(rand.NewSource(2)).Read(dat)
+	noise := &AnalyseInfo{Type: AnalyseTypeData, Data: dat}
+	if err := w.Write(noise); err != nil {
+		t.Fatal(err)
+	}
+	if noise.IsCompressed() {
+		t.Error("random frame compressed")
+	}
+	info := &AnalyseInfo{Type: AnalyseTypeData, Data: bytes.Repeat([]byte("a"), 1000)}
+	if err := info.CompressData(CompressGzip); err != nil || !info.IsCompressed() {
+		t.Fatal("compress error", err)
+	}
+	if err := info.DecompressData(CompressNone); err == nil {
+		t.Error("decompress without compress id")
+	}
+	if err := info.DecompressData(CompressGzip); err != nil || !bytes.Equal(info.Data, bytes.Repeat([]byte("a"), 1000)) {
+		t.Error("decompress error", err)
+	}
+}
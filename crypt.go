@@ -0,0 +1,188 @@
+package rsync
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// stream cipher ids
+const (
+	CipherAESGCM           = 1
+	CipherChaCha20Poly1305 = 2
+)
+
+const (
+	CryptMagic     = "RENC"
+	CryptChunkSize = 1 << 16
+	cryptSaltSize  = 16
+	cryptKeyInfo   = "rsync stream key"
+)
+
+var ErrStreamTruncated = errors.New("encrypted stream truncated")
+
+// session key from the pre-shared key and the random per stream salt
+func newStreamAEAD(c uint8, key []byte, salt []byte) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, errors.New("key empty")
+	}
+	sk := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(cryptKeyInfo)), sk); err != nil {
+		return nil, err
+	}
+	switch c {
+	case CipherAESGCM:
+		block, err := aes.NewCipher(sk)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(sk)
+	}
+	return nil, fmt.Errorf("cipher %d not support", c)
+}
+
+// chunk sequence number and last flag, the flag is also authenticated
+func streamNonce(aead cipher.AEAD, seq uint64, last byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, tobyte64(seq))
+	nonce[8] = last
+	return nonce
+}
+
+// EncryptWriter seals a signature or delta stream in authenticated chunks,
+// Close writes the last chunk so a truncated stream is detected
+type EncryptWriter struct {
+	W    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	seq  uint64
+}
+
+func NewEncryptWriter(w io.Writer, key []byte, c uint8) (*EncryptWriter, error) {
+	salt := make([]byte, cryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newStreamAEAD(c, key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeHeader(w, CryptMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte{c}, salt...)); err != nil {
+		return nil, err
+	}
+	return &EncryptWriter{W: w, aead: aead}, nil
+}
+
+func (this *EncryptWriter) seal(dat []byte, last byte) error {
+	if this.aead == nil {
+		return errors.New("writer closed")
+	}
+	out := this.aead.Seal(nil, streamNonce(this.aead, this.seq, last), dat, []byte{last})
+	this.seq++
+	if _, err := this.W.Write(append([]byte{last}, tobyte32(uint32(len(out)))...)); err != nil {
+		return err
+	}
+	_, err := this.W.Write(out)
+	return err
+}
+
+func (this *EncryptWriter) Write(p []byte) (int, error) {
+	this.buf = append(this.buf, p...)
+	for len(this.buf) >= CryptChunkSize {
+		if err := this.seal(this.buf[:CryptChunkSize], 0); err != nil {
+			return 0, err
+		}
+		this.buf = this.buf[CryptChunkSize:]
+	}
+	return len(p), nil
+}
+
+func (this *EncryptWriter) Close() error {
+	if err := this.seal(this.buf, 1); err != nil {
+		return err
+	}
+	this.buf = nil
+	this.aead = nil
+	return nil
+}
+
+// DecryptReader opens a stream written by EncryptWriter
+type DecryptReader struct {
+	R    io.Reader
+	aead cipher.AEAD
+	buf  []byte
+	seq  uint64
+	done bool
+}
+
+func NewDecryptReader(r io.Reader, key []byte) (*DecryptReader, error) {
+	if err := readHeader(r, CryptMagic); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 1+cryptSaltSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	aead, err := newStreamAEAD(b[0], key, b[1:])
+	if err != nil {
+		return nil, err
+	}
+	return &DecryptReader{R: r, aead: aead}, nil
+}
+
+func (this *DecryptReader) next() error {
+	b5 := make([]byte, 5)
+	if _, err := io.ReadFull(this.R, b5); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrStreamTruncated
+	} else if err != nil {
+		return err
+	}
+	last := b5[0]
+	size, err := touint32(b5[1:])
+	if err != nil {
+		return err
+	}
+	if last > 1 || size > CryptChunkSize+uint32(this.aead.Overhead()) {
+		return errors.New("encrypted chunk error")
+	}
+	dat := make([]byte, size)
+	if _, err := io.ReadFull(this.R, dat); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrStreamTruncated
+	} else if err != nil {
+		return err
+	}
+	out, err := this.aead.Open(dat[:0], streamNonce(this.aead, this.seq, last), dat, []byte{last})
+	if err != nil {
+		return err
+	}
+	this.seq++
+	this.buf = out
+	this.done = last == 1
+	return nil
+}
+
+func (this *DecryptReader) Read(p []byte) (int, error) {
+	for len(this.buf) == 0 {
+		if this.done {
+			return 0, io.EOF
+		}
+		if err := this.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, this.buf)
+	this.buf = this.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,88 @@
+package rsync
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestEncryptStream(t *testing.T) {
+	key := []byte("pre-shared key")
+	dat := make([]byte, CryptChunkSize*2+100)
+	rand.New(rand.NewSource(1)).Read(dat)
+	for _, c := range []uint8{CipherAESGCM, CipherChaCha20Poly1305} {
+		buf := &bytes.Buffer{}
+		w, err := NewEncryptWriter(buf, key, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(dat); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		enc := buf.Bytes()
+		if bytes.Contains(enc, dat[:64]) {
+			t.Error("plain data in stream")
+		}
+		r, err := NewDecryptReader(bytes.NewReader(enc), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(out, dat) {
+			t.Fatal("decrypt error", c, err)
+		}
+		//wrong key
+		r, _ = NewDecryptReader(bytes.NewReader(enc), []byte("other key"))
+		if _, err := io.ReadAll(r); err == nil {
+			t.Error("wrong key accepted")
+		}
+		//truncated after a full chunk
+		r, _ = NewDecryptReader(bytes.NewReader(enc[:len(enc)-200]), key)
+		if _, err := io.ReadAll(r); err != ErrStreamTruncated {
+			t.Error("truncate error", err)
+		}
+		//tampered
+		bad := append([]byte{}, enc...)
+		bad[len(bad)-1] ^= 1
+		r, _ = NewDecryptReader(bytes.NewReader(bad), key)
+		if _, err := io.ReadAll(r); err == nil {
+			t.Error("tampered stream accepted")
+		}
+	}
+}
+
+func TestEncryptDelta(t *testing.T) {
+	key := []byte("k")
+	basis := bytes.Repeat([]byte("0123456789abcdef"), 300)
+	src := append([]byte("head"), basis...)
+	sig, err := Signature(bytes.NewReader(basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := NewEncryptWriter(buf, key, CipherChaCha20Poly1305)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Delta(sig, bytes.NewReader(src), w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewDecryptReader(buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if err := Patch(bytes.NewReader(basis), r, out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), src) {
+		t.Error("patch result error")
+	}
+}
@@ -0,0 +1,683 @@
+package rsync
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultDaemonAddr is the daemon listen address when the config has none
+const DefaultDaemonAddr = ":8730"
+
+// ErrReadOnly is returned for writes to a read only daemon module
+var ErrReadOnly = errors.New("module is read only")
+
+// DaemonModule is one directory served by the daemon, client paths start with its Name
+type DaemonModule struct {
+	Name     string
+	Path     string
+	Comment  string
+	ReadOnly bool
+	//merge options of the module store, see LocalStore
+	InPlace   bool
+	TempDir   string
+	BackupDir string
+	Fsync     bool
+	CacheDir  string //signature cache dir, no cache when empty
+	Fuzzy     bool
+	//clients allowed by address, ips or cidrs, a client matching HostsAllow is allowed, else one
+	//matching HostsDeny is denied, else it is allowed when HostsAllow is empty
+	HostsAllow []string
+	HostsDeny  []string
+	AuthUsers  []string //common names of the tls client certificates allowed, any client when empty
+	//limits of the module, 0 is no limit
+	MaxConnections int   //concurrent connections using the module
+	BWLimit        int64 //delta bytes per second of all clients
+	MaxFileSize    int64 //largest file a delta may build
+}
+
+// DaemonConfig is the daemon config, see ReadDaemonConfig for the file format
+type DaemonConfig struct {
+	Listen   string
+	Cert     string //tls is on when set
+	Key      string
+	ClientCA string //require client certificates signed by this ca
+	Secret   []byte //require hmac authenticated messages
+	Modules  []*DaemonModule
+	//limits of the connections, 0 is no limit
+	MaxConnections       int   //concurrent connections
+	MaxClientConnections int   //concurrent connections of one client address
+	ClientBWLimit        int64 //bytes per second both ways of one client address
+	//"landlock" confines the daemon to the module dirs before it serves, see Daemon.Sandbox
+	Sandbox string
+}
+
+// LoadDaemonConfig reads the config file
+func LoadDaemonConfig(file string) (*DaemonConfig, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	conf, err := ReadDaemonConfig(fd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	//relative paths are relative to the config file
+	dir := filepath.Dir(file)
+	rel := func(p *string) {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	rel(&conf.Cert)
+	rel(&conf.Key)
+	rel(&conf.ClientCA)
+	for _, m := range conf.Modules {
+		rel(&m.Path)
+		rel(&m.TempDir)
+		rel(&m.BackupDir)
+		rel(&m.CacheDir)
+	}
+	return conf, nil
+}
+
+// ReadDaemonConfig parses an rsyncd.conf like config, global "key = value" lines
+// come first then one [name] section per module:
+//
+//	listen = :8730
+//	cert = server.crt
+//	key = server.key
+//	client ca = ca.crt
+//	secret file = rsyncd.secret
+//	max connections = 100
+//	max connections per client = 4
+//	client bwlimit = 1048576
+//	sandbox = landlock
+//
+//	[backup]
+//	path = /srv/backup
+//	comment = nightly backups
+//	read only = false
+//	hosts allow = 10.0.0.0/8 192.168.1.7
+//	auth users = backup-agent
+//	max file size = 10737418240
+//
+// module keys are path, comment, read only, in place, temp dir, backup dir, fsync, signature cache, fuzzy,
+// hosts allow, hosts deny, auth users, max connections, bwlimit and max file size, lists are separated
+// by spaces or commas, # and ; start comments
+func ReadDaemonConfig(r io.Reader) (*DaemonConfig, error) {
+	conf := &DaemonConfig{}
+	var mod *DaemonModule
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || text[0] == '#' || text[0] == ';' {
+			continue
+		}
+		if text[0] == '[' {
+			if !strings.HasSuffix(text, "]") {
+				return nil, fmt.Errorf("line %d: section error", line)
+			}
+			mod = &DaemonModule{Name: strings.TrimSpace(text[1 : len(text)-1])}
+			conf.Modules = append(conf.Modules, mod)
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: missing =", line)
+		}
+		key = strings.ToLower(strings.Join(strings.Fields(key), " "))
+		value = strings.TrimSpace(value)
+		var err error
+		if mod == nil {
+			err = conf.set(key, value)
+		} else {
+			err = mod.set(key, value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return conf, conf.Validate()
+}
+
+func (this *DaemonConfig) set(key string, value string) error {
+	switch key {
+	case "listen", "address":
+		this.Listen = value
+	case "cert":
+		this.Cert = value
+	case "key":
+		this.Key = value
+	case "client ca":
+		this.ClientCA = value
+	case "secret":
+		this.Secret = []byte(value)
+	case "secret file":
+		b, err := os.ReadFile(value)
+		if err != nil {
+			return err
+		}
+		this.Secret = []byte(strings.TrimSpace(string(b)))
+	case "max connections":
+		n, err := parseConfigLimit(value)
+		this.MaxConnections = int(n)
+		return err
+	case "max connections per client":
+		n, err := parseConfigLimit(value)
+		this.MaxClientConnections = int(n)
+		return err
+	case "client bwlimit":
+		n, err := parseConfigLimit(value)
+		this.ClientBWLimit = n
+		return err
+	case "sandbox":
+		this.Sandbox = value
+	default:
+		return fmt.Errorf("unknown key %q", key)
+	}
+	return nil
+}
+
+func (this *DaemonModule) set(key string, value string) error {
+	var err error
+	switch key {
+	case "path":
+		this.Path = value
+	case "comment":
+		this.Comment = value
+	case "read only":
+		this.ReadOnly, err = parseConfigBool(value)
+	case "in place":
+		this.InPlace, err = parseConfigBool(value)
+	case "temp dir":
+		this.TempDir = value
+	case "backup dir":
+		this.BackupDir = value
+	case "fsync":
+		this.Fsync, err = parseConfigBool(value)
+	case "signature cache":
+		this.CacheDir = value
+	case "fuzzy":
+		this.Fuzzy, err = parseConfigBool(value)
+	case "hosts allow":
+		this.HostsAllow = configList(value)
+	case "hosts deny":
+		this.HostsDeny = configList(value)
+	case "auth users":
+		this.AuthUsers = configList(value)
+	case "max connections":
+		var n int64
+		n, err = parseConfigLimit(value)
+		this.MaxConnections = int(n)
+	case "bwlimit":
+		this.BWLimit, err = parseConfigLimit(value)
+	case "max file size":
+		this.MaxFileSize, err = parseConfigLimit(value)
+	default:
+		return fmt.Errorf("unknown module key %q", key)
+	}
+	return err
+}
+
+// parseConfigBool accepts yes/no and on/off besides the strconv forms
+func parseConfigBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "on":
+		return true, nil
+	case "no", "off":
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// configList splits a list of spaces or commas
+func configList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// parseConfigLimit parses a limit >= 0, 0 is no limit
+func parseConfigLimit(value string) (int64, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("limit %d < 0", n)
+	}
+	return n, err
+}
+
+// Validate checks the module names and paths
+func (this *DaemonConfig) Validate() error {
+	if (this.Cert == "") != (this.Key == "") {
+		return errors.New("cert and key must be set together")
+	}
+	if this.ClientCA != "" && this.Cert == "" {
+		return errors.New("client ca needs cert")
+	}
+	if this.Sandbox != "" && this.Sandbox != "landlock" && this.Sandbox != "none" {
+		return fmt.Errorf("sandbox %q error", this.Sandbox)
+	}
+	if len(this.Modules) == 0 {
+		return errors.New("no module")
+	}
+	names := map[string]bool{}
+	for _, m := range this.Modules {
+		if m.Name == "" || strings.ContainsAny(m.Name, "/\\") || m.Name == "." || m.Name == ".." {
+			return fmt.Errorf("module name %q error", m.Name)
+		}
+		if names[m.Name] {
+			return fmt.Errorf("module %s duplicated", m.Name)
+		}
+		names[m.Name] = true
+		if m.Path == "" {
+			return fmt.Errorf("module %s has no path", m.Name)
+		}
+		for _, h := range append(append([]string{}, m.HostsAllow...), m.HostsDeny...) {
+			if _, _, err := net.ParseCIDR(h); err != nil && net.ParseIP(h) == nil {
+				return fmt.Errorf("module %s host %q error", m.Name, h)
+			}
+		}
+	}
+	return nil
+}
+
+// allows reports whether the module serves p, requests without a peer are local and allowed
+func (this *DaemonModule) allows(p *Peer) bool {
+	if p == nil {
+		return true
+	}
+	if len(this.AuthUsers) > 0 && (p.User == "" || !slices.Contains(this.AuthUsers, p.User)) {
+		return false
+	}
+	ip := net.ParseIP(p.Addr)
+	if matchHosts(this.HostsAllow, ip) {
+		return true
+	}
+	if matchHosts(this.HostsDeny, ip) {
+		return false
+	}
+	return len(this.HostsAllow) == 0
+}
+
+// matchHosts reports whether ip is one of the ips or in one of the cidrs of hosts
+func matchHosts(hosts []string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, h := range hosts {
+		if _, n, err := net.ParseCIDR(h); err == nil {
+			if n.Contains(ip) {
+				return true
+			}
+		} else if hip := net.ParseIP(h); hip != nil && hip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleStore routes "module/path" requests to the module stores
+type moduleStore struct {
+	modules map[string]*DaemonModule
+	stores  map[string]*LocalStore
+	limits  map[string]*Limiter //delta bandwidth of the modules with BWLimit
+	mu      sync.Mutex
+	active  map[string]int //connections holding a slot of the modules
+}
+
+// moduleSlots are the modules a connection holds a slot of, guarded by moduleStore.mu
+type moduleSlots map[string]bool
+
+type moduleSlotsKey struct{}
+
+// session counts the connection of ctx against the module MaxConnections from its first request
+// to a module until end is called, requests without a session hold a slot while they run
+func (this *moduleStore) session(ctx context.Context) (context.Context, func()) {
+	slots := moduleSlots{}
+	end := func() {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		for mod := range slots {
+			this.active[mod]--
+		}
+	}
+	return context.WithValue(ctx, moduleSlotsKey{}, slots), end
+}
+
+func newModuleStore(mods []*DaemonModule) *moduleStore {
+	ret := &moduleStore{
+		modules: map[string]*DaemonModule{},
+		stores:  map[string]*LocalStore{},
+		limits:  map[string]*Limiter{},
+		active:  map[string]int{},
+	}
+	for _, m := range mods {
+		ret.modules[m.Name] = m
+		s := &LocalStore{
+			Root:        m.Path,
+			InPlace:     m.InPlace,
+			TempDir:     m.TempDir,
+			BackupDir:   m.BackupDir,
+			Fsync:       m.Fsync,
+			Fuzzy:       m.Fuzzy,
+			MaxFileSize: m.MaxFileSize,
+		}
+		if m.CacheDir != "" {
+			s.Cache = NewSignatureCache(m.CacheDir)
+		}
+		ret.stores[m.Name] = s
+		if m.BWLimit > 0 {
+			ret.limits[m.Name] = NewLimiter(m.BWLimit)
+		}
+	}
+	return ret
+}
+
+// splitModule splits name into the module name and the path in the module
+func splitModule(name string) (string, string) {
+	mod, rest, _ := strings.Cut(strings.TrimPrefix(name, "/"), "/")
+	return mod, rest
+}
+
+// store returns the module store of name and the path in it, write requests fail on read only modules
+// and clients the module doesn't allow with fs.ErrPermission, release ends the request counted
+// against the module MaxConnections, it does nothing in sessions
+func (this *moduleStore) store(ctx context.Context, name string, write bool) (*LocalStore, string, func(), error) {
+	mod, rest := splitModule(name)
+	m, ok := this.modules[mod]
+	if !ok {
+		return nil, "", nil, fmt.Errorf("unknown module %q", mod)
+	}
+	if !m.allows(PeerFrom(ctx)) {
+		return nil, "", nil, fmt.Errorf("module %s: %w", mod, fs.ErrPermission)
+	}
+	if write && m.ReadOnly {
+		return nil, "", nil, fmt.Errorf("%w: %s", ErrReadOnly, mod)
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	slots, _ := ctx.Value(moduleSlotsKey{}).(moduleSlots)
+	if slots[mod] {
+		return this.stores[mod], rest, func() {}, nil
+	}
+	if m.MaxConnections > 0 && this.active[mod] >= m.MaxConnections {
+		return nil, "", nil, fmt.Errorf("%w: module %s has %d connections", ErrBusy, mod, m.MaxConnections)
+	}
+	this.active[mod]++
+	if slots != nil {
+		slots[mod] = true
+		return this.stores[mod], rest, func() {}, nil
+	}
+	release := func() {
+		this.mu.Lock()
+		this.active[mod]--
+		this.mu.Unlock()
+	}
+	return this.stores[mod], rest, release, nil
+}
+
+func (this *moduleStore) Signature(ctx context.Context, name string) (*HashInfo, error) {
+	s, rest, release, err := this.store(ctx, name, false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return s.Signature(ctx, rest)
+}
+
+func (this *moduleStore) Apply(ctx context.Context, name string, delta io.Reader) error {
+	s, rest, release, err := this.store(ctx, name, true)
+	if err != nil {
+		return err
+	}
+	defer release()
+	mod, _ := splitModule(name)
+	if l := this.limits[mod]; l != nil {
+		delta = NewLimitReader(ctx, delta, l)
+	}
+	return s.Apply(ctx, rest, delta)
+}
+
+func (this *moduleStore) Resumed(ctx context.Context, name string) (int64, error) {
+	s, rest, release, err := this.store(ctx, name, false)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return s.Resumed(ctx, rest)
+}
+
+// List of the empty dir lists the modules as dirs
+func (this *moduleStore) List(ctx context.Context, dir string) ([]FileEntry, error) {
+	if dir == "" || dir == "/" {
+		list := make([]FileEntry, 0, len(this.modules))
+		for name, m := range this.modules {
+			if m.allows(PeerFrom(ctx)) {
+				list = append(list, FileEntry{Path: name, Mode: os.ModeDir | 0555})
+			}
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Path < list[j].Path
+		})
+		return list, nil
+	}
+	s, rest, release, err := this.store(ctx, dir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return s.List(ctx, rest)
+}
+
+func (this *moduleStore) Remove(ctx context.Context, name string) error {
+	s, rest, release, err := this.store(ctx, name, true)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return s.Remove(ctx, rest)
+}
+
+func (this *moduleStore) Symlink(ctx context.Context, target string, name string) error {
+	s, rest, release, err := this.store(ctx, name, true)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return s.Symlink(ctx, target, rest)
+}
+
+func (this *moduleStore) Link(ctx context.Context, target string, name string) error {
+	s, rest, release, err := this.store(ctx, name, true)
+	if err != nil {
+		return err
+	}
+	defer release()
+	//hard link targets are paths of the same module
+	tmod, trest := splitModule(target)
+	if mod, _ := splitModule(name); tmod != mod {
+		return fmt.Errorf("link %s: target %s in another module", name, target)
+	}
+	return s.Link(ctx, trest, rest)
+}
+
+func (this *moduleStore) Close() error {
+	return nil
+}
+
+// Daemon is the long running server of a set of modules, like rsyncd,
+// TCPClient and QUICClient paths start with the module name
+type Daemon struct {
+	*TCPServer
+	Config *DaemonConfig
+}
+
+// NewDaemon checks the config and the module dirs
+func NewDaemon(conf *DaemonConfig) (*Daemon, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	for _, m := range conf.Modules {
+		fi, err := os.Stat(m.Path)
+		if err != nil {
+			return nil, fmt.Errorf("module %s: %w", m.Name, err)
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("module %s: %s is not a dir", m.Name, m.Path)
+		}
+	}
+	ms := newModuleStore(conf.Modules)
+	srv := &TCPServer{
+		Secret:  conf.Secret,
+		store:   ms,
+		session: ms.session,
+		conns:   map[net.Conn]bool{},
+	}
+	srv.admit = (&daemonQuota{conf: conf, clients: map[string]*clientQuota{}}).admit
+	return &Daemon{TCPServer: srv, Config: conf}, nil
+}
+
+// daemonQuota counts the connections of every client address
+type daemonQuota struct {
+	conf    *DaemonConfig
+	mu      sync.Mutex
+	total   int
+	clients map[string]*clientQuota
+}
+
+// clientQuota is the open connections of one client address and their shared bandwidth
+type clientQuota struct {
+	conns int
+	limit *Limiter
+}
+
+// admit refuses connections past the limits with ErrBusy and throttles the client bandwidth
+func (this *daemonQuota) admit(conn net.Conn) (net.Conn, func(), error) {
+	host := peerHost(conn.RemoteAddr())
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if max := this.conf.MaxConnections; max > 0 && this.total >= max {
+		return nil, nil, fmt.Errorf("%w: %d connections", ErrBusy, max)
+	}
+	cq := this.clients[host]
+	if max := this.conf.MaxClientConnections; max > 0 && cq != nil && cq.conns >= max {
+		return nil, nil, fmt.Errorf("%w: %s has %d connections", ErrBusy, host, max)
+	}
+	if cq == nil {
+		cq = &clientQuota{}
+		if this.conf.ClientBWLimit > 0 {
+			cq.limit = NewLimiter(this.conf.ClientBWLimit)
+		}
+		this.clients[host] = cq
+	}
+	cq.conns++
+	this.total++
+	release := func() {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		this.total--
+		if cq.conns--; cq.conns == 0 {
+			delete(this.clients, host)
+		}
+	}
+	if cq.limit != nil {
+		ctx := context.Background()
+		conn = &limitConn{Conn: conn, r: NewLimitReader(ctx, conn, cq.limit), w: NewLimitWriter(ctx, conn, cq.limit)}
+	}
+	return conn, release, nil
+}
+
+// limitConn throttles both directions of a connection
+type limitConn struct {
+	net.Conn
+	r *LimitReader
+	w *LimitWriter
+}
+
+func (this *limitConn) Read(p []byte) (int, error) {
+	return this.r.Read(p)
+}
+
+func (this *limitConn) Write(p []byte) (int, error) {
+	return this.w.Write(p)
+}
+
+// ListenAndServe serves on Config.Listen, with tls when Config.Cert is set, the Config.Sandbox
+// is entered after the listener and certificates are set up
+func (this *Daemon) ListenAndServe() error {
+	addr := this.Config.Listen
+	if addr == "" {
+		addr = DefaultDaemonAddr
+	}
+	var l net.Listener
+	var err error
+	if this.Config.Cert == "" {
+		l, err = net.Listen("tcp", addr)
+	} else {
+		var conf *tls.Config
+		if conf, err = ServerTLSConfig(this.Config.Cert, this.Config.Key, this.Config.ClientCA); err != nil {
+			return err
+		}
+		l, err = tls.Listen("tcp", addr, conf)
+	}
+	if err != nil {
+		return err
+	}
+	if this.Config.Sandbox == "landlock" {
+		if err := this.Sandbox(); err != nil {
+			l.Close()
+			return fmt.Errorf("sandbox: %w", err)
+		}
+	}
+	return this.Serve(l)
+}
+
+// Sandbox confines the process to the module dirs with landlock, files elsewhere can't be opened
+// even when a bug or a symlink leads there, read only modules can only be read. It restricts the
+// whole process for good, linux only, and builds with cgo fail since not every thread is reachable
+func (this *Daemon) Sandbox() error {
+	rw, ro, err := this.Config.sandboxDirs()
+	if err != nil {
+		return err
+	}
+	return landlock(rw, ro)
+}
+
+// sandboxDirs are the dirs the modules change and read, missing work dirs are created
+func (this *DaemonConfig) sandboxDirs() ([]string, []string, error) {
+	var rw, ro []string
+	for _, m := range this.Modules {
+		if m.ReadOnly {
+			ro = append(ro, m.Path)
+		} else {
+			rw = append(rw, m.Path)
+		}
+		for _, dir := range []string{m.TempDir, m.BackupDir, m.CacheDir} {
+			if dir == "" {
+				continue
+			}
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return nil, nil, err
+			}
+			rw = append(rw, dir)
+		}
+	}
+	return rw, ro, nil
+}
@@ -0,0 +1,381 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadDaemonConfig(t *testing.T) {
+	conf, err := ReadDaemonConfig(strings.NewReader(`
+# global
+listen = 127.0.0.1:9000
+secret = key
+max connections = 10
+max connections per client = 2
+client bwlimit = 1000
+sandbox = landlock
+
+[data]
+path = /srv/data
+comment = the data
+[logs]
+path = /srv/logs
+read only = yes
+; options
+in place = true
+max connections = 3
+hosts allow = 10.0.0.0/8, 192.168.1.7
+hosts deny = 0.0.0.0/0
+auth users = alice bob
+bwlimit = 500
+max file size = 4096
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Listen != "127.0.0.1:9000" || string(conf.Secret) != "key" || len(conf.Modules) != 2 {
+		t.Fatalf("config %+v", conf)
+	}
+	if m := conf.Modules[1]; m.Name != "logs" || m.Path != "/srv/logs" || !m.ReadOnly || !m.InPlace {
+		t.Fatalf("module %+v", m)
+	}
+	if conf.MaxConnections != 10 || conf.MaxClientConnections != 2 || conf.ClientBWLimit != 1000 || conf.Sandbox != "landlock" {
+		t.Fatalf("limits %+v", conf)
+	}
+	if m := conf.Modules[1]; m.MaxConnections != 3 || m.BWLimit != 500 || m.MaxFileSize != 4096 {
+		t.Fatalf("module limits %+v", m)
+	}
+	if m := conf.Modules[1]; len(m.HostsAllow) != 2 || m.HostsDeny[0] != "0.0.0.0/0" || len(m.AuthUsers) != 2 {
+		t.Fatalf("module access %+v", m)
+	}
+	for _, bad := range []string{
+		"",
+		"[a]\n",
+		"[a]\npath = x\n[a]\npath = y\n",
+		"[a/b]\npath = x\n",
+		"nothing = 1\n[a]\npath = x\n",
+		"[a]\npath = x\nread only = maybe\n",
+		"cert = a.crt\n[a]\npath = x\n",
+		"max connections = -1\n[a]\npath = x\n",
+		"[a]\npath = x\nmax file size = big\n",
+		"[a]\npath = x\nhosts allow = 10.0.0.300\n",
+		"sandbox = jail\n[a]\npath = x\n",
+	} {
+		if _, err := ReadDaemonConfig(strings.NewReader(bad)); err == nil {
+			t.Fatalf("%q accepted", bad)
+		}
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	data := t.TempDir()
+	logs := t.TempDir()
+	if err := os.WriteFile(filepath.Join(logs, "a.log"), []byte("log"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDaemon(&DaemonConfig{
+		Secret: []byte("key"),
+		Modules: []*DaemonModule{
+			{Name: "data", Path: data},
+			{Name: "logs", Path: logs, ReadOnly: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+	defer d.Close()
+	ctx := context.Background()
+	c, err := DialTCP(ctx, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Secret = []byte("key")
+	defer c.Close()
+	list, err := c.List(ctx, "")
+	if err != nil || len(list) != 2 || list[0].Path != "data" || !list[1].IsDir() {
+		t.Fatalf("module list %v %v", list, err)
+	}
+	dat := bytes.Repeat([]byte("daemon"), 1000)
+	if err := Push(ctx, c, bytes.NewReader(dat), "data/sub/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(data, "sub", "a.txt")); err != nil || !bytes.Equal(got, dat) {
+		t.Fatal("push error", err)
+	}
+	if err := c.Link(ctx, "data/sub/a.txt", "data/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Link(ctx, "logs/a.log", "data/c.txt"); err == nil {
+		t.Fatal("link across modules accepted")
+	}
+	//read only modules serve signatures and lists but refuse writes
+	if sig, err := c.Signature(ctx, "logs/a.log"); err != nil || sig.IsEmpty() {
+		t.Fatal("read only signature error", err)
+	}
+	if list, err := c.List(ctx, "logs"); err != nil || len(list) != 1 {
+		t.Fatal("read only list error", err)
+	}
+	if err := Push(ctx, c, bytes.NewReader(dat), "logs/a.log"); err == nil || !strings.Contains(err.Error(), ErrReadOnly.Error()) {
+		t.Fatal("read only push accepted", err)
+	}
+	if err := c.Remove(ctx, "logs/a.log"); err == nil {
+		t.Fatal("read only remove accepted")
+	}
+	if _, err := c.Signature(ctx, "other/a.txt"); err == nil {
+		t.Fatal("unknown module accepted")
+	}
+	//dir sync into a module
+	src := t.TempDir()
+	testWriteFiles(t, src, map[string]string{"x.txt": "xxx", "d/y.txt": "yyy"})
+	if err := NewDirSyncer(src, c, "data/mirror").Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, filepath.Join(data, "mirror"), map[string]string{"x.txt": "xxx", "d/y.txt": "yyy"})
+}
+
+func TestNewDaemon(t *testing.T) {
+	if _, err := NewDaemon(&DaemonConfig{Modules: []*DaemonModule{{Name: "a", Path: filepath.Join(t.TempDir(), "none")}}}); err == nil {
+		t.Fatal("missing module dir accepted")
+	}
+}
+
+func TestDaemonQuotas(t *testing.T) {
+	data := t.TempDir()
+	d, err := NewDaemon(&DaemonConfig{
+		MaxClientConnections: 1,
+		ClientBWLimit:        20000,
+		Modules:              []*DaemonModule{{Name: "data", Path: data, MaxFileSize: 30000, MaxConnections: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+	defer d.Close()
+	ctx := context.Background()
+	dial := func() *TCPClient {
+		c, err := DialTCP(ctx, l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	c := dial()
+	if _, err := c.List(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	//one connection per client address
+	c2 := dial()
+	if _, err := c2.List(ctx, ""); !errors.Is(err, ErrBusy) || !IsRetryable(err) {
+		t.Error("second connection accepted", err)
+	}
+	c2.Close()
+	//the client bandwidth throttles the delta past the burst
+	dat := make([]byte, 30000)
+	rand.New(rand.NewSource(1)).Read(dat)
+	now := time.Now()
+	if err := Push(ctx, c, bytes.NewReader(dat), "data/a.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(now) < 300*time.Millisecond {
+		t.Error("client bandwidth not limited", time.Since(now))
+	}
+	err = Push(ctx, c, bytes.NewReader(append(dat, 1)), "data/a.bin")
+	if !errors.Is(err, ErrTooLarge) || IsRetryable(err) {
+		t.Error("large file accepted", err)
+	}
+	c.Close()
+	//the closed connection frees its slot
+	for i := 0; ; i++ {
+		c = dial()
+		_, err := c.List(ctx, "")
+		c.Close()
+		if err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("connection slot not freed", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	//requests outside sessions hold a module slot while they run
+	ms := d.store.(*moduleStore)
+	_, _, release, err := ms.store(ctx, "data/a.bin", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.Signature(ctx, "data/a.bin"); !errors.Is(err, ErrBusy) {
+		t.Error("module request past its limit", err)
+	}
+	release()
+	if _, err := ms.Signature(ctx, "data/a.bin"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDaemonModuleSessions(t *testing.T) {
+	d, err := NewDaemon(&DaemonConfig{
+		Modules: []*DaemonModule{{Name: "data", Path: t.TempDir(), MaxConnections: 1}, {Name: "other", Path: t.TempDir()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+	defer d.Close()
+	ctx := context.Background()
+	dial := func() *TCPClient {
+		c, err := DialTCP(ctx, l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	c1, c2 := dial(), dial()
+	defer c2.Close()
+	//the first session keeps its slot between requests
+	for i := 0; i < 3; i++ {
+		if _, err := c1.List(ctx, "data"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c2.List(ctx, "data"); !errors.Is(err, ErrBusy) {
+		t.Error("second session got the module slot", err)
+	}
+	if _, err := c2.List(ctx, "other"); err != nil {
+		t.Error("module without limit", err)
+	}
+	//the closed session frees its slot
+	c1.Close()
+	for i := 0; ; i++ {
+		_, err := c2.List(ctx, "data")
+		if err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("module slot not freed", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c3 := dial()
+	defer c3.Close()
+	if _, err := c3.List(ctx, "data"); !errors.Is(err, ErrBusy) {
+		t.Error("third session got the module slot", err)
+	}
+}
+
+func TestDaemonAccess(t *testing.T) {
+	mods := []*DaemonModule{
+		{Name: "open", Path: t.TempDir()},
+		{Name: "lan", Path: t.TempDir(), HostsAllow: []string{"10.0.0.0/8"}},
+		{Name: "deny", Path: t.TempDir(), HostsAllow: []string{"10.1.2.3"}, HostsDeny: []string{"10.0.0.0/8"}},
+		{Name: "users", Path: t.TempDir(), AuthUsers: []string{"alice"}},
+	}
+	ms := newModuleStore(mods)
+	for _, v := range []struct {
+		peer    *Peer
+		modules string
+	}{
+		{nil, "deny lan open users"},
+		{&Peer{Addr: "127.0.0.1"}, "open"},
+		{&Peer{Addr: "10.9.9.9"}, "lan open"},
+		{&Peer{Addr: "10.1.2.3"}, "deny lan open"},
+		{&Peer{Addr: "127.0.0.1", User: "alice"}, "open users"},
+		{&Peer{Addr: "127.0.0.1", User: "bob"}, "open"},
+	} {
+		ctx := withPeer(context.Background(), v.peer)
+		list, err := ms.List(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range list {
+			names = append(names, e.Path)
+		}
+		if strings.Join(names, " ") != v.modules {
+			t.Error(v.peer, names)
+		}
+		for _, m := range mods {
+			_, err := ms.Signature(ctx, m.Name+"/a.txt")
+			if allowed := strings.Contains(" "+v.modules+" ", " "+m.Name+" "); allowed != (err == nil) {
+				t.Error(v.peer, m.Name, err)
+			} else if err != nil && !errors.Is(err, fs.ErrPermission) {
+				t.Error(m.Name, err)
+			}
+		}
+	}
+	//the daemon passes the client address, names can't leave the module with ..
+	d, err := NewDaemon(&DaemonConfig{Modules: mods})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+	defer d.Close()
+	ctx := context.Background()
+	c, err := DialTCP(ctx, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if list, err := c.List(ctx, ""); err != nil || len(list) != 1 || list[0].Path != "open" {
+		t.Error("remote module list", list, err)
+	}
+	if err := Push(ctx, c, strings.NewReader("x"), "lan/a.txt"); !errors.Is(err, fs.ErrPermission) {
+		t.Error("denied module push", err)
+	}
+	for _, name := range []string{"open/../lan/a.txt", "open/a/../../lan/a.txt", "open/.."} {
+		if err := Push(ctx, c, strings.NewReader("x"), name); err == nil {
+			t.Error(name, "accepted")
+		}
+	}
+	if err := c.Symlink(ctx, "../../lan", "open/escape"); err == nil {
+		t.Error("symlink out of the module accepted")
+	}
+	if err := Push(ctx, c, strings.NewReader("x"), "open/a.txt"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSandboxDirs(t *testing.T) {
+	dir := t.TempDir()
+	conf := &DaemonConfig{Modules: []*DaemonModule{
+		{Name: "a", Path: filepath.Join(dir, "a"), TempDir: filepath.Join(dir, "tmp")},
+		{Name: "b", Path: filepath.Join(dir, "b"), ReadOnly: true, CacheDir: filepath.Join(dir, "cache")},
+	}}
+	rw, ro, err := conf.sandboxDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(rw, " ") != strings.Join([]string{conf.Modules[0].Path, conf.Modules[0].TempDir, conf.Modules[1].CacheDir}, " ") ||
+		len(ro) != 1 || ro[0] != conf.Modules[1].Path {
+		t.Error("sandbox dirs", rw, ro)
+	}
+	//the work dirs exist to be added to the sandbox
+	if fi, err := os.Stat(conf.Modules[1].CacheDir); err != nil || !fi.IsDir() {
+		t.Error("cache dir not created", err)
+	}
+}
@@ -0,0 +1,126 @@
+package rsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultSSHCommand is the remote command Dial runs over ssh, it serves the protocol with ServeStdio
+const DefaultSSHCommand = "rsync"
+
+// Dial opens the transport of the url dst and returns the path on it. Local paths and file:// are
+// a LocalStore rooted at the path, tcp://, tls:// and rsync:// dial a TCPServer or daemon,
+// http(s):// an HTTPServer and ssh://[user@]host/path runs DefaultSSHCommand on the host, paths
+// are relative to the remote home and ssh://host//abs is absolute. Clients needing secrets, tls
+// certificates or limits are made with their own constructors
+func Dial(ctx context.Context, dst string) (Transport, string, error) {
+	u, err := url.Parse(dst)
+	if err != nil || u.Scheme == "" || len(u.Scheme) == 1 {
+		//a local path, windows drive letters parse as schemes
+		return NewLocalStore(dst), "", nil
+	}
+	dir := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "file":
+		if u.Host != "" && u.Host != "localhost" {
+			return nil, "", fmt.Errorf("file url %s on another host", dst)
+		}
+		return NewLocalStore(filepath.FromSlash(u.Path)), "", nil
+	case "tcp", "tls", "rsync":
+		if u.Scheme == "rsync" && u.Port() == "" {
+			//a daemon on the default port, paths start with the module
+			u.Host = net.JoinHostPort(u.Hostname(), strings.TrimPrefix(DefaultDaemonAddr, ":"))
+		}
+		var c *TCPClient
+		if u.Scheme == "tls" {
+			c, err = DialTLS(ctx, u.Host, nil)
+		} else {
+			c, err = DialTCP(ctx, u.Host)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		return c, dir, nil
+	case "http", "https":
+		return NewHTTPClient(u.Scheme+"://"+u.Host, nil), dir, nil
+	case "ssh":
+		host := u.Host
+		if u.User != nil {
+			host = u.User.Username() + "@" + host
+		}
+		root := dir
+		if root == "" {
+			root = "."
+		}
+		c, err := DialSSH(ctx, host, DefaultSSHCommand+" serve-stdio "+root)
+		if err != nil {
+			return nil, "", err
+		}
+		return c, "", nil
+	}
+	return nil, "", fmt.Errorf("unknown url scheme %q", u.Scheme)
+}
+
+// Sync is SyncContext without a deadline
+func Sync(src string, dst string) (Stats, error) {
+	return SyncContext(context.Background(), src, dst)
+}
+
+// SyncContext rebuilds the local file or dir src at the url dst opened by Dial. A dir is synced
+// into the dst path, a file is pushed into the dst dir when it exists or a path ending in / and to
+// the dst path else
+func SyncContext(ctx context.Context, src string, dst string) (Stats, error) {
+	if u, err := url.Parse(src); err == nil && u.Scheme == "file" {
+		src = filepath.FromSlash(u.Path)
+	} else if err == nil && len(u.Scheme) > 1 {
+		return Stats{}, errors.New("sync source must be local")
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return Stats{}, err
+	}
+	t, dir, err := Dial(ctx, dst)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer t.Close()
+	if fi.IsDir() {
+		s := NewDirSyncer(src, t, dir)
+		err := s.Sync(ctx)
+		return s.Stats, err
+	}
+	fd, err := os.Open(src)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer fd.Close()
+	st, err := PushStats(ctx, t, fd, fileTarget(t, src, dir))
+	if st == nil {
+		return Stats{}, err
+	}
+	return *st, err
+}
+
+// fileTarget is the path the file src is pushed to, a LocalStore not rooted at a dir is moved
+// to the parent so its root names the file
+func fileTarget(t Transport, src string, dir string) string {
+	if ls, ok := t.(*LocalStore); ok {
+		if fi, err := os.Stat(ls.Root); err == nil && fi.IsDir() {
+			return filepath.Base(src)
+		}
+		name := filepath.Base(ls.Root)
+		ls.Root = filepath.Dir(ls.Root)
+		return name
+	}
+	if dir == "" || strings.HasSuffix(dir, "/") {
+		return path.Join(dir, filepath.Base(src))
+	}
+	return dir
+}
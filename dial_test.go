@@ -0,0 +1,60 @@
+package rsync
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncURL(t *testing.T) {
+	files := map[string]string{"a.txt": "aaaa", "b/c.txt": "cccc"}
+	src := t.TempDir()
+	testWriteFiles(t, src, files)
+	//a local path and a file url
+	dst := t.TempDir()
+	if _, err := Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, dst, files)
+	dst2 := t.TempDir()
+	if _, err := Sync("file://"+filepath.ToSlash(src), "file://"+filepath.ToSlash(dst2)); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, dst2, files)
+	//a file to a new name and into a dir
+	if _, err := Sync(filepath.Join(src, "a.txt"), filepath.Join(dst, "copy.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Sync(filepath.Join(src, "a.txt"), filepath.Join(dst, "b")); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, dst, map[string]string{"copy.txt": "aaaa", "b/a.txt": "aaaa"})
+	//a tcp server
+	root := t.TempDir()
+	srv := NewTCPServer(root)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+	st, err := SyncContext(context.Background(), src, "tcp://"+l.Addr().String()+"/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Files != 2 {
+		t.Error("tcp sync stats error", st.String())
+	}
+	testCheckFiles(t, filepath.Join(root, "sub"), files)
+	if _, err := Sync(src, "foo://host/x"); err == nil {
+		t.Error("unknown scheme accepted")
+	}
+	if _, err := Sync("http://host/x", dst); err == nil {
+		t.Error("remote source accepted")
+	}
+	if _, err := os.Stat(filepath.Join(dst, "x")); err == nil {
+		t.Error("failed sync wrote files")
+	}
+}
@@ -0,0 +1,790 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileEntry is one file list entry, Path is slash separated and relative to the listed dir
+type FileEntry struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Mode    os.FileMode
+	Link    string //symlink target
+	//path of the first listed file sharing the inode, set on source lists walked for hard links
+	HardLink string
+}
+
+func (this FileEntry) IsDir() bool {
+	return this.Mode.IsDir()
+}
+
+func (this FileEntry) IsRegular() bool {
+	return this.Mode.IsRegular()
+}
+
+func (this FileEntry) IsSymlink() bool {
+	return this.Mode&os.ModeSymlink != 0
+}
+
+// Lister is implemented by transports that can send the file list of a destination dir
+type Lister interface {
+	// List returns the entries under dir, a missing dir has an empty list
+	List(ctx context.Context, dir string) ([]FileEntry, error)
+}
+
+// symlink handling of a dir walk
+const (
+	SymlinkKeep   = 0 //list the link itself, synced as a link to the same target
+	SymlinkFollow = 1 //list what the link points to, dirs are walked unless they loop
+	SymlinkSkip   = 2 //leave links out
+)
+
+// ListDir walks root and returns its dirs, regular files and symlinks sorted by path, root itself is not listed
+func ListDir(ctx context.Context, root string) ([]FileEntry, error) {
+	return listDir(ctx, root, nil, SymlinkKeep, false)
+}
+
+// inodeKey identifies a file for hard link detection
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+// dirWalker collects the entries of a walk
+type dirWalker struct {
+	ctx    context.Context
+	filter *Filter
+	links  int
+	list   []FileEntry
+	inodes map[string]inodeKey //regular files with more than one link
+}
+
+// listDir is ListDir skipping the paths f doesn't keep, excluded dirs are not walked,
+// with hard set files sharing an inode point to the first of them
+func listDir(ctx context.Context, root string, f *Filter, links int, hard bool) ([]FileEntry, error) {
+	fi, err := os.Stat(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []FileEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("list %s: not a dir", root)
+	}
+	w := &dirWalker{ctx: ctx, filter: f, links: links, list: []FileEntry{}}
+	if hard {
+		w.inodes = map[string]inodeKey{}
+	}
+	if err := w.walk(root, "", []os.FileInfo{fi}); err != nil {
+		return nil, err
+	}
+	sort.Slice(w.list, func(i, j int) bool {
+		return w.list[i].Path < w.list[j].Path
+	})
+	if len(w.inodes) > 0 {
+		first := map[inodeKey]string{}
+		for i, v := range w.list {
+			key, ok := w.inodes[v.Path]
+			if !ok {
+				continue
+			}
+			if p, ok := first[key]; ok {
+				w.list[i].HardLink = p
+			} else {
+				first[key] = v.Path
+			}
+		}
+	}
+	return w.list, nil
+}
+
+// listFS is listDir for the dir root of fsys, fs.FS has no links so only dirs and regular files are listed
+func listFS(ctx context.Context, fsys fs.FS, root string, f *Filter) ([]FileEntry, error) {
+	fi, err := fs.Stat(fsys, root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []FileEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("list %s: not a dir", root)
+	}
+	list := []FileEntry{}
+	err = fs.WalkDir(fsys, root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if file == root {
+			return nil
+		}
+		name := file
+		if root != "." {
+			name = strings.TrimPrefix(file, root+"/")
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		if !f.Match(name, d.IsDir()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		list = append(list, FileEntry{Path: name, Size: fi.Size(), ModTime: fi.ModTime(), Mode: fi.Mode()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Path < list[j].Path
+	})
+	return list, nil
+}
+
+// walk lists dir at rel, parents holds the dirs above it to stop followed links looping
+func (this *dirWalker) walk(dir string, rel string, parents []os.FileInfo) error {
+	ds, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, d := range ds {
+		if err := this.ctx.Err(); err != nil {
+			return err
+		}
+		file := filepath.Join(dir, d.Name())
+		name := path.Join(rel, d.Name())
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			switch this.links {
+			case SymlinkSkip:
+				continue
+			case SymlinkFollow:
+				if fi, err = os.Stat(file); err != nil {
+					//dangling link
+					continue
+				}
+			default:
+				if link, err = os.Readlink(file); err != nil {
+					return err
+				}
+			}
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() && link == "" {
+			continue
+		}
+		if !this.filter.Match(name, fi.IsDir()) {
+			continue
+		}
+		if fi.IsDir() && walkLoop(parents, fi) {
+			continue
+		}
+		if this.inodes != nil && fi.Mode().IsRegular() {
+			if dev, ino, ok := fileInode(fi); ok && fileNlink(fi) > 1 {
+				this.inodes[name] = inodeKey{dev: dev, ino: ino}
+			}
+		}
+		this.list = append(this.list, FileEntry{
+			Path:    name,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			Mode:    fi.Mode(),
+			Link:    link,
+		})
+		if fi.IsDir() {
+			if err := this.walk(file, name, append(parents, fi)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func walkLoop(parents []os.FileInfo, fi os.FileInfo) bool {
+	for _, p := range parents {
+		if os.SameFile(p, fi) {
+			return true
+		}
+	}
+	return false
+}
+
+// dirPath maps dir into Root like FilePath, the empty dir is Root
+func (this *LocalStore) dirPath(dir string) (string, error) {
+	if dir == "" || dir == "/" {
+		return this.Root, nil
+	}
+	return this.FilePath(dir)
+}
+
+func (this *LocalStore) List(ctx context.Context, dir string) ([]FileEntry, error) {
+	file, err := this.dirPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	return ListDir(ctx, file)
+}
+
+// WriteFileList encodes the list as count(4) then
+// path len(2), path, size(8), mtime ns(8), mode(4), link len(2), link per entry
+func WriteFileList(w io.Writer, list []FileEntry) error {
+	if _, err := w.Write(tobyte32(uint32(len(list)))); err != nil {
+		return err
+	}
+	for _, v := range list {
+		if len(v.Path) > 0xFFFF || len(v.Link) > 0xFFFF {
+			return fmt.Errorf("file path %q too long", v.Path)
+		}
+		buf := &bytes.Buffer{}
+		buf.Write(tobyte16(uint16(len(v.Path))))
+		buf.WriteString(v.Path)
+		buf.Write(tobyte64(uint64(v.Size)))
+		buf.Write(tobyte64(uint64(v.ModTime.UnixNano())))
+		buf.Write(tobyte32(uint32(v.Mode)))
+		buf.Write(tobyte16(uint16(len(v.Link))))
+		buf.WriteString(v.Link)
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ReadFileList(r io.Reader) ([]FileEntry, error) {
+	b4 := make([]byte, 4)
+	if _, err := io.ReadFull(r, b4); err != nil {
+		return nil, err
+	}
+	num, err := touint32(b4)
+	if err != nil {
+		return nil, err
+	}
+	list := []FileEntry{}
+	b20 := make([]byte, 20)
+	for i := uint32(0); i < num; i++ {
+		name, err := readString16(r)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, b20); err != nil {
+			return nil, err
+		}
+		link, err := readString16(r)
+		if err != nil {
+			return nil, err
+		}
+		size, err := toint64(b20[:8])
+		if err != nil {
+			return nil, err
+		}
+		mtime, err := touint64(b20[8:16])
+		if err != nil {
+			return nil, err
+		}
+		mode, err := touint32(b20[16:])
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, FileEntry{
+			Path:    name,
+			Size:    size,
+			ModTime: time.Unix(0, int64(mtime)),
+			Mode:    os.FileMode(mode),
+			Link:    link,
+		})
+	}
+	return list, nil
+}
+
+// readString16 reads len(2) then the string
+func readString16(r io.Reader) (string, error) {
+	b2 := make([]byte, 2)
+	if _, err := io.ReadFull(r, b2); err != nil {
+		return "", err
+	}
+	n, err := touint16(b2)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Remover is implemented by transports that can delete destination files
+type Remover interface {
+	// Remove deletes a file or an empty dir
+	Remove(ctx context.Context, path string) error
+}
+
+func (this *LocalStore) Remove(ctx context.Context, name string) error {
+	file, err := this.FilePath(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
+
+// Symlinker is implemented by transports that can create symlinks
+type Symlinker interface {
+	// Symlink replaces path with a link to target
+	Symlink(ctx context.Context, target string, path string) error
+}
+
+// Symlink creates the link, targets must be relative and stay under Root so the store can't be escaped through them.
+// The links are checked where they are, not where other links lead: the dirs of name must not be links and the target
+// may only go up with leading .. components, so later links can't make it resolve out of Root
+func (this *LocalStore) Symlink(ctx context.Context, target string, name string) error {
+	file, err := this.FilePath(name)
+	if err != nil {
+		return err
+	}
+	if filepath.IsAbs(filepath.FromSlash(target)) || strings.HasPrefix(target, "/") {
+		return fmt.Errorf("symlink %s target %q is absolute", name, target)
+	}
+	//a .. after a name goes up from wherever a link of that name leads
+	up := 0
+	for i, c := range strings.Split(filepath.ToSlash(target), "/") {
+		if c != ".." {
+			continue
+		}
+		if i != up {
+			return fmt.Errorf("symlink %s target %q has .. after a name", name, target)
+		}
+		up++
+	}
+	depth := strings.Count(path.Clean("/"+name), "/") - 1
+	if up > depth {
+		return fmt.Errorf("symlink %s target %q leaves root", name, target)
+	}
+	for dir := filepath.Dir(file); dir != filepath.Clean(this.Root); dir = filepath.Dir(dir) {
+		if fi, err := os.Lstat(dir); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("symlink %s: parent %s is a link", name, dir)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(file); err == nil {
+		if fi.IsDir() {
+			return fmt.Errorf("symlink %s: is a dir", name)
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(target, file)
+}
+
+// HardLinker is implemented by transports that can create hard links
+type HardLinker interface {
+	// Link replaces path with a hard link to the existing file target
+	Link(ctx context.Context, target string, path string) error
+}
+
+func (this *LocalStore) Link(ctx context.Context, target string, name string) error {
+	old, err := this.FilePath(target)
+	if err != nil {
+		return err
+	}
+	file, err := this.FilePath(name)
+	if err != nil {
+		return err
+	}
+	ofi, err := os.Lstat(old)
+	if err != nil {
+		return err
+	}
+	if !ofi.Mode().IsRegular() {
+		return fmt.Errorf("link %s: target %s not a regular file", name, target)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(file); err == nil {
+		if os.SameFile(fi, ofi) {
+			return nil
+		}
+		if fi.IsDir() {
+			return fmt.Errorf("link %s: is a dir", name)
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return os.Link(old, file)
+}
+
+// ErrMaxDelete is returned when a sync would delete more than DirSyncer.MaxDelete entries
+var ErrMaxDelete = errors.New("max delete exceeded")
+
+// DirSyncer rebuilds the regular files under Src in Dir on the Dst transport end
+type DirSyncer struct {
+	Src    string
+	FS     fs.FS //read the Src dir from it instead of the OS filesystem, symlinks are left out
+	Dst    Transport
+	Dir    string  //destination dir, empty is the transport root
+	Filter *Filter //applied to both sides, excluded destination files are left alone
+	//remove destination entries missing in Src after the transfer, Dst must be a Lister and a Remover
+	Delete bool
+	//> 0 caps the entries Delete may remove, nothing is removed when there are more
+	MaxDelete int
+	//SymlinkKeep recreates links when Dst is a Symlinker, SymlinkFollow syncs their targets, SymlinkSkip leaves them out
+	Symlinks int
+	//send files sharing an inode once and hard link the others, Dst must be a HardLinker
+	HardLinks bool
+	//ask the destination for the signatures of missing files too, a LocalStore with Fuzzy set
+	//answers with a similarly named basis
+	Fuzzy bool
+	//send only the appended tail of files grown since the last sync, see DeltaAppend
+	Append bool
+	//of the destination dir, files of the same size and md5 are not synced and the kept
+	//signatures are used instead of asking Dst
+	Manifest *Manifest
+	//skip files whose whole strong hash equals that of the destination signature, for trees
+	//where mtimes don't tell changed files apart
+	Checksum bool
+	//skip files the destination lists with the size and mtime of the source without any block work,
+	//only Lister destinations list them
+	QuickCheck bool
+	//> 0 is the largest mtime difference QuickCheck still takes as equal, 0 compares whole seconds
+	ModifyWindow time.Duration
+	Stats        Stats  //of the last Sync
+	Hooks        *Hooks //observe the pushed frames, paths are the destination paths
+	//called with the change record of every synced and deleted entry, paths are relative to Src
+	OnItem func(item ItemChange)
+}
+
+func NewDirSyncer(src string, dst Transport, dir string) *DirSyncer {
+	return &DirSyncer{Src: src, Dst: dst, Dir: dir}
+}
+
+func (this *DirSyncer) dstPath(rel string) string {
+	if this.Dir == "" {
+		return rel
+	}
+	return path.Join(this.Dir, rel)
+}
+
+// Sync walks Src, fetches the destination list when Dst is a Lister and pushes every regular file,
+// files missing on the destination are sent whole without asking for their signature
+func (this *DirSyncer) Sync(ctx context.Context) error {
+	now := time.Now()
+	this.Stats = Stats{}
+	defer func() {
+		this.Stats.Duration = time.Since(now)
+	}()
+	src, dst, all, err := this.lists(ctx)
+	if err != nil {
+		return err
+	}
+	for _, v := range src {
+		if v.IsSymlink() {
+			if err := this.syncLink(ctx, v, dst); err != nil {
+				return fmt.Errorf("sync %s: %w", v.Path, err)
+			}
+			continue
+		}
+		if !v.IsRegular() {
+			continue
+		}
+		if v.HardLink != "" {
+			h, ok := this.Dst.(HardLinker)
+			if !ok {
+				return errors.New("transport can't create hard links")
+			}
+			if err := h.Link(ctx, this.dstPath(v.HardLink), this.dstPath(v.Path)); err != nil {
+				return fmt.Errorf("sync %s: %w", v.Path, err)
+			}
+			this.item(ItemChange{Path: v.Path, Kind: ItemNew, Mode: v.Mode, Link: v.HardLink, Hard: true})
+			continue
+		}
+		if err := this.syncFile(ctx, v, dst); err != nil {
+			return fmt.Errorf("sync %s: %w", v.Path, err)
+		}
+	}
+	if this.Delete {
+		return this.deleteExtraneous(ctx, src, dst, all)
+	}
+	return nil
+}
+
+// lists returns the source list, the kept destination entries by path and the whole destination list,
+// the destination is nil when Dst is not a Lister
+func (this *DirSyncer) lists(ctx context.Context) ([]FileEntry, map[string]FileEntry, []FileEntry, error) {
+	var src []FileEntry
+	var err error
+	if this.FS != nil {
+		src, err = listFS(ctx, this.FS, this.Src, this.Filter)
+	} else {
+		src, err = listDir(ctx, this.Src, this.Filter, this.Symlinks, this.HardLinks)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	l, ok := this.Dst.(Lister)
+	if !ok {
+		if this.Delete {
+			return nil, nil, nil, errors.New("delete needs a transport listing files")
+		}
+		return src, nil, nil, nil
+	}
+	all, err := l.List(ctx, this.Dir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	dst := map[string]FileEntry{}
+	for _, v := range this.Filter.Apply(all) {
+		dst[v.Path] = v
+	}
+	return src, dst, all, nil
+}
+
+// quickSame reports whether QuickCheck finds v listed with its size and mtime, Checksum replaces
+// it and sources without mtime never match
+func (this *DirSyncer) quickSame(v FileEntry, dst map[string]FileEntry) bool {
+	if !this.QuickCheck || this.Checksum || v.ModTime.IsZero() {
+		return false
+	}
+	d, ok := dst[v.Path]
+	if !ok || !d.IsRegular() || d.Size != v.Size {
+		return false
+	}
+	if this.ModifyWindow <= 0 {
+		return d.ModTime.Unix() == v.ModTime.Unix()
+	}
+	diff := d.ModTime.Sub(v.ModTime)
+	return diff <= this.ModifyWindow && diff >= -this.ModifyWindow
+}
+
+// missingSignature is the empty signature for files the destination doesn't have, nil when it has them,
+// the destination is unknown or Fuzzy asks it for a basis
+func (this *DirSyncer) missingSignature(v FileEntry, dst map[string]FileEntry) (*HashInfo, error) {
+	if dst == nil || this.Fuzzy {
+		return nil, nil
+	}
+	if d, ok := dst[v.Path]; ok && !d.IsDir() {
+		return nil, nil
+	}
+	//the same the destination would send
+	return Signature(bytes.NewReader(nil))
+}
+
+// deleteExtraneous removes the extraneous entries
+func (this *DirSyncer) deleteExtraneous(ctx context.Context, src []FileEntry, dst map[string]FileEntry, all []FileEntry) error {
+	r, ok := this.Dst.(Remover)
+	if !ok {
+		return errors.New("delete needs a transport removing files")
+	}
+	del, err := this.extraneous(src, dst, all)
+	if err != nil {
+		return err
+	}
+	for _, p := range del {
+		if err := r.Remove(ctx, this.dstPath(p)); err != nil {
+			return fmt.Errorf("delete %s: %w", p, err)
+		}
+		this.item(ItemChange{Path: p, Kind: ItemDeleted, Mode: dst[p].Mode})
+	}
+	return nil
+}
+
+// extraneous returns the dst entries missing in src, children before their dir,
+// dirs holding filtered out entries are kept
+func (this *DirSyncer) extraneous(src []FileEntry, dst map[string]FileEntry, all []FileEntry) ([]string, error) {
+	keep := map[string]bool{}
+	for _, v := range src {
+		keep[v.Path] = true
+	}
+	for _, v := range all {
+		if _, ok := dst[v.Path]; ok {
+			continue
+		}
+		for p := path.Dir(v.Path); p != "."; p = path.Dir(p) {
+			keep[p] = true
+		}
+	}
+	del := []string{}
+	for p := range dst {
+		if !keep[p] {
+			del = append(del, p)
+		}
+	}
+	if this.MaxDelete > 0 && len(del) > this.MaxDelete {
+		return nil, fmt.Errorf("%w: %d > %d", ErrMaxDelete, len(del), this.MaxDelete)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(del)))
+	return del, nil
+}
+
+// syncLink creates the link unless the destination has the same one
+func (this *DirSyncer) syncLink(ctx context.Context, v FileEntry, dst map[string]FileEntry) error {
+	it := newItemChange(v, dst)
+	if d, ok := dst[v.Path]; ok && d.IsSymlink() && d.Link == v.Link {
+		it.Kind = ItemSkipped
+		this.item(it)
+		return nil
+	}
+	s, ok := this.Dst.(Symlinker)
+	if !ok {
+		return errors.New("transport can't create symlinks")
+	}
+	if err := s.Symlink(ctx, v.Link, this.dstPath(v.Path)); err != nil {
+		return err
+	}
+	if it.Kind == ItemSkipped {
+		it.Kind = ItemChanged
+	}
+	this.item(it)
+	return nil
+}
+
+// openSrc opens the source file rel from FS or the OS filesystem
+func (this *DirSyncer) openSrc(rel string) (fs.File, error) {
+	if this.FS != nil {
+		return this.FS.Open(path.Join(this.Src, rel))
+	}
+	return os.Open(filepath.Join(this.Src, filepath.FromSlash(rel)))
+}
+
+// srcMeta sets the metadata of FS files, os files get theirs from the delta
+func (this *DirSyncer) srcMeta(fd fs.File) func(fh *FileHashInfo) {
+	return func(fh *FileHashInfo) {
+		if _, ok := fd.(*os.File); ok {
+			return
+		}
+		//embedded files have no time
+		if fi, err := fd.Stat(); err == nil && !fi.ModTime().IsZero() {
+			fh.Meta = NewFileMeta(fi)
+		}
+	}
+}
+
+// syncFile pushes v unless a quick check, the Manifest or Checksum find it unchanged,
+// dst is the destination list, nil when unknown
+func (this *DirSyncer) syncFile(ctx context.Context, v FileEntry, dst map[string]FileEntry) error {
+	it := newItemChange(v, dst)
+	if this.quickSame(v, dst) {
+		this.Stats.Unchanged++
+		this.item(it.skipped())
+		return nil
+	}
+	sig, err := this.missingSignature(v, dst)
+	if err != nil {
+		return err
+	}
+	if this.Manifest != nil {
+		if e, ok := this.Manifest.Lookup(v.Path); ok {
+			same, err := this.manifestSame(e, v)
+			if err != nil {
+				return err
+			}
+			if same {
+				this.item(it.skipped())
+				return nil
+			}
+			if sig == nil {
+				sig = e.Sig
+			}
+		}
+	}
+	fd, err := this.openSrc(v.Path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if sig == nil {
+		if sig, err = this.Dst.Signature(ctx, this.dstPath(v.Path)); err != nil {
+			return err
+		}
+		this.Stats.SignatureSize += signatureSize(sig)
+	}
+	if this.Checksum {
+		same, err := checksumSame(fd, sig, v.Size)
+		if err != nil {
+			return err
+		}
+		if same {
+			this.Stats.Unchanged++
+			this.item(it.skipped())
+			return nil
+		}
+	}
+	setup := []func(fh *FileHashInfo){this.srcMeta(fd)}
+	if this.Append {
+		setup = append(setup, appendOnly)
+	}
+	hooks := this.Hooks
+	var hash []byte
+	if this.OnItem != nil {
+		hooks = hooks.onComplete(func(path string, size int64, h []byte) {
+			hash = h
+		})
+	}
+	literal := this.Stats.Literal
+	if err := pushSignature(ctx, this.Dst, sig, fd, this.dstPath(v.Path), &this.Stats, hooks, setup...); err != nil {
+		return err
+	}
+	it.Literal = this.Stats.Literal - literal
+	switch {
+	case it.Kind == ItemNew || dst == nil && sig.IsEmpty():
+		it.Kind = ItemNew
+	case !bytes.Equal(hash, sig.MD5):
+		it.Kind = ItemChanged
+	case it.Time || it.Perms:
+		it.Kind = ItemMetadata
+	}
+	this.item(it)
+	return nil
+}
+
+// checksumSame reports whether fd of size has the seeded strong hash of sig, fd is
+// rewound for the push when it differs
+func checksumSame(fd fs.File, sig *HashInfo, size int64) (bool, error) {
+	//deduplicated trailing blocks leave the covered size short of the basis size
+	if sig.IsEmpty() || sig.Size() > size {
+		return false, nil
+	}
+	sh, err := GetStrongHasher(sig.Strong)
+	if err != nil {
+		return false, err
+	}
+	h := SeededHasher(sh, sig.Seed).New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return false, err
+	}
+	if bytes.Equal(h.Sum(nil), sig.MD5) {
+		return true, nil
+	}
+	rs, ok := fd.(io.Seeker)
+	if !ok {
+		return false, fmt.Errorf("%w: checksum source not seekable", errors.ErrUnsupported)
+	}
+	_, err = rs.Seek(0, io.SeekStart)
+	return false, err
+}
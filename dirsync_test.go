@@ -0,0 +1,346 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func testWriteFiles(t *testing.T, root string, files map[string]string) {
+	for name, dat := range files {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(dat), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testCheckFiles(t *testing.T, root string, files map[string]string) {
+	for name, dat := range files {
+		got, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(got, []byte(dat)) {
+			t.Errorf("file %s error", name)
+		}
+	}
+}
+
+func TestDirSyncer(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		"a.txt":       "hello world",
+		"b/c.txt":     string(bytes.Repeat([]byte("0123456789"), 1000)),
+		"b/d/e.txt":   "",
+		"b/d/f/g.bin": string(bytes.Repeat([]byte{1, 2, 3}, 5000)),
+	}
+	testWriteFiles(t, src, files)
+	testWriteFiles(t, dst, map[string]string{"b/c.txt": "0123456789"})
+	ctx := context.Background()
+	if err := NewDirSyncer(src, NewLocalStore(dst), "").Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, dst, files)
+	list, err := NewLocalStore(dst).List(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, v := range list {
+		names = append(names, v.Path)
+	}
+	if want := []string{"c.txt", "d", "d/e.txt", "d/f", "d/f/g.bin"}; fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Fatal("list error", names)
+	}
+	if list, err := NewLocalStore(dst).List(ctx, "none"); err != nil || len(list) != 0 {
+		t.Error("missing dir list error", list, err)
+	}
+}
+
+func TestDirSyncerTCP(t *testing.T) {
+	src, root := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		"x/1.txt": "one",
+		"x/2.txt": "two",
+		"3.txt":   string(bytes.Repeat([]byte("three"), 3000)),
+	}
+	testWriteFiles(t, src, files)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewTCPServer(root)
+	go srv.Serve(l)
+	defer srv.Close()
+	ctx := context.Background()
+	c, err := DialTCP(ctx, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := NewDirSyncer(src, c, "deploy").Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, filepath.Join(root, "deploy"), files)
+	list, err := c.List(ctx, "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 4 || list[0].Path != "3.txt" || list[0].Size != 15000 {
+		t.Error("tcp list error", list)
+	}
+	if _, err := c.List(ctx, "../x"); err == nil {
+		t.Error("list outside root")
+	}
+	if err := c.Symlink(ctx, "3.txt", "deploy/l.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(root, "deploy/l.txt")); err != nil || len(got) != 15000 {
+		t.Error("tcp symlink error", err)
+	}
+	if err := c.Link(ctx, "deploy/3.txt", "deploy/h.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(root, "deploy/h.txt")); err != nil || len(got) != 15000 {
+		t.Error("tcp link error", err)
+	}
+	if err := c.Remove(ctx, "deploy/x/1.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Remove(ctx, "deploy/x"); err == nil {
+		t.Error("non empty dir removed")
+	}
+	if _, err := os.Stat(filepath.Join(root, "deploy/x/1.txt")); !os.IsNotExist(err) {
+		t.Error("tcp remove error")
+	}
+}
+
+func TestDirSyncerDelete(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	testWriteFiles(t, src, map[string]string{"a.txt": "a", "b/c.txt": "c"})
+	testWriteFiles(t, dst, map[string]string{
+		"old.txt":      "old",
+		"b/old.txt":    "old",
+		"gone/x/y.txt": "y",
+		"keep/k.log":   "log",
+		"keep/z.txt":   "z",
+	})
+	f := NewFilter()
+	f.Exclude("*.log")
+	s := NewDirSyncer(src, NewLocalStore(dst), "")
+	s.Filter = f
+	s.Delete = true
+	s.MaxDelete = 5
+	ctx := context.Background()
+	if err := s.Sync(ctx); !errors.Is(err, ErrMaxDelete) {
+		t.Fatal("max delete error expected", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "old.txt")); err != nil {
+		t.Fatal("deleted over the cap")
+	}
+	s.MaxDelete = 6
+	if err := s.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	list, err := ListDir(ctx, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, v := range list {
+		names = append(names, v.Path)
+	}
+	if want := []string{"a.txt", "b", "b/c.txt", "keep", "keep/k.log"}; fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Error("delete error", names)
+	}
+}
+
+func TestDirSyncerSymlinks(t *testing.T) {
+	src := t.TempDir()
+	testWriteFiles(t, src, map[string]string{"data/a.txt": "a"})
+	for link, target := range map[string]string{"link.txt": "data/a.txt", "dir": "data", "data/loop": ".."} {
+		if err := os.Symlink(target, filepath.Join(src, link)); err != nil {
+			t.Skip(err)
+		}
+	}
+	ctx := context.Background()
+	for mode, want := range map[int]string{
+		SymlinkKeep:   "[data data/a.txt data/loop dir link.txt]",
+		SymlinkFollow: "[data data/a.txt dir dir/a.txt link.txt]",
+		SymlinkSkip:   "[data data/a.txt]",
+	} {
+		dst := t.TempDir()
+		s := NewDirSyncer(src, NewLocalStore(dst), "")
+		s.Symlinks = mode
+		if err := s.Sync(ctx); err != nil {
+			t.Fatal(mode, err)
+		}
+		list, err := ListDir(ctx, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, v := range list {
+			names = append(names, v.Path)
+		}
+		if fmt.Sprint(names) != want {
+			t.Error("symlink mode", mode, names)
+		}
+		if mode == SymlinkKeep {
+			if target, err := os.Readlink(filepath.Join(dst, "link.txt")); err != nil || target != "data/a.txt" {
+				t.Error("link error", target, err)
+			}
+		}
+	}
+	store := NewLocalStore(t.TempDir())
+	for _, target := range []string{"/etc/passwd", "../x", "a/../../x"} {
+		if err := store.Symlink(ctx, target, "l"); err == nil {
+			t.Errorf("unsafe target %q accepted", target)
+		}
+	}
+	//a link up to the root is fine, going on through it or past it is not
+	if err := store.Symlink(ctx, "..", "d/up"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Symlink(ctx, "../secret", "d/up/esc"); err == nil {
+		t.Error("link through a link accepted")
+	}
+	if err := store.Symlink(ctx, "up/../../secret", "d/esc"); err == nil {
+		t.Error("link going up from a link accepted")
+	}
+	if _, err := os.Lstat(filepath.Join(store.Root, "esc")); !os.IsNotExist(err) {
+		t.Error("escaping link created", err)
+	}
+}
+
+func TestDirSyncerHardLinks(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	testWriteFiles(t, src, map[string]string{"a.txt": "shared", "c.txt": "alone"})
+	if err := os.Link(filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")); err != nil {
+		t.Skip(err)
+	}
+	ctx := context.Background()
+	list, err := listDir(ctx, src, nil, SymlinkKeep, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list[0].HardLink != "" || list[1].HardLink != "a.txt" || list[2].HardLink != "" {
+		t.Fatal("hard link list error", list)
+	}
+	s := NewDirSyncer(src, NewLocalStore(dst), "")
+	s.HardLinks = true
+	if err := s.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, dst, map[string]string{"a.txt": "shared", "b.txt": "shared", "c.txt": "alone"})
+	fa, _ := os.Stat(filepath.Join(dst, "a.txt"))
+	fb, _ := os.Stat(filepath.Join(dst, "b.txt"))
+	if !os.SameFile(fa, fb) {
+		t.Error("hard link not preserved")
+	}
+}
+
+func TestDirSyncerFS(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"site/index.html":    {Data: []byte("<html></html>"), Mode: 0644, ModTime: mtime},
+		"site/css/a.css":     {Data: bytes.Repeat([]byte("body{}"), 2000), Mode: 0600, ModTime: mtime},
+		"site/skip.tmp":      {Data: []byte("excluded")},
+		"other/not-sent.txt": {Data: []byte("outside Src")},
+	}
+	dst := t.TempDir()
+	testWriteFiles(t, dst, map[string]string{"css/a.css": "body{}"})
+	s := NewDirSyncer("site", NewLocalStore(dst), "")
+	s.FS = fsys
+	s.Filter = NewFilter()
+	s.Filter.Exclude("*.tmp")
+	if err := s.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, dst, map[string]string{
+		"index.html": "<html></html>",
+		"css/a.css":  string(fsys["site/css/a.css"].Data),
+	})
+	if _, err := os.Stat(filepath.Join(dst, "skip.tmp")); !os.IsNotExist(err) {
+		t.Error("excluded file synced")
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "css", "a.css")); err != nil || !fi.ModTime().Equal(mtime) {
+		t.Error("file meta not synced", err)
+	}
+	if s.Stats.Files != 2 || s.Stats.Matched == 0 {
+		t.Error("stats error", s.Stats.Files, s.Stats.Matched)
+	}
+}
+
+func TestDirSyncerChecksum(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	big := bytes.Repeat([]byte("0123456789"), 1000)
+	files := map[string]string{"same.txt": string(big), "diff.txt": "hello world", "new.txt": "new"}
+	testWriteFiles(t, src, files)
+	//same sizes on both ends, only the content tells diff.txt apart
+	testWriteFiles(t, dst, map[string]string{"same.txt": string(big), "diff.txt": "hello WORLD"})
+	ctx := context.Background()
+	s := NewDirSyncer(src, NewLocalStore(dst), "")
+	s.Checksum = true
+	if err := s.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, dst, files)
+	if s.Stats.Unchanged != 1 || s.Stats.Files != 2 {
+		t.Error("checksum stats error", s.Stats.Unchanged, s.Stats.Files)
+	}
+	//fs sources are rewound after hashing
+	fsys := fstest.MapFS{"d/same.txt": {Data: big}, "d/diff.txt": {Data: []byte("hello there")}}
+	s = &DirSyncer{Src: "d", FS: fsys, Dst: NewLocalStore(dst), Checksum: true}
+	if err := s.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, dst, map[string]string{"same.txt": string(big), "diff.txt": "hello there"})
+	if s.Stats.Unchanged != 1 || s.Stats.Files != 1 {
+		t.Error("fs checksum stats error", s.Stats.Unchanged, s.Stats.Files)
+	}
+}
+
+func TestDirSyncerQuickCheck(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	files := map[string]string{"a.txt": "hello world", "b.txt": "hello there", "c.txt": "new"}
+	testWriteFiles(t, src, files)
+	testWriteFiles(t, dst, map[string]string{"a.txt": "hello WORLD", "b.txt": "hello THERE"})
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		os.Chtimes(filepath.Join(src, name), mtime, mtime)
+	}
+	//a.txt looks unchanged, b.txt is half a second off
+	os.Chtimes(filepath.Join(dst, "a.txt"), mtime, mtime)
+	os.Chtimes(filepath.Join(dst, "b.txt"), mtime, mtime.Add(time.Second/2))
+	ctx := context.Background()
+	s := NewDirSyncer(src, NewLocalStore(dst), "")
+	s.QuickCheck = true
+	s.ModifyWindow = time.Second / 4
+	if err := s.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, dst, map[string]string{"a.txt": "hello WORLD", "b.txt": "hello there", "c.txt": "new"})
+	if s.Stats.Unchanged != 1 || s.Stats.Files != 2 {
+		t.Error("quick check stats error", s.Stats.Unchanged, s.Stats.Files)
+	}
+	//checksum replaces the quick check
+	s.Checksum = true
+	if err := s.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, dst, files)
+	if s.Stats.Unchanged != 2 || s.Stats.Files != 1 {
+		t.Error("checksum stats error", s.Stats.Unchanged, s.Stats.Files)
+	}
+}
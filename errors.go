@@ -0,0 +1,135 @@
+package rsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// failure causes, match them with errors.Is
+var (
+	//the rebuilt file hash differs from the hash of the close frame
+	ErrHashMismatch = errors.New("hash mismatch")
+	//a delta needs the signature of the basis
+	ErrNoSignature = errors.New("no signature")
+	//a basis block is shorter than its signature or index frame says
+	ErrShortBlock = errors.New("short block")
+	//a call or frame out of order, like frames before the open frame or after the close frame
+	ErrStateOrder = errors.New("state order")
+	//a delta or merge uses other hash algorithms than the signature was made with
+	ErrAlgorithmMismatch = errors.New("hash algorithm mismatch")
+	//a server limit of concurrent connections or requests, retry later
+	ErrBusy = errors.New("server busy")
+	//the file is larger than the server accepts
+	ErrTooLarge = errors.New("file too large")
+)
+
+// FrameError is a failed delta frame with its file and position
+type FrameError struct {
+	Path  string //merged file, empty for Patch
+	Type  int    //frame type bits
+	Off   int64  //output offset of the frame
+	Index uint32 //signature index of index frames
+	Err   error
+}
+
+func (this *FrameError) Error() string {
+	s := fmt.Sprintf("frame at %d", this.Off)
+	if this.Type&AnalyseTypeIndex != 0 {
+		s += fmt.Sprintf(" index %d", this.Index)
+	}
+	if this.Path != "" {
+		s = this.Path + " " + s
+	}
+	return s + ": " + this.Err.Error()
+}
+
+func (this *FrameError) Unwrap() error {
+	return this.Err
+}
+
+func newFrameError(path string, off int64, hi *AnalyseInfo, err error) error {
+	return &FrameError{Path: path, Type: hi.Type, Off: off, Index: hi.Index, Err: err}
+}
+
+// ErrorCode is the cause of a failure sent in band to the peer
+type ErrorCode uint16
+
+// error codes, unknown causes are CodeUnknown
+const (
+	CodeUnknown ErrorCode = iota
+	CodeNotExist
+	CodePermission
+	CodeExist
+	CodeNoSpace
+	CodeHashMismatch
+	CodeMalformed
+	CodeShortBlock
+	CodeNoSignature
+	CodeStateOrder
+	CodeAlgorithm
+	CodeTimeout
+	CodeCanceled
+	CodeBusy
+	CodeTooLarge
+)
+
+// codeErrors maps the codes to the errors they match, the first match wins
+var codeErrors = []struct {
+	code ErrorCode
+	err  error
+}{
+	{CodeHashMismatch, ErrHashMismatch},
+	{CodeShortBlock, ErrShortBlock},
+	{CodeNoSignature, ErrNoSignature},
+	{CodeStateOrder, ErrStateOrder},
+	{CodeAlgorithm, ErrAlgorithmMismatch},
+	{CodeMalformed, ErrMalformed},
+	{CodeBusy, ErrBusy},
+	{CodeTooLarge, ErrTooLarge},
+	{CodeNoSpace, syscall.ENOSPC},
+	{CodeNotExist, fs.ErrNotExist},
+	{CodePermission, fs.ErrPermission},
+	{CodeExist, fs.ErrExist},
+	{CodeTimeout, os.ErrDeadlineExceeded},
+	{CodeTimeout, context.DeadlineExceeded},
+	{CodeCanceled, context.Canceled},
+}
+
+// ErrorCodeOf is the code of err for the peer
+func ErrorCodeOf(err error) ErrorCode {
+	for _, v := range codeErrors {
+		if errors.Is(err, v.err) {
+			return v.code
+		}
+	}
+	return CodeUnknown
+}
+
+// err is the error matched by code, nil for CodeUnknown
+func (this ErrorCode) err() error {
+	for _, v := range codeErrors {
+		if v.code == this {
+			return v.err
+		}
+	}
+	return nil
+}
+
+// RemoteError is a failure the peer reported, errors.Is matches the error of its code
+// so IsRetryable tells whether a retry may help
+type RemoteError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (this *RemoteError) Error() string {
+	return "remote error: " + this.Message
+}
+
+func (this *RemoteError) Unwrap() error {
+	return this.Code.err()
+}
@@ -0,0 +1,119 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	if err := Delta(nil, bytes.NewReader(nil), &bytes.Buffer{}); !errors.Is(err, ErrNoSignature) {
+		t.Error("no signature", err)
+	}
+	basis := bytes.Repeat([]byte("0123456789abcdef"), 200)
+	sig, err := Signature(bytes.NewReader(basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := &bytes.Buffer{}
+	if err := Delta(sig, bytes.NewReader(append([]byte("x"), basis...)), delta); err != nil {
+		t.Fatal(err)
+	}
+	var fe *FrameError
+	err = Patch(bytes.NewReader(basis[:100]), bytes.NewReader(delta.Bytes()), &bytes.Buffer{})
+	if !errors.Is(err, ErrShortBlock) || !errors.As(err, &fe) || fe.Type&AnalyseTypeIndex == 0 {
+		t.Error("short block", err)
+	}
+	err = Patch(bytes.NewReader(append([]byte{1}, basis[1:]...)), bytes.NewReader(delta.Bytes()), &bytes.Buffer{})
+	if !errors.Is(err, ErrHashMismatch) || !errors.As(err, &fe) || fe.Off != int64(len(basis))+1 {
+		t.Error("hash mismatch", err)
+	}
+	m := NewFileMerger(filepath.Join(t.TempDir(), "f.bin"), sig)
+	if err := m.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	err = m.Write(&AnalyseInfo{Type: AnalyseTypeData, Data: []byte("x")})
+	if !errors.Is(err, ErrStateOrder) || !errors.As(err, &fe) || fe.Path != m.Path {
+		t.Error("state order", err)
+	}
+}
+
+func TestAlgorithmMismatch(t *testing.T) {
+	dir := t.TempDir()
+	basis := bytes.Repeat([]byte("0123456789abcdef"), 200)
+	path := filepath.Join(dir, "f.bin")
+	if err := os.WriteFile(path, basis, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := Signature(bytes.NewReader(basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range []interface{}{SHA256Hasher, BuzHasher} {
+		fh := NewFileHashInfo(path, sig, arg)
+		if err := fh.Open(); err != nil {
+			t.Fatal(err)
+		}
+		err = fh.Analyse(func(info *AnalyseInfo) error { return nil })
+		fh.Close()
+		if !errors.Is(err, ErrAlgorithmMismatch) || IsRetryable(err) {
+			t.Error(arg, err)
+		}
+	}
+	//a delta made against a sha256 signature can't merge with the md5 one
+	sig2, err := GetFileHashInfo(path, nil, SHA256Hasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []*AnalyseInfo
+	fh := NewFileHashInfo(path, sig2)
+	if err := fh.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	err = fh.Analyse(func(info *AnalyseInfo) error {
+		frames = append(frames, info.Clone())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewFileMerger(path, sig)
+	if err := m.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if err := m.Write(frames[0]); !errors.Is(err, ErrAlgorithmMismatch) {
+		t.Error("merge", err)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	for _, v := range []struct {
+		err  error
+		code ErrorCode
+	}{
+		{fmt.Errorf("open: %w", fs.ErrNotExist), CodeNotExist},
+		{&FrameError{Err: ErrShortBlock}, CodeShortBlock},
+		{&os.PathError{Op: "write", Path: "f", Err: syscall.ENOSPC}, CodeNoSpace},
+		{context.Canceled, CodeCanceled},
+		{errors.New("other"), CodeUnknown},
+	} {
+		if code := ErrorCodeOf(v.err); code != v.code {
+			t.Error(v.err, code)
+		}
+	}
+	if err := (&RemoteError{Code: CodeTimeout, Message: "timeout"}); !errors.Is(err, os.ErrDeadlineExceeded) || !IsRetryable(err) {
+		t.Error("remote timeout", err)
+	}
+	if err := (&RemoteError{Message: "x"}); errors.Unwrap(err) != nil || err.Error() != "remote error: x" {
+		t.Error("remote unknown", err)
+	}
+}
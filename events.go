@@ -0,0 +1,121 @@
+package rsync
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// event types
+const (
+	EventProgress = "progress" //bytes of a file sent so far
+	EventFile     = "file"     //the change record of an entry
+	EventDone     = "done"     //a sync finished, with its stats and error
+)
+
+// DefaultEventInterval is the least time between progress events
+const DefaultEventInterval = time.Second
+
+// Event is one line of the json event stream
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Path    string    `json:"path,omitempty"`
+	Kind    string    `json:"kind,omitempty"`    //file events, see ItemChange.KindName
+	Item    string    `json:"item,omitempty"`    //file events, the rsync -i line
+	Bytes   int64     `json:"bytes,omitempty"`   //progress events, output bytes done
+	Literal int64     `json:"literal,omitempty"` //file events, literal bytes sent
+	Stats   *Stats    `json:"stats,omitempty"`   //done events
+	Error   string    `json:"error,omitempty"`   //done events of failed syncs
+}
+
+// EventWriter writes events as line delimited json for tools driving syncs, safe for
+// concurrent use
+type EventWriter struct {
+	Interval time.Duration //least time between progress events, < 0 none
+	mu       sync.Mutex
+	enc      *json.Encoder
+	last     time.Time
+	err      error
+}
+
+func NewEventWriter(w io.Writer) *EventWriter {
+	enc := json.NewEncoder(w)
+	//keep the > of item lines readable
+	enc.SetEscapeHTML(false)
+	return &EventWriter{Interval: DefaultEventInterval, enc: enc}
+}
+
+// Emit writes e, stamped with the current time when it has none, the first write error
+// is kept and returned by later calls
+func (this *EventWriter) Emit(e Event) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.emit(e)
+}
+
+func (this *EventWriter) emit(e Event) error {
+	if this.err != nil {
+		return this.err
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	this.err = this.enc.Encode(e)
+	return this.err
+}
+
+// Done writes the done event of a sync ending with err
+func (this *EventWriter) Done(st *Stats, err error) error {
+	e := Event{Type: EventDone, Stats: st}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return this.Emit(e)
+}
+
+// progress writes the progress event of path at most once per Interval
+func (this *EventWriter) progress(path string, n int64) {
+	if this.Interval < 0 {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	now := time.Now()
+	if now.Sub(this.last) < this.Interval {
+		return
+	}
+	this.last = now
+	this.emit(Event{Type: EventProgress, Time: now, Path: path, Bytes: n})
+}
+
+// Attach makes s write the file events of its entries and the progress of its pushes,
+// the hooks and OnItem s has are still called
+func (this *EventWriter) Attach(s *DirSyncer) {
+	h := &Hooks{}
+	if s.Hooks != nil {
+		*h = *s.Hooks
+	}
+	matched, literal := h.OnBlockMatched, h.OnLiteral
+	h.OnBlockMatched = func(path string, off int64, basisOff int64, size int) {
+		if matched != nil {
+			matched(path, off, basisOff, size)
+		}
+		this.progress(path, off+int64(size))
+	}
+	h.OnLiteral = func(path string, off int64, data []byte) {
+		if literal != nil {
+			literal(path, off, data)
+		}
+		this.progress(path, off+int64(len(data)))
+	}
+	s.Hooks = h
+	item := s.OnItem
+	s.OnItem = func(it ItemChange) {
+		if item != nil {
+			item(it)
+		}
+		this.Emit(Event{Type: EventFile, Path: it.Path, Kind: it.KindName(), Item: it.String(), Literal: it.Literal})
+	}
+}
@@ -0,0 +1,66 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEventWriter(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	big := strings.Repeat("0123456789", 2000)
+	testWriteFiles(t, src, map[string]string{"a.txt": "a", "b/c.txt": big})
+	testWriteFiles(t, dst, map[string]string{"b/c.txt": big[:DefaultBlockSize*2]})
+	out := &bytes.Buffer{}
+	ev := NewEventWriter(out)
+	ev.Interval = 0
+	s := NewDirSyncer(src, NewLocalStore(dst), "")
+	items := 0
+	s.OnItem = func(item ItemChange) {
+		items++
+	}
+	ev.Attach(s)
+	err := s.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev.Done(&s.Stats, err)
+	ev.Done(nil, errors.New("failed"))
+	types := map[string]int{}
+	var events []Event
+	sc := bufio.NewScanner(out)
+	for sc.Scan() {
+		var e Event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(sc.Text(), err)
+		}
+		if e.Time.IsZero() {
+			t.Error("event without time", sc.Text())
+		}
+		types[e.Type]++
+		events = append(events, e)
+	}
+	if items != 2 || types[EventFile] != 2 || types[EventDone] != 2 || types[EventProgress] == 0 {
+		t.Fatal("event counts error", items, types)
+	}
+	files := map[string]Event{}
+	for _, e := range events {
+		if e.Type == EventFile {
+			files[e.Path] = e
+		}
+	}
+	if files["a.txt"].Kind != "new" || files["b/c.txt"].Kind != "changed" || files["b/c.txt"].Literal == 0 {
+		t.Error("file events error", files)
+	}
+	done := events[len(events)-2]
+	if done.Stats == nil || done.Stats.Files != 2 || done.Error != "" {
+		t.Error("done event error", done)
+	}
+	if last := events[len(events)-1]; last.Stats != nil || last.Error != "failed" {
+		t.Error("failed done event error", last)
+	}
+}
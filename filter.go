@@ -0,0 +1,178 @@
+package rsync
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// FilterRule includes or excludes the paths matching Pattern
+//
+//	name      matches the last path elements, "*.log" any log file, "a/b" any b in an a dir
+//	/name     anchored at the synced root
+//	name/     matches dirs only
+//	* ? [a-z] don't match "/", ** matches anything
+type FilterRule struct {
+	Include bool
+	Pattern string
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+func NewFilterRule(include bool, pattern string) (*FilterRule, error) {
+	rule := &FilterRule{Include: include, Pattern: pattern}
+	p := pattern
+	if strings.HasSuffix(p, "/") {
+		rule.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	if p == "" {
+		return nil, fmt.Errorf("filter pattern %q error", pattern)
+	}
+	expr := "(^|/)"
+	if strings.HasPrefix(p, "/") {
+		expr = "^"
+		p = p[1:]
+	}
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; c {
+		case '*':
+			if i+1 < len(p) && p[i+1] == '*' {
+				expr += ".*"
+				i++
+			} else {
+				expr += "[^/]*"
+			}
+		case '?':
+			expr += "[^/]"
+		case '[':
+			j := strings.IndexByte(p[i+1:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("filter pattern %q error", pattern)
+			}
+			class := p[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr += "[" + class + "]"
+			i += j + 1
+		default:
+			expr += regexp.QuoteMeta(string(c))
+		}
+	}
+	re, err := regexp.Compile(expr + "$")
+	if err != nil {
+		return nil, fmt.Errorf("filter pattern %q error: %w", pattern, err)
+	}
+	rule.re = re
+	return rule, nil
+}
+
+// Match reports whether the slash separated path relative to the synced root matches
+func (this *FilterRule) Match(path string, dir bool) bool {
+	if this.dirOnly && !dir {
+		return false
+	}
+	return this.re.MatchString(path)
+}
+
+// Filter is an ordered rule chain, the first matching rule decides and unmatched paths are included
+type Filter struct {
+	Rules []*FilterRule
+}
+
+func NewFilter() *Filter {
+	return &Filter{}
+}
+
+func (this *Filter) add(include bool, patterns []string) error {
+	for _, p := range patterns {
+		rule, err := NewFilterRule(include, p)
+		if err != nil {
+			return err
+		}
+		this.Rules = append(this.Rules, rule)
+	}
+	return nil
+}
+
+// Include appends include rules
+func (this *Filter) Include(patterns ...string) error {
+	return this.add(true, patterns)
+}
+
+// Exclude appends exclude rules
+func (this *Filter) Exclude(patterns ...string) error {
+	return this.add(false, patterns)
+}
+
+// ReadFrom appends the rules read from r, one per line as "+ pattern" or "- pattern",
+// a line without prefix is an exclude and blank lines or lines starting with # or ; are skipped
+func (this *Filter) ReadFrom(r io.Reader) (int64, error) {
+	cr := &countReader{r: r}
+	sc := bufio.NewScanner(cr)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if strings.TrimSpace(line) == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		var err error
+		switch {
+		case strings.HasPrefix(line, "+ "):
+			err = this.Include(line[2:])
+		case strings.HasPrefix(line, "- "):
+			err = this.Exclude(line[2:])
+		default:
+			err = this.Exclude(line)
+		}
+		if err != nil {
+			return cr.n, err
+		}
+	}
+	return cr.n, sc.Err()
+}
+
+// Match reports whether path is kept, a nil filter keeps everything
+func (this *Filter) Match(path string, dir bool) bool {
+	if this == nil {
+		return true
+	}
+	for _, rule := range this.Rules {
+		if rule.Match(path, dir) {
+			return rule.Include
+		}
+	}
+	return true
+}
+
+// Apply drops the entries not kept and the entries under dropped dirs
+func (this *Filter) Apply(list []FileEntry) []FileEntry {
+	if this == nil {
+		return list
+	}
+	ret := []FileEntry{}
+	dropped := map[string]bool{}
+	for _, v := range list {
+		if filterDropped(dropped, v.Path) {
+			continue
+		}
+		if !this.Match(v.Path, v.IsDir()) {
+			dropped[v.Path] = true
+			continue
+		}
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+// filterDropped reports whether a parent dir of path was dropped
+func filterDropped(dropped map[string]bool, path string) bool {
+	for i := strings.LastIndexByte(path, '/'); i > 0; i = strings.LastIndexByte(path[:i], '/') {
+		if dropped[path[:i]] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package rsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilterRule(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		dir     bool
+		match   bool
+	}{
+		{"*.log", "a.log", false, true},
+		{"*.log", "x/y/a.log", false, true},
+		{"*.log", "a.log.txt", false, false},
+		{"node_modules/", "web/node_modules", true, true},
+		{"node_modules/", "web/node_modules", false, false},
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"src/*.go", "src/a.go", false, true},
+		{"src/*.go", "x/src/a.go", false, true},
+		{"src/*.go", "src/x/a.go", false, false},
+		{"src/**.go", "src/x/a.go", false, true},
+		{"a?c", "abc", false, true},
+		{"a?c", "a/c", false, false},
+		{"[!a]*.tmp", "b.tmp", false, true},
+		{"[!a]*.tmp", "a.tmp", false, false},
+		{"a+b", "a+b", false, true},
+	}
+	for _, v := range tests {
+		rule, err := NewFilterRule(false, v.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule.Match(v.path, v.dir) != v.match {
+			t.Errorf("%q match %q error", v.pattern, v.path)
+		}
+	}
+	for _, p := range []string{"", "/", "a[b"} {
+		if _, err := NewFilterRule(false, p); err == nil {
+			t.Errorf("pattern %q error expected", p)
+		}
+	}
+}
+
+func TestFilterChain(t *testing.T) {
+	f := NewFilter()
+	rules := "# keep the important log\n+ keep.log\n- *.log\n\ntmp/\n"
+	if _, err := f.ReadFrom(strings.NewReader(rules)); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Rules) != 3 {
+		t.Fatal("rules error", len(f.Rules))
+	}
+	if !f.Match("x/keep.log", false) || f.Match("x/a.log", false) || f.Match("tmp", true) || !f.Match("a.txt", false) {
+		t.Error("filter match error")
+	}
+	list := f.Apply([]FileEntry{
+		{Path: "a.txt"},
+		{Path: "tmp", Mode: os.ModeDir},
+		{Path: "tmp-x"},
+		{Path: "tmp/b.txt"},
+		{Path: "tmp/c", Mode: os.ModeDir},
+		{Path: "tmp/c/d.txt"},
+		{Path: "z.log"},
+	})
+	if len(list) != 2 || list[0].Path != "a.txt" || list[1].Path != "tmp-x" {
+		t.Error("filter apply error", list)
+	}
+}
+
+func TestDirSyncerFilter(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	testWriteFiles(t, src, map[string]string{
+		"app.js":                  "app",
+		"debug.log":               "log",
+		"node_modules/x/index.js": "x",
+		"lib/a.js":                "a",
+		"lib/b.tmp":               "b",
+	})
+	f := NewFilter()
+	if err := f.Exclude("node_modules/", "*.log", "*.tmp"); err != nil {
+		t.Fatal(err)
+	}
+	s := NewDirSyncer(src, NewLocalStore(dst), "")
+	s.Filter = f
+	if err := s.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, dst, map[string]string{"app.js": "app", "lib/a.js": "a"})
+	for _, name := range []string{"debug.log", "node_modules", "lib/b.tmp"} {
+		if _, err := os.Stat(filepath.Join(dst, name)); !os.IsNotExist(err) {
+			t.Errorf("%s synced", name)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package rsync
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// serialized format, bump FormatVersion on every incompatible change
+//
+// a delta is a sequence of frames, a frame is
+//
+//	type(1) [DeltaMagic header when open] body len(4) body crc(4)
+//
+// crc is the crc32 castagnoli of the frame bytes before it, a corrupted frame fails where it
+// is read instead of at the file hash of the close frame
+// and the body has the fields of the type bits in this order
+//
+//	open   strong(1) compress(1) seed(4) file size(8) block size(2) [meta(20) when meta]
+//	data   data len(4) data
+//	index  signature index(4) basis offset(8)
+//	short  block len(2)
+//	close  hash len(1) hash
+//
+// readers reject bodies longer than MaxFrameSize or not exactly holding the fields
+//
+// every multi byte integer of the formats is little endian, written with the tobyte helpers
+// and read back with the to helpers that check the field size
+const (
+	FormatVersion  = 10
+	SignatureMagic = "RSIG"
+	DeltaMagic     = "RDLT"
+	//bytes used for the block size field
+	BlockSizeWidth = 2
+	//largest frame body, a full data frame with the other fields fits
+	MaxFrameSize = MaxLiteralSize + 1<<10
+)
+
+var (
+	ErrBadMagic           = errors.New("bad magic")
+	ErrUnsupportedVersion = errors.New("unsupported version")
+	//decoded data is truncated or has invalid fields
+	ErrMalformed = errors.New("malformed data")
+	//the frame crc doesn't match its bytes
+	ErrFrameChecksum = fmt.Errorf("%w: frame checksum mismatch", ErrMalformed)
+)
+
+// magic version width
+func writeHeader(w io.Writer, magic string) error {
+	if _, err := w.Write([]byte(magic)); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{FormatVersion, BlockSizeWidth}); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readHeader(r io.Reader, magic string) error {
+	b := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	if string(b[:len(magic)]) != magic {
+		return fmt.Errorf("%w: %q", ErrBadMagic, b[:len(magic)])
+	}
+	if v := b[len(magic)]; v != FormatVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, v)
+	}
+	if w := b[len(magic)+1]; w != BlockSizeWidth {
+		return fmt.Errorf("%w: block size width %d", ErrUnsupportedVersion, w)
+	}
+	return nil
+}
+
+// le is the byte order of all formats
+var le = binary.LittleEndian
+
+func tobyte16(v uint16) []byte {
+	return le.AppendUint16(nil, v)
+}
+
+func tobyte32(v uint32) []byte {
+	return le.AppendUint32(nil, v)
+}
+
+func tobyte64(v uint64) []byte {
+	return le.AppendUint64(nil, v)
+}
+
+func touint16(b []byte) (uint16, error) {
+	if len(b) != 2 {
+		return 0, fmt.Errorf("%w: uint16 size %d", ErrMalformed, len(b))
+	}
+	return le.Uint16(b), nil
+}
+
+func touint32(b []byte) (uint32, error) {
+	if len(b) != 4 {
+		return 0, fmt.Errorf("%w: uint32 size %d", ErrMalformed, len(b))
+	}
+	return le.Uint32(b), nil
+}
+
+func touint64(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, fmt.Errorf("%w: uint64 size %d", ErrMalformed, len(b))
+	}
+	return le.Uint64(b), nil
+}
+
+// toint64 is touint64 for offsets and sizes, values past math.MaxInt64 are rejected
+func toint64(b []byte) (int64, error) {
+	v, err := touint64(b)
+	if err != nil {
+		return 0, err
+	}
+	if v > math.MaxInt64 {
+		return 0, fmt.Errorf("%w: int64 overflow", ErrMalformed)
+	}
+	return int64(v), nil
+}
@@ -0,0 +1,234 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFormatHeader(t *testing.T) {
+	hi, err := Signature(bytes.NewReader([]byte("format header test data")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := hi.ToBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := buf.Bytes()
+	if string(dat[:4]) != SignatureMagic {
+		t.Fatal("signature magic error")
+	}
+	bad := append([]byte{}, dat...)
+	bad[4] = FormatVersion + 1
+	if _, err := NewHashInfoWithBuf(bytes.NewReader(bad)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Error("version not checked", err)
+	}
+	bad = append([]byte{}, dat...)
+	bad[0] = 'X'
+	if _, err := NewHashInfoWithBuf(bytes.NewReader(bad)); !errors.Is(err, ErrBadMagic) {
+		t.Error("magic not checked", err)
+	}
+	delta := &bytes.Buffer{}
+	if err := Delta(hi, bytes.NewReader([]byte("format header")), delta); err != nil {
+		t.Fatal(err)
+	}
+	dd := delta.Bytes()
+	if string(dd[1:5]) != DeltaMagic {
+		t.Fatal("delta magic error")
+	}
+	dd[5] = FormatVersion + 1
+	if err := (&AnalyseInfo{}).Read(bytes.NewReader(dd)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Error("delta version not checked", err)
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	if _, err := touint16([]byte{1}); !errors.Is(err, ErrMalformed) {
+		t.Error("touint16", err)
+	}
+	if _, err := toint64([]byte{0, 0, 0, 0, 0, 0, 0, 0x80}); !errors.Is(err, ErrMalformed) {
+		t.Error("toint64", err)
+	}
+	if _, err := NewFileReader(nil, 64); err == nil {
+		t.Error("nil file reader")
+	}
+	dat := make([]byte, 4096)
+	for i := range dat {
+		dat[i] = byte(i * 7)
+	}
+	hi, err := Signature(bytes.NewReader(dat[:3000]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := hi.ToBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := buf.Bytes()
+	//every truncation fails without panic
+	for i := 0; i < len(sig); i++ {
+		if err := NewHashInfo().Read(bytes.NewReader(sig[:i])); err == nil {
+			t.Fatal("truncated signature read", i)
+		}
+	}
+	//the short block is longer than the block size
+	bad := append([]byte{}, sig...)
+	bad[len(bad)-2], bad[len(bad)-1] = 0xFF, 0xFF
+	if err := NewHashInfo().Read(bytes.NewReader(bad)); !errors.Is(err, ErrMalformed) {
+		t.Error("block length", err)
+	}
+	//a zero block size, even without blocks
+	zero, _ := Signature(bytes.NewReader(nil))
+	zero.BlockSize = 0
+	empty, err := zero.ToBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewHashInfo().Read(bytes.NewReader(empty.Bytes())); !errors.Is(err, ErrMalformed) {
+		t.Error("zero block size", err)
+	}
+	//deltas against it send the whole file
+	whole := &bytes.Buffer{}
+	if err := Delta(NewHashInfo(), bytes.NewReader(dat), whole); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if err := Patch(bytes.NewReader(nil), whole, out); err != nil || !bytes.Equal(out.Bytes(), dat) {
+		t.Error("zero block size delta", err)
+	}
+	delta := &bytes.Buffer{}
+	if err := Delta(hi, bytes.NewReader(dat), delta); err != nil {
+		t.Fatal(err)
+	}
+	//a negative basis offset
+	frame := &bytes.Buffer{}
+	(&AnalyseInfo{Type: AnalyseTypeIndex, Off: -1}).Write(frame)
+	if err := (&AnalyseInfo{}).Read(frame); !errors.Is(err, ErrMalformed) {
+		t.Error("index offset", err)
+	}
+	for i := 0; i < delta.Len(); i++ {
+		r := bytes.NewReader(delta.Bytes()[:i])
+		for {
+			info := &AnalyseInfo{}
+			if err := info.Read(r); err != nil {
+				break
+			}
+		}
+	}
+}
+
+func TestFrameCodec(t *testing.T) {
+	frames := []*AnalyseInfo{
+		{Type: AnalyseTypeOpen | AnalyseTypeMeta, Off: 10, BlockSize: 1024, Strong: StrongSHA256, Seed: 3,
+			Meta: &FileMeta{Mode: 0644, ModTime: time.Unix(5, 6), Uid: -1, Gid: 7}},
+		{Type: AnalyseTypeData, Data: []byte("literal")},
+		{Type: AnalyseTypeIndex, Index: 9, Off: 2048},
+		{Type: AnalyseTypeIndex | AnalyseTypeShort | AnalyseTypeData, Index: 2, Off: 4096, Len: 5, Data: []byte("x")},
+		{Type: AnalyseTypeClose, Hash: []byte("0123456789abcdef")},
+	}
+	buf := &bytes.Buffer{}
+	for _, v := range frames {
+		if err := v.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, v := range frames {
+		got := &AnalyseInfo{}
+		if err := got.Read(buf); err != nil {
+			t.Fatal(i, err)
+		}
+		if got.Type != v.Type || got.Index != v.Index || got.Off != v.Off || got.Len != v.Len ||
+			!bytes.Equal(got.Data, v.Data) || !bytes.Equal(got.Hash, v.Hash) || got.Seed != v.Seed {
+			t.Errorf("frame %d %+v != %+v", i, got, v)
+		}
+	}
+	if err := (&AnalyseInfo{}).Read(buf); err != io.EOF {
+		t.Error("end of stream", err)
+	}
+	frame := func(typ byte, size uint32, body []byte) *bytes.Reader {
+		b := append(append([]byte{typ}, tobyte32(size)...), body...)
+		return bytes.NewReader(append(b, tobyte32(crc32.Checksum(b, castagnoli))...))
+	}
+	//a flipped bit in any frame fails at that frame
+	enc := &bytes.Buffer{}
+	for _, v := range frames {
+		v.Write(enc)
+	}
+	for _, pos := range []int{1, 12, enc.Len() / 2, enc.Len() - 1} {
+		dat := bytes.Clone(enc.Bytes())
+		dat[pos] ^= 0x10
+		r := bytes.NewReader(dat)
+		var err error
+		for err == nil {
+			err = (&AnalyseInfo{}).Read(r)
+		}
+		//a corrupt length runs past the end of the stream
+		if !errors.Is(err, ErrMalformed) && !errors.Is(err, ErrBadMagic) && err != io.ErrUnexpectedEOF {
+			t.Error("corrupt byte", pos, err)
+		}
+	}
+	if err := (&AnalyseInfo{}).Read(frame(AnalyseTypeData, 5, []byte{1, 0, 0, 0, 'x'})); err != nil {
+		t.Error("checksum frame", err)
+	}
+	r := frame(AnalyseTypeData, 5, []byte{1, 0, 0, 0, 'x'})
+	dat := make([]byte, r.Len())
+	r.Read(dat)
+	dat[4+3] ^= 1
+	if err := (&AnalyseInfo{}).Read(bytes.NewReader(dat)); err != ErrFrameChecksum {
+		t.Error("checksum mismatch", err)
+	}
+	for name, r := range map[string]*bytes.Reader{
+		"too large": frame(AnalyseTypeData, MaxFrameSize+1, nil),
+		"extra":     frame(AnalyseTypeIndex, 13, make([]byte, 13)),
+		"short":     frame(AnalyseTypeIndex, 8, make([]byte, 8)),
+		"data len":  frame(AnalyseTypeData, 6, []byte{9, 0, 0, 0, 1, 2}),
+		"data max":  frame(AnalyseTypeData, 4, tobyte32(MaxLiteralSize+1)),
+		"type 0":    frame(0, 0, nil),
+		"truncated": frame(AnalyseTypeData, 4, []byte{2, 0}),
+	} {
+		err := (&AnalyseInfo{}).Read(r)
+		if name == "truncated" {
+			if err != io.ErrUnexpectedEOF {
+				t.Error(name, err)
+			}
+		} else if !errors.Is(err, ErrMalformed) {
+			t.Error(name, err)
+		}
+	}
+}
+
+func TestByteOrder(t *testing.T) {
+	//fields are little endian
+	if !bytes.Equal(tobyte16(0x0102), []byte{2, 1}) || !bytes.Equal(tobyte32(0x01020304), []byte{4, 3, 2, 1}) {
+		t.Error("byte order error")
+	}
+	if !bytes.Equal(tobyte64(0x0102030405060708), []byte{8, 7, 6, 5, 4, 3, 2, 1}) {
+		t.Error("uint64 byte order error")
+	}
+	for _, v := range []uint64{0, 1, math.MaxUint32 + 1, math.MaxInt64, math.MaxUint64} {
+		if got, err := touint64(tobyte64(v)); err != nil || got != v {
+			t.Error("uint64 round trip error", v, got, err)
+		}
+	}
+	if v, err := toint64(tobyte64(math.MaxInt64)); err != nil || v != math.MaxInt64 {
+		t.Error("int64 error", v, err)
+	}
+	if _, err := toint64(tobyte64(math.MaxInt64 + 1)); !errors.Is(err, ErrMalformed) {
+		t.Error("int64 overflow accepted", err)
+	}
+	//wrong field sizes are rejected instead of read past
+	if _, err := touint16([]byte{1}); !errors.Is(err, ErrMalformed) {
+		t.Error("short uint16 accepted")
+	}
+	if _, err := touint32([]byte{1, 2, 3, 4, 5}); !errors.Is(err, ErrMalformed) {
+		t.Error("long uint32 accepted")
+	}
+	if _, err := touint64(nil); !errors.Is(err, ErrMalformed) {
+		t.Error("empty uint64 accepted")
+	}
+}
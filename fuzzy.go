@@ -0,0 +1,66 @@
+package rsync
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FuzzyBasis returns the file of the dir of path with the name closest to the missing path, like
+// rsync --fuzzy a renamed or versioned copy makes a better basis than nothing, empty when no name
+// has at least half of the longer name in common
+func FuzzyBasis(path string) string {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	list, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	best, score := "", 0
+	for _, e := range list {
+		n := e.Name()
+		if n == name || !e.Type().IsRegular() || isTempName(n) {
+			continue
+		}
+		d := editDistance(name, n)
+		if d*2 > max(len(name), len(n)) {
+			continue
+		}
+		//ReadDir is sorted, ties keep the first name
+		if best == "" || d < score {
+			best, score = n, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return filepath.Join(dir, best)
+}
+
+// isTempName reports the merge temp and progress files
+func isTempName(name string) bool {
+	return strings.HasSuffix(name, ".tmp") || strings.HasSuffix(name, ".part")
+}
+
+// editDistance is the levenshtein distance of the bytes of a and b
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,70 @@
+package rsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFuzzyBasis(t *testing.T) {
+	dir := t.TempDir()
+	testWriteFiles(t, dir, map[string]string{
+		"report-2023.pdf":     "a",
+		"report-2024.pdf":     "b",
+		"other.txt":           "c",
+		"report-2025.pdf.tmp": "d",
+	})
+	if err := os.Mkdir(filepath.Join(dir, "report-2026.pdf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got := FuzzyBasis(filepath.Join(dir, "report-2025.pdf")); got != filepath.Join(dir, "report-2023.pdf") {
+		t.Errorf("fuzzy basis %s", got)
+	}
+	if got := FuzzyBasis(filepath.Join(dir, "notes.md")); got != "" {
+		t.Errorf("fuzzy basis %s for a different name", got)
+	}
+	if got := FuzzyBasis(filepath.Join(dir, "none", "a.txt")); got != "" {
+		t.Errorf("fuzzy basis %s in a missing dir", got)
+	}
+	if d := editDistance("kitten", "sitting"); d != 3 {
+		t.Errorf("edit distance %d", d)
+	}
+}
+
+func TestDirSyncerFuzzy(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	big := strings.Repeat("versioned data block ", 2000)
+	testWriteFiles(t, dst, map[string]string{"data-v1.bin": big})
+	testWriteFiles(t, src, map[string]string{"data-v2.bin": big + "v2"})
+	ctx := context.Background()
+	store := NewLocalStore(dst)
+	store.Fuzzy = true
+	s := NewDirSyncer(src, store, "")
+	s.Fuzzy = true
+	rp, err := s.DryRun(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rp.Files) != 1 || rp.Files[0].Action != ActionCreate || rp.Bytes >= int64(len(big)) {
+		t.Fatalf("dry run %+v", rp)
+	}
+	if err := s.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, dst, map[string]string{"data-v1.bin": big, "data-v2.bin": big + "v2"})
+	if s.Stats.Literal >= int64(len(big)) || s.Stats.Matched == 0 {
+		t.Errorf("fuzzy basis not used %s", s.Stats.String())
+	}
+	//the merger reads the basis from another file
+	m := NewFileMerger(filepath.Join(dst, "x.bin"), &HashInfo{})
+	m.Basis = filepath.Join(dst, "data-v1.bin")
+	if err := m.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.RFile == nil || filepath.Base(m.RFile.Name()) != "data-v1.bin" {
+		t.Error("basis not opened")
+	}
+}
@@ -1,5 +1,30 @@
 module rsync
 
-go 1.13
+go 1.23
 
-require github.com/gofrs/flock v0.7.1
+require (
+	github.com/fsnotify/fsnotify v1.8.0
+	github.com/gofrs/flock v0.7.1
+	github.com/klauspost/compress v1.17.11
+	github.com/quic-go/quic-go v0.48.2
+	golang.org/x/crypto v0.31.0
+	google.golang.org/grpc v1.68.1
+	google.golang.org/protobuf v1.36.12
+	lukechampine.com/blake3 v1.4.1
+)
+
+require (
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	go.uber.org/mock v0.4.0 // indirect
+	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
+	golang.org/x/mod v0.17.0 // indirect
+	golang.org/x/net v0.29.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240903143218-8af14fe29dc1 // indirect
+	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
+)
@@ -0,0 +1,216 @@
+package rsync
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"rsync/rsyncpb"
+)
+
+// GRPCServer implements the rsyncpb.Rsync service on Store
+type GRPCServer struct {
+	rsyncpb.UnimplementedRsyncServer
+	Store *LocalStore
+}
+
+func NewGRPCServer(root string) *GRPCServer {
+	return &GRPCServer{Store: NewLocalStore(root)}
+}
+
+func (this *GRPCServer) Register(s grpc.ServiceRegistrar) {
+	rsyncpb.RegisterRsyncServer(s, this)
+}
+
+func (this *GRPCServer) GetSignature(ctx context.Context, req *rsyncpb.SignatureRequest) (*rsyncpb.HashInfo, error) {
+	hi, err := this.Store.Signature(ctx, req.Path)
+	if err != nil {
+		return nil, err
+	}
+	return hi.ToProto(), nil
+}
+
+func (this *GRPCServer) ApplyDelta(stream rsyncpb.Rsync_ApplyDeltaServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	pending := first.Frame
+	err = this.Store.ApplyFrames(stream.Context(), first.Path, func() (*AnalyseInfo, error) {
+		if pending == nil {
+			m, err := stream.Recv()
+			if err != nil {
+				return nil, err
+			}
+			pending = m.Frame
+		}
+		info := &AnalyseInfo{}
+		err := info.FromProto(pending)
+		pending = nil
+		return info, err
+	})
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(&rsyncpb.ApplyResult{})
+}
+
+func (this *GRPCServer) Sync(stream rsyncpb.Rsync_SyncServer) error {
+	m, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	path, ok := m.Msg.(*rsyncpb.SyncMessage_Path)
+	if !ok {
+		return errors.New("sync path missing")
+	}
+	hi, err := this.Store.Signature(stream.Context(), path.Path)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&rsyncpb.SyncMessage{Msg: &rsyncpb.SyncMessage_Signature{Signature: hi.ToProto()}}); err != nil {
+		return err
+	}
+	err = this.Store.ApplyFrames(stream.Context(), path.Path, func() (*AnalyseInfo, error) {
+		m, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		frame, ok := m.Msg.(*rsyncpb.SyncMessage_Frame)
+		if !ok {
+			return nil, errors.New("sync frame missing")
+		}
+		info := &AnalyseInfo{}
+		return info, info.FromProto(frame.Frame)
+	})
+	if err != nil {
+		return err
+	}
+	return stream.Send(&rsyncpb.SyncMessage{Msg: &rsyncpb.SyncMessage_Result{Result: &rsyncpb.ApplyResult{}}})
+}
+
+// GRPCClient is the Transport for a GRPCServer
+type GRPCClient struct {
+	Conn   *grpc.ClientConn
+	Client rsyncpb.RsyncClient
+	Limit  *Limiter //throttles literal data
+}
+
+func NewGRPCClient(conn *grpc.ClientConn) *GRPCClient {
+	return &GRPCClient{Conn: conn, Client: rsyncpb.NewRsyncClient(conn)}
+}
+
+// DialGRPC creates the client connection, credentials and balancing come from opts
+func DialGRPC(target string, opts ...grpc.DialOption) (*GRPCClient, error) {
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewGRPCClient(conn), nil
+}
+
+// DialGRPCTLS is DialGRPC with tls transport credentials
+func DialGRPCTLS(target string, conf *tls.Config, opts ...grpc.DialOption) (*GRPCClient, error) {
+	return DialGRPC(target, append(opts, grpc.WithTransportCredentials(credentials.NewTLS(conf)))...)
+}
+
+// GRPCServerTLS is the server option for tls, set conf.ClientAuth to require client certificates
+func GRPCServerTLS(conf *tls.Config) grpc.ServerOption {
+	return grpc.Creds(credentials.NewTLS(conf))
+}
+
+func (this *GRPCClient) Signature(ctx context.Context, path string) (*HashInfo, error) {
+	m, err := this.Client.GetSignature(ctx, &rsyncpb.SignatureRequest{Path: path})
+	if err != nil {
+		return nil, err
+	}
+	hi := NewHashInfo()
+	if err := hi.FromProto(m); err != nil {
+		return nil, err
+	}
+	return hi, nil
+}
+
+func (this *GRPCClient) Apply(ctx context.Context, path string, delta io.Reader) error {
+	stream, err := this.Client.ApplyDelta(ctx)
+	if err != nil {
+		return err
+	}
+	for {
+		info := &AnalyseInfo{}
+		if err := info.Read(delta); err != nil {
+			stream.CloseSend()
+			return err
+		}
+		if err := this.Limit.waitFrame(ctx, info); err != nil {
+			stream.CloseSend()
+			return err
+		}
+		if err := stream.Send(&rsyncpb.DeltaFrame{Path: path, Frame: info.ToProto()}); err != nil {
+			//the server status explains a broken stream
+			if _, rerr := stream.CloseAndRecv(); rerr != nil {
+				return rerr
+			}
+			return err
+		}
+		path = ""
+		if info.IsClose() {
+			break
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+// Sync pushes src to path over one bidirectional stream
+func (this *GRPCClient) Sync(ctx context.Context, src io.Reader, path string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := this.Client.Sync(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&rsyncpb.SyncMessage{Msg: &rsyncpb.SyncMessage_Path{Path: path}}); err != nil {
+		return err
+	}
+	m, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	sm, ok := m.Msg.(*rsyncpb.SyncMessage_Signature)
+	if !ok {
+		return errors.New("sync signature missing")
+	}
+	sig := NewHashInfo()
+	if err := sig.FromProto(sm.Signature); err != nil {
+		return err
+	}
+	err = analyseReader(sig, src, func(info *AnalyseInfo) error {
+		if err := this.Limit.waitFrame(ctx, info); err != nil {
+			return err
+		}
+		return stream.Send(&rsyncpb.SyncMessage{Msg: &rsyncpb.SyncMessage_Frame{Frame: info.ToProto()}})
+	})
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	m, err = stream.Recv()
+	if err != nil {
+		return err
+	}
+	if _, ok := m.Msg.(*rsyncpb.SyncMessage_Result); !ok {
+		return errors.New("sync result missing")
+	}
+	return nil
+}
+
+func (this *GRPCClient) Close() error {
+	return this.Conn.Close()
+}
@@ -0,0 +1,53 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCTransport(t *testing.T) {
+	root := t.TempDir()
+	l := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	NewGRPCServer(root).Register(s)
+	go s.Serve(l)
+	defer s.Stop()
+	c, err := DialGRPC("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+	dat := make([]byte, DefaultBlockSize*20+9)
+	rand.New(rand.NewSource(1)).Read(dat)
+	if err := Push(ctx, c, bytes.NewReader(dat), "a.bin"); err != nil {
+		t.Fatal(err)
+	}
+	dat[DefaultBlockSize*5] ^= 1
+	if err := c.Sync(ctx, bytes.NewReader(dat), "a.bin"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(root, "a.bin"))
+	if err != nil || !bytes.Equal(got, dat) {
+		t.Fatal("remote file error", err)
+	}
+	if err := c.Sync(ctx, bytes.NewReader(dat), "../a.bin"); err == nil {
+		t.Error("path error expected")
+	}
+	if err := Push(ctx, c, bytes.NewReader(dat), "../a.bin"); err == nil {
+		t.Error("path error expected")
+	}
+}
@@ -0,0 +1,160 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+)
+
+// ProtocolVersion is the tcp message protocol of this build, peers without the hello
+// message speak version 1, version 3 peers send heartbeats and version 4 peers error codes
+const ProtocolVersion = 4
+
+// Capabilities are what one end of a connection supports, the hello messages exchange them
+// before the first request and both ends use the common part found by Negotiate
+type Capabilities struct {
+	Version  uint16
+	Strong   []uint8 //strong hash ids, preferred first
+	Weak     []uint8 //weak hash ids, preferred first
+	Compress []uint8 //literal compress ids, preferred first
+	MaxBlock uint16  //largest signature block size
+}
+
+// LocalCapabilities are the registered hashes and the compressions of this build,
+// the default hashes first
+func LocalCapabilities() Capabilities {
+	caps := Capabilities{
+		Version:  ProtocolVersion,
+		Compress: []uint8{CompressNone, CompressZstd, CompressGzip},
+		MaxBlock: math.MaxUint16,
+	}
+	for id := range strongHashers {
+		caps.Strong = append(caps.Strong, id)
+	}
+	for id := range weakHashers {
+		caps.Weak = append(caps.Weak, id)
+	}
+	slices.Sort(caps.Strong)
+	slices.Sort(caps.Weak)
+	return caps
+}
+
+// legacyCapabilities are those of version 1 peers, they sign with md5 and adler32 only
+func legacyCapabilities() Capabilities {
+	return Capabilities{
+		Version:  1,
+		Strong:   []uint8{StrongMD5},
+		Weak:     []uint8{WeakAdler32},
+		Compress: []uint8{CompressNone},
+		MaxBlock: math.MaxUint16,
+	}
+}
+
+// Negotiate is the common denominator of this and peer in the preference order of this,
+// the lower version and block size, without a common hash it fails with ErrAlgorithmMismatch
+func (this Capabilities) Negotiate(peer Capabilities) (Capabilities, error) {
+	caps := Capabilities{
+		Version:  min(this.Version, peer.Version),
+		Strong:   common(this.Strong, peer.Strong),
+		Weak:     common(this.Weak, peer.Weak),
+		Compress: common(this.Compress, peer.Compress),
+		MaxBlock: min(this.MaxBlock, peer.MaxBlock),
+	}
+	if len(caps.Strong) == 0 {
+		return caps, fmt.Errorf("%w: no common strong hash", ErrAlgorithmMismatch)
+	}
+	if len(caps.Weak) == 0 {
+		return caps, fmt.Errorf("%w: no common weak hash", ErrAlgorithmMismatch)
+	}
+	//every peer reads uncompressed literals
+	if len(caps.Compress) == 0 {
+		caps.Compress = []uint8{CompressNone}
+	}
+	return caps, nil
+}
+
+// common is the ids of a also in b, in the order of a
+func common(a, b []uint8) []uint8 {
+	var ids []uint8
+	for _, id := range a {
+		if slices.Contains(b, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Write encodes version(2) max block(2) and the strong, weak and compress ids,
+// each list is count(1) followed by the ids
+func (this Capabilities) Write(w io.Writer) error {
+	buf := &bytes.Buffer{}
+	buf.Write(tobyte16(this.Version))
+	buf.Write(tobyte16(this.MaxBlock))
+	for _, ids := range [][]uint8{this.Strong, this.Weak, this.Compress} {
+		if len(ids) > math.MaxUint8 {
+			return fmt.Errorf("%d capability ids too many", len(ids))
+		}
+		buf.WriteByte(uint8(len(ids)))
+		buf.Write(ids)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Read decodes the layout of Write
+func (this *Capabilities) Read(r io.Reader) error {
+	b4 := make([]byte, 4)
+	if _, err := io.ReadFull(r, b4); err != nil {
+		return noEOF(err)
+	}
+	*this = Capabilities{}
+	this.Version, _ = touint16(b4[:2])
+	this.MaxBlock, _ = touint16(b4[2:])
+	for _, ids := range []*[]uint8{&this.Strong, &this.Weak, &this.Compress} {
+		n := []byte{0}
+		if _, err := io.ReadFull(r, n); err != nil {
+			return noEOF(err)
+		}
+		*ids = make([]uint8, n[0])
+		if _, err := io.ReadFull(r, *ids); err != nil {
+			return noEOF(err)
+		}
+	}
+	return nil
+}
+
+type capabilitiesKey struct{}
+
+// withCapabilities passes the negotiated capabilities of a connection to the store answering it
+func withCapabilities(ctx context.Context, caps Capabilities) context.Context {
+	return context.WithValue(ctx, capabilitiesKey{}, caps)
+}
+
+// capabilitiesFrom are the negotiated capabilities of the request, false for version 1 peers
+func capabilitiesFrom(ctx context.Context) (Capabilities, bool) {
+	caps, ok := ctx.Value(capabilitiesKey{}).(Capabilities)
+	return caps, ok
+}
+
+// useCapabilities signs with the preferred negotiated hashes and blocks of at most MaxBlock
+func (this *FileHashInfo) useCapabilities(caps Capabilities) error {
+	if len(caps.Strong) == 0 || len(caps.Weak) == 0 {
+		return fmt.Errorf("%w: no common hash", ErrAlgorithmMismatch)
+	}
+	sh, err := GetStrongHasher(caps.Strong[0])
+	if err != nil {
+		return err
+	}
+	wh, err := GetWeakHasher(caps.Weak[0])
+	if err != nil {
+		return err
+	}
+	this.Hasher, this.Weak = sh, wh
+	if caps.MaxBlock > 0 && this.BlockSize > caps.MaxBlock {
+		this.BlockSize = caps.MaxBlock
+	}
+	return nil
+}
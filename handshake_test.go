@@ -0,0 +1,133 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	local := LocalCapabilities()
+	if local.Version != ProtocolVersion || local.Strong[0] != StrongMD5 || local.Weak[0] != WeakAdler32 {
+		t.Fatal("local capabilities error", local)
+	}
+	buf := &bytes.Buffer{}
+	if err := local.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	var got Capabilities
+	if err := got.Read(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != local.Version || got.MaxBlock != local.MaxBlock || !slices.Equal(got.Strong, local.Strong) ||
+		!slices.Equal(got.Weak, local.Weak) || !slices.Equal(got.Compress, local.Compress) {
+		t.Error("capabilities codec error", got)
+	}
+	if err := got.Read(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("short capabilities", err)
+	}
+	peer := Capabilities{Version: 5, Strong: []uint8{StrongBLAKE3, StrongSHA256}, Weak: []uint8{WeakCRC32C, WeakAdler32}, MaxBlock: 4096}
+	caps, err := peer.Negotiate(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.Version != ProtocolVersion || caps.MaxBlock != 4096 || !slices.Equal(caps.Strong, peer.Strong) ||
+		!slices.Equal(caps.Weak, peer.Weak) || !slices.Equal(caps.Compress, []uint8{CompressNone}) {
+		t.Error("negotiate error", caps)
+	}
+	if _, err := peer.Negotiate(legacyCapabilities()); !errors.Is(err, ErrAlgorithmMismatch) {
+		t.Error("no common strong hash", err)
+	}
+}
+
+func TestTCPHandshake(t *testing.T) {
+	root := t.TempDir()
+	dat := make([]byte, DefaultBlockSize*10+33)
+	rand.New(rand.NewSource(1)).Read(dat)
+	if err := os.WriteFile(filepath.Join(root, "f.bin"), dat, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewTCPServer(root)
+	ctx := context.Background()
+	//the server signs with the hashes the client prefers
+	cc, sc := net.Pipe()
+	go srv.ServeConn(sc)
+	c := NewTCPClient(cc)
+	c.Capabilities = Capabilities{Version: ProtocolVersion, Strong: []uint8{StrongBLAKE3}, Weak: []uint8{WeakCRC32C}, MaxBlock: 512}
+	sig, err := c.Signature(ctx, "f.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Strong != StrongBLAKE3 || sig.Weak != WeakCRC32C || sig.BlockSize != 512 {
+		t.Error("negotiated signature error", sig.Strong, sig.Weak, sig.BlockSize)
+	}
+	dat = append([]byte("new"), dat...)
+	if err := Push(ctx, c, bytes.NewReader(dat), "f.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(root, "f.bin")); err != nil || !bytes.Equal(got, dat) {
+		t.Error("push error", err)
+	}
+	if caps, err := c.Negotiated(ctx); err != nil || caps.Version != ProtocolVersion {
+		t.Error("negotiated error", caps, err)
+	}
+	c.Close()
+	//clients without the hello get the version 1 signature, unknown requests are refused
+	cc, sc = net.Pipe()
+	go srv.ServeConn(sc)
+	codec := newTCPCodec(cc, nil, true, Timeouts{})
+	if err := codec.write(99, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := codec.write(tcpGetSignature, []byte("f.bin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := codec.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if typ, _, err := codec.read(); err != nil || typ != tcpError {
+		t.Error("unknown request", typ, err)
+	}
+	typ, payload, err := codec.read()
+	if err != nil || typ != tcpSignature {
+		t.Fatal("version 1 signature", typ, err)
+	}
+	hi := NewHashInfo()
+	if err := hi.Read(bytes.NewReader(payload)); err != nil || hi.Strong != StrongMD5 || hi.Weak != WeakAdler32 {
+		t.Error("version 1 signature error", err)
+	}
+	cc.Close()
+	//servers refusing the hello speak version 1
+	cc, sc = net.Pipe()
+	go func() {
+		defer sc.Close()
+		s := newTCPCodec(sc, nil, false, Timeouts{})
+		if typ, _, err := s.read(); err != nil || typ != tcpHello {
+			return
+		}
+		s.write(tcpError, []byte("unknown"))
+		s.flush()
+		if typ, _, err := s.read(); err != nil || typ != tcpGetSignature {
+			return
+		}
+		hi, _ := Signature(bytes.NewReader(nil))
+		buf, _ := hi.ToBuffer()
+		s.write(tcpSignature, buf.Bytes())
+		s.flush()
+	}()
+	c = NewTCPClient(cc)
+	if _, err := c.Signature(ctx, "f.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if caps, err := c.Negotiated(ctx); err != nil || caps.Version != 1 || !slices.Equal(caps.Strong, []uint8{StrongMD5}) {
+		t.Error("version 1 fallback error", caps, err)
+	}
+	cc.Close()
+}
@@ -0,0 +1,242 @@
+package rsync
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"errors"
+	"fmt"
+	"hash"
+
+	"lukechampine.com/blake3"
+)
+
+// strong hash ids recorded in HashInfo and the open frame
+const (
+	StrongMD5    = 0
+	StrongSHA256 = 1
+	StrongBLAKE3 = 2
+)
+
+// StrongHasher creates the strong hash used for block and whole-file checksums
+type StrongHasher interface {
+	ID() uint8
+	Name() string
+	Size() int
+	New() hash.Hash
+}
+
+type strongHasher struct {
+	id   uint8
+	name string
+	size int
+	fn   func() hash.Hash
+}
+
+func (this *strongHasher) ID() uint8 {
+	return this.id
+}
+
+func (this *strongHasher) Name() string {
+	return this.name
+}
+
+func (this *strongHasher) Size() int {
+	return this.size
+}
+
+func (this *strongHasher) New() hash.Hash {
+	return this.fn()
+}
+
+var (
+	MD5Hasher StrongHasher = &strongHasher{
+		id:   StrongMD5,
+		name: "md5",
+		size: md5.Size,
+		fn:   md5.New,
+	}
+	SHA256Hasher StrongHasher = &strongHasher{
+		id:   StrongSHA256,
+		name: "sha256",
+		size: sha256.Size,
+		fn:   sha256.New,
+	}
+	BLAKE3Hasher StrongHasher = &strongHasher{
+		id:   StrongBLAKE3,
+		name: "blake3",
+		size: 32,
+		fn: func() hash.Hash {
+			return blake3.New(32, nil)
+		},
+	}
+)
+
+var strongHashers = map[uint8]StrongHasher{
+	StrongMD5:    MD5Hasher,
+	StrongSHA256: SHA256Hasher,
+	StrongBLAKE3: BLAKE3Hasher,
+}
+
+// RegisterStrongHasher adds or replaces the hasher for h.ID(), call it from init
+func RegisterStrongHasher(h StrongHasher) {
+	strongHashers[h.ID()] = h
+}
+
+// GetStrongHasher returns the hasher registered for id
+func GetStrongHasher(id uint8) (StrongHasher, error) {
+	h, ok := strongHashers[id]
+	if !ok {
+		return nil, fmt.Errorf("strong hash %d not support", id)
+	}
+	return h, nil
+}
+
+func strongSum(h StrongHasher, dat []byte) []byte {
+	hh := h.New()
+	hh.Write(dat)
+	return hh.Sum(nil)
+}
+
+// SeededHasher mixes seed into every sum of h like the rsync checksum seed, a sender that
+// doesn't know the seed in advance can't craft blocks colliding with the basis, seed 0 returns h
+func SeededHasher(h StrongHasher, seed uint32) StrongHasher {
+	if seed == 0 {
+		return h
+	}
+	return &seededHasher{StrongHasher: h, seed: tobyte32(seed)}
+}
+
+type seededHasher struct {
+	StrongHasher
+	seed []byte
+}
+
+func (this *seededHasher) New() hash.Hash {
+	h := &seededHash{Hash: this.StrongHasher.New(), seed: this.seed}
+	h.Reset()
+	if _, ok := h.Hash.(encoding.BinaryMarshaler); ok {
+		return &seededStateHash{h}
+	}
+	return h
+}
+
+// seededHash hashes the seed before the data, also after Reset
+type seededHash struct {
+	hash.Hash
+	seed []byte
+}
+
+func (this *seededHash) Reset() {
+	this.Hash.Reset()
+	this.Hash.Write(this.seed)
+}
+
+// seededStateHash passes the state marshaling of resumable merges on
+type seededStateHash struct {
+	*seededHash
+}
+
+func (this *seededStateHash) MarshalBinary() ([]byte, error) {
+	return this.Hash.(encoding.BinaryMarshaler).MarshalBinary()
+}
+
+func (this *seededStateHash) UnmarshalBinary(b []byte) error {
+	um, ok := this.Hash.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return errors.New("hash state not support")
+	}
+	return um.UnmarshalBinary(b)
+}
+
+// RandomSeed returns a random non zero checksum seed
+func RandomSeed() (uint32, error) {
+	b := make([]byte, 4)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return 0, err
+		}
+		if v, err := touint32(b); err != nil || v != 0 {
+			return v, err
+		}
+	}
+}
+
+// frames queued for an asyncHash before Write waits
+const asyncHashDepth = 16
+
+// asyncHash hashes the data written to it in a goroutine, Write copies the data and returns so the
+// caller writes the next frame while the last one is hashed. Sum and Reset wait for the queue, it
+// is used by one goroutine
+type asyncHash struct {
+	h      hash.Hash
+	ch     chan *[]byte
+	ack    chan struct{}
+	closed bool
+}
+
+func newAsyncHash(h hash.Hash) *asyncHash {
+	ret := &asyncHash{h: h, ch: make(chan *[]byte, asyncHashDepth), ack: make(chan struct{})}
+	go ret.run()
+	return ret
+}
+
+func (this *asyncHash) run() {
+	for pb := range this.ch {
+		if pb == nil {
+			this.ack <- struct{}{}
+			continue
+		}
+		this.h.Write(*pb)
+		putBuffer(pb)
+	}
+}
+
+func (this *asyncHash) Write(p []byte) (int, error) {
+	pb := getBuffer(len(p))
+	copy(*pb, p)
+	this.ch <- pb
+	return len(p), nil
+}
+
+// wait returns once the queued data is hashed
+func (this *asyncHash) wait() {
+	if this.closed {
+		return
+	}
+	this.ch <- nil
+	<-this.ack
+}
+
+// hash waits for the queue and returns the hash of the data written
+func (this *asyncHash) hash() hash.Hash {
+	this.wait()
+	return this.h
+}
+
+func (this *asyncHash) Sum(b []byte) []byte {
+	return this.hash().Sum(b)
+}
+
+func (this *asyncHash) Reset() {
+	this.hash().Reset()
+}
+
+func (this *asyncHash) Size() int {
+	return this.h.Size()
+}
+
+func (this *asyncHash) BlockSize() int {
+	return this.h.BlockSize()
+}
+
+// close hashes the queued data and ends the goroutine, the hash stays readable
+func (this *asyncHash) close() {
+	if this.closed {
+		return
+	}
+	this.wait()
+	this.closed = true
+	close(this.ch)
+}
@@ -0,0 +1,184 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBLAKE3Hasher(t *testing.T) {
+	sum := strongSum(BLAKE3Hasher, []byte{})
+	if hex.EncodeToString(sum) != "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262" {
+		t.Error("blake3 sum error")
+	}
+}
+
+func TestStrongHasherSync(t *testing.T) {
+	basis := bytes.Repeat([]byte("strong hash basis data "), 300)
+	src := append([]byte("head "), basis[100:]...)
+	for _, sh := range []StrongHasher{MD5Hasher, SHA256Hasher, BLAKE3Hasher} {
+		hi, err := GetReaderHashInfo(bytes.NewReader(basis), nil, 256, sh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := hi.ToBuffer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := NewHashInfoWithBuf(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig.Strong != sh.ID() || !HashInfoEqual(hi, sig) {
+			t.Fatal(sh.Name(), "signature read error")
+		}
+		delta := &bytes.Buffer{}
+		if err := Delta(sig, bytes.NewReader(src), delta); err != nil {
+			t.Fatal(err)
+		}
+		out := &bytes.Buffer{}
+		if err := Patch(bytes.NewReader(basis), delta, out); err != nil {
+			t.Fatal(sh.Name(), err)
+		}
+		if !bytes.Equal(out.Bytes(), src) {
+			t.Error(sh.Name(), "patch result error")
+		}
+	}
+}
+
+func TestSeededHasher(t *testing.T) {
+	if SeededHasher(MD5Hasher, 0) != MD5Hasher {
+		t.Fatal("seed 0 changed the hasher")
+	}
+	dat := []byte("seeded block")
+	a := strongSum(SeededHasher(SHA256Hasher, 1), dat)
+	b := strongSum(SeededHasher(SHA256Hasher, 2), dat)
+	if bytes.Equal(a, b) || bytes.Equal(a, strongSum(SHA256Hasher, dat)) {
+		t.Fatal("seed not mixed")
+	}
+	h := SeededHasher(SHA256Hasher, 1).New()
+	h.Write([]byte("other"))
+	h.Reset()
+	h.Write(dat)
+	if !bytes.Equal(h.Sum(nil), a) {
+		t.Fatal("reset dropped the seed")
+	}
+	//resumable merges restore the running state
+	h.Reset()
+	h.Write(dat[:4])
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2 := SeededHasher(SHA256Hasher, 1).New()
+	if err := h2.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		t.Fatal(err)
+	}
+	h2.Write(dat[4:])
+	if !bytes.Equal(h2.Sum(nil), a) {
+		t.Fatal("restored state error")
+	}
+}
+
+func TestSeededDelta(t *testing.T) {
+	basis := make([]byte, DefaultBlockSize*20+5)
+	rand.New(rand.NewSource(7)).Read(basis)
+	src := append(append([]byte{}, basis[:DefaultBlockSize*5]...), basis[DefaultBlockSize*6:]...)
+	fh := NewFileHashInfo("")
+	seed, err := RandomSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Seed = seed
+	if err := fh.fill(context.Background(), bytes.NewReader(basis), nil); err != nil {
+		t.Fatal(err)
+	}
+	sig := fh.GetHashInfo()
+	buf, err := sig.ToBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := NewHashInfoWithBuf(buf)
+	if err != nil || got.Seed != fh.Seed || !HashInfoEqual(got, sig) {
+		t.Fatal("seed not kept", err)
+	}
+	unseeded, err := GetReaderHashInfo(bytes.NewReader(basis), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(unseeded.Blocks[0].H3, sig.Blocks[0].H3) {
+		t.Fatal("block hash not seeded")
+	}
+	if unseeded.Blocks[0].H1 == sig.Blocks[0].H1 && unseeded.Blocks[0].H2 == sig.Blocks[0].H2 {
+		t.Fatal("weak sum not seeded")
+	}
+	delta := &bytes.Buffer{}
+	if err := Delta(sig, bytes.NewReader(src), delta); err != nil {
+		t.Fatal(err)
+	}
+	rp, err := Compare(sig, bytes.NewReader(src))
+	if err != nil || rp.Blocks != 20 {
+		t.Fatal("seeded match error", err)
+	}
+	out := &bytes.Buffer{}
+	if err := Patch(bytes.NewReader(basis), delta, out); err != nil || !bytes.Equal(out.Bytes(), src) {
+		t.Fatal("seeded patch error", err)
+	}
+}
+
+func TestAsyncHash(t *testing.T) {
+	dat := make([]byte, 1<<20)
+	rand.New(rand.NewSource(11)).Read(dat)
+	want := MD5Hasher.New()
+	ah := newAsyncHash(MD5Hasher.New())
+	buf := make([]byte, 1000)
+	for off := 0; off < len(dat); off += len(buf) {
+		n := copy(buf, dat[off:])
+		want.Write(buf[:n])
+		ah.Write(buf[:n])
+		//the caller reuses its buffer at once
+		rand.Read(buf)
+	}
+	if !bytes.Equal(ah.Sum(nil), want.Sum(nil)) {
+		t.Error("async hash error")
+	}
+	ah.Write([]byte("more"))
+	want.Write([]byte("more"))
+	ah.close()
+	if !bytes.Equal(ah.Sum(nil), want.Sum(nil)) || ah.Size() != want.Size() {
+		t.Error("closed async hash error")
+	}
+	ah.close()
+	//merges of many frames
+	dir := t.TempDir()
+	file := filepath.Join(dir, "f.bin")
+	basis := dat[:len(dat)/2]
+	if err := os.WriteFile(file, basis, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := GetFileHashInfo(file, nil, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := append(bytes.Clone(dat[len(dat)/2:]), basis...)
+	m := NewFileMerger(file, sig, WithWorkers(2))
+	if !m.AsyncHash {
+		t.Fatal("workers don't set async hash")
+	}
+	if err := m.Open(); err != nil {
+		t.Fatal(err)
+	}
+	err = analyseReader(sig, bytes.NewReader(src), m.Write)
+	m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(file); !bytes.Equal(got, src) {
+		t.Error("async merge error")
+	}
+}
@@ -0,0 +1,72 @@
+package rsync
+
+// Hooks observe the frames of a delta while it is made or merged, nil callbacks are skipped
+type Hooks struct {
+	//a basis block of size bytes at basisOff is copied to output offset off
+	OnBlockMatched func(path string, off int64, basisOff int64, size int)
+	//data is sent or written as literal at output offset off
+	OnLiteral func(path string, off int64, data []byte)
+	//the close frame, size is the output size and hash its strong hash
+	OnFileComplete func(path string, size int64, hash []byte)
+}
+
+// frame fires the events of info, off is the output offset and moves past the frame
+func (this *Hooks) frame(path string, off *int64, blockSize int64, info *AnalyseInfo) {
+	if this == nil {
+		return
+	}
+	if info.IsData() {
+		if this.OnLiteral != nil {
+			this.OnLiteral(path, *off, info.Data)
+		}
+		*off += int64(len(info.Data))
+	}
+	if info.IsIndex() {
+		size := blockSize
+		if info.IsShort() {
+			size = int64(info.Len)
+		}
+		if this.OnBlockMatched != nil {
+			this.OnBlockMatched(path, *off, info.Off, int(size))
+		}
+		*off += size
+	}
+	if info.IsClose() && this.OnFileComplete != nil {
+		this.OnFileComplete(path, *off, info.Hash)
+	}
+}
+
+// observe returns fn firing the events of the frames it passes on
+func (this *Hooks) observe(path string, fn func(info *AnalyseInfo) error) func(info *AnalyseInfo) error {
+	if this == nil {
+		return fn
+	}
+	off := int64(0)
+	blockSize := int64(0)
+	return func(info *AnalyseInfo) error {
+		if info.IsOpen() {
+			blockSize = int64(info.BlockSize)
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+		this.frame(path, &off, blockSize, info)
+		return nil
+	}
+}
+
+// onComplete is a copy of this also calling fn with the close frame
+func (this *Hooks) onComplete(fn func(path string, size int64, hash []byte)) *Hooks {
+	h := &Hooks{}
+	if this != nil {
+		*h = *this
+	}
+	prev := h.OnFileComplete
+	h.OnFileComplete = func(path string, size int64, hash []byte) {
+		if prev != nil {
+			prev(path, size, hash)
+		}
+		fn(path, size, hash)
+	}
+	return h
+}
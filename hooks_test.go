@@ -0,0 +1,87 @@
+package rsync
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type hookCounter struct {
+	matched  int
+	literal  int64
+	complete int64
+	next     int64
+}
+
+func (this *hookCounter) hooks(t *testing.T) *Hooks {
+	return &Hooks{
+		OnBlockMatched: func(path string, off int64, basisOff int64, size int) {
+			if off != this.next {
+				t.Error("matched offset error", off, this.next)
+			}
+			this.next += int64(size)
+			this.matched++
+		},
+		OnLiteral: func(path string, off int64, data []byte) {
+			if off != this.next {
+				t.Error("literal offset error", off, this.next)
+			}
+			this.next += int64(len(data))
+			this.literal += int64(len(data))
+		},
+		OnFileComplete: func(path string, size int64, hash []byte) {
+			this.complete = size
+		},
+	}
+}
+
+func TestHooks(t *testing.T) {
+	dir := t.TempDir()
+	basis := make([]byte, DefaultBlockSize*10+7)
+	rand.New(rand.NewSource(6)).Read(basis)
+	src := append([]byte("prefix"), basis...)
+	bfile, sfile := filepath.Join(dir, "basis"), filepath.Join(dir, "src")
+	os.WriteFile(bfile, basis, 0644)
+	os.WriteFile(sfile, src, 0644)
+	sig, err := GetFileHashInfo(bfile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send, recv := &hookCounter{}, &hookCounter{}
+	fh := NewFileHashInfo(sfile, sig, send.hooks(t))
+	if err := fh.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	m := NewFileMerger(bfile, sig)
+	m.Hooks = recv.hooks(t)
+	if err := m.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fh.Analyse(m.Write); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*hookCounter{send, recv} {
+		if c.matched != 11 || c.literal != 6 || c.complete != int64(len(src)) {
+			t.Error("hook counts error", c)
+		}
+	}
+}
+
+func TestDirSyncerHooks(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	testWriteFiles(t, src, map[string]string{"a.txt": "aaaa", "b.txt": "bb"})
+	s := NewDirSyncer(src, NewLocalStore(dst), "out")
+	done := map[string]int64{}
+	s.Hooks = &Hooks{OnFileComplete: func(path string, size int64, hash []byte) {
+		done[path] = size
+	}}
+	if err := s.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 2 || done["out/a.txt"] != 4 || done["out/b.txt"] != 2 {
+		t.Error("dir hooks error", done)
+	}
+}
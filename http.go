@@ -0,0 +1,221 @@
+package rsync
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// HTTPHandler serves Store over http, GET path returns the signature and PUT path applies the delta body.
+// It has no access control of its own, set Authorize or mount it behind an auth middleware
+type HTTPHandler struct {
+	Store *LocalStore
+	//checks each request before it is served, an error answers 403, nil serves everyone
+	Authorize func(req *http.Request) error
+}
+
+func NewHTTPHandler(root string) *HTTPHandler {
+	return &HTTPHandler{Store: NewLocalStore(root)}
+}
+
+// httpFrameOverhead is the most bytes a frame takes besides its literal data
+const httpFrameOverhead = MaxFrameSize - MaxLiteralSize
+
+// maxDeltaSize is the largest delta body of a file up to size, the file sent as data frames with
+// the open and close frames, matched blocks take fewer bytes than their literal data
+func maxDeltaSize(size int64) int64 {
+	return size + (size/MaxLiteralSize+3)*httpFrameOverhead
+}
+
+// httpStatus is the status of a failed request, bad requests are 4xx so clients don't retry them
+// and failures of the server 5xx
+func httpStatus(err error) int {
+	var me *http.MaxBytesError
+	var fe *FrameError
+	switch {
+	case errors.As(err, &me), errors.Is(err, ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, ErrBusy):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, syscall.ENOSPC):
+		return http.StatusInsufficientStorage
+	case errors.As(err, &fe), errors.Is(err, fs.ErrInvalid), errors.Is(err, ErrMalformed), errors.Is(err, ErrBadMagic),
+		errors.Is(err, ErrUnsupportedVersion), errors.Is(err, ErrStateOrder), errors.Is(err, ErrNoSignature),
+		errors.Is(err, ErrShortBlock), errors.Is(err, ErrAlgorithmMismatch), errors.Is(err, ErrHashMismatch):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func (this *HTTPHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if this.Authorize != nil {
+		if err := this.Authorize(req); err != nil {
+			http.Error(res, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	switch req.Method {
+	case http.MethodGet:
+		hi, err := this.Store.Signature(req.Context(), path)
+		if err != nil {
+			http.Error(res, err.Error(), httpStatus(err))
+			return
+		}
+		res.Header().Set("Content-Type", "application/octet-stream")
+		hi.WriteTo(res)
+	case http.MethodPut:
+		body := req.Body
+		if this.Store.MaxFileSize > 0 {
+			body = http.MaxBytesReader(res, body, maxDeltaSize(this.Store.MaxFileSize))
+		}
+		if err := this.Store.Apply(req.Context(), path, body); err != nil {
+			http.Error(res, err.Error(), httpStatus(err))
+			return
+		}
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		res.Header().Set("Allow", "GET, PUT")
+		http.Error(res, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HTTPClient is the Transport for an HTTPHandler mounted at URL
+type HTTPClient struct {
+	URL       string
+	Client    *http.Client
+	Retries   int           //extra attempts for failed idempotent requests
+	RetryWait time.Duration //wait before the first retry, doubled after each
+	Limit     *Limiter      //throttles the delta upload
+}
+
+// NewHTTPClient uses tlsConfig for https urls when not nil
+func NewHTTPClient(base string, tlsConfig *tls.Config) *HTTPClient {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConfig
+	//a hung server fails the request, the body upload is not bounded
+	tr.ResponseHeaderTimeout = DefaultIOTimeout
+	return &HTTPClient{
+		URL:       strings.TrimSuffix(base, "/"),
+		Client:    &http.Client{Transport: tr},
+		Retries:   3,
+		RetryWait: time.Second / 2,
+	}
+}
+
+// HTTPStatusError is a non 2xx response
+type HTTPStatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (this *HTTPStatusError) Error() string {
+	return fmt.Sprintf("http status %d: %s", this.StatusCode, this.Message)
+}
+
+func (this *HTTPClient) fileURL(path string) string {
+	return this.URL + "/" + (&url.URL{Path: strings.TrimPrefix(path, "/")}).EscapedPath()
+}
+
+// server errors and broken connections are retried, client errors and bad data are not
+func retryable(err error) bool {
+	return !permanent(err)
+}
+
+// retry runs fn up to Retries+1 times while it fails with a retryable error
+func (this *HTTPClient) retry(ctx context.Context, fn func() error) error {
+	p := &RetryPolicy{Retries: this.Retries, Wait: this.RetryWait, Retryable: retryable}
+	return p.Do(ctx, fn)
+}
+
+func (this *HTTPClient) do(req *http.Request) (*http.Response, error) {
+	res, err := this.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, &HTTPStatusError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	return res, nil
+}
+
+func (this *HTTPClient) Signature(ctx context.Context, path string) (*HashInfo, error) {
+	var hi *HashInfo
+	err := this.retry(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, this.fileURL(path), nil)
+		if err != nil {
+			return err
+		}
+		res, err := this.do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		hi = NewHashInfo()
+		_, err = hi.ReadFrom(res.Body)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hi, nil
+}
+
+// Apply streams delta as the request body, it is retried only when delta can seek back
+func (this *HTTPClient) Apply(ctx context.Context, path string, delta io.Reader) error {
+	apply := func() error {
+		var body io.Reader = delta
+		if this.Limit != nil {
+			body = NewLimitReader(ctx, delta, this.Limit)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, this.fileURL(path), io.NopCloser(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		res, err := this.do(req)
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+	rs, ok := delta.(io.ReadSeeker)
+	if !ok {
+		return apply()
+	}
+	return this.retry(ctx, func() error {
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return apply()
+	})
+}
+
+// Sync pushes src to path, the whole signature and delta exchange is retried
+func (this *HTTPClient) Sync(ctx context.Context, src io.ReadSeeker, path string) error {
+	return this.retry(ctx, func() error {
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return Push(ctx, this, src, path)
+	})
+}
+
+func (this *HTTPClient) Close() error {
+	this.Client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,128 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPTransport(t *testing.T) {
+	root := t.TempDir()
+	fails := int32(1)
+	h := NewHTTPHandler(root)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		//first request fails to exercise retries
+		if atomic.AddInt32(&fails, -1) >= 0 {
+			http.Error(res, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(res, req)
+	}))
+	defer ts.Close()
+	c := NewHTTPClient(ts.URL+"/", ts.Client().Transport.(*http.Transport).TLSClientConfig)
+	c.RetryWait = time.Millisecond
+	defer c.Close()
+	ctx := context.Background()
+	dat := make([]byte, DefaultBlockSize*6+5)
+	rand.New(rand.NewSource(1)).Read(dat)
+	if err := c.Sync(ctx, bytes.NewReader(dat), "dir/a b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	dat[100] ^= 1
+	if err := c.Sync(ctx, bytes.NewReader(dat), "dir/a b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(root, "dir", "a b.txt"))
+	if err != nil || !bytes.Equal(got, dat) {
+		t.Fatal("remote file error", err)
+	}
+	//client errors are not retried
+	err = c.Sync(ctx, bytes.NewReader(dat), "../x")
+	if se, ok := err.(*HTTPStatusError); !ok || se.StatusCode != http.StatusBadRequest {
+		t.Error("status error expected", err)
+	}
+}
+
+func TestHTTPHandlerStatus(t *testing.T) {
+	root := t.TempDir()
+	h := NewHTTPHandler(root)
+	h.Store.MaxFileSize = 1000
+	h.Authorize = func(req *http.Request) error {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			return errors.New("not authorized")
+		}
+		return nil
+	}
+	serve := func(method string, path string, body []byte, auth bool) int {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if auth {
+			req.Header.Set("Authorization", "Bearer secret")
+		}
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		return res.Code
+	}
+	if code := serve(http.MethodGet, "/a.txt", nil, false); code != http.StatusForbidden {
+		t.Error("unauthorized request", code)
+	}
+	if code := serve(http.MethodGet, "/a.txt", nil, true); code != http.StatusOK {
+		t.Error("authorized request", code)
+	}
+	delta := func(dat []byte) []byte {
+		out := &bytes.Buffer{}
+		if err := Delta(NewHashInfo(), bytes.NewReader(dat), out); err != nil {
+			t.Fatal(err)
+		}
+		return out.Bytes()
+	}
+	if code := serve(http.MethodPut, "/a.txt", delta([]byte("hello")), true); code != http.StatusNoContent {
+		t.Error("put", code)
+	}
+	//bad requests are not retried, server failures are
+	if code := serve(http.MethodPut, "/a.txt", []byte("not a delta"), true); code != http.StatusBadRequest {
+		t.Error("malformed delta", code)
+	}
+	if code := serve(http.MethodPut, "/..%2Fx", delta([]byte("hello")), true); code != http.StatusBadRequest {
+		t.Error("bad path", code)
+	}
+	if code := serve(http.MethodPut, "/b.txt", delta(make([]byte, 2000)), true); code != http.StatusRequestEntityTooLarge {
+		t.Error("large file", code)
+	}
+	if err := os.WriteFile(filepath.Join(root, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(http.MethodPut, "/file/a.txt", delta([]byte("hello")), true); code != http.StatusInternalServerError {
+		t.Error("server failure", code)
+	}
+	//the body is cut past the largest delta of MaxFileSize
+	body := &bytes.Buffer{}
+	frames := 0
+	var info AnalyseInfo
+	r := bytes.NewReader(delta([]byte("hello")))
+	for info.Read(r) == nil {
+		if info.IsOpen() {
+			frames++
+			if err := info.Write(body); err != nil {
+				t.Fatal(err)
+			}
+			data := &AnalyseInfo{Type: AnalyseTypeData, Data: make([]byte, 100)}
+			for body.Len() < int(maxDeltaSize(1000)) {
+				data.Write(body)
+			}
+		}
+	}
+	if frames != 1 {
+		t.Fatal("open frame missing")
+	}
+	if code := serve(http.MethodPut, "/c.txt", body.Bytes(), true); code != http.StatusRequestEntityTooLarge {
+		t.Error("large body", code)
+	}
+}
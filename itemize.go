@@ -0,0 +1,116 @@
+package rsync
+
+import (
+	"os"
+	"strings"
+)
+
+// item change kinds
+const (
+	ItemSkipped  = 0 //left as it is
+	ItemNew      = 1 //created on the destination
+	ItemChanged  = 2 //content sent, or a link pointed elsewhere
+	ItemMetadata = 3 //same content, the mtime or permissions updated
+	ItemDeleted  = 4 //removed from the destination
+)
+
+// itemKinds are the names of the item change kinds
+var itemKinds = []string{"skipped", "new", "changed", "metadata", "deleted"}
+
+// ItemChange is the change record of one entry, like a line of rsync -i, the flags
+// compare the source with the destination entry and are unset without one
+type ItemChange struct {
+	Path    string
+	Kind    int
+	Mode    os.FileMode //of the source, zero for deleted entries the destination didn't list
+	Link    string      //symlink target or the path of the hard linked file
+	Hard    bool        //Link is a hard link
+	Size    bool        //the sizes differ
+	Time    bool        //the mtimes differ
+	Perms   bool        //the permissions differ
+	Literal int64       //literal bytes sent
+}
+
+// newItemChange compares v with its entry in dst, missing entries and entries of another type are new
+func newItemChange(v FileEntry, dst map[string]FileEntry) ItemChange {
+	it := ItemChange{Path: v.Path, Mode: v.Mode, Link: v.Link}
+	if dst == nil {
+		return it
+	}
+	d, ok := dst[v.Path]
+	if !ok || d.Mode.Type() != v.Mode.Type() {
+		it.Kind = ItemNew
+		return it
+	}
+	it.Size = d.Size != v.Size
+	it.Time = !v.ModTime.IsZero() && d.ModTime.Unix() != v.ModTime.Unix()
+	it.Perms = d.Mode.Perm() != v.Mode.Perm()
+	return it
+}
+
+// KindName is the name of Kind, "skipped", "new", "changed", "metadata" or "deleted"
+func (this ItemChange) KindName() string {
+	if this.Kind < 0 || this.Kind >= len(itemKinds) {
+		return "unknown"
+	}
+	return itemKinds[this.Kind]
+}
+
+// skipped is a copy of this left as it is
+func (this ItemChange) skipped() ItemChange {
+	this.Kind = ItemSkipped
+	return this
+}
+
+// String formats this as rsync -i does, the update type, the file type and the
+// cstpoguax attributes before the path, rsync only prints the ones not skipped
+func (this ItemChange) String() string {
+	if this.Kind == ItemDeleted {
+		return "*deleting   " + this.Path
+	}
+	typ := "f"
+	if this.Mode.IsDir() {
+		typ = "d"
+	} else if this.Mode&os.ModeSymlink != 0 {
+		typ = "L"
+	}
+	update := "."
+	switch {
+	case this.Kind == ItemSkipped || this.Kind == ItemMetadata:
+	case this.Hard:
+		update = "h"
+	case typ != "f":
+		//made on the destination without data
+		update = "c"
+	default:
+		update = ">"
+	}
+	attrs := []byte(strings.Repeat(" ", 9))
+	switch this.Kind {
+	case ItemNew:
+		attrs = []byte(strings.Repeat("+", 9))
+	case ItemChanged, ItemMetadata:
+		attrs = []byte(strings.Repeat(".", 9))
+		for i, set := range []bool{this.Kind == ItemChanged, this.Size, this.Time, this.Perms} {
+			if set {
+				attrs[i] = "cstp"[i]
+			}
+		}
+	}
+	line := update + typ + string(attrs) + " " + this.Path
+	if this.Link != "" {
+		sep := " -> "
+		if this.Hard {
+			sep = " => "
+		}
+		line += sep + this.Link
+	}
+	return line
+}
+
+// item calls OnItem with it
+func (this *DirSyncer) item(it ItemChange) {
+	if this.OnItem != nil {
+		this.OnItem(it)
+	}
+}
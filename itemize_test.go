@@ -0,0 +1,54 @@
+package rsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestItemChange(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	testWriteFiles(t, src, map[string]string{"new.txt": "new", "changed.txt": "hello world", "meta.txt": "meta", "same.txt": "same"})
+	testWriteFiles(t, dst, map[string]string{"changed.txt": "hello", "meta.txt": "meta", "same.txt": "same", "gone.txt": "gone"})
+	if err := os.Symlink("new.txt", filepath.Join(src, "l.txt")); err != nil {
+		t.Skip(err)
+	}
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, root := range []string{src, dst} {
+		os.Chtimes(filepath.Join(root, "same.txt"), mtime, mtime)
+	}
+	os.Chtimes(filepath.Join(src, "meta.txt"), mtime, mtime)
+	s := NewDirSyncer(src, NewLocalStore(dst), "")
+	s.Delete = true
+	items := map[string]ItemChange{}
+	s.OnItem = func(item ItemChange) {
+		items[item.Path] = item
+	}
+	if err := s.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"new.txt":     ">f+++++++++ new.txt",
+		"changed.txt": ">fcs....... changed.txt",
+		"meta.txt":    ".f..t...... meta.txt",
+		"same.txt":    ".f          same.txt",
+		"l.txt":       "cL+++++++++ l.txt -> new.txt",
+		"gone.txt":    "*deleting   gone.txt",
+	}
+	if len(items) != len(want) {
+		t.Error("items error", items)
+	}
+	for p, line := range want {
+		if got := items[p].String(); got != line {
+			t.Errorf("item %s: %q want %q", p, got, line)
+		}
+	}
+	if it := items["changed.txt"]; it.Kind != ItemChanged || it.Literal == 0 {
+		t.Error("changed item error", it)
+	}
+	if items["meta.txt"].Kind != ItemMetadata || items["gone.txt"].Kind != ItemDeleted {
+		t.Error("item kinds error", items)
+	}
+}
@@ -0,0 +1,465 @@
+package rsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/md4"
+)
+
+// librsync/rdiff file magics
+const (
+	LibrsyncDeltaMagic       = 0x72730236
+	LibrsyncMD4SigMagic      = 0x72730136
+	LibrsyncBLAKE2SigMagic   = 0x72730137
+	LibrsyncRkMD4SigMagic    = 0x72730146
+	LibrsyncRkBLAKE2SigMagic = 0x72730147
+)
+
+// librsync hash ids, the strong id low bits are the truncated sum length
+const (
+	WeakRollsum          = 3
+	WeakRabinKarp        = 4
+	StrongLibrsyncMD4    = 0x40 //0x41-0x50 md4 truncated to 1-16 bytes
+	StrongLibrsyncBLAKE2 = 0x60 //0x61-0x80 blake2b truncated to 1-32 bytes
+)
+
+// librsync delta commands
+const (
+	librsyncOpEnd       = 0x00
+	librsyncOpLiteral64 = 0x40
+	librsyncOpLiteralN1 = 0x41
+	librsyncOpCopyN1N1  = 0x45
+	librsyncOpCopyN8N8  = 0x54
+)
+
+var (
+	RollsumHasher WeakHasher = &weakHasher{
+		id:   WeakRollsum,
+		name: "rollsum",
+		fn: func() RollingHash {
+			return &rollsum{}
+		},
+	}
+	RabinKarpHasher WeakHasher = &weakHasher{
+		id:   WeakRabinKarp,
+		name: "rabinkarp",
+		fn: func() RollingHash {
+			return newRabinKarp()
+		},
+	}
+)
+
+func init() {
+	RegisterWeakHasher(RollsumHasher)
+	RegisterWeakHasher(RabinKarpHasher)
+	for i := 1; i <= md4.Size; i++ {
+		RegisterStrongHasher(newTruncHasher(StrongLibrsyncMD4, "md4", i, md4.New))
+	}
+	for i := 1; i <= blake2b.Size256; i++ {
+		RegisterStrongHasher(newTruncHasher(StrongLibrsyncBLAKE2, "blake2b", i, func() hash.Hash {
+			h, _ := blake2b.New256(nil)
+			return h
+		}))
+	}
+}
+
+type truncHash struct {
+	hash.Hash
+	n int
+}
+
+func (this *truncHash) Sum(b []byte) []byte {
+	return append(b, this.Hash.Sum(nil)[:this.n]...)
+}
+
+func (this *truncHash) Size() int {
+	return this.n
+}
+
+func newTruncHasher(base uint8, name string, n int, fn func() hash.Hash) StrongHasher {
+	return &strongHasher{
+		id:   base + uint8(n),
+		name: fmt.Sprintf("%s-%d", name, n),
+		size: n,
+		fn: func() hash.Hash {
+			return &truncHash{Hash: fn(), n: n}
+		},
+	}
+}
+
+// librsync rollsum, adler32 like without modulo and with a char offset
+const rollsumCharOffset = 31
+
+type rollsum struct {
+	s1 uint16
+	s2 uint16
+	n  uint32
+}
+
+func (this *rollsum) Reset() {
+	this.s1 = 0
+	this.s2 = 0
+	this.n = 0
+}
+
+func (this *rollsum) Write(p []byte) (int, error) {
+	for _, c := range p {
+		this.s1 += uint16(c) + rollsumCharOffset
+		this.s2 += this.s1
+	}
+	this.n += uint32(len(p))
+	return len(p), nil
+}
+
+func (this *rollsum) Roll(out, in byte) {
+	this.s1 += uint16(in) - uint16(out)
+	this.s2 += this.s1 - uint16(this.n)*(uint16(out)+rollsumCharOffset)
+}
+
+func (this *rollsum) Sum32() uint32 {
+	return uint32(this.s2)<<16 | uint32(this.s1)
+}
+
+// librsync rabinkarp
+const (
+	rabinKarpSeed = 1
+	rabinKarpMult = 0x08104225
+	rabinKarpAdj  = 0x08104224
+)
+
+type rabinKarp struct {
+	h    uint32
+	mult uint32
+}
+
+func newRabinKarp() *rabinKarp {
+	return &rabinKarp{h: rabinKarpSeed, mult: 1}
+}
+
+func (this *rabinKarp) Reset() {
+	this.h = rabinKarpSeed
+	this.mult = 1
+}
+
+func (this *rabinKarp) Write(p []byte) (int, error) {
+	for _, c := range p {
+		this.h = this.h*rabinKarpMult + uint32(c)
+		this.mult *= rabinKarpMult
+	}
+	return len(p), nil
+}
+
+func (this *rabinKarp) Roll(out, in byte) {
+	this.h = this.h*rabinKarpMult + uint32(in) - this.mult*(uint32(out)+rabinKarpAdj)
+}
+
+func (this *rabinKarp) Sum32() uint32 {
+	return this.h
+}
+
+func librsyncHashers(magic uint32, strongLen int) (WeakHasher, StrongHasher, error) {
+	var weak WeakHasher
+	var base uint8
+	var max int
+	switch magic {
+	case LibrsyncMD4SigMagic:
+		weak, base, max = RollsumHasher, StrongLibrsyncMD4, md4.Size
+	case LibrsyncBLAKE2SigMagic:
+		weak, base, max = RollsumHasher, StrongLibrsyncBLAKE2, blake2b.Size256
+	case LibrsyncRkMD4SigMagic:
+		weak, base, max = RabinKarpHasher, StrongLibrsyncMD4, md4.Size
+	case LibrsyncRkBLAKE2SigMagic:
+		weak, base, max = RabinKarpHasher, StrongLibrsyncBLAKE2, blake2b.Size256
+	default:
+		return nil, nil, fmt.Errorf("%w: librsync signature %#x", ErrBadMagic, magic)
+	}
+	if strongLen == 0 {
+		strongLen = max
+	}
+	if strongLen < 0 || strongLen > max {
+		return nil, nil, fmt.Errorf("librsync strong length %d error", strongLen)
+	}
+	strong, err := GetStrongHasher(base + uint8(strongLen))
+	if err != nil {
+		return nil, nil, err
+	}
+	return weak, strong, nil
+}
+
+// WriteLibrsyncSignature writes the rdiff signature of r to w,
+// strongLen 0 keeps the full strong sum
+func WriteLibrsyncSignature(r io.Reader, w io.Writer, magic uint32, blockLen int, strongLen int) error {
+	weak, strong, err := librsyncHashers(magic, strongLen)
+	if err != nil {
+		return err
+	}
+	if blockLen <= 0 {
+		return errors.New("block size error")
+	}
+	bw := bufio.NewWriter(w)
+	b4 := make([]byte, 4)
+	for _, v := range []uint32{magic, uint32(blockLen), uint32(strong.Size())} {
+		binary.BigEndian.PutUint32(b4, v)
+		if _, err := bw.Write(b4); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, blockLen)
+	for {
+		num, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		binary.BigEndian.PutUint32(b4, weakSum(weak, buf[:num]))
+		if _, err := bw.Write(b4); err != nil {
+			return err
+		}
+		if _, err := bw.Write(strongSum(strong, buf[:num])); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadLibrsyncSignature reads an rdiff signature into a HashInfo usable by Analyse,
+// the whole file hash is unknown and block sizes over 65535 are not supported
+func ReadLibrsyncSignature(r io.Reader) (*HashInfo, error) {
+	hdr := make([]byte, 12)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	magic := binary.BigEndian.Uint32(hdr[0:])
+	blockLen := binary.BigEndian.Uint32(hdr[4:])
+	strongLen := binary.BigEndian.Uint32(hdr[8:])
+	if blockLen == 0 || blockLen > 0xFFFF {
+		return nil, fmt.Errorf("librsync block length %d not support", blockLen)
+	}
+	if strongLen == 0 {
+		return nil, errors.New("librsync strong length error")
+	}
+	weak, strong, err := librsyncHashers(magic, int(strongLen))
+	if err != nil {
+		return nil, err
+	}
+	hi := NewHashInfo()
+	hi.BlockSize = uint16(blockLen)
+	hi.Strong = strong.ID()
+	hi.Weak = weak.ID()
+	b4 := make([]byte, 4)
+	for i := uint32(0); ; i++ {
+		if _, err := io.ReadFull(r, b4); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		h := binary.BigEndian.Uint32(b4)
+		hb := HashBlock{
+			Idx: i,
+			Off: uint64(i) * uint64(blockLen),
+			H1:  uint16(h & 0xFFFF),
+			H2:  uint16((h >> 16) & 0xFFFF),
+			H3:  make([]byte, strongLen),
+		}
+		if _, err := io.ReadFull(r, hb.H3); err != nil {
+			return nil, err
+		}
+		hi.Blocks = append(hi.Blocks, hb)
+	}
+	return hi, nil
+}
+
+// LibrsyncDeltaWriter converts delta frames into an rdiff delta stream,
+// contiguous block matches are merged into one copy command
+type LibrsyncDeltaWriter struct {
+	W         *bufio.Writer
+	BlockSize int64
+	copyOff   int64
+	copyLen   int64
+}
+
+func NewLibrsyncDeltaWriter(w io.Writer) *LibrsyncDeltaWriter {
+	return &LibrsyncDeltaWriter{
+		W: bufio.NewWriter(w),
+	}
+}
+
+// smallest of 1 2 4 8 bytes, returns the width index
+func librsyncIntLen(v uint64) int {
+	switch {
+	case v <= 0xFF:
+		return 0
+	case v <= 0xFFFF:
+		return 1
+	case v <= 0xFFFFFFFF:
+		return 2
+	default:
+		return 3
+	}
+}
+
+func (this *LibrsyncDeltaWriter) writeInt(v uint64, width int) error {
+	b8 := make([]byte, 8)
+	binary.BigEndian.PutUint64(b8, v)
+	_, err := this.W.Write(b8[8-(1<<width):])
+	return err
+}
+
+func (this *LibrsyncDeltaWriter) flushCopy() error {
+	if this.copyLen == 0 {
+		return nil
+	}
+	ow := librsyncIntLen(uint64(this.copyOff))
+	lw := librsyncIntLen(uint64(this.copyLen))
+	if err := this.W.WriteByte(byte(librsyncOpCopyN1N1 + ow*4 + lw)); err != nil {
+		return err
+	}
+	if err := this.writeInt(uint64(this.copyOff), ow); err != nil {
+		return err
+	}
+	if err := this.writeInt(uint64(this.copyLen), lw); err != nil {
+		return err
+	}
+	this.copyLen = 0
+	return nil
+}
+
+func (this *LibrsyncDeltaWriter) literal(dat []byte) error {
+	if len(dat) == 0 {
+		return nil
+	}
+	if err := this.flushCopy(); err != nil {
+		return err
+	}
+	if len(dat) <= librsyncOpLiteral64 {
+		if err := this.W.WriteByte(byte(len(dat))); err != nil {
+			return err
+		}
+	} else {
+		lw := librsyncIntLen(uint64(len(dat)))
+		if err := this.W.WriteByte(byte(librsyncOpLiteralN1 + lw)); err != nil {
+			return err
+		}
+		if err := this.writeInt(uint64(len(dat)), lw); err != nil {
+			return err
+		}
+	}
+	_, err := this.W.Write(dat)
+	return err
+}
+
+func (this *LibrsyncDeltaWriter) Write(info *AnalyseInfo) error {
+	if info.IsOpen() {
+		this.BlockSize = int64(info.BlockSize)
+		b4 := make([]byte, 4)
+		binary.BigEndian.PutUint32(b4, LibrsyncDeltaMagic)
+		if _, err := this.W.Write(b4); err != nil {
+			return err
+		}
+	}
+	if info.IsData() {
+		if err := this.literal(info.Data); err != nil {
+			return err
+		}
+	}
+	if info.IsIndex() {
+		size := this.BlockSize
+		if info.IsShort() {
+			size = int64(info.Len)
+		}
+		if this.copyLen > 0 && this.copyOff+this.copyLen != info.Off {
+			if err := this.flushCopy(); err != nil {
+				return err
+			}
+		}
+		if this.copyLen == 0 {
+			this.copyOff = info.Off
+		}
+		this.copyLen += size
+	}
+	if info.IsClose() {
+		if err := this.flushCopy(); err != nil {
+			return err
+		}
+		if err := this.W.WriteByte(librsyncOpEnd); err != nil {
+			return err
+		}
+		return this.W.Flush()
+	}
+	return nil
+}
+
+// LibrsyncDelta compares r with the basis described by sig and writes an rdiff delta to w
+func LibrsyncDelta(sig *HashInfo, r io.Reader, w io.Writer) error {
+	dw := NewLibrsyncDeltaWriter(w)
+	return analyseReader(sig, r, dw.Write)
+}
+
+// LibrsyncPatch applies an rdiff delta to basis and writes the rebuilt file to out
+func LibrsyncPatch(basis io.ReaderAt, delta io.Reader, out io.Writer) error {
+	br := bufio.NewReader(delta)
+	b8 := make([]byte, 8)
+	readInt := func(width int) (uint64, error) {
+		n := 1 << width
+		for i := 0; i < 8-n; i++ {
+			b8[i] = 0
+		}
+		if _, err := io.ReadFull(br, b8[8-n:]); err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint64(b8), nil
+	}
+	if _, err := io.ReadFull(br, b8[:4]); err != nil {
+		return err
+	}
+	if magic := binary.BigEndian.Uint32(b8); magic != LibrsyncDeltaMagic {
+		return fmt.Errorf("%w: librsync delta %#x", ErrBadMagic, magic)
+	}
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch {
+		case op == librsyncOpEnd:
+			return nil
+		case op <= librsyncOpLiteral64 || op < librsyncOpCopyN1N1:
+			size := uint64(op)
+			if op > librsyncOpLiteral64 {
+				if size, err = readInt(int(op - librsyncOpLiteralN1)); err != nil {
+					return err
+				}
+			}
+			if num, err := io.CopyN(out, br, int64(size)); err != nil {
+				return err
+			} else if num != int64(size) {
+				return io.ErrUnexpectedEOF
+			}
+		case op <= librsyncOpCopyN8N8:
+			off, err := readInt(int(op-librsyncOpCopyN1N1) / 4)
+			if err != nil {
+				return err
+			}
+			size, err := readInt(int(op-librsyncOpCopyN1N1) % 4)
+			if err != nil {
+				return err
+			}
+			sr := io.NewSectionReader(basis, int64(off), int64(size))
+			if num, err := io.Copy(out, sr); err != nil {
+				return err
+			} else if num != int64(size) {
+				return io.ErrUnexpectedEOF
+			}
+		default:
+			return fmt.Errorf("librsync delta command %#x not support", op)
+		}
+	}
+}
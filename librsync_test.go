@@ -0,0 +1,63 @@
+package rsync
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestLibrsyncRollsum(t *testing.T) {
+	//s1 = 3*31 + 'a' + 'b' + 'c', s2 = 3*128 + 2*129 + 130
+	if v := weakSum(RollsumHasher, []byte("abc")); v != 772<<16|387 {
+		t.Error("rollsum error", v)
+	}
+	dat := make([]byte, 2000)
+	rand.New(rand.NewSource(6)).Read(dat)
+	for _, wh := range []WeakHasher{RollsumHasher, RabinKarpHasher} {
+		h := wh.New()
+		h.Write(dat[:100])
+		for i := 100; i < len(dat); i++ {
+			h.Roll(dat[i-100], dat[i])
+			if h.Sum32() != weakSum(wh, dat[i-99:i+1]) {
+				t.Fatal(wh.Name(), "roll error at", i)
+			}
+		}
+	}
+}
+
+func TestLibrsyncSync(t *testing.T) {
+	rnd := rand.New(rand.NewSource(7))
+	basis := make([]byte, 5000)
+	rnd.Read(basis)
+	src := append([]byte{}, basis[:1000]...)
+	src = append(src, []byte("changed")...)
+	src = append(src, basis[1500:]...)
+	magics := []uint32{LibrsyncMD4SigMagic, LibrsyncBLAKE2SigMagic, LibrsyncRkMD4SigMagic, LibrsyncRkBLAKE2SigMagic}
+	for _, magic := range magics {
+		sig := &bytes.Buffer{}
+		if err := WriteLibrsyncSignature(bytes.NewReader(basis), sig, magic, 256, 8); err != nil {
+			t.Fatal(err)
+		}
+		if sig.Len() != 12+(5000+255)/256*12 {
+			t.Fatal("signature size error", sig.Len())
+		}
+		hi, err := ReadLibrsyncSignature(sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delta := &bytes.Buffer{}
+		if err := LibrsyncDelta(hi, bytes.NewReader(src), delta); err != nil {
+			t.Fatal(err)
+		}
+		if delta.Len() > 1000 {
+			t.Errorf("%#x delta too large %d", magic, delta.Len())
+		}
+		out := &bytes.Buffer{}
+		if err := LibrsyncPatch(bytes.NewReader(basis), delta, out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), src) {
+			t.Errorf("%#x patch result error", magic)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package rsync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+)
+
+// Logger receives the log lines of the library
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// DefaultLogger is used by objects without their own Logger
+var DefaultLogger Logger = log.Default()
+
+// DiscardLogger drops everything, set DefaultLogger to it to silence the library
+var DiscardLogger Logger = log.New(io.Discard, "", 0)
+
+// slogLogger writes the lines to a slog.Logger
+type slogLogger struct {
+	l     *slog.Logger
+	level slog.Level
+}
+
+func (this *slogLogger) Printf(format string, v ...interface{}) {
+	this.l.Log(context.Background(), this.level, fmt.Sprintf(format, v...))
+}
+
+// NewSlogLogger routes the library lines to l at level
+func NewSlogLogger(l *slog.Logger, level slog.Level) Logger {
+	return &slogLogger{l: l, level: level}
+}
+
+// logf writes to l or DefaultLogger when l is nil
+func logf(l Logger, format string, v ...interface{}) {
+	if l == nil {
+		l = DefaultLogger
+	}
+	if l != nil {
+		l.Printf(format, v...)
+	}
+}
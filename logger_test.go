@@ -0,0 +1,55 @@
+package rsync
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testLogger struct {
+	lines []string
+}
+
+func (this *testLogger) Printf(format string, v ...interface{}) {
+	this.lines = append(this.lines, fmt.Sprintf(format, v...))
+}
+
+func TestMergerLogger(t *testing.T) {
+	sig, err := Signature(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewFileMerger(filepath.Join(t.TempDir(), "f.txt"), sig)
+	l := &testLogger{}
+	m.Logger = l
+	if err := m.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.Write(&AnalyseInfo{Type: AnalyseTypeOpen, Strong: StrongMD5})
+	if err := m.Write(&AnalyseInfo{Type: AnalyseTypeClose, Hash: []byte("bad")}); err == nil {
+		t.Fatal("hash error expected")
+	}
+	if len(l.lines) != 1 || !strings.Contains(l.lines[0], "not match") {
+		t.Error("logger error", l.lines)
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewSlogLogger(slog.New(slog.NewTextHandler(buf, nil)), slog.LevelWarn)
+	logf(l, "merge %s", "x")
+	if !strings.Contains(buf.String(), "level=WARN msg=\"merge x\"") {
+		t.Error("slog error", buf.String())
+	}
+	old := DefaultLogger
+	DefaultLogger = l
+	defer func() { DefaultLogger = old }()
+	logf(nil, "default")
+	if !strings.Contains(buf.String(), "default") {
+		t.Error("default logger error")
+	}
+}
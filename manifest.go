@@ -0,0 +1,222 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const ManifestMagic = "RSMF"
+
+// manifest entry flags
+const (
+	manifestFlagSig = 1 << 0
+)
+
+// ManifestEntry describes one regular file of a dir
+type ManifestEntry struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Mode    os.FileMode
+	MD5     []byte    //md5 of the whole file, unseeded
+	Sig     *HashInfo //nil when not kept
+}
+
+// Manifest lists the regular files of a dir with their hashes, a DirSyncer given the manifest
+// of its destination only compares the blocks of files whose size or hash differ
+type Manifest struct {
+	Entries []ManifestEntry //sorted by path when built by NewManifest
+	index   map[string]int
+}
+
+// NewManifest hashes the regular files under root kept by f, sigs also keeps their signatures
+// made with opts as for NewFileHashInfo
+func NewManifest(ctx context.Context, root string, f *Filter, sigs bool, opts ...interface{}) (*Manifest, error) {
+	list, err := listDir(ctx, root, f, SymlinkSkip, false)
+	if err != nil {
+		return nil, err
+	}
+	ret := &Manifest{Entries: []ManifestEntry{}}
+	for _, v := range list {
+		if !v.IsRegular() {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		e := ManifestEntry{Path: v.Path, Size: v.Size, ModTime: v.ModTime, Mode: v.Mode}
+		file := filepath.Join(root, filepath.FromSlash(v.Path))
+		if e.MD5, err = fileMD5(file); err != nil {
+			return nil, err
+		}
+		if sigs {
+			if e.Sig, err = GetFileHashInfo(file, nil, opts...); err != nil {
+				return nil, fmt.Errorf("manifest %s: %w", v.Path, err)
+			}
+		}
+		ret.Add(e)
+	}
+	return ret, nil
+}
+
+// fileMD5 is the md5 of the file content
+func fileMD5(file string) ([]byte, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return readerMD5(fd)
+}
+
+func readerMD5(r io.Reader) ([]byte, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Add appends e, a later entry of the same path replaces the earlier one in Lookup
+func (this *Manifest) Add(e ManifestEntry) {
+	this.Entries = append(this.Entries, e)
+	if this.index != nil {
+		this.index[e.Path] = len(this.Entries) - 1
+	}
+}
+
+// Lookup returns the entry of path
+func (this *Manifest) Lookup(path string) (*ManifestEntry, bool) {
+	if this.index == nil {
+		this.index = make(map[string]int, len(this.Entries))
+		for i, v := range this.Entries {
+			this.index[v.Path] = i
+		}
+	}
+	i, ok := this.index[path]
+	if !ok {
+		return nil, false
+	}
+	return &this.Entries[i], true
+}
+
+// Write header count(4) and every entry as
+//
+//	path len(2) path size(8) mtime ns(8) mode(4) md5(16) flags(1) [signature when sig]
+func (this *Manifest) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if err := writeHeader(bw, ManifestMagic); err != nil {
+		return err
+	}
+	bw.Write(tobyte32(uint32(len(this.Entries))))
+	for _, v := range this.Entries {
+		if len(v.Path) > 0xFFFF {
+			return fmt.Errorf("manifest path %s too long", v.Path)
+		}
+		if len(v.MD5) != md5.Size {
+			return fmt.Errorf("manifest %s md5 size %d error", v.Path, len(v.MD5))
+		}
+		bw.Write(tobyte16(uint16(len(v.Path))))
+		bw.WriteString(v.Path)
+		bw.Write(tobyte64(uint64(v.Size)))
+		bw.Write(tobyte64(uint64(v.ModTime.UnixNano())))
+		bw.Write(tobyte32(uint32(v.Mode)))
+		bw.Write(v.MD5)
+		flags := byte(0)
+		if v.Sig != nil && v.Sig.MD5 != nil {
+			flags |= manifestFlagSig
+		}
+		if err := bw.WriteByte(flags); err != nil {
+			return err
+		}
+		if flags&manifestFlagSig != 0 {
+			if err := v.Sig.Write(bw); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// Read replaces the entries with the manifest read from r, it never reads past its end
+func (this *Manifest) Read(r io.Reader) error {
+	if err := readHeader(r, ManifestMagic); err != nil {
+		return err
+	}
+	b4 := make([]byte, 4)
+	if _, err := io.ReadFull(r, b4); err != nil {
+		return noEOF(err)
+	}
+	num, err := touint32(b4)
+	if err != nil {
+		return err
+	}
+	this.Entries = []ManifestEntry{}
+	this.index = nil
+	fixed := make([]byte, 8+8+4+md5.Size+1)
+	for i := uint32(0); i < num; i++ {
+		e := ManifestEntry{}
+		if e.Path, err = readString16(r); err != nil {
+			return fmt.Errorf("read manifest: %w", noEOF(err))
+		}
+		if _, err := io.ReadFull(r, fixed); err != nil {
+			return fmt.Errorf("manifest %s: %w", e.Path, noEOF(err))
+		}
+		if e.Size, err = toint64(fixed[:8]); err != nil {
+			return err
+		}
+		mtime, err := touint64(fixed[8:16])
+		if err != nil {
+			return err
+		}
+		e.ModTime = time.Unix(0, int64(mtime))
+		mode, err := touint32(fixed[16:20])
+		if err != nil {
+			return err
+		}
+		e.Mode = os.FileMode(mode)
+		e.MD5 = bytes.Clone(fixed[20 : 20+md5.Size])
+		flags := fixed[len(fixed)-1]
+		if flags&^manifestFlagSig != 0 {
+			return fmt.Errorf("%w: manifest %s flags %x", ErrMalformed, e.Path, flags)
+		}
+		if flags&manifestFlagSig != 0 {
+			e.Sig = NewHashInfo()
+			if err := e.Sig.Read(r); err != nil {
+				return fmt.Errorf("manifest %s: %w", e.Path, noEOF(err))
+			}
+		}
+		this.Entries = append(this.Entries, e)
+	}
+	return nil
+}
+
+func NewManifestWithBuf(r io.Reader) (*Manifest, error) {
+	m := &Manifest{}
+	return m, m.Read(r)
+}
+
+// manifestSame reports whether the source file v has the size and md5 of the manifest entry,
+// the md5 is only read when the sizes match
+func (this *DirSyncer) manifestSame(e *ManifestEntry, v FileEntry) (bool, error) {
+	if e.Size != v.Size {
+		return false, nil
+	}
+	fd, err := this.openSrc(v.Path)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+	sum, err := readerMD5(fd)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(sum, e.MD5), nil
+}
@@ -0,0 +1,52 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	ctx := context.Background()
+	big := strings.Repeat("manifest data ", 1000)
+	src, dst := t.TempDir(), t.TempDir()
+	testWriteFiles(t, dst, map[string]string{"same.txt": big, "changed.txt": big, "gone.txt": "gone"})
+	testWriteFiles(t, src, map[string]string{"same.txt": big, "changed.txt": big + "tail", "new/a.txt": "new"})
+	m, err := NewManifest(ctx, dst, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := m.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	m, err = NewManifestWithBuf(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Entries) != 3 {
+		t.Fatal("manifest entries error", len(m.Entries))
+	}
+	e, ok := m.Lookup("same.txt")
+	if !ok || e.Size != int64(len(big)) || e.Sig == nil || !e.Mode.IsRegular() {
+		t.Fatal("manifest entry error", e)
+	}
+	s := NewDirSyncer(src, NewLocalStore(dst), "")
+	s.Manifest = m
+	if err := s.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, dst, map[string]string{"same.txt": big, "changed.txt": big + "tail", "new/a.txt": "new"})
+	//same.txt is skipped and the kept signature of changed.txt is used
+	if s.Stats.Files != 2 || s.Stats.SignatureSize != 0 || s.Stats.Matched == 0 {
+		t.Error("manifest sync stats error", s.Stats.String())
+	}
+	//a cut manifest fails
+	dat := buf.Bytes()
+	if _, err := NewManifestWithBuf(bytes.NewReader(dat[:len(dat)-3])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("cut manifest error", err)
+	}
+}
@@ -0,0 +1,144 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// StreamMerger merges delta frames like FileMerger into any output, blocks are read from Basis and
+// the rebuilt file is written to Out in order or at its offsets to OutAt. There is no temp file or
+// rename, a failed merge leaves what was written. Deltas rebuild the file from its start to its end,
+// so Out may be a pure stream like stdout, a pipe or a socket feeding tar or a compressor, an Out
+// with a Flush method is flushed once the file hash matched
+type StreamMerger struct {
+	Basis  io.ReaderAt
+	Out    io.Writer
+	OutAt  io.WriterAt //used when Out is nil
+	Path   string      //names the file in errors and hooks
+	Hooks  *Hooks      //observe the merged frames
+	Size   int64       //the file size of the open frame
+	Meta   *FileMeta   //of the open frame
+	Frames int64       //frames merged
+	hash   hash.Hash
+	bs     int64
+	comp   uint8
+	off    int64 //output offset
+	done   bool
+}
+
+func NewStreamMerger(basis io.ReaderAt, out io.Writer) *StreamMerger {
+	return &StreamMerger{Basis: basis, Out: out}
+}
+
+// NewStreamMergerAt writes to out at the file offsets, for block devices and preallocated buffers
+func NewStreamMergerAt(basis io.ReaderAt, out io.WriterAt) *StreamMerger {
+	return &StreamMerger{Basis: basis, OutAt: out}
+}
+
+// Offset is the output size written so far
+func (this *StreamMerger) Offset() int64 {
+	return this.off
+}
+
+// Done reports whether the close frame was merged and the file hash matched
+func (this *StreamMerger) Done() bool {
+	return this.done
+}
+
+// write puts b at the output offset into the file hash and the output
+func (this *StreamMerger) write(b []byte) error {
+	this.hash.Write(b)
+	var err error
+	if this.Out != nil {
+		_, err = this.Out.Write(b)
+	} else {
+		_, err = this.OutAt.WriteAt(b, this.off)
+	}
+	this.off += int64(len(b))
+	return err
+}
+
+// Write merges one frame, failures are *FrameError
+func (this *StreamMerger) Write(info *AnalyseInfo) error {
+	off := this.off
+	if err := this.merge(info); err != nil {
+		return newFrameError(this.Path, off, info, err)
+	}
+	this.Frames++
+	this.Hooks.frame(this.Path, &off, this.bs, info)
+	return nil
+}
+
+func (this *StreamMerger) merge(info *AnalyseInfo) error {
+	if this.done {
+		return fmt.Errorf("%w: frame after close", ErrStateOrder)
+	}
+	if info.IsOpen() {
+		if this.hash != nil {
+			return fmt.Errorf("%w: open frame repeated", ErrStateOrder)
+		}
+		if this.Out == nil && this.OutAt == nil {
+			return errors.New("output nil")
+		}
+		sh, err := GetStrongHasher(info.Strong)
+		if err != nil {
+			return err
+		}
+		this.hash = SeededHasher(sh, info.Seed).New()
+		this.bs = int64(info.BlockSize)
+		this.comp = info.Compress
+		this.Size = info.Off
+		this.Meta = info.Meta
+	}
+	if this.hash == nil {
+		return fmt.Errorf("%w: frame before open", ErrStateOrder)
+	}
+	if info.IsData() {
+		if err := info.DecompressData(this.comp); err != nil {
+			return err
+		}
+		if err := this.write(info.Data); err != nil {
+			return err
+		}
+	}
+	if info.IsIndex() {
+		if this.bs == 0 {
+			return errors.New("block size error")
+		}
+		if this.Basis == nil {
+			return errors.New("basis nil")
+		}
+		size := this.bs
+		if info.IsShort() {
+			size = int64(info.Len)
+		}
+		pb := getBuffer(int(size))
+		defer putBuffer(pb)
+		b := (*pb)[:size]
+		n, err := this.Basis.ReadAt(b, info.Off)
+		if n < len(b) {
+			if err == nil || err == io.EOF {
+				err = ErrShortBlock
+			}
+			return err
+		}
+		if err := this.write(b); err != nil {
+			return err
+		}
+	}
+	if info.IsClose() {
+		if !bytes.Equal(this.hash.Sum(nil), info.Hash) {
+			return ErrHashMismatch
+		}
+		if f, ok := this.Out.(interface{ Flush() error }); ok {
+			if err := f.Flush(); err != nil {
+				return err
+			}
+		}
+		this.done = true
+	}
+	return nil
+}
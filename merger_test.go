@@ -0,0 +1,101 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// testWriterAt is an in memory io.WriterAt
+type testWriterAt struct {
+	b []byte
+}
+
+func (this *testWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(this.b) {
+		this.b = append(this.b, make([]byte, end-len(this.b))...)
+	}
+	return copy(this.b[off:], p), nil
+}
+
+func TestStreamMerger(t *testing.T) {
+	rnd := rand.New(rand.NewSource(7))
+	basis := make([]byte, DefaultBlockSize*30+10)
+	rnd.Read(basis)
+	src := append([]byte("head"), basis[DefaultBlockSize*5:]...)
+	sig, err := Signature(bytes.NewReader(basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := &bytes.Buffer{}
+	if err := Delta(sig, bytes.NewReader(src), delta); err != nil {
+		t.Fatal(err)
+	}
+	out := &testWriterAt{}
+	if err := PatchAt(bytes.NewReader(basis), bytes.NewReader(delta.Bytes()), out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.b, src) {
+		t.Fatal("patch at error")
+	}
+	matched := int64(0)
+	buf := &bytes.Buffer{}
+	m := NewStreamMerger(bytes.NewReader(basis), buf)
+	m.Hooks = &Hooks{OnBlockMatched: func(path string, off int64, basisOff int64, size int) {
+		matched += int64(size)
+	}}
+	if err := mergeFrames(m, bytes.NewReader(delta.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Done() || m.Offset() != int64(len(src)) || m.Size != int64(len(src)) || !bytes.Equal(buf.Bytes(), src) {
+		t.Fatal("stream merge error")
+	}
+	if matched != int64(len(basis)-DefaultBlockSize*5) {
+		t.Error("hooks error", matched)
+	}
+	if err := m.Write(&AnalyseInfo{Type: AnalyseTypeData, Data: []byte("x")}); !errors.Is(err, ErrStateOrder) {
+		t.Error("frame after close error", err)
+	}
+	//blocks past the end of a shorter basis
+	m = NewStreamMerger(bytes.NewReader(basis[:DefaultBlockSize*10]), &bytes.Buffer{})
+	err = mergeFrames(m, bytes.NewReader(delta.Bytes()))
+	var fe *FrameError
+	if !errors.Is(err, ErrShortBlock) || !errors.As(err, &fe) {
+		t.Error("short basis error", err)
+	}
+}
+
+func TestStreamMergerPipe(t *testing.T) {
+	rnd := rand.New(rand.NewSource(14))
+	basis := make([]byte, DefaultBlockSize*40)
+	rnd.Read(basis)
+	src := append(append([]byte{}, basis[DefaultBlockSize*3:]...), "tail"...)
+	sig, err := Signature(bytes.NewReader(basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := &bytes.Buffer{}
+	if err := Delta(sig, bytes.NewReader(src), delta); err != nil {
+		t.Fatal(err)
+	}
+	//a pipe can't seek, the reader gets the file in order
+	pr, pw := io.Pipe()
+	got := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(pr)
+		got <- b
+	}()
+	bw := bufio.NewWriterSize(pw, 1<<20)
+	err = Patch(bytes.NewReader(basis), delta, bw)
+	//flushed at the close frame
+	if bw.Buffered() != 0 {
+		t.Error("stream not flushed")
+	}
+	pw.CloseWithError(err)
+	if b := <-got; err != nil || !bytes.Equal(b, src) {
+		t.Error("pipe merge error", err)
+	}
+}
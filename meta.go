@@ -0,0 +1,92 @@
+package rsync
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// FileMeta is the file metadata carried in the open frame and applied to the merged file
+type FileMeta struct {
+	Mode    os.FileMode //permission bits
+	ModTime time.Time
+	Uid     int //-1 unknown
+	Gid     int //-1 unknown
+}
+
+// NewFileMeta takes the metadata of fi, owner ids are known on unix only
+func NewFileMeta(fi os.FileInfo) *FileMeta {
+	uid, gid := fileOwner(fi)
+	return &FileMeta{
+		Mode:    fi.Mode().Perm(),
+		ModTime: fi.ModTime(),
+		Uid:     uid,
+		Gid:     gid,
+	}
+}
+
+func metaID(v int) uint32 {
+	if v < 0 {
+		return 0xFFFFFFFF
+	}
+	return uint32(v)
+}
+
+func metaInt(v uint32) int {
+	if v == 0xFFFFFFFF {
+		return -1
+	}
+	return int(v)
+}
+
+// Write mode(4) mtime ns(8) uid(4) gid(4)
+func (this *FileMeta) Write(w io.Writer) error {
+	buf := make([]byte, 0, 20)
+	buf = append(buf, tobyte32(uint32(this.Mode.Perm()))...)
+	buf = append(buf, tobyte64(uint64(this.ModTime.UnixNano()))...)
+	buf = append(buf, tobyte32(metaID(this.Uid))...)
+	buf = append(buf, tobyte32(metaID(this.Gid))...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func (this *FileMeta) Read(r io.Reader) error {
+	buf := make([]byte, 20)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	mode, err := touint32(buf[:4])
+	if err != nil {
+		return err
+	}
+	mtime, err := touint64(buf[4:12])
+	if err != nil {
+		return err
+	}
+	uid, err := touint32(buf[12:16])
+	if err != nil {
+		return err
+	}
+	gid, err := touint32(buf[16:])
+	if err != nil {
+		return err
+	}
+	this.Mode = os.FileMode(mode).Perm()
+	this.ModTime = time.Unix(0, int64(mtime))
+	this.Uid = metaInt(uid)
+	this.Gid = metaInt(gid)
+	return nil
+}
+
+// Apply sets mode and mtime of file, owner too when set and known
+func (this *FileMeta) Apply(file string, owner bool) error {
+	if owner && this.Uid >= 0 && this.Gid >= 0 {
+		if err := os.Lchown(file, this.Uid, this.Gid); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(file, this.Mode.Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(file, this.ModTime, this.ModTime)
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package rsync
+
+import "os"
+
+func fileOwner(fi os.FileInfo) (int, int) {
+	return -1, -1
+}
+
+func fileInode(fi os.FileInfo) (uint64, uint64, bool) {
+	return 0, 0, false
+}
+
+func fileNlink(fi os.FileInfo) uint64 {
+	return 1
+}
+
+// syncDir is not supported, dirs can't be opened for sync
+func syncDir(dir string) error {
+	return nil
+}
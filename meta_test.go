@@ -0,0 +1,80 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileMetaFrame(t *testing.T) {
+	mt := time.Unix(1600000000, 123456789)
+	info := &AnalyseInfo{
+		Type:   AnalyseTypeOpen | AnalyseTypeMeta,
+		Off:    10,
+		Strong: StrongMD5,
+		Meta:   &FileMeta{Mode: 0640, ModTime: mt, Uid: 1000, Gid: -1},
+	}
+	buf := &bytes.Buffer{}
+	if err := info.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	got := &AnalyseInfo{}
+	if err := got.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got.Meta == nil || *got.Meta != (FileMeta{Mode: 0640, ModTime: mt, Uid: 1000, Gid: -1}) {
+		t.Error("meta frame error", got.Meta)
+	}
+	b, err := info.MarshalProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = &AnalyseInfo{}
+	if err := got.UnmarshalProto(b); err != nil {
+		t.Fatal(err)
+	}
+	if got.Meta == nil || !got.Meta.ModTime.Equal(mt) || got.Meta.Mode != 0640 || got.Meta.Gid != -1 {
+		t.Error("meta proto error", got.Meta)
+	}
+	info.Meta = nil
+	if err := info.Write(buf); err == nil {
+		t.Error("meta nil error expected")
+	}
+}
+
+func TestPushFileMeta(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	file := filepath.Join(src, "a.sh")
+	if err := os.WriteFile(file, bytes.Repeat([]byte("echo\n"), 1000), 0750); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(file, 0750)
+	mt := time.Unix(1500000000, 0)
+	if err := os.Chtimes(file, mt, mt); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if err := Push(context.Background(), NewLocalStore(dst), fd, "a.sh"); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(dst, "a.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0750 || !fi.ModTime().Equal(mt) {
+		t.Error("file meta error", fi.Mode(), fi.ModTime())
+	}
+}
+
+func TestSyncDir(t *testing.T) {
+	if err := syncDir(t.TempDir()); err != nil {
+		t.Error(err)
+	}
+}
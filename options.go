@@ -0,0 +1,144 @@
+package rsync
+
+import "io/fs"
+
+// Option configures NewFileHashInfo, NewFileMerger and NewLocalStore,
+// options that don't apply to a constructor are ignored
+type Option func(o *options)
+
+type options struct {
+	blockSize      uint16
+	info           *HashInfo
+	strong         StrongHasher
+	weak           WeakHasher
+	dups           *DupPolicy
+	hooks          *Hooks
+	workers        int
+	fillCheckpoint string
+	fsys           fs.FS
+	maxLiteral     int
+	basis          string
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithBlockSize sets the signature block size
+func WithBlockSize(n uint16) Option {
+	return func(o *options) {
+		o.blockSize = n
+	}
+}
+
+// WithSignature sets the basis signature, block size and hashes are taken from it
+func WithSignature(hi *HashInfo) Option {
+	return func(o *options) {
+		o.info = hi
+	}
+}
+
+// WithStrongHash sets the block and file hash
+func WithStrongHash(h StrongHasher) Option {
+	return func(o *options) {
+		o.strong = h
+	}
+}
+
+// WithWeakHash sets the rolling hash
+func WithWeakHash(h WeakHasher) Option {
+	return func(o *options) {
+		o.weak = h
+	}
+}
+
+// WithDups sets the handling of blocks equal to an earlier block
+func WithDups(p DupPolicy) Option {
+	return func(o *options) {
+		o.dups = &p
+	}
+}
+
+// WithHooks sets the frame observers
+func WithHooks(h *Hooks) Option {
+	return func(o *options) {
+		o.hooks = h
+	}
+}
+
+// WithWorkers sets the goroutines hashing signature blocks, 1 when n < 1
+func WithWorkers(n int) Option {
+	return func(o *options) {
+		o.workers = n
+	}
+}
+
+// WithFillCheckpoint keeps the signature fill progress in path, see FileHashInfo.Checkpoint
+func WithFillCheckpoint(path string) Option {
+	return func(o *options) {
+		o.fillCheckpoint = path
+	}
+}
+
+// WithFS opens the file paths in fsys instead of the OS filesystem
+func WithFS(fsys fs.FS) Option {
+	return func(o *options) {
+		o.fsys = fsys
+	}
+}
+
+// WithMaxLiteral coalesces literal data into frames up to n bytes, see FileHashInfo.MaxLiteral
+func WithMaxLiteral(n int) Option {
+	return func(o *options) {
+		o.maxLiteral = n
+	}
+}
+
+// WithBasis reads the merge basis blocks from path, the merged file goes to the merger path
+func WithBasis(path string) Option {
+	return func(o *options) {
+		o.basis = path
+	}
+}
+
+// apply sets the options given, the signature first
+func (this *FileHashInfo) apply(o *options) {
+	if o.info != nil {
+		this.Info = o.info
+		this.BlockSize = o.info.BlockSize
+		this.Hasher, _ = o.info.Hasher()
+		this.Seed = o.info.Seed
+		this.Weak, _ = o.info.WeakHasher()
+	}
+	if o.blockSize > 0 {
+		this.BlockSize = o.blockSize
+	}
+	if o.strong != nil {
+		this.Hasher = o.strong
+	}
+	if o.weak != nil {
+		this.Weak = o.weak
+	}
+	if o.dups != nil {
+		this.Dups = *o.dups
+	}
+	if o.hooks != nil {
+		this.Hooks = o.hooks
+	}
+	if o.workers > 0 {
+		this.Workers = o.workers
+	}
+	if o.fillCheckpoint != "" {
+		this.Checkpoint = o.fillCheckpoint
+	}
+	if o.fsys != nil {
+		this.FS = o.fsys
+	}
+	if o.maxLiteral > 0 {
+		this.MaxLiteral = o.maxLiteral
+	}
+}
@@ -0,0 +1,96 @@
+package rsync
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOptions(t *testing.T) {
+	hooks := &Hooks{}
+	fh := NewFileHashInfo("", WithBlockSize(512), WithStrongHash(SHA256Hasher), WithDups(DupKeepAll), WithHooks(hooks))
+	if fh.BlockSize != 512 || fh.Hasher != SHA256Hasher || fh.Dups != DupKeepAll || fh.Hooks != hooks {
+		t.Error("options not applied")
+	}
+	sig, err := Signature(bytes.NewReader([]byte("options test data")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig.Seed = 7
+	//later args override earlier ones, options mix with the older args
+	fh = NewFileHashInfo("", 256, WithSignature(sig))
+	if fh.Info != sig || fh.BlockSize != sig.BlockSize || fh.Seed != 7 {
+		t.Error("signature option error")
+	}
+	if fh = NewFileHashInfo("", WithSignature(sig), 256); fh.BlockSize != 256 {
+		t.Error("block size arg error")
+	}
+	m := NewFileMerger("f.bin", sig, WithBlockSize(128), WithHooks(hooks))
+	if m.BlockSize != 128 || m.Hooks != hooks {
+		t.Error("merger options error")
+	}
+	if ls := NewLocalStore("dir", WithWorkers(3), WithHooks(hooks)); ls.Workers != 3 || ls.Hooks != hooks {
+		t.Error("local store options error")
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	r := rand.New(rand.NewSource(8))
+	for _, size := range []int{0, 100, 1024 * 16, 1024*200 + 33} {
+		dat := make([]byte, size)
+		r.Read(dat)
+		//duplicates across hash rounds
+		if size > 1024*100 {
+			copy(dat[1024*90:], dat[:1024*5])
+		}
+		a, err := GetReaderHashInfo(bytes.NewReader(dat), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := GetReaderHashInfo(bytes.NewReader(dat), nil, WithWorkers(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !HashInfoEqual(a, b) || len(a.Blocks) != len(b.Blocks) {
+			t.Error("workers signature differs", size)
+		}
+	}
+}
+
+func TestMergerBasis(t *testing.T) {
+	dir := t.TempDir()
+	basis := make([]byte, DefaultBlockSize*20+9)
+	rand.New(rand.NewSource(15)).Read(basis)
+	copyPath := filepath.Join(dir, "copy.bin")
+	if err := os.WriteFile(copyPath, basis, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := GetFileHashInfo(copyPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := append(append([]byte{}, basis[DefaultBlockSize*2:]...), "new"...)
+	//rebuilt into a new dir, the blocks come from the existing copy
+	out := filepath.Join(dir, "out", "new.bin")
+	os.MkdirAll(filepath.Dir(out), 0755)
+	m := NewFileMerger(out, sig, WithBasis(copyPath))
+	if m.Basis != copyPath {
+		t.Fatal("basis option error")
+	}
+	if err := m.Open(); err != nil {
+		t.Fatal(err)
+	}
+	err = analyseReader(sig, bytes.NewReader(src), m.Write)
+	m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, src) {
+		t.Error("output error")
+	}
+	if got, _ := os.ReadFile(copyPath); !bytes.Equal(got, basis) {
+		t.Error("basis changed")
+	}
+}
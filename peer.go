@@ -0,0 +1,62 @@
+package rsync
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+)
+
+// Peer is the client of a server request, stores find it with PeerFrom
+type Peer struct {
+	Addr string //client ip, the address without port for other networks
+	User string //common name of the verified tls client certificate, empty without one
+}
+
+type peerKey struct{}
+
+func withPeer(ctx context.Context, p *Peer) context.Context {
+	return context.WithValue(ctx, peerKey{}, p)
+}
+
+// PeerFrom is the client of the request ctx, nil outside servers
+func PeerFrom(ctx context.Context) *Peer {
+	p, _ := ctx.Value(peerKey{}).(*Peer)
+	return p
+}
+
+// peerHost is the address without port
+func peerHost(addr net.Addr) string {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// peerUser is the common name of the verified client certificate
+func peerUser(chains [][]*x509.Certificate) string {
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return ""
+	}
+	return chains[0][0].Subject.CommonName
+}
+
+// peerContext is the request context of conn, tls connections finish their handshake
+// within the handshake timeout to know the client certificate
+func peerContext(conn net.Conn, timeouts Timeouts) (context.Context, error) {
+	p := &Peer{Addr: peerHost(conn.RemoteAddr())}
+	if tc, ok := conn.(*tls.Conn); ok {
+		ctx := context.Background()
+		if d := timeouts.handshake(); d > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		p.User = peerUser(tc.ConnectionState().VerifiedChains)
+	}
+	return withPeer(context.Background(), p), nil
+}
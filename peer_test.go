@@ -0,0 +1,44 @@
+package rsync
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func TestPeerContext(t *testing.T) {
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	ctx, err := peerContext(sc, Timeouts{})
+	if p := PeerFrom(ctx); err != nil || p == nil || p.Addr != "pipe" || p.User != "" {
+		t.Fatal("pipe peer", p, err)
+	}
+	if PeerFrom(context.Background()) != nil {
+		t.Error("local request has a peer")
+	}
+	//the common name of the client certificate is the user
+	sconf, cconf := testTLSConfig(t)
+	d, err := NewDaemon(&DaemonConfig{Modules: []*DaemonModule{
+		{Name: "mine", Path: t.TempDir(), AuthUsers: []string{"localhost"}},
+		{Name: "other", Path: t.TempDir(), AuthUsers: []string{"other"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", sconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+	defer d.Close()
+	c, err := DialTLS(context.Background(), l.Addr().String(), cconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	list, err := c.List(context.Background(), "")
+	if err != nil || len(list) != 1 || list[0].Path != "mine" {
+		t.Error("modules of the user", list, err)
+	}
+}
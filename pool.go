@@ -0,0 +1,41 @@
+package rsync
+
+import (
+	"bytes"
+	"math/bits"
+	"sync"
+)
+
+// buffers by power of two capacity, a buffer taken with getBuffer is owned by the
+// caller until putBuffer, slices of it must not be kept after that
+var bufPools [64]sync.Pool
+
+// getBuffer returns a pooled slice of n bytes
+func getBuffer(n int) *[]byte {
+	c := 0
+	if n > 1 {
+		c = bits.Len(uint(n - 1))
+	}
+	if v, ok := bufPools[c].Get().(*[]byte); ok {
+		*v = (*v)[:n]
+		return v
+	}
+	b := make([]byte, n, 1<<c)
+	return &b
+}
+
+// putBuffer gives a getBuffer slice back to the pool
+func putBuffer(b *[]byte) {
+	c := bits.Len(uint(cap(*b) - 1))
+	if cap(*b) == 0 || cap(*b) != 1<<c {
+		return
+	}
+	bufPools[c].Put(b)
+}
+
+// read-ahead buffers of FileReader
+var readerPool = sync.Pool{
+	New: func() any {
+		return &bytes.Buffer{}
+	},
+}
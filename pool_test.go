@@ -0,0 +1,31 @@
+package rsync
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 1000, 1024, 1025, 1 << 20} {
+		b := getBuffer(n)
+		if len(*b) != n || cap(*b) < n {
+			t.Fatal("buffer size", n, len(*b), cap(*b))
+		}
+		putBuffer(b)
+	}
+	//slices not from the pool are dropped
+	b := make([]byte, 10, 100)
+	putBuffer(&b)
+	fr, err := NewFileReader(bytes.NewReader([]byte("pooled read ahead")), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dat, err := fr.Slice(7, 4); err != nil || string(dat) != "read" {
+		t.Fatal("slice error", err)
+	}
+	fr.Release()
+	fr.Release()
+	if fr.Buf != nil {
+		t.Error("buffer kept after release")
+	}
+}
@@ -0,0 +1,23 @@
+package rsync
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// FALLOC_FL_KEEP_SIZE, the file size stays so appends and resumes see the written size
+const fallocKeepSize = 0x1
+
+// preallocate reserves the disk blocks of a file of size bytes, filesystems without fallocate
+// are left alone
+func preallocate(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EINTR) {
+		return nil
+	}
+	return err
+}
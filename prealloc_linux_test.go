@@ -0,0 +1,14 @@
+package rsync
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocatedSize is the disk space of fi, 0 when unknown
+func allocatedSize(fi os.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return 0
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package rsync
+
+import "os"
+
+// preallocate is not supported, growing the file changes the size merges resume from
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package rsync
+
+import "os"
+
+func allocatedSize(fi os.FileInfo) int64 {
+	return 0
+}
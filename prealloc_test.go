@@ -0,0 +1,56 @@
+package rsync
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+	dir := t.TempDir()
+	fd, err := os.Create(filepath.Join(dir, "a.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if err := preallocate(fd, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the size merges resume from is kept
+	if fi.Size() != 0 {
+		t.Error("preallocate size", fi.Size())
+	}
+	if n := allocatedSize(fi); n > 0 && n < 1<<20 {
+		t.Error("preallocated size", n)
+	}
+	//merges into the preallocated temp file
+	file := filepath.Join(dir, "f.bin")
+	basis := make([]byte, DefaultBlockSize*30)
+	rand.New(rand.NewSource(12)).Read(basis)
+	if err := os.WriteFile(file, basis, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := GetFileHashInfo(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := append(bytes.Repeat([]byte("new"), 5000), basis...)
+	m := NewFileMerger(file, sig)
+	if err := m.Open(); err != nil {
+		t.Fatal(err)
+	}
+	err = analyseReader(sig, bytes.NewReader(src), m.Write)
+	m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(file); !bytes.Equal(got, src) {
+		t.Error("merge error")
+	}
+}
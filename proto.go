@@ -0,0 +1,171 @@
+package rsync
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"rsync/rsyncpb"
+)
+
+// ToProto converts the signature to its protobuf message
+func (this *HashInfo) ToProto() *rsyncpb.HashInfo {
+	m := &rsyncpb.HashInfo{
+		Version:   FormatVersion,
+		BlockSize: uint32(this.BlockSize),
+		Strong:    uint32(this.Strong),
+		Weak:      uint32(this.Weak),
+		Hash:      this.MD5,
+		Blocks:    make([]*rsyncpb.HashBlock, len(this.Blocks)),
+		InPlace:   this.InPlace,
+		Seed:      this.Seed,
+	}
+	for i, v := range this.Blocks {
+		m.Blocks[i] = &rsyncpb.HashBlock{
+			Idx: v.Idx,
+			Off: v.Off,
+			H1:  uint32(v.H1),
+			H2:  uint32(v.H2),
+			H3:  v.H3,
+			Len: uint32(v.Len),
+		}
+	}
+	return m
+}
+
+// FromProto fills the signature from a protobuf message and validates it
+func (this *HashInfo) FromProto(m *rsyncpb.HashInfo) error {
+	if m.Version != FormatVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, m.Version)
+	}
+	this.reset()
+	if m.BlockSize > math.MaxUint16 || m.Strong > math.MaxUint8 || m.Weak > math.MaxUint8 {
+		return fmt.Errorf("hash info field overflow")
+	}
+	this.BlockSize = uint16(m.BlockSize)
+	this.Strong = uint8(m.Strong)
+	this.Weak = uint8(m.Weak)
+	sh, err := this.Hasher()
+	if err != nil {
+		return err
+	}
+	if _, err := this.WeakHasher(); err != nil {
+		return err
+	}
+	if len(m.Hash) != sh.Size() {
+		return fmt.Errorf("file hash size error")
+	}
+	this.MD5 = m.Hash
+	this.InPlace = m.InPlace
+	this.Seed = m.Seed
+	this.Blocks = make([]HashBlock, len(m.Blocks))
+	for i, v := range m.Blocks {
+		if v.H1 > math.MaxUint16 || v.H2 > math.MaxUint16 || v.Len > math.MaxUint16 {
+			return fmt.Errorf("hash block %d field overflow", i)
+		}
+		if len(v.H3) != sh.Size() {
+			return fmt.Errorf("hash block %d strong hash size error", i)
+		}
+		this.Blocks[i] = HashBlock{
+			Idx: v.Idx,
+			Off: v.Off,
+			H1:  uint16(v.H1),
+			H2:  uint16(v.H2),
+			H3:  v.H3,
+			Len: uint16(v.Len),
+		}
+	}
+	return this.validate()
+}
+
+func (this *HashInfo) MarshalProto() ([]byte, error) {
+	return proto.Marshal(this.ToProto())
+}
+
+func (this *HashInfo) UnmarshalProto(b []byte) error {
+	m := &rsyncpb.HashInfo{}
+	if err := proto.Unmarshal(b, m); err != nil {
+		return err
+	}
+	return this.FromProto(m)
+}
+
+// ToProto converts the frame to its protobuf message
+func (this *AnalyseInfo) ToProto() *rsyncpb.AnalyseInfo {
+	m := &rsyncpb.AnalyseInfo{
+		Type:  uint32(this.Type),
+		Index: this.Index,
+		Off:   this.Off,
+		Data:  this.Data,
+		Hash:  this.Hash,
+		Len:   uint32(this.Len),
+	}
+	if this.IsOpen() {
+		m.Version = FormatVersion
+		m.BlockSize = uint32(this.BlockSize)
+		m.Strong = uint32(this.Strong)
+		m.Compress = uint32(this.Compress)
+		m.Seed = this.Seed
+		if this.Meta != nil {
+			m.Meta = &rsyncpb.FileMeta{
+				Mode:  uint32(this.Meta.Mode.Perm()),
+				Mtime: this.Meta.ModTime.UnixNano(),
+				Uid:   int32(this.Meta.Uid),
+				Gid:   int32(this.Meta.Gid),
+			}
+		}
+	}
+	return m
+}
+
+// FromProto fills the frame from a protobuf message and validates it
+func (this *AnalyseInfo) FromProto(m *rsyncpb.AnalyseInfo) error {
+	if m.Type > math.MaxUint8 || m.BlockSize > math.MaxUint16 || m.Len > math.MaxUint16 || m.Strong > math.MaxUint8 || m.Compress > math.MaxUint8 {
+		return fmt.Errorf("analyse info field overflow")
+	}
+	if len(m.Data) > MaxLiteralSize {
+		return fmt.Errorf("analyse info data too large")
+	}
+	*this = AnalyseInfo{
+		Type:      int(m.Type),
+		Index:     m.Index,
+		Off:       m.Off,
+		Data:      m.Data,
+		Hash:      m.Hash,
+		BlockSize: uint16(m.BlockSize),
+		Len:       uint16(m.Len),
+		Strong:    uint8(m.Strong),
+		Compress:  uint8(m.Compress),
+		Seed:      m.Seed,
+	}
+	if this.IsOpen() && m.Version != FormatVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, m.Version)
+	}
+	if this.IsMeta() {
+		if m.Meta == nil {
+			return fmt.Errorf("analyse info meta missing")
+		}
+		this.Meta = &FileMeta{
+			Mode:    os.FileMode(m.Meta.Mode).Perm(),
+			ModTime: time.Unix(0, m.Meta.Mtime),
+			Uid:     int(m.Meta.Uid),
+			Gid:     int(m.Meta.Gid),
+		}
+	}
+	return nil
+}
+
+func (this *AnalyseInfo) MarshalProto() ([]byte, error) {
+	return proto.Marshal(this.ToProto())
+}
+
+func (this *AnalyseInfo) UnmarshalProto(b []byte) error {
+	m := &rsyncpb.AnalyseInfo{}
+	if err := proto.Unmarshal(b, m); err != nil {
+		return err
+	}
+	return this.FromProto(m)
+}
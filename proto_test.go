@@ -0,0 +1,68 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"rsync/rsyncpb"
+)
+
+func TestProtoCodec(t *testing.T) {
+	basis := bytes.Repeat([]byte("protobuf signature "), 200)
+	hi, err := GetReaderHashInfo(bytes.NewReader(basis), nil, 128, SHA256Hasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := hi.MarshalProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hh := NewHashInfo()
+	if err := hh.UnmarshalProto(b); err != nil {
+		t.Fatal(err)
+	}
+	if !HashInfoEqual(hi, hh) || hh.Strong != hi.Strong {
+		t.Fatal("proto signature error")
+	}
+	src := append([]byte("new "), basis...)
+	sf := NewReaderHashInfo(bytes.NewReader(src), int64(len(src)), hh)
+	delta := &bytes.Buffer{}
+	if err := sf.Analyse(func(ai *AnalyseInfo) error {
+		b, err := ai.MarshalProto()
+		if err != nil {
+			return err
+		}
+		info := &AnalyseInfo{}
+		if err := info.UnmarshalProto(b); err != nil {
+			return err
+		}
+		return info.Write(delta)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if err := Patch(bytes.NewReader(basis), delta, out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), src) {
+		t.Error("patch result error")
+	}
+}
+
+func TestProtoMalformed(t *testing.T) {
+	hi, err := GetReaderHashInfo(bytes.NewReader(bytes.Repeat([]byte("malformed "), 100)), nil, 128, SHA256Hasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, bad := range map[string]func(m *rsyncpb.HashInfo){
+		"zero block size": func(m *rsyncpb.HashInfo) { m.BlockSize = 0 },
+		"block length":    func(m *rsyncpb.HashInfo) { m.Blocks[len(m.Blocks)-1].Len = 129 },
+	} {
+		m := hi.ToProto()
+		bad(m)
+		if err := NewHashInfo().FromProto(m); !errors.Is(err, ErrMalformed) {
+			t.Error(name, err)
+		}
+	}
+}
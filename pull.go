@@ -0,0 +1,198 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Fetcher returns n bytes of the source at off, n < 0 reads to its end and a range past the end is empty
+type Fetcher func(ctx context.Context, off int64, n int64) (io.ReadCloser, error)
+
+// HTTPFetcher fetches the ranges of the file served at url, the server must support Range requests
+func HTTPFetcher(client *http.Client, url string) Fetcher {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ctx context.Context, off int64, n int64) (io.ReadCloser, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch res.StatusCode {
+		case http.StatusPartialContent:
+			return res.Body, nil
+		case http.StatusRequestedRangeNotSatisfiable:
+			res.Body.Close()
+			return io.NopCloser(bytes.NewReader(nil)), nil
+		case http.StatusOK:
+			if off == 0 {
+				//the whole file, only the range is read
+				return res.Body, nil
+			}
+			res.Body.Close()
+			return nil, errors.New("server ignores range requests")
+		}
+		defer res.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, &HTTPStatusError{StatusCode: res.StatusCode, Message: string(bytes.TrimSpace(msg))}
+	}
+}
+
+// pullSegment is a part of the source, copied from the basis at boff or fetched when boff < 0
+type pullSegment struct {
+	off  int64
+	n    int64
+	boff int64
+}
+
+// Pull rebuilds the source of sig into out, the blocks found in basis are copied from it and only
+// the rest is fetched. It is the delta run the other way, the receiver matches the sender signature
+// against its own data, as used to update files from plain http servers
+func Pull(ctx context.Context, sig *HashInfo, basis io.ReaderAt, size int64, fetch Fetcher, out io.Writer) (Stats, error) {
+	now := time.Now()
+	st := Stats{}
+	if sig == nil {
+		return st, ErrNoSignature
+	}
+	sh, err := sig.Hasher()
+	if err != nil {
+		return st, err
+	}
+	if sig.InPlace {
+		//no output position here
+		sig = sig.Clone()
+		sig.InPlace = false
+	}
+	//source offset of a block to basis offset
+	found := map[int64]int64{}
+	pos := int64(0)
+	err = analyseReader(sig, io.NewSectionReader(basis, 0, size), func(info *AnalyseInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsData() {
+			pos += int64(len(info.Data))
+		}
+		if info.IsIndex() {
+			if _, ok := found[info.Off]; !ok {
+				found[info.Off] = pos
+			}
+			if info.IsShort() {
+				pos += int64(info.Len)
+			} else {
+				pos += int64(sig.BlockSize)
+			}
+		}
+		return nil
+	}, func(fh *FileHashInfo) {
+		//every block counts
+		fh.WholeFileProbe = 0
+	})
+	if err != nil {
+		return st, err
+	}
+	blocks := append([]HashBlock{}, sig.Blocks...)
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Off < blocks[j].Off
+	})
+	segs := []pullSegment{}
+	add := func(seg pullSegment) {
+		//consecutive fetches are one request
+		if l := len(segs) - 1; l >= 0 && seg.boff < 0 && segs[l].boff < 0 && segs[l].off+segs[l].n == seg.off {
+			segs[l].n += seg.n
+			return
+		}
+		segs = append(segs, seg)
+	}
+	pos = 0
+	for _, b := range blocks {
+		off := int64(b.Off)
+		if off < pos {
+			continue
+		}
+		if off > pos {
+			//deduplicated blocks
+			add(pullSegment{off: pos, n: off - pos, boff: -1})
+		}
+		n := int64(sig.BlockSize)
+		if b.IsShort() {
+			n = int64(b.Len)
+		}
+		boff, ok := found[off]
+		if !ok {
+			boff = -1
+		} else {
+			st.Blocks++
+		}
+		add(pullSegment{off: off, n: n, boff: boff})
+		pos = off + n
+	}
+	fh := SeededHasher(sh, sig.Seed).New()
+	cw := &countWriter{w: out}
+	w := io.MultiWriter(cw, fh)
+	for _, seg := range segs {
+		if err := ctx.Err(); err != nil {
+			return st, err
+		}
+		if seg.boff >= 0 {
+			if _, err := io.Copy(w, io.NewSectionReader(basis, seg.boff, seg.n)); err != nil {
+				return st, err
+			}
+			st.Matched += seg.n
+			continue
+		}
+		if err := pullFetch(ctx, fetch, seg.off, seg.n, w, &st); err != nil {
+			return st, err
+		}
+	}
+	//deduplicated trailing blocks are not in the signature
+	if !bytes.Equal(fh.Sum(nil), sig.MD5) {
+		if err := pullFetch(ctx, fetch, pos, -1, w, &st); err != nil {
+			return st, err
+		}
+	}
+	if !bytes.Equal(fh.Sum(nil), sig.MD5) {
+		return st, fmt.Errorf("%w: pulled file", ErrHashMismatch)
+	}
+	st.TotalSize = cw.n
+	st.Files = 1
+	st.Duration = time.Since(now)
+	return st, nil
+}
+
+// pullFetch copies the range of the source to w
+func pullFetch(ctx context.Context, fetch Fetcher, off int64, n int64, w io.Writer, st *Stats) error {
+	rc, err := fetch(ctx, off, n)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	if n >= 0 {
+		r = io.LimitReader(rc, n)
+	}
+	m, err := io.Copy(w, r)
+	st.Literal += m
+	if err != nil {
+		return err
+	}
+	if n >= 0 && m != n {
+		return fmt.Errorf("fetch %d bytes at %d: %w", n, off, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
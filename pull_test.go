@@ -0,0 +1,68 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPull(t *testing.T) {
+	rnd := rand.New(rand.NewSource(5))
+	old := make([]byte, DefaultBlockSize*100+77)
+	rnd.Read(old)
+	src := append([]byte{}, old[:DefaultBlockSize*40]...)
+	src = append(src, bytes.Repeat([]byte("new data"), 300)...)
+	src = append(src, old[DefaultBlockSize*40:]...)
+	//deduplicated trailing blocks
+	src = append(src, make([]byte, DefaultBlockSize*3)...)
+	requests := 0
+	hs := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests++
+		http.ServeContent(res, req, "src.bin", time.Time{}, bytes.NewReader(src))
+	}))
+	defer hs.Close()
+	ctx := context.Background()
+	fetch := HTTPFetcher(nil, hs.URL)
+	for _, dups := range []DupPolicy{DupDedup, DupKeepAll} {
+		sig, err := GetReaderHashInfo(bytes.NewReader(src), nil, WithDups(dups))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := &bytes.Buffer{}
+		requests = 0
+		st, err := Pull(ctx, sig, bytes.NewReader(old), int64(len(old)), fetch, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), src) {
+			t.Fatal("pulled file error", dups)
+		}
+		if st.Literal > 2400+DefaultBlockSize*6 || st.Matched < int64(len(old))-DefaultBlockSize*2 || requests > 3 {
+			t.Error("pull stats error", dups, st.Literal, st.Matched, requests)
+		}
+		if st.TotalSize != int64(len(src)) {
+			t.Error("total size error", st.TotalSize)
+		}
+	}
+	//without a basis everything is fetched
+	sig, _ := GetReaderHashInfo(bytes.NewReader(src), nil)
+	out := &bytes.Buffer{}
+	st, err := Pull(ctx, sig, bytes.NewReader(nil), 0, fetch, out)
+	if err != nil || !bytes.Equal(out.Bytes(), src) || st.Literal != int64(len(src)) {
+		t.Error("pull without basis error", err, st.Literal)
+	}
+	//a signature of another file
+	other, _ := GetReaderHashInfo(bytes.NewReader(old), nil)
+	if _, err := Pull(ctx, other, bytes.NewReader(old), int64(len(old)), HTTPFetcher(nil, hs.URL), &bytes.Buffer{}); err != nil {
+		t.Error("pull of old error", err)
+	}
+	other.MD5[0]++
+	if _, err := Pull(ctx, other, bytes.NewReader(old), int64(len(old)), fetch, &bytes.Buffer{}); !errors.Is(err, ErrHashMismatch) {
+		t.Error("hash mismatch error", err)
+	}
+}
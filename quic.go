@@ -0,0 +1,239 @@
+package rsync
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICProto is the ALPN protocol of the quic transport
+const QUICProto = "rsync"
+
+// quicStream gives a stream the net.Conn methods the tcp message client needs
+type quicStream struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (this *quicStream) LocalAddr() net.Addr {
+	return this.conn.LocalAddr()
+}
+
+func (this *quicStream) RemoteAddr() net.Addr {
+	return this.conn.RemoteAddr()
+}
+
+func quicTLSConfig(conf *tls.Config) *tls.Config {
+	if conf == nil {
+		conf = &tls.Config{}
+	}
+	conf = conf.Clone()
+	if len(conf.NextProtos) == 0 {
+		conf.NextProtos = []string{QUICProto}
+	}
+	return conf
+}
+
+// QUICClient is the Transport for a QUICServer, every request runs on its own stream
+// so concurrent file syncs share the connection without head of line blocking
+type QUICClient struct {
+	Conn     quic.Connection
+	Secret   []byte   //authenticate every message with hmac
+	Limit    *Limiter //throttles literal data of all streams
+	Timeouts Timeouts //bound the message waits of every stream
+}
+
+func DialQUIC(ctx context.Context, addr string, tlsConf *tls.Config) (*QUICClient, error) {
+	conn, err := quic.DialAddr(ctx, addr, quicTLSConfig(tlsConf), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &QUICClient{Conn: conn}, nil
+}
+
+func (this *QUICClient) stream(ctx context.Context) (*TCPClient, error) {
+	s, err := this.Conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := NewTCPClient(&quicStream{Stream: s, conn: this.Conn})
+	c.Secret = this.Secret
+	c.Limit = this.Limit
+	c.Timeouts = this.Timeouts
+	return c, nil
+}
+
+func (this *QUICClient) Signature(ctx context.Context, path string) (*HashInfo, error) {
+	c, err := this.stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.Signature(ctx, path)
+}
+
+func (this *QUICClient) Resumed(ctx context.Context, path string) (int64, error) {
+	c, err := this.stream(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	return c.Resumed(ctx, path)
+}
+
+func (this *QUICClient) List(ctx context.Context, dir string) ([]FileEntry, error) {
+	c, err := this.stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.List(ctx, dir)
+}
+
+func (this *QUICClient) Remove(ctx context.Context, path string) error {
+	c, err := this.stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Remove(ctx, path)
+}
+
+func (this *QUICClient) Symlink(ctx context.Context, target string, path string) error {
+	c, err := this.stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Symlink(ctx, target, path)
+}
+
+func (this *QUICClient) Link(ctx context.Context, target string, path string) error {
+	c, err := this.stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Link(ctx, target, path)
+}
+
+func (this *QUICClient) Apply(ctx context.Context, path string, delta io.Reader) error {
+	c, err := this.stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Apply(ctx, path, delta)
+}
+
+func (this *QUICClient) Close() error {
+	return this.Conn.CloseWithError(0, "")
+}
+
+// QUICServer answers QUICClient streams from Store
+type QUICServer struct {
+	Store    *LocalStore
+	Secret   []byte   //require hmac authenticated messages
+	Timeouts Timeouts //bound the waits for requests, frames and reply writes of every stream
+	mu       sync.Mutex
+	listener *quic.Listener
+	conns    map[quic.Connection]bool
+	wg       sync.WaitGroup
+	closed   bool
+}
+
+func NewQUICServer(root string) *QUICServer {
+	return &QUICServer{
+		Store: NewLocalStore(root),
+		conns: map[quic.Connection]bool{},
+	}
+}
+
+func (this *QUICServer) ListenAndServe(addr string, tlsConf *tls.Config) error {
+	l, err := quic.ListenAddr(addr, quicTLSConfig(tlsConf), nil)
+	if err != nil {
+		return err
+	}
+	return this.Serve(l)
+}
+
+// Serve accepts connections until Close, then returns net.ErrClosed
+func (this *QUICServer) Serve(l *quic.Listener) error {
+	this.mu.Lock()
+	if this.closed {
+		this.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	this.listener = l
+	this.mu.Unlock()
+	for {
+		conn, err := l.Accept(context.Background())
+		if err != nil {
+			this.mu.Lock()
+			closed := this.closed
+			this.mu.Unlock()
+			if closed {
+				return net.ErrClosed
+			}
+			return err
+		}
+		this.mu.Lock()
+		if this.closed {
+			this.mu.Unlock()
+			conn.CloseWithError(0, "")
+			continue
+		}
+		this.conns[conn] = true
+		this.wg.Add(1)
+		this.mu.Unlock()
+		go func() {
+			defer this.wg.Done()
+			this.serveConn(conn)
+			this.mu.Lock()
+			delete(this.conns, conn)
+			this.mu.Unlock()
+		}()
+	}
+}
+
+func (this *QUICServer) serveConn(conn quic.Connection) {
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	ctx := withPeer(context.Background(), &Peer{
+		Addr: peerHost(conn.RemoteAddr()),
+		User: peerUser(conn.ConnectionState().TLS.VerifiedChains),
+	})
+	for {
+		s, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.Close()
+			serveTCPMessages(ctx, this.Store, s, this.Secret, this.Timeouts)
+		}()
+	}
+}
+
+// Close stops accepting, closes open connections and waits for their handlers
+func (this *QUICServer) Close() error {
+	this.mu.Lock()
+	this.closed = true
+	var err error
+	if this.listener != nil {
+		err = this.listener.Close()
+	}
+	for conn := range this.conns {
+		conn.CloseWithError(0, "server closed")
+	}
+	this.mu.Unlock()
+	this.wg.Wait()
+	return err
+}
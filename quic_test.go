@@ -0,0 +1,67 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestQUICTransport(t *testing.T) {
+	root := t.TempDir()
+	sconf, cconf := testTLSConfig(t)
+	l, err := quic.ListenAddr("127.0.0.1:0", quicTLSConfig(sconf), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewQUICServer(root)
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(l)
+	}()
+	ctx := context.Background()
+	c, err := DialQUIC(ctx, l.Addr().String(), cconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 5; i++ {
+		dat := make([]byte, DefaultBlockSize*(i+1)*3+i)
+		rnd.Read(dat)
+		files[fmt.Sprintf("d/%d.bin", i)] = dat
+	}
+	wg := sync.WaitGroup{}
+	for name, dat := range files {
+		wg.Add(1)
+		go func(name string, dat []byte) {
+			defer wg.Done()
+			if err := Push(ctx, c, bytes.NewReader(dat), name); err != nil {
+				t.Error(name, err)
+			}
+		}(name, dat)
+	}
+	wg.Wait()
+	for name, dat := range files {
+		got, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil || !bytes.Equal(got, dat) {
+			t.Error("remote file error", name, err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := srv.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := <-done; err != net.ErrClosed {
+		t.Error("serve error", err)
+	}
+}
@@ -0,0 +1,399 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"time"
+)
+
+// DeltaRange is a source range sent as literal data
+type DeltaRange struct {
+	Off int64
+	Len int64
+}
+
+// DeltaReport describes what the delta of a source against a signature would transfer
+type DeltaReport struct {
+	Size    int64        //source size
+	Matched int64        //bytes copied from basis blocks
+	Literal int64        //bytes sent as literal data
+	Blocks  int          //matched blocks
+	Delta   int64        //encoded delta size, the estimated bytes to transfer
+	Ranges  []DeltaRange //literal ranges of the source
+	Changed bool         //the source differs from the basis
+}
+
+// Compare runs the analyse of r against sig and reports the delta without writing it
+func Compare(sig *HashInfo, r io.Reader) (*DeltaReport, error) {
+	rp := &DeltaReport{Ranges: []DeltaRange{}}
+	cw := &countWriter{w: io.Discard}
+	blockSize := int64(sig.BlockSize)
+	var hash []byte
+	err := analyseReader(sig, r, func(info *AnalyseInfo) error {
+		if err := info.Write(cw); err != nil {
+			return err
+		}
+		if info.IsOpen() {
+			rp.Size = info.Off
+			blockSize = int64(info.BlockSize)
+		}
+		pos := rp.Matched + rp.Literal
+		if info.IsData() {
+			n := int64(len(info.Data))
+			if i := len(rp.Ranges) - 1; i >= 0 && rp.Ranges[i].Off+rp.Ranges[i].Len == pos {
+				rp.Ranges[i].Len += n
+			} else {
+				rp.Ranges = append(rp.Ranges, DeltaRange{Off: pos, Len: n})
+			}
+			rp.Literal += n
+		}
+		if info.IsIndex() {
+			n := blockSize
+			if info.IsShort() {
+				n = int64(info.Len)
+			}
+			rp.Matched += n
+			rp.Blocks++
+		}
+		if info.IsClose() {
+			hash = info.Hash
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rp.Delta = cw.n
+	rp.Changed = !bytes.Equal(hash, sig.MD5) || rp.Size != sig.Size()
+	return rp, nil
+}
+
+// BlockChange is a run of blocks in a signature diff, Off is the new file offset of added and moved
+// blocks and the old one of removed blocks, From is the old offset of moved blocks
+type BlockChange struct {
+	Off  int64
+	From int64
+	Len  int64
+}
+
+// SignatureReport lists what changed between two signatures of a file at block granularity
+type SignatureReport struct {
+	Added     []BlockChange //new blocks not in the old file
+	Removed   []BlockChange //old blocks not in the new file
+	Moved     []BlockChange //blocks of the old file at another offset, copies included
+	Unchanged int64         //bytes of blocks at the same offset in both
+}
+
+// DiffHashInfo compares the blocks of two signatures made with the same block size, hashes and seed,
+// keep all duplicate signatures report every copy
+func DiffHashInfo(old *HashInfo, new *HashInfo) (*SignatureReport, error) {
+	if old.BlockSize != new.BlockSize || old.Strong != new.Strong || old.Seed != new.Seed {
+		return nil, errors.New("signatures not comparable, block size, strong hash or seed differ")
+	}
+	key := func(b HashBlock) string {
+		return string(b.H3) + string(tobyte16(b.Len))
+	}
+	blen := func(b HashBlock) int64 {
+		if b.IsShort() {
+			return int64(b.Len)
+		}
+		return int64(old.BlockSize)
+	}
+	sorted := func(hi *HashInfo) []HashBlock {
+		bs := append([]HashBlock{}, hi.Blocks...)
+		sort.Slice(bs, func(i, j int) bool {
+			return bs[i].Off < bs[j].Off
+		})
+		return bs
+	}
+	olds, news := sorted(old), sorted(new)
+	//old offsets of every block content, the unused ones are removed
+	offs := map[string][]int64{}
+	used := map[int64]bool{}
+	for _, b := range olds {
+		offs[key(b)] = append(offs[key(b)], int64(b.Off))
+	}
+	rp := &SignatureReport{Added: []BlockChange{}, Removed: []BlockChange{}, Moved: []BlockChange{}}
+	moved := []HashBlock{}
+	for _, b := range news {
+		k := key(b)
+		if _, ok := offs[k]; !ok {
+			rp.Added = appendChange(rp.Added, BlockChange{Off: int64(b.Off), From: -1, Len: blen(b)})
+			continue
+		}
+		if slices.Contains(offs[k], int64(b.Off)) && !used[int64(b.Off)] {
+			used[int64(b.Off)] = true
+			rp.Unchanged += blen(b)
+			continue
+		}
+		moved = append(moved, b)
+	}
+	for _, b := range moved {
+		froms := offs[key(b)]
+		from := froms[0]
+		for _, off := range froms {
+			if !used[off] {
+				from = off
+				break
+			}
+		}
+		used[from] = true
+		rp.Moved = appendChange(rp.Moved, BlockChange{Off: int64(b.Off), From: from, Len: blen(b)})
+	}
+	for _, b := range olds {
+		if !used[int64(b.Off)] {
+			rp.Removed = appendChange(rp.Removed, BlockChange{Off: int64(b.Off), From: -1, Len: blen(b)})
+		}
+	}
+	return rp, nil
+}
+
+// appendChange adds c to cs, joined with the last change when both continue it
+func appendChange(cs []BlockChange, c BlockChange) []BlockChange {
+	if i := len(cs) - 1; i >= 0 && cs[i].Off+cs[i].Len == c.Off && (c.From < 0 || cs[i].From+cs[i].Len == c.From) {
+		cs[i].Len += c.Len
+		return cs
+	}
+	return append(cs, c)
+}
+
+// dry run actions
+const (
+	ActionCreate    = "create"
+	ActionUpdate    = "update"
+	ActionUnchanged = "unchanged"
+	ActionSymlink   = "symlink"
+	ActionHardLink  = "hardlink"
+	ActionDelete    = "delete"
+)
+
+// FileReport is the dry run result of one destination path, Delta is set for regular files
+type FileReport struct {
+	Path   string
+	Action string
+	Delta  *DeltaReport
+}
+
+// SyncReport is the result of DirSyncer.DryRun
+type SyncReport struct {
+	Files []FileReport
+	Bytes int64 //estimated delta bytes to transfer
+}
+
+// Changed returns the reports of paths a sync would touch
+func (this *SyncReport) Changed() []FileReport {
+	ret := []FileReport{}
+	for _, v := range this.Files {
+		if v.Action != ActionUnchanged {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// DryRun compares Src with the destination like Sync does, signatures included, and reports
+// what would change without writing anything
+func (this *DirSyncer) DryRun(ctx context.Context) (*SyncReport, error) {
+	src, dst, all, err := this.lists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rp := &SyncReport{Files: []FileReport{}}
+	for _, v := range src {
+		switch {
+		case v.IsSymlink():
+			action := ActionSymlink
+			if d, ok := dst[v.Path]; ok && d.IsSymlink() && d.Link == v.Link {
+				action = ActionUnchanged
+			}
+			rp.Files = append(rp.Files, FileReport{Path: v.Path, Action: action})
+		case !v.IsRegular():
+		case v.HardLink != "":
+			rp.Files = append(rp.Files, FileReport{Path: v.Path, Action: ActionHardLink})
+		default:
+			fr, err := this.compareFile(ctx, v, dst)
+			if err != nil {
+				return nil, fmt.Errorf("compare %s: %w", v.Path, err)
+			}
+			rp.Bytes += fr.Delta.Delta
+			rp.Files = append(rp.Files, *fr)
+		}
+	}
+	if this.Delete {
+		del, err := this.extraneous(src, dst, all)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range del {
+			rp.Files = append(rp.Files, FileReport{Path: p, Action: ActionDelete})
+		}
+	}
+	return rp, nil
+}
+
+func (this *DirSyncer) compareFile(ctx context.Context, v FileEntry, dst map[string]FileEntry) (*FileReport, error) {
+	sig, err := this.missingSignature(v, dst)
+	if err != nil {
+		return nil, err
+	}
+	action := ActionCreate
+	if sig == nil {
+		if sig, err = this.Dst.Signature(ctx, this.dstPath(v.Path)); err != nil {
+			return nil, err
+		}
+		action = ActionUpdate
+		if d, ok := dst[v.Path]; dst != nil && (!ok || d.IsDir()) {
+			//a fuzzy basis
+			action = ActionCreate
+		}
+	}
+	fd, err := this.openSrc(v.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	delta, err := Compare(sig, fd)
+	if err != nil {
+		return nil, err
+	}
+	if action == ActionUpdate && !delta.Changed {
+		action = ActionUnchanged
+	}
+	return &FileReport{Path: v.Path, Action: action, Delta: delta}, nil
+}
+
+// compressNames are the names of the compress ids
+var compressNames = []string{"none", "zstd", "gzip"}
+
+// dumpRun is a run of delta ops DumpDelta prints as one line
+type dumpRun struct {
+	data   bool  //literal data, else basis blocks
+	out    int64 //output offset
+	basis  int64 //basis offset of the first block
+	len    int64 //output bytes
+	blocks int64
+	first  uint32 //block index of the first and last block
+	last   uint32
+	raw    int64 //compressed literal bytes
+	bytes  int64 //encoded frame bytes
+}
+
+func (this *dumpRun) print(w io.Writer) {
+	if this.data {
+		fmt.Fprintf(w, "data  out %d len %d bytes %d", this.out, this.len, this.bytes)
+		if this.raw > 0 {
+			fmt.Fprintf(w, " compressed %d", this.raw)
+		}
+		fmt.Fprintln(w)
+		return
+	}
+	fmt.Fprintf(w, "copy  out %d basis %d len %d blocks %d index %d-%d bytes %d\n",
+		this.out, this.basis, this.len, this.blocks, this.first, this.last, this.bytes)
+}
+
+// DumpDelta decodes the delta frames of r and prints their ops to w a line each, runs of literal
+// data and of basis blocks copied in order are joined, out is the output offset and bytes the
+// encoded size, every file ends with a line of its totals
+func DumpDelta(r io.Reader, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	cr := &countReader{r: r}
+	var run *dumpRun
+	flush := func() {
+		if run != nil {
+			run.print(bw)
+			run = nil
+		}
+	}
+	out, blockSize, compress := int64(0), int64(0), uint8(CompressNone)
+	var total DeltaReport
+	frames, size := 0, int64(0)
+	for n := 0; ; n++ {
+		start := cr.n
+		info := &AnalyseInfo{}
+		err := info.Read(cr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			flush()
+			bw.Flush()
+			return fmt.Errorf("frame %d: %w", n, err)
+		}
+		fb := cr.n - start
+		frames++
+		total.Delta += fb
+		if info.IsOpen() {
+			flush()
+			out, blockSize, compress, size = 0, int64(info.BlockSize), info.Compress, info.Off
+			total, frames = DeltaReport{Delta: fb}, 1
+			name := fmt.Sprint(info.Compress)
+			if int(info.Compress) < len(compressNames) {
+				name = compressNames[info.Compress]
+			}
+			fmt.Fprintf(bw, "open  size %d block %d strong %s compress %s seed %d", info.Off, info.BlockSize,
+				strongName(info.Strong), name, info.Seed)
+			if info.IsWhole() {
+				bw.WriteString(" whole")
+			}
+			if info.IsMeta() && info.Meta != nil {
+				fmt.Fprintf(bw, " mode %v mtime %s", info.Meta.Mode, info.Meta.ModTime.UTC().Format(time.RFC3339))
+			}
+			fmt.Fprintf(bw, " bytes %d\n", fb)
+			fb = 0
+		}
+		if info.IsData() {
+			raw := int64(0)
+			if info.IsCompressed() {
+				raw = int64(len(info.Data))
+				if err := info.DecompressData(compress); err != nil {
+					flush()
+					bw.Flush()
+					return fmt.Errorf("frame %d: %w", n, err)
+				}
+			}
+			dn := int64(len(info.Data))
+			if run == nil || !run.data {
+				flush()
+				run = &dumpRun{data: true, out: out}
+			}
+			run.len += dn
+			run.raw += raw
+			run.bytes += fb
+			fb = 0
+			out += dn
+			total.Literal += dn
+		}
+		if info.IsIndex() {
+			bn := blockSize
+			if info.IsShort() {
+				bn = int64(info.Len)
+			}
+			if run == nil || run.data || run.basis+run.len != info.Off || run.last+1 != info.Index {
+				flush()
+				run = &dumpRun{out: out, basis: info.Off, first: info.Index}
+			}
+			run.len += bn
+			run.blocks++
+			run.last = info.Index
+			run.bytes += fb
+			fb = 0
+			out += bn
+			total.Matched += bn
+			total.Blocks++
+		}
+		if info.IsClose() {
+			flush()
+			fmt.Fprintf(bw, "close out %d hash %x bytes %d\n", out, info.Hash, fb)
+			fmt.Fprintf(bw, "file  size %d matched %d blocks %d literal %d frames %d bytes %d\n",
+				size, total.Matched, total.Blocks, total.Literal, frames, total.Delta)
+		}
+	}
+	flush()
+	return bw.Flush()
+}
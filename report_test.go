@@ -0,0 +1,162 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	basis := make([]byte, DefaultBlockSize*20)
+	rand.New(rand.NewSource(3)).Read(basis)
+	sig, err := Signature(bytes.NewReader(basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err := Compare(sig, bytes.NewReader(basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rp.Changed || rp.Literal != 0 || rp.Blocks != 20 || rp.Matched != int64(len(basis)) {
+		t.Error("same report error", rp)
+	}
+	src := append([]byte{}, basis...)
+	copy(src[DefaultBlockSize*5:], bytes.Repeat([]byte{7}, DefaultBlockSize*2))
+	rp, err = Compare(sig, bytes.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DeltaRange{{Off: DefaultBlockSize * 5, Len: DefaultBlockSize * 2}}
+	if !rp.Changed || rp.Literal != DefaultBlockSize*2 || rp.Blocks != 18 || fmt.Sprint(rp.Ranges) != fmt.Sprint(want) {
+		t.Error("changed report error", rp)
+	}
+	delta := &bytes.Buffer{}
+	if err := Delta(sig, bytes.NewReader(src), delta); err != nil {
+		t.Fatal(err)
+	}
+	if rp.Delta != int64(delta.Len()) {
+		t.Error("delta size error", rp.Delta, delta.Len())
+	}
+}
+
+func TestDirSyncerDryRun(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	testWriteFiles(t, src, map[string]string{"new.txt": "new", "same.txt": "same", "mod.txt": "modified"})
+	old := map[string]string{"same.txt": "same", "mod.txt": "original", "old.txt": "old"}
+	testWriteFiles(t, dst, old)
+	s := NewDirSyncer(src, NewLocalStore(dst), "")
+	s.Delete = true
+	rp, err := s.DryRun(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := map[string]string{}
+	for _, v := range rp.Changed() {
+		actions[v.Path] = v.Action
+	}
+	want := map[string]string{"new.txt": ActionCreate, "mod.txt": ActionUpdate, "old.txt": ActionDelete}
+	if fmt.Sprint(actions) != fmt.Sprint(want) || len(rp.Files) != 4 || rp.Bytes == 0 {
+		t.Error("dry run report error", rp.Files)
+	}
+	testCheckFiles(t, dst, old)
+	list, _ := ListDir(context.Background(), dst)
+	if len(list) != 3 {
+		t.Error("dry run wrote files", list)
+	}
+}
+
+func TestDiffHashInfo(t *testing.T) {
+	bs := DefaultBlockSize
+	old := make([]byte, bs*10)
+	rnd := rand.New(rand.NewSource(8))
+	rnd.Read(old)
+	block := func(i int) []byte {
+		return old[i*bs : (i+1)*bs]
+	}
+	x := make([]byte, bs*2)
+	rnd.Read(x)
+	src := append([]byte{}, old[:bs*3]...)
+	src = append(src, x...)
+	src = append(src, old[bs*5:]...)
+	src = append(src, block(3)...)
+	src = append(src, block(0)...)
+	src = append(src, "tail"...)
+	osig, _ := GetReaderHashInfo(bytes.NewReader(old), nil, WithDups(DupKeepAll))
+	nsig, _ := GetReaderHashInfo(bytes.NewReader(src), nil, WithDups(DupKeepAll))
+	rp, err := DiffHashInfo(osig, nsig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := int64(bs)
+	if want := []BlockChange{{Off: 3 * b, From: -1, Len: 2 * b}, {Off: 12 * b, From: -1, Len: 4}}; fmt.Sprint(rp.Added) != fmt.Sprint(want) {
+		t.Error("added error", rp.Added)
+	}
+	if want := []BlockChange{{Off: 4 * b, From: -1, Len: b}}; fmt.Sprint(rp.Removed) != fmt.Sprint(want) {
+		t.Error("removed error", rp.Removed)
+	}
+	if want := []BlockChange{{Off: 10 * b, From: 3 * b, Len: b}, {Off: 11 * b, From: 0, Len: b}}; fmt.Sprint(rp.Moved) != fmt.Sprint(want) {
+		t.Error("moved error", rp.Moved)
+	}
+	if rp.Unchanged != 8*b {
+		t.Error("unchanged error", rp.Unchanged)
+	}
+	same, err := DiffHashInfo(osig, osig)
+	if err != nil || len(same.Added)+len(same.Removed)+len(same.Moved) != 0 || same.Unchanged != int64(len(old)) {
+		t.Error("same signature error", err)
+	}
+	other, _ := GetReaderHashInfo(bytes.NewReader(src), nil, WithBlockSize(DefaultBlockSize*2))
+	if _, err := DiffHashInfo(osig, other); err == nil {
+		t.Error("block size mismatch not reported")
+	}
+}
+
+func TestDumpDelta(t *testing.T) {
+	basis := make([]byte, DefaultBlockSize*20)
+	rand.New(rand.NewSource(4)).Read(basis)
+	sig, err := Signature(bytes.NewReader(basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := append([]byte{}, basis...)
+	copy(src[DefaultBlockSize*5:], bytes.Repeat([]byte{7}, DefaultBlockSize*2))
+	delta := &bytes.Buffer{}
+	if err := DeltaCompress(sig, bytes.NewReader(src), delta, CompressZstd); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if err := DumpDelta(bytes.NewReader(delta.Bytes()), out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("dump lines %q", out.String())
+	}
+	for i, prefix := range []string{
+		fmt.Sprintf("open  size %d block %d strong md5 compress zstd", len(src), DefaultBlockSize),
+		fmt.Sprintf("copy  out 0 basis 0 len %d blocks 5 index 0-4 ", DefaultBlockSize*5),
+		fmt.Sprintf("data  out %d len %d bytes ", DefaultBlockSize*5, DefaultBlockSize*2),
+		fmt.Sprintf("copy  out %d basis %d len %d blocks 13 index 7-19 ", DefaultBlockSize*7, DefaultBlockSize*7, DefaultBlockSize*13),
+		fmt.Sprintf("close out %d hash ", len(src)),
+		fmt.Sprintf("file  size %d matched %d blocks 18 literal %d frames ", len(src), DefaultBlockSize*18, DefaultBlockSize*2),
+	} {
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Errorf("line %d %q want %q", i, lines[i], prefix)
+		}
+	}
+	if !strings.Contains(lines[2], "compressed") || !strings.HasSuffix(lines[5], fmt.Sprintf("bytes %d", delta.Len())) {
+		t.Error("dump sizes error", lines[2], lines[5])
+	}
+	//a cut delta prints what it decoded before failing
+	out.Reset()
+	if err := DumpDelta(bytes.NewReader(delta.Bytes()[:delta.Len()-3]), out); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("cut delta error", err)
+	}
+	if !strings.HasPrefix(out.String(), "open ") {
+		t.Error("cut delta dump", out.String())
+	}
+}
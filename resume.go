@@ -0,0 +1,598 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	ProgressMagic = "RPRT"
+	//merged bytes between two progress checkpoints
+	DefaultCheckpointSize = 4 << 20
+)
+
+// mergeProgress is the state of an interrupted merge, kept in Path+".part", the journal of the
+// merge. It is written as
+//
+//	header frames(8) offset(8) size(8) block size(2) strong(1) compress(1) seed(4) hash len(2) hash crc(4)
+//
+// with the crc32 castagnoli of the fields after the header, a torn journal starts the merge over
+type mergeProgress struct {
+	Frames    int64 //frames merged, the open frame is frame 0
+	Offset    int64 //bytes in the tmp file
+	Size      int64 //target file size from the open frame
+	BlockSize uint16
+	Strong    uint8
+	Compress  uint8
+	Seed      uint32 //checksum seed of the hash
+	Hash      []byte //marshaled running hash state
+}
+
+func (this *mergeProgress) Write(w io.Writer) error {
+	if err := writeHeader(w, ProgressMagic); err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	buf.Write(tobyte64(uint64(this.Frames)))
+	buf.Write(tobyte64(uint64(this.Offset)))
+	buf.Write(tobyte64(uint64(this.Size)))
+	buf.Write(tobyte16(this.BlockSize))
+	buf.Write([]byte{this.Strong, this.Compress})
+	buf.Write(tobyte32(this.Seed))
+	buf.Write(tobyte16(uint16(len(this.Hash))))
+	buf.Write(this.Hash)
+	buf.Write(tobyte32(crc32.Checksum(buf.Bytes(), castagnoli)))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (this *mergeProgress) Read(r io.Reader) error {
+	if err := readHeader(r, ProgressMagic); err != nil {
+		return err
+	}
+	crc := crc32.New(castagnoli)
+	r = io.TeeReader(r, crc)
+	b := make([]byte, 8*3+2+2+4+2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	var err error
+	if this.Frames, err = toint64(b[0:8]); err != nil {
+		return err
+	}
+	if this.Offset, err = toint64(b[8:16]); err != nil {
+		return err
+	}
+	if this.Size, err = toint64(b[16:24]); err != nil {
+		return err
+	}
+	if this.Offset > this.Size {
+		return fmt.Errorf("%w: progress offset %d past size %d", ErrMalformed, this.Offset, this.Size)
+	}
+	if this.BlockSize, err = touint16(b[24:26]); err != nil {
+		return err
+	}
+	this.Strong = b[26]
+	this.Compress = b[27]
+	if this.Seed, err = touint32(b[28:32]); err != nil {
+		return err
+	}
+	n, err := touint16(b[32:34])
+	if err != nil {
+		return err
+	}
+	this.Hash = make([]byte, n)
+	if _, err := io.ReadFull(r, this.Hash); err != nil {
+		return err
+	}
+	sum := crc.Sum32()
+	b4 := make([]byte, 4)
+	if _, err := io.ReadFull(r, b4); err != nil {
+		return noEOF(err)
+	}
+	if v, _ := touint32(b4); v != sum {
+		return fmt.Errorf("%w: progress checksum", ErrMalformed)
+	}
+	return nil
+}
+
+func loadProgress(path string) (*mergeProgress, error) {
+	fd, err := os.Open(path + ".part")
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	p := &mergeProgress{}
+	if err := p.Read(fd); err != nil {
+		return nil, err
+	}
+	if p.Frames < 1 || p.Offset < 0 {
+		return nil, errors.New("progress error")
+	}
+	return p, nil
+}
+
+// resumedSeed returns the checksum seed of an interrupted merge of path, signatures for a resumed
+// merge must keep it
+func resumedSeed(path string, tmp string) (uint32, bool) {
+	if resumedFrames(path, tmp) == 0 {
+		return 0, false
+	}
+	p, err := loadProgress(path)
+	if err != nil {
+		return 0, false
+	}
+	return p.Seed, true
+}
+
+// ResumedFrames returns how many frames of path an interrupted merge already holds, 0 to start over
+func ResumedFrames(path string) int64 {
+	return resumedFrames(path, TempPath(path, ""))
+}
+
+// resumedFrames is ResumedFrames with the temp file tmp
+func resumedFrames(path string, tmp string) int64 {
+	p, err := loadProgress(path)
+	if err != nil {
+		return 0
+	}
+	if fs, err := os.Stat(tmp); err != nil || fs.Size() < p.Offset {
+		return 0
+	}
+	return p.Frames
+}
+
+// ResumeFrames passes the open frame and the frames from index skip on to fn,
+// the sender uses it to continue the delta after the frames the receiver holds
+func ResumeFrames(skip int64, fn func(info *AnalyseInfo) error) func(info *AnalyseInfo) error {
+	idx := int64(0)
+	return func(info *AnalyseInfo) error {
+		i := idx
+		idx++
+		if i == 0 || i >= skip {
+			return fn(info)
+		}
+		return nil
+	}
+}
+
+// restore cuts the tmp file back to the checkpoint, without a usable checkpoint it starts over
+func (this *FileMerger) restore(file *os.File) error {
+	p, err := loadProgress(this.Path)
+	if err == nil {
+		if fs, serr := file.Stat(); serr != nil || fs.Size() < p.Offset {
+			err = errors.New("tmp file truncated")
+		}
+	}
+	if err == nil {
+		err = p.verify(file)
+	}
+	if err != nil {
+		this.progress = nil
+		os.Remove(this.Path + ".part")
+		return file.Truncate(0)
+	}
+	this.progress = p
+	this.off = p.Offset
+	return file.Truncate(p.Offset)
+}
+
+// verify hashes the tmp file up to the checkpoint, data lost in a crash doesn't match the hash state
+func (this *mergeProgress) verify(file io.ReaderAt) error {
+	sh, err := GetStrongHasher(this.Strong)
+	if err != nil {
+		return err
+	}
+	saved := SeededHasher(sh, this.Seed).New()
+	um, ok := saved.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return errors.New("hash state not support")
+	}
+	if err := um.UnmarshalBinary(this.Hash); err != nil {
+		return err
+	}
+	h := SeededHasher(sh, this.Seed).New()
+	if _, err := io.Copy(h, io.NewSectionReader(file, 0, this.Offset)); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), saved.Sum(nil)) {
+		return fmt.Errorf("tmp file doesn't match the progress: %w", ErrHashMismatch)
+	}
+	return nil
+}
+
+// resume continues the running hash of the interrupted merge, hi is the resent open frame
+func (this *FileMerger) resume(hi *AnalyseInfo) error {
+	p := this.progress
+	this.progress = nil
+	if hi.Off != p.Size || hi.Strong != p.Strong || hi.BlockSize != p.BlockSize || hi.Compress != p.Compress || hi.Seed != p.Seed {
+		this.Resume = false
+		os.Remove(this.Path + ".part")
+		return errors.New("resume progress not match delta")
+	}
+	um, ok := this.hashState().(encoding.BinaryUnmarshaler)
+	if !ok {
+		return errors.New("hash state not support")
+	}
+	if err := um.UnmarshalBinary(p.Hash); err != nil {
+		return err
+	}
+	this.Frames = p.Frames - 1
+	return nil
+}
+
+// checkpoint saves the progress once CheckpointSize bytes were merged since the last one
+func (this *FileMerger) checkpoint(force bool) error {
+	if !this.Resume || this.WFile == nil || this.Hash == nil {
+		return nil
+	}
+	fs, err := this.WFile.Stat()
+	if err != nil {
+		return err
+	}
+	size := int64(this.CheckpointSize)
+	if size <= 0 {
+		size = DefaultCheckpointSize
+	}
+	if this.copyLen > 0 {
+		//the output offset counts the pending copy
+		if !force && this.off-this.saved < size {
+			return nil
+		}
+		if err := this.flushCopy(); err != nil {
+			return err
+		}
+		if fs, err = this.WFile.Stat(); err != nil {
+			return err
+		}
+	}
+	if !force && fs.Size()-this.saved < size {
+		return nil
+	}
+	m, ok := this.hashState().(encoding.BinaryMarshaler)
+	if !ok {
+		return nil
+	}
+	state, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := this.WFile.Sync(); err != nil {
+		return err
+	}
+	p := &mergeProgress{
+		Frames:    this.Frames,
+		Offset:    fs.Size(),
+		Size:      this.Size,
+		BlockSize: this.BlockSize,
+		Strong:    this.strong,
+		Compress:  this.Compress,
+		Seed:      this.seed,
+		Hash:      state,
+	}
+	buf := &bytes.Buffer{}
+	if err := p.Write(buf); err != nil {
+		return err
+	}
+	if err := writeJournal(this.Path+".part.tmp", buf.Bytes(), this.Fsync); err != nil {
+		return err
+	}
+	this.saved = fs.Size()
+	if err := os.Rename(this.Path+".part.tmp", this.Path+".part"); err != nil {
+		return err
+	}
+	if this.Fsync {
+		return syncDir(filepath.Dir(this.Path))
+	}
+	return nil
+}
+
+// writeJournal writes the progress file, fsync keeps it over a power loss
+func writeJournal(file string, dat []byte, fsync bool) error {
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(dat)
+	if err == nil && fsync {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Resumed returns the frames of an interrupted merge the sender can skip, valid after Open
+func (this *FileMerger) Resumed() int64 {
+	if this.progress == nil {
+		return 0
+	}
+	return this.progress.Frames
+}
+
+// Resumer is implemented by transports that can continue an interrupted Apply
+type Resumer interface {
+	// Resumed returns the frames of path the remote end already merged
+	Resumed(ctx context.Context, path string) (int64, error)
+}
+
+const (
+	SignatureProgressMagic = "RSGP"
+	//hashed bytes between two signature fill checkpoints
+	DefaultSignatureCheckpoint = 64 << 20
+)
+
+// fillProgress is the state of an interrupted FillHashInfo, kept in FileHashInfo.Checkpoint
+type fillProgress struct {
+	Size      int64 //source size
+	ModTime   int64 //source mtime in ns, 0 for readers
+	BlockSize uint16
+	Strong    uint8
+	Weak      uint8
+	Dups      DupPolicy
+	Seed      uint32
+	Offset    int64       //bytes hashed
+	Hash      []byte      //marshaled file hash state
+	Remap     []uint32    //DupDedup remap of the hashed blocks
+	Blocks    []HashBlock //signature blocks by index
+}
+
+func (this *fillProgress) Write(w io.Writer) error {
+	if err := writeHeader(w, SignatureProgressMagic); err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	buf.Write(tobyte64(uint64(this.Size)))
+	buf.Write(tobyte64(uint64(this.ModTime)))
+	buf.Write(tobyte16(this.BlockSize))
+	buf.Write([]byte{this.Strong, this.Weak, byte(this.Dups)})
+	buf.Write(tobyte32(this.Seed))
+	buf.Write(tobyte64(uint64(this.Offset)))
+	buf.Write(tobyte16(uint16(len(this.Hash))))
+	buf.Write(this.Hash)
+	buf.Write(tobyte32(uint32(len(this.Remap))))
+	for _, v := range this.Remap {
+		buf.Write(tobyte32(v))
+	}
+	buf.Write(tobyte32(uint32(len(this.Blocks))))
+	for _, hb := range this.Blocks {
+		if err := hb.Write(buf); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (this *fillProgress) Read(r io.Reader) error {
+	if err := readHeader(r, SignatureProgressMagic); err != nil {
+		return err
+	}
+	b := make([]byte, 8*2+2+3+4+8+2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	var err error
+	if this.Size, err = toint64(b[0:8]); err != nil {
+		return err
+	}
+	if this.ModTime, err = toint64(b[8:16]); err != nil {
+		return err
+	}
+	if this.BlockSize, err = touint16(b[16:18]); err != nil {
+		return err
+	}
+	this.Strong, this.Weak, this.Dups = b[18], b[19], DupPolicy(b[20])
+	if this.Seed, err = touint32(b[21:25]); err != nil {
+		return err
+	}
+	if this.Offset, err = toint64(b[25:33]); err != nil {
+		return err
+	}
+	if this.BlockSize == 0 || this.Offset > this.Size {
+		return fmt.Errorf("%w: fill progress offset %d size %d", ErrMalformed, this.Offset, this.Size)
+	}
+	n, err := touint16(b[33:35])
+	if err != nil {
+		return err
+	}
+	this.Hash = make([]byte, n)
+	if _, err := io.ReadFull(r, this.Hash); err != nil {
+		return err
+	}
+	sh, err := GetStrongHasher(this.Strong)
+	if err != nil {
+		return err
+	}
+	//both counts are bounded by the hashed blocks
+	limit := uint32((this.Offset + int64(this.BlockSize) - 1) / int64(this.BlockSize))
+	b4 := make([]byte, 4)
+	if _, err := io.ReadFull(r, b4); err != nil {
+		return err
+	}
+	rn, err := touint32(b4)
+	if err != nil {
+		return err
+	}
+	if rn > limit {
+		return fmt.Errorf("%w: fill progress remap count %d", ErrMalformed, rn)
+	}
+	this.Remap = make([]uint32, rn)
+	for i := range this.Remap {
+		if _, err := io.ReadFull(r, b4); err != nil {
+			return err
+		}
+		if this.Remap[i], err = touint32(b4); err != nil {
+			return err
+		}
+	}
+	if _, err := io.ReadFull(r, b4); err != nil {
+		return err
+	}
+	bn, err := touint32(b4)
+	if err != nil {
+		return err
+	}
+	if bn > limit {
+		return fmt.Errorf("%w: fill progress block count %d", ErrMalformed, bn)
+	}
+	this.Blocks = make([]HashBlock, bn)
+	for i := range this.Blocks {
+		this.Blocks[i].H3 = make([]byte, sh.Size())
+		if err := this.Blocks[i].Read(uint32(i), r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillSource returns the size and mtime a fill checkpoint is valid for
+func (this *FileHashInfo) fillSource() (int64, int64) {
+	mtime := int64(0)
+	if this.File != nil {
+		if fs, err := this.File.Stat(); err == nil {
+			mtime = fs.ModTime().UnixNano()
+		}
+	} else if this.FS != nil && this.Meta != nil {
+		mtime = this.Meta.ModTime.UnixNano()
+	}
+	return this.FileSize, mtime
+}
+
+// loadFill restores the checkpointed fill into st, false when there is none for this source and options
+func (this *FileHashInfo) loadFill(st *fillState) bool {
+	fd, err := os.Open(this.Checkpoint)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+	p := &fillProgress{}
+	if err := p.Read(fd); err != nil {
+		return false
+	}
+	size, mtime := this.fillSource()
+	if p.Size != size || p.ModTime != mtime || p.BlockSize != this.BlockSize || p.Strong != this.Hasher.ID() ||
+		p.Weak != this.Weak.ID() || p.Dups != this.Dups || p.Seed != this.Seed {
+		return false
+	}
+	if p.Offset%int64(p.BlockSize) != 0 {
+		return false
+	}
+	if this.Dups == DupDedup && int64(len(p.Remap)) != p.Offset/int64(p.BlockSize) {
+		return false
+	}
+	um, ok := st.hash.(encoding.BinaryUnmarshaler)
+	if !ok || um.UnmarshalBinary(p.Hash) != nil {
+		return false
+	}
+	for _, hb := range p.Blocks {
+		ms := hex.EncodeToString(hb.H3)
+		if _, ok := this.Blocks[ms]; ok {
+			ms += "/" + strconv.FormatUint(uint64(hb.Idx), 10)
+		}
+		this.Blocks[ms] = hb
+	}
+	this.Remap = p.Remap
+	st.off = uint64(p.Offset)
+	st.idx = uint32(len(p.Blocks))
+	return true
+}
+
+// saveFill checkpoints st, a file hash without a marshalable state is not saved
+func (this *FileHashInfo) saveFill(st *fillState) error {
+	m, ok := st.hash.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil
+	}
+	state, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	size, mtime := this.fillSource()
+	p := &fillProgress{
+		Size:      size,
+		ModTime:   mtime,
+		BlockSize: this.BlockSize,
+		Strong:    this.Hasher.ID(),
+		Weak:      this.Weak.ID(),
+		Dups:      this.Dups,
+		Seed:      this.Seed,
+		Offset:    int64(st.off),
+		Hash:      state,
+		Remap:     this.Remap,
+		Blocks:    make([]HashBlock, st.idx),
+	}
+	for _, hb := range this.Blocks {
+		if hb.Idx < st.idx {
+			p.Blocks[hb.Idx] = hb
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := p.Write(buf); err != nil {
+		return err
+	}
+	if err := os.WriteFile(this.Checkpoint+".tmp", buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(this.Checkpoint+".tmp", this.Checkpoint)
+}
+
+// fillResumable is the fill of Reader that continues from the Checkpoint file and saves to it
+func (this *FileHashInfo) fillResumable(ctx context.Context, cb func(info *HashBlock)) error {
+	if this.BlockSize == 0 {
+		return errors.New("block size error")
+	}
+	if this.Hasher == nil {
+		return errors.New("strong hash nil")
+	}
+	if this.Weak == nil {
+		return errors.New("weak hash nil")
+	}
+	this.Blocks = map[string]HashBlock{}
+	this.Remap = nil
+	st := &fillState{hash: this.strong().New()}
+	if !this.loadFill(st) {
+		this.Blocks = map[string]HashBlock{}
+		this.Remap = nil
+		st = &fillState{hash: this.strong().New()}
+	}
+	if _, err := this.Reader.Seek(int64(st.off), io.SeekStart); err != nil {
+		return fmt.Errorf("seek file error: %v", err)
+	}
+	every := this.CheckpointSize
+	if every <= 0 {
+		every = DefaultSignatureCheckpoint
+	}
+	saved := st.off
+	save := func(st *fillState) error {
+		if int64(st.off-saved) < every || st.off%uint64(this.BlockSize) != 0 {
+			return nil
+		}
+		if err := this.saveFill(st); err != nil {
+			return err
+		}
+		saved = st.off
+		return nil
+	}
+	err := this.fillFrom(ctx, bufio.NewReaderSize(this.Reader, DefaultReadAhead), cb, st, save)
+	if err != nil {
+		//keep the work done, a partial last block can't be continued
+		if st.off > saved && st.off%uint64(this.BlockSize) == 0 {
+			this.saveFill(st)
+		}
+		return err
+	}
+	os.Remove(this.Checkpoint)
+	return nil
+}
@@ -0,0 +1,411 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMergerResume(t *testing.T) {
+	//the hash state is also saved when hashed in a goroutine
+	for _, async := range []bool{false, true} {
+		dir := t.TempDir()
+		rnd := rand.New(rand.NewSource(1))
+		basis := make([]byte, DefaultBlockSize*50)
+		rnd.Read(basis)
+		src := append([]byte{}, basis...)
+		rnd.Read(src[DefaultBlockSize*10 : DefaultBlockSize*30])
+		file := filepath.Join(dir, "f.bin")
+		os.WriteFile(file, basis, 0644)
+		sig, err := GetFileHashInfo(file, nil)
+		if err != nil {
+			t.Fatal(async, err)
+		}
+		frames := []*AnalyseInfo{}
+		if err := analyseReader(sig, bytes.NewReader(src), func(info *AnalyseInfo) error {
+			//Data is reused after the call
+			frames = append(frames, info.Clone())
+			return nil
+		}); err != nil {
+			t.Fatal(async, err)
+		}
+		m := NewFileMerger(file, sig)
+		m.Resume = true
+		m.AsyncHash = async
+		m.CheckpointSize = 1
+		if err := m.Open(); err != nil {
+			t.Fatal(async, err)
+		}
+		half := len(frames) / 2
+		for _, info := range frames[:half] {
+			if err := m.Write(info); err != nil {
+				t.Fatal(async, err)
+			}
+		}
+		//interrupted
+		m.Close()
+		if n := ResumedFrames(file); n != int64(half) {
+			t.Fatal(async, "resumed frames error", n, half)
+		}
+		m = NewFileMerger(file, sig)
+		m.Resume = true
+		m.AsyncHash = async
+		if err := m.Open(); err != nil {
+			t.Fatal(async, err)
+		}
+		if m.Resumed() != int64(half) {
+			t.Fatal(async, "merger resumed error", m.Resumed())
+		}
+		sent := 0
+		fn := ResumeFrames(m.Resumed(), func(info *AnalyseInfo) error {
+			sent++
+			return m.Write(info)
+		})
+		for _, info := range frames {
+			if err := fn(info); err != nil {
+				t.Fatal(async, err)
+			}
+		}
+		m.Close()
+		if sent != len(frames)-half+1 {
+			t.Error(async, "sent frames error", sent)
+		}
+		if got, _ := os.ReadFile(file); !bytes.Equal(got, src) {
+			t.Error(async, "resumed file error")
+		}
+		if _, err := os.Stat(file + ".part"); !os.IsNotExist(err) {
+			t.Error(async, "progress not removed")
+		}
+	}
+}
+
+func TestTCPResume(t *testing.T) {
+	root := t.TempDir()
+	srv := NewTCPServer(root)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+	ctx := context.Background()
+	dat := make([]byte, 3<<20)
+	rand.New(rand.NewSource(2)).Read(dat)
+	c, err := DialTCP(ctx, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := c.Signature(ctx, "big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := &bytes.Buffer{}
+	if err := Delta(sig, bytes.NewReader(dat), delta); err != nil {
+		t.Fatal(err)
+	}
+	full := delta.Len()
+	//connection lost half way
+	if err := c.Apply(ctx, "big.bin", io.LimitReader(delta, int64(full/2))); err == nil {
+		t.Fatal("apply error expected")
+	}
+	c.Close()
+	file := filepath.Join(root, "big.bin")
+	for i := 0; ResumedFrames(file) == 0; i++ {
+		if i > 100 {
+			t.Fatal("progress not saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c, err = DialTCP(ctx, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	n, err := c.Resumed(ctx, "big.bin")
+	if err != nil || n == 0 {
+		t.Fatal("resumed error", n, err)
+	}
+	if err := Push(ctx, c, bytes.NewReader(dat), "big.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(file); !bytes.Equal(got, dat) {
+		t.Error("resumed file error")
+	}
+	if n := ResumedFrames(file); n != 0 {
+		t.Error("progress left", n)
+	}
+}
+
+func TestFillResume(t *testing.T) {
+	dir := t.TempDir()
+	rnd := rand.New(rand.NewSource(2))
+	src := make([]byte, DefaultBlockSize*200+100)
+	rnd.Read(src)
+	//duplicates for both policies
+	copy(src[DefaultBlockSize*50:], src[:DefaultBlockSize*3])
+	file := filepath.Join(dir, "f.bin")
+	os.WriteFile(file, src, 0644)
+	cp := filepath.Join(dir, "f.sig.part")
+	for _, dups := range []DupPolicy{DupDedup, DupKeepAll} {
+		want, err := GetFileHashInfo(file, nil, WithDups(dups))
+		if err != nil {
+			t.Fatal(err)
+		}
+		//interrupted after the first checkpoints
+		ctx, cancel := context.WithCancel(context.Background())
+		df := NewFileHashInfo(file, WithDups(dups), WithFillCheckpoint(cp))
+		df.CheckpointSize = DefaultBlockSize * 20
+		if err := df.Open(); err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		err = df.FillHashInfoContext(ctx, func(info *HashBlock) {
+			if n++; n == 100 {
+				cancel()
+			}
+		})
+		df.Close()
+		if err != context.Canceled {
+			t.Fatal("fill not canceled", err)
+		}
+		if _, err := os.Stat(cp); err != nil {
+			t.Fatal("checkpoint not saved", err)
+		}
+		df = NewFileHashInfo(file, WithDups(dups), WithFillCheckpoint(cp))
+		if err := df.Open(); err != nil {
+			t.Fatal(err)
+		}
+		n = 0
+		err = df.FillHashInfo(func(info *HashBlock) {
+			n++
+		})
+		df.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := df.GetHashInfo(); !HashInfoEqual(got, want) || !bytes.Equal(got.MD5, want.MD5) {
+			t.Fatal("resumed signature error", dups)
+		}
+		if n >= len(want.Blocks) {
+			t.Error("fill not resumed", n)
+		}
+		if _, err := os.Stat(cp); !os.IsNotExist(err) {
+			t.Error("checkpoint not removed")
+		}
+	}
+	//a changed source starts over
+	df := NewFileHashInfo(file, WithFillCheckpoint(cp))
+	df.CheckpointSize = DefaultBlockSize * 20
+	if err := df.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	df.FillHashInfoContext(ctx, func(info *HashBlock) {
+		cancel()
+	})
+	df.Close()
+	src[0]++
+	os.WriteFile(file, src, 0644)
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Hour))
+	want, err := GetFileHashInfo(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetFileHashInfo(file, nil, WithFillCheckpoint(cp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !HashInfoEqual(got, want) || !bytes.Equal(got.MD5, want.MD5) {
+		t.Error("changed source signature error")
+	}
+}
+
+func TestKeepPartial(t *testing.T) {
+	rnd := rand.New(rand.NewSource(16))
+	basis := make([]byte, DefaultBlockSize*40)
+	rnd.Read(basis)
+	//inserted data goes with the index frame of the next block
+	ins := make([]byte, 100)
+	rnd.Read(ins)
+	src := append(append(bytes.Clone(basis[:DefaultBlockSize*20]), ins...), basis[DefaultBlockSize*20:]...)
+	newMerger := func(file string, sig *HashInfo) *FileMerger {
+		m := NewFileMerger(file, sig)
+		m.Resume = true
+		m.KeepPartial = true
+		m.CheckpointSize = 1
+		if err := m.Open(); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "f.bin")
+	os.WriteFile(file, basis, 0644)
+	sig, err := GetFileHashInfo(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := []*AnalyseInfo{}
+	if err := analyseReader(sig, bytes.NewReader(src), func(info *AnalyseInfo) error {
+		frames = append(frames, info.Clone())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	//a frame failing after its literal was written keeps the checkpoint before it
+	bad := -1
+	for i, v := range frames {
+		if v.IsIndex() && v.IsData() {
+			bad = i
+			break
+		}
+	}
+	if bad < 0 {
+		t.Fatal("no literal index frame")
+	}
+	m := newMerger(file, sig)
+	for _, v := range frames[:bad] {
+		if err := m.Write(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	broken := frames[bad].Clone()
+	broken.Off = int64(len(basis))
+	if err := m.Write(broken); err == nil {
+		t.Fatal("broken frame merged")
+	}
+	m.Close()
+	if n := ResumedFrames(file); n != int64(bad) {
+		t.Fatal("resumed frames", n, bad)
+	}
+	m = newMerger(file, sig)
+	fn := ResumeFrames(m.Resumed(), m.Write)
+	for _, v := range frames {
+		if err := fn(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Close()
+	if got, _ := os.ReadFile(file); !bytes.Equal(got, src) {
+		t.Fatal("resumed merge error")
+	}
+	//a hash mismatch can't be resumed, the temp file is kept aside
+	sig, err = GetFileHashInfo(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = newMerger(file, sig)
+	err = analyseReader(sig, bytes.NewReader(basis), func(info *AnalyseInfo) error {
+		if info.IsClose() {
+			info.Hash = bytes.Repeat([]byte{1}, len(info.Hash))
+		}
+		return m.Write(info)
+	})
+	m.Close()
+	if !errors.Is(err, ErrHashMismatch) {
+		t.Fatal("hash mismatch error", err)
+	}
+	if got, _ := os.ReadFile(PartialPath(file)); !bytes.Equal(got, basis) {
+		t.Error("partial file not kept")
+	}
+	if got, _ := os.ReadFile(file); !bytes.Equal(got, src) {
+		t.Error("target changed")
+	}
+	if _, err := os.Stat(file + ".part"); !os.IsNotExist(err) {
+		t.Error("progress of a bad merge kept")
+	}
+}
+
+func TestMergeJournal(t *testing.T) {
+	rnd := rand.New(rand.NewSource(17))
+	basis := make([]byte, DefaultBlockSize*30)
+	rnd.Read(basis)
+	src := make([]byte, DefaultBlockSize*30)
+	rnd.Read(src)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "f.bin")
+	os.WriteFile(file, basis, 0644)
+	sig, err := GetFileHashInfo(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := []*AnalyseInfo{}
+	if err := analyseReader(sig, bytes.NewReader(src), func(info *AnalyseInfo) error {
+		frames = append(frames, info.Clone())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	open := func() *FileMerger {
+		m := NewFileMerger(file, sig)
+		m.Resume = true
+		m.Fsync = true
+		m.CheckpointSize = DefaultBlockSize * 4
+		if err := m.Open(); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	//crashes after a checkpoint, the process dies without Close
+	crash := func() {
+		m := open()
+		for _, v := range frames[:len(frames)/2] {
+			if err := m.Write(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		m.WFile.Close()
+		m.Locker.Close()
+		os.Remove(m.Locker.Path())
+	}
+	tmp := TempPath(file, "")
+	for name, damage := range map[string]func(){
+		"intact": func() {},
+		"torn journal": func() {
+			dat, _ := os.ReadFile(file + ".part")
+			os.WriteFile(file+".part", dat[:len(dat)-3], 0644)
+		},
+		"bad journal": func() {
+			dat, _ := os.ReadFile(file + ".part")
+			dat[12] ^= 1
+			os.WriteFile(file+".part", dat, 0644)
+		},
+		"bad data": func() {
+			fd, _ := os.OpenFile(tmp, os.O_RDWR, 0)
+			b := []byte{0}
+			fd.ReadAt(b, 100)
+			fd.WriteAt([]byte{b[0] ^ 1}, 100)
+			fd.Close()
+		},
+	} {
+		os.Remove(tmp)
+		os.Remove(file + ".part")
+		crash()
+		if ResumedFrames(file) == 0 {
+			t.Fatal(name, "no checkpoint")
+		}
+		damage()
+		m := open()
+		if resumed := m.Resumed() > 0; resumed != (name == "intact") {
+			t.Error(name, "resumed", m.Resumed())
+		}
+		fn := ResumeFrames(m.Resumed(), m.Write)
+		for _, v := range frames {
+			if err := fn(v); err != nil {
+				t.Fatal(name, err)
+			}
+		}
+		m.Close()
+		if got, _ := os.ReadFile(file); !bytes.Equal(got, src) {
+			t.Error(name, "merge error")
+		}
+		os.WriteFile(file, basis, 0644)
+	}
+}
@@ -0,0 +1,206 @@
+package rsync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy runs retryable operations again after failures that may pass, the wait before
+// each retry doubles up to MaxWait
+type RetryPolicy struct {
+	Retries   int                  //extra attempts
+	Wait      time.Duration        //before the first retry
+	MaxWait   time.Duration        //caps the wait, 0 no cap
+	Retryable func(err error) bool //IsRetryable when nil
+}
+
+func NewRetryPolicy(retries int, wait time.Duration) *RetryPolicy {
+	return &RetryPolicy{Retries: retries, Wait: wait}
+}
+
+// Do runs fn until it succeeds, fails with an error not retryable or the retries are used up,
+// a nil policy runs fn once
+func (this *RetryPolicy) Do(ctx context.Context, fn func() error) error {
+	if this == nil {
+		return fn()
+	}
+	retryable := this.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	wait := this.Wait
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || i >= this.Retries || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wait *= 2
+		if this.MaxWait > 0 && wait > this.MaxWait {
+			wait = this.MaxWait
+		}
+	}
+}
+
+// permanent reports errors another attempt can't fix, bad data, hash mismatches, missing
+// files and denied access
+func permanent(err error) bool {
+	for _, v := range []error{ErrHashMismatch, ErrMalformed, ErrBadMagic, ErrUnsupportedVersion,
+		ErrStateOrder, ErrNoSignature, ErrShortBlock, ErrAlgorithmMismatch, ErrTooLarge, ErrMaxDelete, fs.ErrNotExist, fs.ErrPermission,
+		fs.ErrExist, context.Canceled, context.DeadlineExceeded} {
+		if errors.Is(err, v) {
+			return true
+		}
+	}
+	var se *HTTPStatusError
+	if errors.As(err, &se) {
+		return se.StatusCode < 500 && se.StatusCode != http.StatusTooManyRequests
+	}
+	return false
+}
+
+// IsRetryable reports transient errors, timeouts, interrupted calls, broken or refused
+// connections, streams cut short and http server errors
+func IsRetryable(err error) bool {
+	if err == nil || permanent(err) {
+		return false
+	}
+	var se *HTTPStatusError
+	if errors.As(err, &se) {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	for _, v := range []error{syscall.EINTR, syscall.EAGAIN, syscall.ECONNRESET, syscall.ECONNREFUSED,
+		syscall.ECONNABORTED, syscall.EPIPE, syscall.ETIMEDOUT, os.ErrDeadlineExceeded,
+		io.ErrUnexpectedEOF, io.ErrClosedPipe, net.ErrClosed, ErrBusy} {
+		if errors.Is(err, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryTransport retries the signature fetches, listings, removes and links of Transport and
+// the delta uploads from an io.ReadSeeker, other deltas can't be sent again
+type RetryTransport struct {
+	Transport
+	Policy *RetryPolicy
+}
+
+func NewRetryTransport(t Transport, policy *RetryPolicy) *RetryTransport {
+	return &RetryTransport{Transport: t, Policy: policy}
+}
+
+func (this *RetryTransport) Signature(ctx context.Context, path string) (*HashInfo, error) {
+	var hi *HashInfo
+	err := this.Policy.Do(ctx, func() error {
+		var err error
+		hi, err = this.Transport.Signature(ctx, path)
+		return err
+	})
+	return hi, err
+}
+
+func (this *RetryTransport) Apply(ctx context.Context, path string, delta io.Reader) error {
+	rs, ok := delta.(io.ReadSeeker)
+	if !ok {
+		return this.Transport.Apply(ctx, path, delta)
+	}
+	return this.Policy.Do(ctx, func() error {
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return this.Transport.Apply(ctx, path, rs)
+	})
+}
+
+func (this *RetryTransport) List(ctx context.Context, dir string) ([]FileEntry, error) {
+	l, ok := this.Transport.(Lister)
+	if !ok {
+		return nil, errors.New("transport can't list files")
+	}
+	var list []FileEntry
+	err := this.Policy.Do(ctx, func() error {
+		var err error
+		list, err = l.List(ctx, dir)
+		return err
+	})
+	return list, err
+}
+
+func (this *RetryTransport) Remove(ctx context.Context, path string) error {
+	r, ok := this.Transport.(Remover)
+	if !ok {
+		return errors.New("transport can't remove files")
+	}
+	return this.Policy.Do(ctx, func() error {
+		return r.Remove(ctx, path)
+	})
+}
+
+func (this *RetryTransport) Symlink(ctx context.Context, target string, path string) error {
+	sl, ok := this.Transport.(Symlinker)
+	if !ok {
+		return errors.New("transport can't create symlinks")
+	}
+	return this.Policy.Do(ctx, func() error {
+		return sl.Symlink(ctx, target, path)
+	})
+}
+
+func (this *RetryTransport) Link(ctx context.Context, target string, path string) error {
+	h, ok := this.Transport.(HardLinker)
+	if !ok {
+		return errors.New("transport can't create hard links")
+	}
+	return this.Policy.Do(ctx, func() error {
+		return h.Link(ctx, target, path)
+	})
+}
+
+// RetryReaderAt retries the failed block reads of R, like basis reads over a network
+type RetryReaderAt struct {
+	R      io.ReaderAt
+	Policy *RetryPolicy
+	Ctx    context.Context //stops the waits, background when nil
+}
+
+func NewRetryReaderAt(ctx context.Context, r io.ReaderAt, policy *RetryPolicy) *RetryReaderAt {
+	return &RetryReaderAt{R: r, Policy: policy, Ctx: ctx}
+}
+
+// ReadAt reads p again as a whole after a retryable failure, io.EOF is passed on
+func (this *RetryReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	ctx := this.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	n := 0
+	err := this.Policy.Do(ctx, func() error {
+		var err error
+		n, err = this.R.ReadAt(p, off)
+		if err == io.EOF {
+			//the end of the data, not a failure
+			return nil
+		}
+		return err
+	})
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,145 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testFlakyTransport fails the first fails calls of Signature and Apply with err
+type testFlakyTransport struct {
+	Transport
+	fails int
+	err   error
+	calls int
+}
+
+func (this *testFlakyTransport) fail() error {
+	this.calls++
+	if this.fails > 0 {
+		this.fails--
+		return this.err
+	}
+	return nil
+}
+
+func (this *testFlakyTransport) Signature(ctx context.Context, path string) (*HashInfo, error) {
+	if err := this.fail(); err != nil {
+		return nil, err
+	}
+	return this.Transport.Signature(ctx, path)
+}
+
+func (this *testFlakyTransport) Apply(ctx context.Context, path string, delta io.Reader) error {
+	if err := this.fail(); err != nil {
+		//the failed upload read part of the delta
+		io.CopyN(io.Discard, delta, 3)
+		return err
+	}
+	return this.Transport.Apply(ctx, path, delta)
+}
+
+// testFlakyReaderAt fails every other read
+type testFlakyReaderAt struct {
+	r     io.ReaderAt
+	calls int
+}
+
+func (this *testFlakyReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	this.calls++
+	if this.calls%2 == 1 {
+		return 0, &os.PathError{Op: "read", Path: "basis", Err: syscall.EINTR}
+	}
+	return this.r.ReadAt(p, off)
+}
+
+func TestRetry(t *testing.T) {
+	for _, v := range []struct {
+		err error
+		ok  bool
+	}{
+		{syscall.EINTR, true},
+		{fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		{os.ErrDeadlineExceeded, true},
+		{io.ErrUnexpectedEOF, true},
+		{&HTTPStatusError{StatusCode: 503}, true},
+		{&HTTPStatusError{StatusCode: 404}, false},
+		{&FrameError{Err: ErrHashMismatch}, false},
+		{fs.ErrNotExist, false},
+		{context.Canceled, false},
+		{errors.New("other"), false},
+	} {
+		if IsRetryable(v.err) != v.ok {
+			t.Errorf("IsRetryable(%v) != %v", v.err, v.ok)
+		}
+	}
+	ctx := context.Background()
+	p := NewRetryPolicy(3, time.Millisecond)
+	n := 0
+	if err := p.Do(ctx, func() error {
+		n++
+		return syscall.EAGAIN
+	}); !errors.Is(err, syscall.EAGAIN) || n != 4 {
+		t.Error("retries error", n, err)
+	}
+	n = 0
+	if err := p.Do(ctx, func() error {
+		n++
+		return ErrHashMismatch
+	}); !errors.Is(err, ErrHashMismatch) || n != 1 {
+		t.Error("permanent error retried", n)
+	}
+	//signature fetch and seekable delta upload
+	root := t.TempDir()
+	flaky := &testFlakyTransport{Transport: NewLocalStore(root), fails: 2, err: syscall.ECONNRESET}
+	rt := NewRetryTransport(flaky, p)
+	dat := bytes.Repeat([]byte("retry data "), 500)
+	sig, err := rt.Signature(ctx, "a.txt")
+	if err != nil || flaky.calls != 3 {
+		t.Fatal("signature retry error", flaky.calls, err)
+	}
+	delta := &bytes.Buffer{}
+	if err := Delta(sig, bytes.NewReader(dat), delta); err != nil {
+		t.Fatal(err)
+	}
+	flaky.fails = 1
+	if err := rt.Apply(ctx, "a.txt", bytes.NewReader(delta.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, root, map[string]string{"a.txt": string(dat)})
+	//a delta read once is not sent again
+	flaky.fails = 1
+	if err := rt.Apply(ctx, "a.txt", io.MultiReader(bytes.NewReader(delta.Bytes()))); !errors.Is(err, syscall.ECONNRESET) {
+		t.Error("stream delta retried", err)
+	}
+	//block reads
+	basisSig, err := Signature(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := append([]byte("head"), dat...)
+	delta.Reset()
+	if err := Delta(basisSig, bytes.NewReader(src), delta); err != nil {
+		t.Fatal(err)
+	}
+	flakyAt := &testFlakyReaderAt{r: bytes.NewReader(dat)}
+	ra := NewRetryReaderAt(ctx, flakyAt, p)
+	out := &bytes.Buffer{}
+	if err := Patch(ra, bytes.NewReader(delta.Bytes()), out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), src) || flakyAt.calls < 2 {
+		t.Error("retried block reads error", flakyAt.calls)
+	}
+	b := make([]byte, 10)
+	if n, err := ra.ReadAt(b, int64(len(dat)-4)); n != 4 || err != io.EOF {
+		t.Error("retry read end error", n, err)
+	}
+}
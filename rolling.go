@@ -0,0 +1,351 @@
+package rsync
+
+import (
+	"fmt"
+	"hash/crc32"
+)
+
+// weak hash ids recorded in HashInfo
+const (
+	WeakAdler32 = 0
+	WeakBuzhash = 1
+	WeakRabin   = 2
+	WeakCRC32C  = 5 //3 and 4 are the librsync hashes
+)
+
+// RollingHash is a weak checksum over a window that can slide one byte at a time,
+// the window is every byte written since Reset
+type RollingHash interface {
+	Reset()
+	Write(p []byte) (int, error)
+	Roll(out, in byte)
+	Sum32() uint32
+}
+
+// WeakHasher creates the rolling hash used for block matching
+type WeakHasher interface {
+	ID() uint8
+	Name() string
+	New() RollingHash
+}
+
+type weakHasher struct {
+	id   uint8
+	name string
+	fn   func() RollingHash
+}
+
+func (this *weakHasher) ID() uint8 {
+	return this.id
+}
+
+func (this *weakHasher) Name() string {
+	return this.name
+}
+
+func (this *weakHasher) New() RollingHash {
+	return this.fn()
+}
+
+var (
+	Adler32Hasher WeakHasher = &weakHasher{
+		id:   WeakAdler32,
+		name: "adler32",
+		fn: func() RollingHash {
+			return newAdler()
+		},
+	}
+	BuzHasher WeakHasher = &weakHasher{
+		id:   WeakBuzhash,
+		name: "buzhash",
+		fn: func() RollingHash {
+			return &buzhash{}
+		},
+	}
+	RabinHasher WeakHasher = &weakHasher{
+		id:   WeakRabin,
+		name: "rabin",
+		fn: func() RollingHash {
+			return &rabin{}
+		},
+	}
+	//crc32 castagnoli, hardware accelerated on most cpus and spreads small blocks better than adler32
+	CRC32CHasher WeakHasher = &weakHasher{
+		id:   WeakCRC32C,
+		name: "crc32c",
+		fn: func() RollingHash {
+			return &crc32c{}
+		},
+	}
+)
+
+var weakHashers = map[uint8]WeakHasher{
+	WeakAdler32: Adler32Hasher,
+	WeakBuzhash: BuzHasher,
+	WeakRabin:   RabinHasher,
+	WeakCRC32C:  CRC32CHasher,
+}
+
+// RegisterWeakHasher adds or replaces the hasher for h.ID(), call it from init
+func RegisterWeakHasher(h WeakHasher) {
+	weakHashers[h.ID()] = h
+}
+
+// GetWeakHasher returns the hasher registered for id
+func GetWeakHasher(id uint8) (WeakHasher, error) {
+	h, ok := weakHashers[id]
+	if !ok {
+		return nil, fmt.Errorf("weak hash %d not support", id)
+	}
+	return h, nil
+}
+
+// SeededWeakHasher maps every byte through a permutation drawn from seed before h sums it, the
+// weak sums of a seeded signature can't be predicted without the seed and still roll, seed 0 returns h
+func SeededWeakHasher(h WeakHasher, seed uint32) WeakHasher {
+	if seed == 0 {
+		return h
+	}
+	perm := &[256]byte{}
+	for i := range perm {
+		perm[i] = byte(i)
+	}
+	//fisher yates shuffle
+	x := uint64(seed)
+	for i := len(perm) - 1; i > 0; i-- {
+		j := splitmix64(&x) % uint64(i+1)
+		perm[i], perm[j] = perm[j], perm[i]
+	}
+	return &seededWeakHasher{WeakHasher: h, perm: perm}
+}
+
+type seededWeakHasher struct {
+	WeakHasher
+	perm *[256]byte
+}
+
+func (this *seededWeakHasher) New() RollingHash {
+	return &seededRolling{RollingHash: this.WeakHasher.New(), perm: this.perm}
+}
+
+// seededRolling passes the mapped bytes on
+type seededRolling struct {
+	RollingHash
+	perm *[256]byte
+}
+
+func (this *seededRolling) Write(p []byte) (int, error) {
+	var buf [256]byte
+	for off := 0; off < len(p); off += len(buf) {
+		b := buf[:min(len(p)-off, len(buf))]
+		for i := range b {
+			b[i] = this.perm[p[off+i]]
+		}
+		this.RollingHash.Write(b)
+	}
+	return len(p), nil
+}
+
+func (this *seededRolling) Roll(out, in byte) {
+	this.RollingHash.Roll(this.perm[out], this.perm[in])
+}
+
+func weakSum(h WeakHasher, dat []byte) uint32 {
+	hh := h.New()
+	hh.Write(dat)
+	return hh.Sum32()
+}
+
+const adlerMod = 65521
+
+// same value as hash/adler32
+type adler struct {
+	a uint32
+	b uint32
+	n uint32
+}
+
+func newAdler() *adler {
+	return &adler{a: 1}
+}
+
+func (this *adler) Reset() {
+	this.a = 1
+	this.b = 0
+	this.n = 0
+}
+
+func (this *adler) Write(p []byte) (int, error) {
+	for _, c := range p {
+		this.a = (this.a + uint32(c)) % adlerMod
+		this.b = (this.b + this.a) % adlerMod
+	}
+	this.n += uint32(len(p))
+	return len(p), nil
+}
+
+func (this *adler) Roll(out, in byte) {
+	this.a = (this.a + adlerMod - uint32(out) + uint32(in)) % adlerMod
+	x := (this.n % adlerMod) * uint32(out) % adlerMod
+	this.b = (this.b + adlerMod - x + this.a + adlerMod - 1) % adlerMod
+}
+
+func (this *adler) Sum32() uint32 {
+	return this.b<<16 | this.a
+}
+
+// splitmix64 advances the state x and returns its next value
+func splitmix64(x *uint64) uint64 {
+	*x += 0x9E3779B97F4A7C15
+	z := *x
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return z ^ (z >> 31)
+}
+
+var buztable = func() [256]uint32 {
+	//splitmix64 with a fixed seed, tables must match on both sides
+	t := [256]uint32{}
+	x := uint64(0x9E3779B97F4A7C15)
+	for i := range t {
+		t[i] = uint32(splitmix64(&x))
+	}
+	return t
+}()
+
+func rotl32(v uint32, n uint32) uint32 {
+	n &= 31
+	return v<<n | v>>(32-n)
+}
+
+type buzhash struct {
+	h uint32
+	n uint32
+}
+
+func (this *buzhash) Reset() {
+	this.h = 0
+	this.n = 0
+}
+
+func (this *buzhash) Write(p []byte) (int, error) {
+	for _, c := range p {
+		this.h = rotl32(this.h, 1) ^ buztable[c]
+	}
+	this.n += uint32(len(p))
+	return len(p), nil
+}
+
+func (this *buzhash) Roll(out, in byte) {
+	this.h = rotl32(this.h, 1) ^ rotl32(buztable[out], this.n) ^ buztable[in]
+}
+
+func (this *buzhash) Sum32() uint32 {
+	return this.h
+}
+
+// rabin-karp polynomial hash mod 2^32
+const rabinBase = 0x01000193
+
+type rabin struct {
+	h   uint32
+	n   uint32
+	pn  uint32
+	pow uint32
+}
+
+func (this *rabin) Reset() {
+	this.h = 0
+	this.n = 0
+}
+
+func (this *rabin) Write(p []byte) (int, error) {
+	for _, c := range p {
+		this.h = this.h*rabinBase + uint32(c) + 1
+	}
+	this.n += uint32(len(p))
+	return len(p), nil
+}
+
+func (this *rabin) Roll(out, in byte) {
+	if this.pn != this.n || this.pow == 0 {
+		this.pow = 1
+		for i := uint32(0); i < this.n; i++ {
+			this.pow *= rabinBase
+		}
+		this.pn = this.n
+	}
+	this.h = this.h*rabinBase + uint32(in) + 1 - (uint32(out)+1)*this.pow
+}
+
+func (this *rabin) Sum32() uint32 {
+	return this.h
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// crc32c is the crc32 castagnoli of the window, same value as hash/crc32. The crc is linear, the
+// byte leaving a window of n bytes changes the crc by out[byte]
+type crc32c struct {
+	h   uint32
+	n   uint32
+	on  uint32 //window size of out
+	out *[256]uint32
+}
+
+func (this *crc32c) Reset() {
+	this.h = 0
+	this.n = 0
+}
+
+func (this *crc32c) Write(p []byte) (int, error) {
+	this.h = crc32.Update(this.h, castagnoli, p)
+	this.n += uint32(len(p))
+	return len(p), nil
+}
+
+// crc32cZeros is the crc of b followed by n zero bytes
+func crc32cZeros(b []byte, n uint32) uint32 {
+	var zero [4096]byte
+	h := crc32.Update(0, castagnoli, b)
+	for n > 0 {
+		k := min(n, uint32(len(zero)))
+		h = crc32.Update(h, castagnoli, zero[:k])
+		n -= k
+	}
+	return h
+}
+
+// outTable is the crc change of every byte leaving a window of n bytes, the crc of the byte
+// followed by n zeros without the init and final xor, built from the 8 single bit bytes
+func (this *crc32c) outTable() {
+	zn, zn1 := crc32cZeros(nil, this.n), crc32cZeros([]byte{0}, this.n)
+	bits := [8]uint32{}
+	for i := range bits {
+		bits[i] = crc32cZeros([]byte{1 << i}, this.n) ^ zn1
+	}
+	out := &[256]uint32{}
+	for b := range out {
+		v := zn1 ^ zn
+		for i := range bits {
+			if b&(1<<i) != 0 {
+				v ^= bits[i]
+			}
+		}
+		out[b] = v
+	}
+	this.out, this.on = out, this.n
+}
+
+func (this *crc32c) Roll(out, in byte) {
+	if this.out == nil || this.on != this.n {
+		this.outTable()
+	}
+	h := ^this.h
+	h = castagnoli[byte(h)^in] ^ h>>8
+	this.h = ^h ^ this.out[out]
+}
+
+func (this *crc32c) Sum32() uint32 {
+	return this.h
+}
@@ -0,0 +1,86 @@
+package rsync
+
+import (
+	"bytes"
+	"hash/adler32"
+	"hash/crc32"
+	"math/rand"
+	"testing"
+)
+
+func TestRollingHash(t *testing.T) {
+	dat := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(dat)
+	if weakSum(Adler32Hasher, dat) != adler32.Checksum(dat) {
+		t.Error("adler32 sum error")
+	}
+	if weakSum(CRC32CHasher, dat) != crc32.Checksum(dat, crc32.MakeTable(crc32.Castagnoli)) {
+		t.Error("crc32c sum error")
+	}
+	for _, wh := range []WeakHasher{Adler32Hasher, BuzHasher, RabinHasher, CRC32CHasher} {
+		for _, w := range []int{1, 31, 32, 700} {
+			h := wh.New()
+			h.Write(dat[:w])
+			for i := w; i < len(dat); i++ {
+				h.Roll(dat[i-w], dat[i])
+				if h.Sum32() != weakSum(wh, dat[i-w+1:i+1]) {
+					t.Fatal(wh.Name(), "roll error window", w, "at", i)
+				}
+			}
+		}
+	}
+}
+
+func TestSeededWeakHasher(t *testing.T) {
+	if SeededWeakHasher(Adler32Hasher, 0) != Adler32Hasher {
+		t.Fatal("seed 0 changed the hasher")
+	}
+	dat := make([]byte, 4096)
+	rand.New(rand.NewSource(2)).Read(dat)
+	for _, wh := range []WeakHasher{Adler32Hasher, BuzHasher, RabinHasher, CRC32CHasher} {
+		sh := SeededWeakHasher(wh, 1)
+		if sh.ID() != wh.ID() {
+			t.Fatal(wh.Name(), "seeded id error")
+		}
+		a := weakSum(sh, dat[:700])
+		if a == weakSum(wh, dat[:700]) || a == weakSum(SeededWeakHasher(wh, 2), dat[:700]) {
+			t.Error(wh.Name(), "seed not mixed")
+		}
+		h := sh.New()
+		h.Write(dat[:700])
+		for i := 700; i < len(dat); i++ {
+			h.Roll(dat[i-700], dat[i])
+			if h.Sum32() != weakSum(sh, dat[i-700+1:i+1]) {
+				t.Fatal(wh.Name(), "seeded roll error at", i)
+			}
+		}
+	}
+}
+
+func TestWeakHasherSync(t *testing.T) {
+	basis := bytes.Repeat([]byte("weak hash basis data "), 300)
+	src := append([]byte("head "), basis[100:]...)
+	for _, wh := range []WeakHasher{Adler32Hasher, BuzHasher, RabinHasher, CRC32CHasher} {
+		sig, err := GetReaderHashInfo(bytes.NewReader(basis), nil, 256, wh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig.Weak != wh.ID() {
+			t.Fatal(wh.Name(), "signature weak id error")
+		}
+		delta := &bytes.Buffer{}
+		if err := Delta(sig, bytes.NewReader(src), delta); err != nil {
+			t.Fatal(err)
+		}
+		if delta.Len() > len(src)/2 {
+			t.Error(wh.Name(), "delta too large", delta.Len())
+		}
+		out := &bytes.Buffer{}
+		if err := Patch(bytes.NewReader(basis), delta, out); err != nil {
+			t.Fatal(wh.Name(), err)
+		}
+		if !bytes.Equal(out.Bytes(), src) {
+			t.Error(wh.Name(), "patch result error")
+		}
+	}
+}
@@ -1,109 +1,124 @@
 package rsync
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/rand"
+	"encoding"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
-	"hash/adler32"
+	"hash/crc32"
+	"hash/fnv"
 	"io"
-	"log"
+	"io/fs"
+	"iter"
+	"math"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 
 	"github.com/gofrs/flock"
 )
 
 const (
 	DefaultBlockSize = 1024
+	DefaultReadAhead = 1 << 20
 )
 
-type HashBlock struct {
-	Idx uint32
-	Off uint32
-	H1  uint16         //adler32 low  = (hash & 0xFFFF)
-	H2  uint16         //adler32 high = ((hash > 16) & 0xFFFF)
-	H3  [md5.Size]byte //md5 sum
-}
-
-func (this HashBlock) Size() int {
-	return md5.Size + 4
-}
-
-func tobyte16(v uint16) []byte {
-	ret := []byte{0, 0}
-	ret[0] = byte(v & 0xFF)
-	ret[1] = byte(v >> 8 & 0xFF)
-	return ret
+// AutoBlockSize is the block size rsync picks for a basis of size bytes, the square root of the size
+// rounded down to a multiple of 8 and clamped to DefaultBlockSize and the largest 16 bit block, so
+// the signature and the delta granularity grow together
+func AutoBlockSize(size int64) uint16 {
+	const maxBlock = 0xFFFF &^ 7
+	if size <= DefaultBlockSize*DefaultBlockSize {
+		return DefaultBlockSize
+	}
+	if size >= maxBlock*maxBlock {
+		return maxBlock
+	}
+	//integer square root, exact where the float one is off by one
+	n := int64(math.Sqrt(float64(size)))
+	for n*n > size {
+		n--
+	}
+	for (n+1)*(n+1) <= size {
+		n++
+	}
+	return uint16(n &^ 7)
 }
 
-func touint16(b []byte) uint16 {
-	if len(b) != 2 {
-		panic(errors.New("b error"))
-	}
-	return uint16(b[0]) | uint16(b[1])<<8
-}
-
-func tobyte64(v uint64) []byte {
-	ret := []byte{0, 0, 0, 0, 0, 0, 0, 0}
-	ret[0] = byte(v & 0xFF)
-	ret[1] = byte(v >> 8 & 0xFF)
-	ret[2] = byte(v >> 16 & 0xFF)
-	ret[3] = byte(v >> 24 & 0xFF)
-	ret[4] = byte(v >> 32 & 0xFF)
-	ret[5] = byte(v >> 40 & 0xFF)
-	ret[6] = byte(v >> 48 & 0xFF)
-	ret[7] = byte(v >> 56 & 0xFF)
-	return ret
+type HashBlock struct {
+	Idx uint32
+	Off uint64 //basis offset
+	H1  uint16 //weak hash low  = (hash & 0xFFFF)
+	H2  uint16 //weak hash high = ((hash > 16) & 0xFFFF)
+	H3  []byte //strong hash sum
+	Len uint16 //> 0 trailing short block length
 }
 
-func touint64(b []byte) uint64 {
-	if len(b) != 8 {
-		panic(errors.New("b error"))
+// NewHashBlock hashes one block, idx is the signature index and off the basis offset
+func NewHashBlock(wh WeakHasher, sh StrongHasher, dat []byte, idx uint32, off uint64) HashBlock {
+	acs := weakSum(wh, dat)
+	return HashBlock{
+		Idx: idx,
+		Off: off,
+		H1:  uint16((acs & 0xFFFF)),
+		H2:  uint16(((acs >> 16) & 0xFFFF)),
+		H3:  strongSum(sh, dat),
 	}
-	v := uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16 | uint64(b[3])<<24
-	v |= uint64(b[4])<<32 | uint64(b[5])<<40 | uint64(b[6])<<48 | uint64(b[7])<<56
-	return v
 }
 
-func tobyte32(v uint32) []byte {
-	ret := []byte{0, 0, 0, 0}
-	ret[0] = byte(v & 0xFF)
-	ret[1] = byte(v >> 8 & 0xFF)
-	ret[2] = byte(v >> 16 & 0xFF)
-	ret[3] = byte(v >> 24 & 0xFF)
-	return ret
+func (this HashBlock) Size() int {
+	return len(this.H3) + 14
 }
 
-func touint32(b []byte) uint32 {
-	if len(b) != 4 {
-		panic(errors.New("b error"))
-	}
-	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+func (this HashBlock) IsShort() bool {
+	return this.Len > 0
 }
 
 func (this *HashBlock) Read(idx uint32, buf io.Reader) error {
+	var err error
 	this.Idx = idx
 	b1 := []byte{0, 0}
-	if _, err := buf.Read(b1); err != nil {
+	if _, err := io.ReadFull(buf, b1); err != nil {
 		return err
 	}
-	this.H1 = touint16(b1)
-	if _, err := buf.Read(b1); err != nil {
+	if this.H1, err = touint16(b1); err != nil {
 		return err
 	}
-	this.H2 = touint16(b1)
-	b2 := []byte{0, 0, 0, 0}
-	if _, err := buf.Read(b2); err != nil {
+	if _, err := io.ReadFull(buf, b1); err != nil {
 		return err
 	}
-	this.Off = touint32(b2)
-	if _, err := buf.Read(this.H3[:]); err != nil {
+	if this.H2, err = touint16(b1); err != nil {
 		return err
 	}
-	return nil
+	b8 := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	if _, err := io.ReadFull(buf, b8); err != nil {
+		return err
+	}
+	off, err := toint64(b8)
+	if err != nil {
+		return err
+	}
+	this.Off = uint64(off)
+	if len(this.H3) == 0 {
+		this.H3 = make([]byte, md5.Size)
+	}
+	if _, err := io.ReadFull(buf, this.H3); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(buf, b1); err != nil {
+		return err
+	}
+	this.Len, err = touint16(b1)
+	return err
 }
 
 func (this HashBlock) Write(buf io.Writer) error {
@@ -113,10 +128,13 @@ func (this HashBlock) Write(buf io.Writer) error {
 	if _, err := buf.Write(tobyte16(this.H2)); err != nil {
 		return err
 	}
-	if _, err := buf.Write(tobyte32(this.Off)); err != nil {
+	if _, err := buf.Write(tobyte64(this.Off)); err != nil {
+		return err
+	}
+	if _, err := buf.Write(this.H3); err != nil {
 		return err
 	}
-	if _, err := buf.Write(this.H3[:]); err != nil {
+	if _, err := buf.Write(tobyte16(this.Len)); err != nil {
 		return err
 	}
 	return nil
@@ -126,45 +144,221 @@ func HashBlockEqual(b1 HashBlock, b2 HashBlock) bool {
 	if b1.H1 != b2.H1 {
 		return false
 	}
-	if b2.H2 != b2.H2 {
+	if b1.H2 != b2.H2 {
 		return false
 	}
-	return bytes.Equal(b1.H3[:], b2.H3[:])
+	if b1.Len != b2.Len {
+		return false
+	}
+	return bytes.Equal(b1.H3, b2.H3)
 }
 
+// HashInfo flags
+const (
+	HashFlagInPlace = 1 << 0
+)
+
+// HashInfo is safe for concurrent deltas once read or filled, they share the map of GetMap,
+// change a Clone instead of a shared signature
 type HashInfo struct {
 	Blocks    []HashBlock //block info
-	MD5       []byte      //file md5
+	MD5       []byte      //file strong hash
 	BlockSize uint16      //block size
+	Strong    uint8       //strong hash id
+	Weak      uint8       //weak hash id
+	//the receiver merges in place, deltas must not match blocks before the output position
+	InPlace bool
+	Seed    uint32 //checksum seed mixed into the strong and weak sums, see SeededHasher and SeededWeakHasher
+	mu      sync.Mutex
+	mp      *HashMap //built once by GetMap, reset by Read
+	end     int64    //source size hashed into state
+	state   []byte   //marshaled file hash state at end, set by fill for ExtendHashInfo
+}
+
+// Clone is a deep copy of the signature without the lookup map
+func (this *HashInfo) Clone() *HashInfo {
+	hi := &HashInfo{
+		Blocks:    make([]HashBlock, len(this.Blocks)),
+		MD5:       bytes.Clone(this.MD5),
+		BlockSize: this.BlockSize,
+		Strong:    this.Strong,
+		Weak:      this.Weak,
+		InPlace:   this.InPlace,
+		Seed:      this.Seed,
+		end:       this.end,
+		state:     bytes.Clone(this.state),
+	}
+	for i, v := range this.Blocks {
+		v.H3 = bytes.Clone(v.H3)
+		hi.Blocks[i] = v
+	}
+	return hi
+}
+
+// reset drops the lookup map and file hash state before the blocks change
+func (this *HashInfo) reset() {
+	this.mu.Lock()
+	this.mp = nil
+	this.mu.Unlock()
+	this.end, this.state = 0, nil
+}
+
+func (this *HashInfo) Hasher() (StrongHasher, error) {
+	return GetStrongHasher(this.Strong)
+}
+
+func (this *HashInfo) WeakHasher() (WeakHasher, error) {
+	return GetWeakHasher(this.Weak)
+}
+
+// checkAlgorithms refuses strong and weak hashes other than the ones of the signature,
+// an empty signature matches any
+func (this *HashInfo) checkAlgorithms(strong, weak uint8) error {
+	if this.IsEmpty() || (this.Strong == strong && this.Weak == weak) {
+		return nil
+	}
+	return fmt.Errorf("%w: signature %s/%s, delta %s/%s", ErrAlgorithmMismatch,
+		strongName(this.Strong), weakName(this.Weak), strongName(strong), weakName(weak))
+}
+
+// strongName is the name of a strong hash id, unknown ids by number
+func strongName(id uint8) string {
+	if h, err := GetStrongHasher(id); err == nil {
+		return h.Name()
+	}
+	return fmt.Sprint(id)
+}
+
+// weakName is the name of a weak hash id, unknown ids by number
+func weakName(id uint8) string {
+	if h, err := GetWeakHasher(id); err == nil {
+		return h.Name()
+	}
+	return fmt.Sprint(id)
 }
 
 func (this *HashInfo) Read(buf io.Reader) error {
-	if len(this.MD5) != md5.Size {
-		this.MD5 = make([]byte, md5.Size)
+	this.reset()
+	if err := readHeader(buf, SignatureMagic); err != nil {
+		return err
 	}
-	if _, err := buf.Read(this.MD5); err != nil {
+	b1 := []byte{0}
+	if _, err := io.ReadFull(buf, b1); err != nil {
 		return err
 	}
-	b2 := []byte{0, 0}
+	this.Strong = b1[0]
+	sh, err := this.Hasher()
+	if err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(buf, b1); err != nil {
+		return err
+	}
+	this.Weak = b1[0]
+	if _, err := this.WeakHasher(); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(buf, b1); err != nil {
+		return err
+	}
+	this.InPlace = b1[0]&HashFlagInPlace != 0
 	b4 := []byte{0, 0, 0, 0}
-	if _, err := buf.Read(b2); err != nil {
+	if _, err := io.ReadFull(buf, b4); err != nil {
+		return err
+	}
+	if this.Seed, err = touint32(b4); err != nil {
+		return err
+	}
+	if len(this.MD5) != sh.Size() {
+		this.MD5 = make([]byte, sh.Size())
+	}
+	if _, err := io.ReadFull(buf, this.MD5); err != nil {
+		return err
+	}
+	b2 := []byte{0, 0}
+	if _, err := io.ReadFull(buf, b2); err != nil {
+		return err
+	}
+	if this.BlockSize, err = touint16(b2); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(buf, b4); err != nil {
 		return err
 	}
-	this.BlockSize = touint16(b2)
-	if _, err := buf.Read(b4); err != nil {
+	num, err := touint32(b4)
+	if err != nil {
 		return err
 	}
-	num := touint32(b4)
+	//before the blocks, a zero block size is never right
+	if this.BlockSize == 0 {
+		return fmt.Errorf("%w: zero block size", ErrMalformed)
+	}
+	this.Blocks = []HashBlock{}
 	for i := uint32(0); i < num; i++ {
-		b := &HashBlock{}
+		b := &HashBlock{H3: make([]byte, sh.Size())}
 		if err := b.Read(i, buf); err != nil {
 			return err
 		}
 		this.Blocks = append(this.Blocks, *b)
 	}
+	return this.validate()
+}
+
+// validate rejects the decoded signatures analyse and the merger can't take, a zero block size
+// or blocks longer than it, Read and FromProto check it
+func (this *HashInfo) validate() error {
+	if this.BlockSize == 0 {
+		return fmt.Errorf("%w: zero block size", ErrMalformed)
+	}
+	for i, b := range this.Blocks {
+		if b.Len > this.BlockSize {
+			return fmt.Errorf("%w: block %d length %d", ErrMalformed, i, b.Len)
+		}
+	}
 	return nil
 }
 
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (this *countWriter) Write(p []byte) (int, error) {
+	n, err := this.w.Write(p)
+	this.n += int64(n)
+	return n, err
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (this *countReader) Read(p []byte) (int, error) {
+	n, err := this.r.Read(p)
+	this.n += int64(n)
+	return n, err
+}
+
+// WriteTo streams the signature to w through a write buffer
+func (this *HashInfo) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	if err := this.Write(bw); err != nil {
+		return cw.n, err
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ReadFrom reads one signature from r and never reads past its end,
+// wrap unbuffered sources such as sockets in a bufio.Reader
+func (this *HashInfo) ReadFrom(r io.Reader) (int64, error) {
+	cr := &countReader{r: r}
+	err := this.Read(cr)
+	return cr.n, err
+}
+
 func (this *HashInfo) ToBuffer() (*bytes.Buffer, error) {
 	buf := &bytes.Buffer{}
 	err := this.Write(buf)
@@ -175,13 +369,23 @@ func (this *HashInfo) Write(buf io.Writer) error {
 	if this.MD5 == nil {
 		return nil
 	}
-	if _, err := buf.Write(this.MD5); err != nil {
+	if err := writeHeader(buf, SignatureMagic); err != nil {
+		return err
+	}
+	flags := byte(0)
+	if this.InPlace {
+		flags |= HashFlagInPlace
+	}
+	if _, err := buf.Write([]byte{this.Strong, this.Weak, flags}); err != nil {
+		return err
+	}
+	if _, err := buf.Write(tobyte32(this.Seed)); err != nil {
 		return err
 	}
-	if _, err := buf.Write([]byte{byte(this.BlockSize & 0xFF)}); err != nil {
+	if _, err := buf.Write(this.MD5); err != nil {
 		return err
 	}
-	if _, err := buf.Write([]byte{byte(this.BlockSize >> 8 & 0xFF)}); err != nil {
+	if _, err := buf.Write(tobyte16(this.BlockSize)); err != nil {
 		return err
 	}
 	if _, err := buf.Write(tobyte32(uint32(len(this.Blocks)))); err != nil {
@@ -208,87 +412,242 @@ func NewHashInfoWithBuf(buf io.Reader) (*HashInfo, error) {
 	return h, h.Read(buf)
 }
 
-type HashMap map[uint16][]HashBlock
+// HashMap finds blocks by their full weak sum, a bit set of the low halves rejects
+// most misses before the map, it is read only after GetMap and safe for concurrent lookups
+type HashMap struct {
+	low    [1 << 16 / 64]uint64
+	blocks map[uint32][]HashBlock
+}
 
-func (this HashMap) PassH1(h uint32) (uint32, bool) {
-	h1 := uint16(h & 0xFFFF)
-	hs, ok := this[h1]
-	if !ok {
-		return 0, false
+func weakKey(h1 uint16, h2 uint16) uint32 {
+	return uint32(h1) | uint32(h2)<<16
+}
+
+// NewHashMap indexes blocks
+func NewHashMap(blocks []HashBlock) *HashMap {
+	m := &HashMap{blocks: map[uint32][]HashBlock{}}
+	for _, v := range blocks {
+		m.low[v.H1/64] |= 1 << (v.H1 % 64)
+		k := weakKey(v.H1, v.H2)
+		m.blocks[k] = append(m.blocks[k], v)
 	}
-	for _, v := range hs {
-		if v.H1 == h1 {
-			return v.Idx, true
-		}
+	return m
+}
+
+// Get returns the blocks of weak sum h
+func (this *HashMap) Get(h uint32) []HashBlock {
+	if !this.hasLow(uint16(h & 0xFFFF)) {
+		return nil
 	}
-	return 0, false
+	return this.blocks[h]
 }
 
-func (this HashMap) PassH2(h uint32) (uint32, bool) {
-	h1 := uint16(h & 0xFFFF)
-	h2 := uint16((h >> 16) & 0xFFFF)
-	hs, ok := this[h1]
-	if !ok {
-		return 0, false
+func (this *HashMap) hasLow(h1 uint16) bool {
+	return this.low[h1/64]&(1<<(h1%64)) != 0
+}
+
+// PassH1 reports whether a block has the low half of h, the index isn't known from the bit set
+func (this *HashMap) PassH1(h uint32) (uint32, bool) {
+	return 0, this.hasLow(uint16(h & 0xFFFF))
+}
+
+func (this *HashMap) PassH2(h uint32) (uint32, bool) {
+	if hs := this.Get(h); len(hs) > 0 {
+		return hs[0].Idx, true
 	}
-	for _, v := range hs {
-		if v.H1 == h1 && v.H2 == h2 {
+	return 0, false
+}
+
+func (this *HashMap) PassH3(h uint32, mv []byte) (uint32, bool) {
+	for _, v := range this.Get(h) {
+		if bytes.Equal(v.H3, mv) {
 			return v.Idx, true
 		}
 	}
 	return 0, false
 }
 
-func (this HashMap) PassH3(h uint32, mv [md5.Size]byte) (uint32, bool) {
-	h1 := uint16(h & 0xFFFF)
-	h2 := uint16((h >> 16) & 0xFFFF)
-	hs, ok := this[h1]
-	if !ok {
-		return 0, false
-	}
-	for _, v := range hs {
-		if v.H1 == h1 && v.H2 == h2 && bytes.Equal(v.H3[:], mv[:]) {
+// Lookup finds the block of weak sum h in one pass, strong is called once at the
+// candidate and its result compared with the candidates left
+func (this *HashMap) Lookup(h uint32, strong func() []byte) (uint32, bool) {
+	var mv []byte
+	for _, v := range this.Get(h) {
+		if mv == nil {
+			mv = strong()
+		}
+		if bytes.Equal(v.H3, mv) {
 			return v.Idx, true
 		}
 	}
 	return 0, false
 }
 
-func (this *HashInfo) GetMap() HashMap {
-	m := HashMap{}
-	for _, v := range this.Blocks {
-		m[v.H1] = append(m[v.H1], v)
+// GetMap returns the lookup map of the blocks, it is built on the first call
+func (this *HashInfo) GetMap() *HashMap {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.mp == nil {
+		this.mp = NewHashMap(this.Blocks)
+	}
+	return this.mp
+}
+
+// ShortBlock returns the trailing short block or nil when the basis is block aligned
+func (this *HashInfo) ShortBlock() *HashBlock {
+	if len(this.Blocks) == 0 {
+		return nil
 	}
-	return m
+	b := &this.Blocks[len(this.Blocks)-1]
+	if !b.IsShort() {
+		return nil
+	}
+	return b
 }
 
 func (this *HashInfo) IsEmpty() bool {
 	return len(this.Blocks) == 0
 }
 
+// Size is the basis size covered by the blocks, the end of the last block,
+// deduplicated trailing blocks are not covered
+func (this *HashInfo) Size() int64 {
+	size := int64(0)
+	for _, b := range this.Blocks {
+		end := int64(b.Off) + int64(this.BlockSize)
+		if b.IsShort() {
+			end = int64(b.Off) + int64(b.Len)
+		}
+		size = max(size, end)
+	}
+	return size
+}
+
 type FileMerger struct {
-	WFile  *os.File
-	RFile  *os.File
-	Size   int64
-	Path   string
-	Hash   hash.Hash
-	Info   *HashInfo
-	Locker *flock.Flock
+	WFile     *os.File
+	RFile     *os.File
+	Size      int64
+	Path      string
+	Hash      hash.Hash
+	Info      *HashInfo
+	Locker    *flock.Flock
+	BlockSize uint16
+	Compress  uint8
+	ReadLimit *Limiter  //throttles basis block reads
+	Basis     string    //read the basis blocks from Basis instead of Path, ignored InPlace
+	Meta      *FileMeta //from the open frame, applied after the rename
+	Owner     bool      //also apply the meta uid/gid
+	//write into Path without a temp copy, needs deltas made against a signature with InPlace set,
+	//Resume is ignored and a failed merge leaves Path damaged
+	InPlace bool
+	//only check the delta against the basis at Path and the close frame hash, nothing is written
+	//or locked and InPlace, Resume and the backups are ignored
+	Verify bool
+	//hash the merged data in a goroutine, the writes to fast disks don't wait for the hash
+	AsyncHash bool
+	//copy runs of matched basis blocks with copy_file_range, in the kernel and shared extents on
+	//filesystems like btrfs and xfs, the blocks are still read for the hash. Set by NewFileMerger,
+	//ignored in place
+	CopyRange bool
+	copySrc   int64  //basis offset of the pending copy
+	copyLen   int64  //pending copy bytes, merged but not written yet
+	off       int64  //output offset
+	TempDir   string //temp file dir, the Path dir when empty, see TempPath for resumable merges
+	tmp       string
+	//keep the replaced file as BackupDir/name+BackupSuffix, no backup when both are empty
+	BackupDir    string
+	BackupSuffix string
+	//fsync the temp file before the rename and the dir after it, a crash can't leave a truncated Path
+	Fsync  bool
+	Logger Logger //DefaultLogger when nil
+	Hooks  *Hooks //observe the merged frames
+	Resume bool   //keep progress in Path+".part" so an interrupted merge can continue
+	//keep the temp file of a failed merge without resumable progress, like a hash mismatch or a
+	//merge without Resume, at PartialPath for inspection or as the Basis of the next merge
+	KeepPartial bool
+	Frames      int64 //frames merged
+	//merged bytes between progress checkpoints, DefaultCheckpointSize when 0
+	CheckpointSize int
+	progress       *mergeProgress
+	saved          int64
+	strong         uint8
+	seed           uint32
+	whole          bool //the delta has no index frames
+	done           bool
+	failed         bool //a frame failed, the output may hold part of it
 }
 
 func (this *FileMerger) doOpen(hi *AnalyseInfo) error {
 	this.Size = hi.Off
-	if this.WFile == nil {
-		return errors.New("file not open")
+	sh, err := GetStrongHasher(hi.Strong)
+	if err != nil {
+		return err
+	}
+	//blocks of the basis are matched by the signature hashes, whole file deltas match none
+	if this.Info != nil && !this.Info.IsEmpty() && !hi.IsWhole() && hi.Strong != this.Info.Strong {
+		return fmt.Errorf("%w: signature %s, delta %s", ErrAlgorithmMismatch, strongName(this.Info.Strong), sh.Name())
+	}
+	this.closeHash()
+	this.Hash = SeededHasher(sh, hi.Seed).New()
+	if this.AsyncHash {
+		this.Hash = newAsyncHash(this.Hash)
+	}
+	this.strong = hi.Strong
+	this.seed = hi.Seed
+	if hi.BlockSize > 0 {
+		this.BlockSize = hi.BlockSize
+	}
+	this.Compress = hi.Compress
+	this.Meta = hi.Meta
+	this.whole = hi.IsWhole()
+	if this.WFile == nil && !this.Verify {
+		return fmt.Errorf("%w: merger not open", ErrStateOrder)
+	}
+	//less fragments and a full disk fails before the data is sent
+	if this.WFile != nil && !this.Verify {
+		if err := preallocate(this.WFile, this.Size); err != nil {
+			return fmt.Errorf("preallocate %s: %w", this.Path, err)
+		}
+	}
+	if this.progress != nil {
+		return this.resume(hi)
 	}
 	return nil
 }
 
+// hashState is the merge hash with the queued data of AsyncHash hashed
+func (this *FileMerger) hashState() hash.Hash {
+	if ah, ok := this.Hash.(*asyncHash); ok {
+		return ah.hash()
+	}
+	return this.Hash
+}
+
+// closeHash ends the goroutine of AsyncHash
+func (this *FileMerger) closeHash() {
+	if ah, ok := this.Hash.(*asyncHash); ok {
+		ah.close()
+	}
+}
+
 func (this *FileMerger) doClose(hi *AnalyseInfo) error {
+	if err := this.flushCopy(); err != nil {
+		return err
+	}
 	mv := this.Hash.Sum(nil)
+	this.closeHash()
 	if !bytes.Equal(mv[:], hi.Hash) {
-		log.Println(hex.EncodeToString(mv[:]), hex.EncodeToString(hi.Hash))
-		return errors.New("hash error")
+		logf(this.Logger, "merge %s hash %s not match %s", this.Path, hex.EncodeToString(mv[:]), hex.EncodeToString(hi.Hash))
+		if this.Verify {
+			return ErrHashMismatch
+		}
+		//a bad result can't be resumed
+		this.Resume = false
+		os.Remove(this.Path + ".part")
+		return ErrHashMismatch
+	}
+	if this.Verify {
+		this.done = true
+		return nil
 	}
 	if err := this.attach(); err != nil {
 		return err
@@ -297,55 +656,156 @@ func (this *FileMerger) doClose(hi *AnalyseInfo) error {
 }
 
 func (this *FileMerger) doData(hi *AnalyseInfo) error {
+	if err := hi.DecompressData(this.Compress); err != nil {
+		return err
+	}
 	if num, err := this.Hash.Write(hi.Data); err != nil {
 		return err
 	} else if num != len(hi.Data) {
-		return fmt.Errorf("write hash data num error: index = %d", hi.Index)
+		return io.ErrShortWrite
+	}
+	return this.write(hi.Data, hi.Index)
+}
+
+// write appends data to the output, in place it goes to the output offset of the target
+func (this *FileMerger) write(data []byte, idx uint32) error {
+	if err := this.flushCopy(); err != nil {
+		return err
+	}
+	var num int
+	var err error
+	if this.Verify {
+		num = len(data)
+	} else if this.InPlace {
+		num, err = this.WFile.WriteAt(data, this.off)
+	} else {
+		num, err = this.WFile.Write(data)
 	}
-	if num, err := this.WFile.Write(hi.Data); err != nil {
+	if err != nil {
 		return err
-	} else if num != len(hi.Data) {
-		return fmt.Errorf("write file data num error: index = %d", hi.Index)
+	} else if num != len(data) {
+		return io.ErrShortWrite
 	}
+	this.off += int64(num)
 	return nil
 }
 
+// ReadBlock returns the basis data of b, the caller owns the slice
 func (this *FileMerger) ReadBlock(b *HashBlock) ([]byte, error) {
+	data := make([]byte, this.blockLen(b))
+	if err := this.readBlock(b, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (this *FileMerger) blockLen(b *HashBlock) int {
+	if b.IsShort() {
+		return int(b.Len)
+	}
+	return int(this.BlockSize)
+}
+
+// readBlock reads the basis data of b into data of blockLen bytes
+func (this *FileMerger) readBlock(b *HashBlock, data []byte) error {
 	if this.RFile == nil {
-		return nil, errors.New("not found file : " + this.Path)
+		return fmt.Errorf("basis of %s: %w", this.Path, os.ErrNotExist)
 	}
-	data := make([]byte, this.Info.BlockSize)
-	if _, err := this.RFile.Seek(int64(b.Off)*int64(this.Info.BlockSize), io.SeekStart); err != nil {
-		return nil, err
+	if err := this.ReadLimit.WaitN(context.Background(), len(data)); err != nil {
+		return err
 	}
-	if num, err := this.RFile.Read(data); err != nil {
-		return nil, err
-	} else if num != len(data) {
-		return nil, fmt.Errorf("read file data num error: index = %d", b.Idx)
+	if _, err := this.RFile.Seek(int64(b.Off), io.SeekStart); err != nil {
+		return err
 	}
-	return data, nil
+	if _, err := io.ReadFull(this.RFile, data); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrShortBlock
+	} else if err != nil {
+		return err
+	}
+	return nil
 }
 
 func (this *FileMerger) doIndex(hi *AnalyseInfo) error {
-	b := this.Info.Blocks[hi.Index]
-	data, err := this.ReadBlock(&b)
-	if err != nil {
+	b := HashBlock{Idx: hi.Index, Off: uint64(hi.Off), Len: hi.Len}
+	if this.whole {
+		return errors.New("whole file delta has index frame")
+	}
+	if this.InPlace && !this.Verify && hi.Off < this.off {
+		return errors.New("in place basis block overwritten")
+	}
+	buf := getBuffer(this.blockLen(&b))
+	defer putBuffer(buf)
+	data := *buf
+	if err := this.readBlock(&b, data); err != nil {
 		return err
 	}
 	if num, err := this.Hash.Write(data); err != nil {
 		return err
 	} else if num != len(data) {
-		return fmt.Errorf("write hash data num error: index = %d", hi.Index)
+		return io.ErrShortWrite
+	}
+	if this.CopyRange && !this.InPlace && !this.Verify {
+		return this.copyBlock(int64(b.Off), int64(len(data)))
+	}
+	return this.write(data, hi.Index)
+}
+
+// copyBlock adds the basis block at off to the pending copy, a block not following it starts a new one
+func (this *FileMerger) copyBlock(off int64, n int64) error {
+	if this.copyLen > 0 && this.copySrc+this.copyLen != off {
+		if err := this.flushCopy(); err != nil {
+			return err
+		}
+	}
+	if this.copyLen == 0 {
+		this.copySrc = off
+	}
+	this.copyLen += n
+	this.off += n
+	return nil
+}
+
+// flushCopy writes the pending copy, os.File.ReadFrom uses copy_file_range where it can
+func (this *FileMerger) flushCopy() error {
+	if this.copyLen == 0 {
+		return nil
 	}
-	if num, err := this.WFile.Write(data); err != nil {
+	src, n := this.copySrc, this.copyLen
+	this.copyLen = 0
+	if _, err := this.RFile.Seek(src, io.SeekStart); err != nil {
+		return err
+	}
+	num, err := this.WFile.ReadFrom(io.LimitReader(this.RFile, n))
+	if err != nil {
 		return err
-	} else if num != len(data) {
-		return fmt.Errorf("write file data num error: index = %d", hi.Index)
+	}
+	if num != n {
+		return ErrShortBlock
 	}
 	return nil
 }
 
+// Write merges one frame, failures are *FrameError
 func (this *FileMerger) Write(hi *AnalyseInfo) error {
+	off := this.off
+	if err := this.merge(hi); err != nil {
+		this.failed = true
+		return newFrameError(this.Path, off, hi, err)
+	}
+	this.Hooks.frame(this.Path, &off, int64(this.BlockSize), hi)
+	return nil
+}
+
+func (this *FileMerger) merge(hi *AnalyseInfo) error {
+	if this.done {
+		return fmt.Errorf("%w: frame after close", ErrStateOrder)
+	}
+	if hi.IsOpen() == (this.Hash != nil) {
+		if hi.IsOpen() {
+			return fmt.Errorf("%w: open frame repeated", ErrStateOrder)
+		}
+		return fmt.Errorf("%w: frame before open", ErrStateOrder)
+	}
 	var err error = nil
 	if hi.IsOpen() {
 		err = this.doOpen(hi)
@@ -366,135 +826,505 @@ func (this *FileMerger) Write(hi *AnalyseInfo) error {
 		return err
 	}
 	if hi.IsClose() {
-		err = this.doClose(hi)
+		return this.doClose(hi)
 	}
-	return err
+	this.Frames++
+	return this.checkpoint(false)
 }
 
 func (this *FileMerger) IsLocked() bool {
 	return this.Locker.Locked()
 }
 
+// ErrFileLocked is returned by Open when another merge of the same path is running
+var ErrFileLocked = errors.New("file locked")
+
 func (this *FileMerger) Open() error {
+	if this.Verify {
+		this.off = 0
+		this.openBasis()
+		return nil
+	}
 	if this.IsLocked() {
-		return errors.New("file locked")
+		return fmt.Errorf("%w: %s", ErrFileLocked, this.Path)
 	}
-	file, err := os.OpenFile(this.Path+".tmp", os.O_CREATE|os.O_APPEND|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
-	if err != nil {
+	if ok, err := this.Locker.TryLock(); err != nil {
 		return err
+	} else if !ok {
+		return fmt.Errorf("%w: %s is merged by another merger", ErrFileLocked, this.Path)
+	}
+	this.off = 0
+	this.failed = false
+	if this.InPlace {
+		return this.openInPlace()
 	}
-	if err := this.Locker.Lock(); err != nil {
+	file, err := this.openTemp()
+	if err != nil {
 		return err
 	}
+	if this.Resume {
+		if err := this.restore(file); err != nil {
+			file.Close()
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekEnd); err != nil {
+			file.Close()
+			return err
+		}
+	}
 	this.WFile = file
-	file, err = os.OpenFile(this.Path, os.O_RDONLY, os.ModePerm)
+	this.openBasis()
+	return nil
+}
+
+// openBasis opens the file the index frames read, RFile stays nil when it is missing
+func (this *FileMerger) openBasis() {
+	basis := this.Path
+	if this.Basis != "" {
+		basis = this.Basis
+	}
+	file, err := os.OpenFile(basis, os.O_RDONLY, os.ModePerm)
 	if err != nil {
 		this.RFile = nil
 	} else {
 		this.RFile = file
 	}
-	return nil
 }
 
-func (this *FileMerger) attach() error {
-	this.Close()
-	return os.Rename(this.Path+".tmp", this.Path)
+// TempPath is the temp file of a resumable merge of path, path+".tmp" or a name unique to path in dir
+func TempPath(path string, dir string) string {
+	if dir == "" {
+		return path + ".tmp"
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	h := fnv.New64a()
+	h.Write([]byte(abs))
+	return filepath.Join(dir, fmt.Sprintf(".%s.%016x.tmp", filepath.Base(path), h.Sum64()))
 }
 
-func (this *FileMerger) Close() {
-	if this.RFile != nil {
-		this.RFile.Close()
-		this.RFile = nil
-	}
-	if this.WFile != nil {
-		this.WFile.Close()
-		this.WFile = nil
+// openTemp opens the temp file, resumable merges use TempPath so a later merge finds it,
+// others a new name with the pid and a random suffix
+func (this *FileMerger) openTemp() (*os.File, error) {
+	if this.Resume {
+		this.tmp = TempPath(this.Path, this.TempDir)
+		//not O_APPEND, kernel copies of CopyRange need a plain offset, restore reads the checkpoint
+		return os.OpenFile(this.tmp, os.O_CREATE|os.O_RDWR, os.ModePerm)
+	}
+	dir := this.TempDir
+	if dir == "" {
+		dir = filepath.Dir(this.Path)
+	}
+	rnd := make([]byte, 6)
+	if _, err := rand.Read(rnd); err != nil {
+		return nil, err
 	}
-	if this.Locker != nil {
-		this.Locker.Close()
-		os.Remove(this.Locker.Path())
-		this.Locker = nil
+	tmp := filepath.Join(dir, fmt.Sprintf(".%s.%d.%x.tmp", filepath.Base(this.Path), os.Getpid(), rnd))
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.ModePerm)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("temp file %s of %s already exists", tmp, this.Path)
+	} else if err != nil {
+		return nil, err
 	}
+	this.tmp = tmp
+	return file, nil
 }
 
-func NewFileMerger(file string, hi *HashInfo) *FileMerger {
-	return &FileMerger{
-		Path:   file,
-		Hash:   md5.New(),
-		Info:   hi,
-		Locker: flock.New(file + ".lck"),
-	}
+// PartialPath is where KeepPartial moves the temp file of a failed merge of path
+func PartialPath(path string) string {
+	return path + ".partial"
 }
 
-type FileReader struct {
-	File *os.File
-	Size uint16
-	Off  int64
-	Buf  *bytes.Buffer
-	Hash hash.Hash
+// TempFile is the temp file of the open merge, empty in place
+func (this *FileMerger) TempFile() string {
+	return this.tmp
 }
 
-func (this *FileReader) Truncate(size int) error {
-	if size == 0 {
-		return nil
-	}
-	buf := make([]byte, size)
-	num, err := this.Buf.Read(buf)
+// openInPlace uses one descriptor of Path for reading blocks and writing
+func (this *FileMerger) openInPlace() error {
+	this.Resume = false
+	//the old content is gone once the merge writes
+	if err := this.backup(true); err != nil {
+		return fmt.Errorf("backup %s: %w", this.Path, err)
+	}
+	file, err := os.OpenFile(this.Path, os.O_CREATE|os.O_RDWR, os.ModePerm)
 	if err != nil {
 		return err
 	}
-	this.Off += int64(num)
+	this.WFile = file
+	this.RFile = file
 	return nil
 }
 
-func (this *FileReader) Read(offset int64) ([]byte, error) {
-	one := []byte{0}
-	ds := this.Buf.Bytes()
-	idx := int(offset - this.Off)
-	if idx >= 0 && idx < len(ds) {
-		one[0] = ds[idx]
-		return one, nil
+// moveFile renames src to dst, copying when they are on different filesystems
+func moveFile(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || filepath.Dir(src) == filepath.Dir(dst) {
+		return err
 	}
-	if _, err := this.File.Seek(offset, io.SeekStart); err != nil {
-		return nil, err
+	if err := copyFile(src, dst); err != nil {
+		return err
 	}
-	buf := make([]byte, this.Size)
-	if num, err := this.File.Read(buf); err != nil {
-		return nil, err
-	} else if _, err := this.Buf.Write(buf[:num]); err != nil {
-		return nil, err
-	} else if _, err := this.Hash.Write(buf[:num]); err != nil {
+	return os.Remove(src)
+}
+
+// copyFile copies src to a synced temp file next to dst and renames it to dst
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(dst), fmt.Sprintf(".%s.%d.copy.tmp", filepath.Base(dst), os.Getpid()))
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	os.Chtimes(tmp, fi.ModTime(), fi.ModTime())
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// BackupPath is where the replaced file is kept, empty without BackupDir and BackupSuffix
+func (this *FileMerger) BackupPath() string {
+	if this.BackupDir == "" && this.BackupSuffix == "" {
+		return ""
+	}
+	dir := this.BackupDir
+	if dir == "" {
+		dir = filepath.Dir(this.Path)
+	}
+	return filepath.Join(dir, filepath.Base(this.Path)+this.BackupSuffix)
+}
+
+// backup keeps the current file at BackupPath, Path stays in place until the rename replaces it,
+// a hard link is enough then, in place needs a copy
+func (this *FileMerger) backup(copy bool) error {
+	bp := this.BackupPath()
+	if bp == "" {
+		return nil
+	}
+	fi, err := os.Lstat(this.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(bp), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(bp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !copy && os.Link(this.Path, bp) == nil {
+		return nil
+	}
+	return copyFile(this.Path, bp)
+}
+
+func (this *FileMerger) attach() error {
+	this.done = true
+	if this.Fsync && !this.InPlace {
+		if err := this.WFile.Sync(); err != nil {
+			return err
+		}
+	}
+	if this.InPlace {
+		//the target may have been longer
+		if err := this.WFile.Truncate(this.off); err != nil {
+			return err
+		}
+		if this.Fsync {
+			if err := this.WFile.Sync(); err != nil {
+				return err
+			}
+		}
+		this.Close()
+		if this.Meta != nil {
+			return this.Meta.Apply(this.Path, this.Owner)
+		}
+		return nil
+	}
+	this.Close()
+	os.Remove(this.Path + ".part")
+	if err := this.backup(false); err != nil {
+		return fmt.Errorf("backup %s: %w", this.Path, err)
+	}
+	if err := moveFile(this.tmp, this.Path); err != nil {
+		return err
+	}
+	if this.Fsync {
+		if err := syncDir(filepath.Dir(this.Path)); err != nil {
+			return err
+		}
+	}
+	if this.Meta != nil {
+		return this.Meta.Apply(this.Path, this.Owner)
+	}
+	return nil
+}
+
+// Close keeps the progress of an unfinished merge when Resume is set, after a failed frame the
+// last checkpoint before it is kept
+func (this *FileMerger) Close() {
+	if this.Resume && !this.done && !this.failed {
+		if err := this.checkpoint(true); err != nil {
+			logf(this.Logger, "save merge %s progress error: %v", this.Path, err)
+		}
+	}
+	this.closeHash()
+	if this.RFile != nil && this.RFile != this.WFile {
+		this.RFile.Close()
+	}
+	this.RFile = nil
+	if this.WFile != nil {
+		this.WFile.Close()
+		this.WFile = nil
+		//without saved progress the partial file can't be resumed
+		if !this.done && this.tmp != "" && resumedFrames(this.Path, this.tmp) == 0 {
+			if !this.KeepPartial || this.off == 0 || os.Rename(this.tmp, PartialPath(this.Path)) != nil {
+				os.Remove(this.tmp)
+			}
+		}
+	}
+	//a verify doesn't lock, the lock file may be another merger's
+	if this.Locker != nil && !this.Verify {
+		this.Locker.Close()
+		os.Remove(this.Locker.Path())
+		this.Locker = nil
+	}
+}
+
+// NewFileMerger merges deltas made against hi into file, opts may set WithBlockSize, WithHooks,
+// WithBasis and WithWorkers, more than one worker sets AsyncHash. file is the output and the basis
+// unless WithBasis names an existing copy to read the blocks from
+func NewFileMerger(file string, hi *HashInfo, opts ...Option) *FileMerger {
+	o := newOptions(opts)
+	m := &FileMerger{
+		Path:      file,
+		Info:      hi,
+		Locker:    flock.New(file + ".lck"),
+		BlockSize: hi.BlockSize,
+		Hooks:     o.hooks,
+		AsyncHash: o.workers > 1,
+		CopyRange: true,
+		Basis:     o.basis,
+	}
+	if o.blockSize > 0 {
+		m.BlockSize = o.blockSize
+	}
+	return m
+}
+
+// FileReader reads the source sequentially into a read-ahead buffer
+type FileReader struct {
+	File io.Reader
+	Size int           //read ahead size
+	Off  int64         //file offset of Buf start
+	Buf  *bytes.Buffer //buffered file data
+	Hash hash.Hash     //hash of all data read, nil not hashed
+}
+
+// Truncate drops size bytes from the buffer start
+func (this *FileReader) Truncate(size int) error {
+	if size == 0 {
+		return nil
+	}
+	if size > this.Buf.Len() {
+		return errors.New("truncate size error")
+	}
+	this.Buf.Next(size)
+	this.Off += int64(size)
+	return nil
+}
+
+func (this *FileReader) Read(offset int64) ([]byte, error) {
+	one, err := this.Slice(offset, 1)
+	if err == io.ErrUnexpectedEOF {
+		return nil, io.EOF
+	}
+	if err != nil {
 		return nil, err
 	}
-	ds = this.Buf.Bytes()
-	if len(ds) > 0 {
-		one[0] = ds[idx]
-		return one, nil
+	return []byte{one[0]}, nil
+}
+
+// Slice returns n buffered bytes at offset, reading forward from the file as needed,
+// the result is only valid until the next Slice or Truncate
+func (this *FileReader) Slice(offset int64, n int) ([]byte, error) {
+	idx := int(offset - this.Off)
+	if idx < 0 {
+		return nil, errors.New("offset truncated")
+	}
+	for this.Buf.Len() < idx+n {
+		this.Buf.Grow(this.Size)
+		num, err := this.Buf.ReadFrom(io.LimitReader(this.File, int64(this.Size)))
+		if err != nil {
+			return nil, err
+		}
+		if num == 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if this.Hash == nil {
+			continue
+		}
+		ds := this.Buf.Bytes()
+		if _, err := this.Hash.Write(ds[len(ds)-int(num):]); err != nil {
+			return nil, err
+		}
 	}
-	return nil, io.EOF
+	return this.Buf.Bytes()[idx : idx+n], nil
 }
 
-func NewFileReader(f *os.File, siz uint16) *FileReader {
+func NewFileReader(f io.Reader, siz int) (*FileReader, error) {
 	if f == nil {
-		panic(errors.New("f nil"))
+		return nil, errors.New("file reader nil")
+	}
+	if siz <= 0 {
+		return nil, fmt.Errorf("file reader size %d error", siz)
 	}
 	c := &FileReader{}
-	c.Hash = md5.New()
+	c.Hash = MD5Hasher.New()
 	c.File = f
-	c.Buf = &bytes.Buffer{}
+	c.Buf = readerPool.Get().(*bytes.Buffer)
 	c.Size = siz
-	return c
+	return c, nil
 }
 
+// Release gives the read-ahead buffer back to the pool, slices of it must not be used after
+func (this *FileReader) Release() {
+	if this.Buf == nil {
+		return
+	}
+	this.Buf.Reset()
+	readerPool.Put(this.Buf)
+	this.Buf = nil
+}
+
+// DupPolicy selects how signatures handle blocks equal to an earlier block
+type DupPolicy uint8
+
+const (
+	//keep the first of equal blocks, FileHashInfo.Remap maps basis blocks to the kept indexes
+	DupDedup DupPolicy = iota
+	//keep every block, the signature index is the basis block number,
+	//in place merges can then use a later copy of a block already overwritten
+	DupKeepAll
+)
+
 type FileHashInfo struct {
 	Info      *HashInfo            //hash info from computer
 	Path      string               //file path
 	File      *os.File             //if file opened
-	Blocks    map[string]HashBlock //block info
+	FS        fs.FS                //open Path in it instead of the OS filesystem
+	Reader    io.ReadSeeker        //source data, file or caller reader
+	Blocks    map[string]HashBlock //block info by strong hash hex, DupKeepAll appends /idx to duplicates
+	Dups      DupPolicy            //handling of blocks equal to an earlier block
+	Remap     []uint32             //DupDedup: signature index of every basis block, set by fill
 	Count     int64                //block count
-	MD5       []byte               //file md5
+	MD5       []byte               //file strong hash
 	BlockSize uint16               //block size
 	FileSize  int64                //file size
+	Hasher    StrongHasher         //strong hash for blocks and file
+	Seed      uint32               //checksum seed of Hasher and Weak, see SeededHasher
+	Weak      WeakHasher           //rolling hash for blocks
+	Meta      *FileMeta            //sent in the open frame, set by Open
+	Hooks     *Hooks               //observe the frames passed to the analyse callback
+	WholeFile bool                 //send the source as data without matching blocks
+	Workers   int                  //goroutines hashing signature blocks and scanning source segments, 1 when < 1
+	//growing files: when the basis hash matches the source prefix only the tail is sent as data,
+	//else the delta falls back to block matching
+	Append bool
+	//switch to WholeFile when no block of the first WholeFileProbe bytes matches,
+	//only sources larger than 4 probes are probed, 0 never
+	WholeFileProbe int64
+	//coalesce literal data into frames up to this size, one block when <= BlockSize and
+	//MaxLiteralSize at most, fewer frames for sources with few matches
+	MaxLiteral int
+	//Analyse scans segments of this size with Workers goroutines, sources smaller than two segments
+	//are scanned serially, DefaultSegmentSize when 0
+	SegmentSize int64
+	//keep the fill progress in this file so an interrupted fill of the unchanged source continues
+	//from it, the restored blocks are not passed to the fill callback
+	Checkpoint string
+	//hashed bytes between fill checkpoints, DefaultSignatureCheckpoint when 0
+	CheckpointSize int64
+	end            int64     //bytes hashed by fill
+	state          []byte    //marshaled file hash state at end
+	closer         io.Closer //the file opened in FS
+}
+
+// DefaultWholeFileProbe is the FileHashInfo.WholeFileProbe of NewFileHashInfo
+const DefaultWholeFileProbe = 1 << 20
+
+// MaxLiteralSize is the largest literal of a data frame
+const MaxLiteralSize = 256 << 10
+
+// maxLiteral is the literal size of a data frame
+func (this *FileHashInfo) maxLiteral() int64 {
+	return min(max(int64(this.MaxLiteral), int64(this.BlockSize)), MaxLiteralSize)
+}
+
+var errProbeMatched = errors.New("probe matched")
+
+// probe reports whether a block of the first WholeFileProbe bytes of rs matches, rs is sought back after
+func (this *FileHashInfo) probe(ctx context.Context, rs io.ReadSeeker) (bool, error) {
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	p := *this
+	p.Hooks, p.Meta, p.WholeFileProbe, p.Append = nil, nil, 0, false
+	p.FileSize = this.WholeFileProbe
+	err = p.analyse(ctx, rs, func(info *AnalyseInfo) error {
+		if info.IsIndex() {
+			return errProbeMatched
+		}
+		return nil
+	})
+	if _, serr := rs.Seek(start, io.SeekStart); serr != nil {
+		return false, serr
+	}
+	if err == errProbeMatched {
+		return true, nil
+	}
+	return false, err
+}
+
+// strong is Hasher with the checksum seed
+func (this *FileHashInfo) strong() StrongHasher {
+	return SeededHasher(this.Hasher, this.Seed)
+}
+
+// weak is Weak with the checksum seed
+func (this *FileHashInfo) weak() WeakHasher {
+	return SeededWeakHasher(this.Weak, this.Seed)
 }
 
 func (this *FileHashInfo) GetHashInfo() *HashInfo {
@@ -509,6 +1339,11 @@ func (this *FileHashInfo) GetHashInfo() *HashInfo {
 		Blocks:    hbs,
 		MD5:       this.MD5,
 		BlockSize: this.BlockSize,
+		Strong:    this.Hasher.ID(),
+		Weak:      this.Weak.ID(),
+		Seed:      this.Seed,
+		end:       this.end,
+		state:     this.state,
 	}
 }
 
@@ -519,7 +1354,7 @@ func HashInfoEqual(h1 *HashInfo, h2 *HashInfo) bool {
 	if !bytes.Equal(h1.MD5, h2.MD5) {
 		return false
 	}
-	if h1.BlockSize != h2.BlockSize {
+	if h1.BlockSize != h2.BlockSize || h1.Seed != h2.Seed {
 		return false
 	}
 	if len(h1.Blocks) != len(h2.Blocks) {
@@ -534,95 +1369,247 @@ func HashInfoEqual(h1 *HashInfo, h2 *HashInfo) bool {
 }
 
 const (
-	AnalyseTypeOpen  = 1 << 0 //off=filesize 1+8
-	AnalyseTypeData  = 1 << 1 //data 1+datalen
-	AnalyseTypeIndex = 1 << 2 //index 1 + 4
-	AnalyseTypeClose = 1 << 3 //hash 1 + 16
+	AnalyseTypeOpen       = 1 << 0 //header strong compress seed off=filesize blocksize 1+6+1+1+4+8+2
+	AnalyseTypeData       = 1 << 1 //data 1+datalen
+	AnalyseTypeIndex      = 1 << 2 //basis offset 1 + 8
+	AnalyseTypeClose      = 1 << 3 //hash 1 + 1 + hashlen
+	AnalyseTypeShort      = 1 << 4 //short index block length 1 + 2
+	AnalyseTypeCompressed = 1 << 5 //data compressed with the open frame compress id
+	AnalyseTypeMeta       = 1 << 6 //open followed by file meta 20
+	AnalyseTypeWhole      = 1 << 7 //open of a delta sending the whole file as data
 )
 
 type AnalyseInfo struct {
-	Index uint32 // >= 0 map to blocks
-	Off   int64  //
-	Data  []byte // len > 0 has new data
-	Type  int    // AnalyseType*
-	Hash  []byte //
+	Index     uint32    // >= 0 map to blocks, not serialized
+	Off       int64     //open: file size, index: basis offset
+	Data      []byte    // len > 0 has new data, Analyse reuses it after the callback, see Clone
+	Type      int       // AnalyseType*
+	Hash      []byte    //
+	BlockSize uint16    //basis block size, open only
+	Len       uint16    //short index block length
+	Strong    uint8     //strong hash id, open only
+	Compress  uint8     //literal compress id, open only
+	Seed      uint32    //checksum seed of the file hash, open only
+	Meta      *FileMeta //source file metadata, open only
 }
 
+// Read decodes one frame, see the frame layout in format.go, io.EOF is returned
+// only when the stream ends before the frame
 func (this *AnalyseInfo) Read(buf io.Reader) error {
 	b1 := []byte{0}
-	b2 := []byte{0, 0}
+	if _, err := io.ReadFull(buf, b1); err != nil {
+		return err
+	}
+	*this = AnalyseInfo{Type: int(b1[0])}
+	if this.Type == 0 {
+		return fmt.Errorf("%w: frame type 0", ErrMalformed)
+	}
+	crc := crc32.New(castagnoli)
+	crc.Write(b1)
+	fr := io.TeeReader(buf, crc)
+	if this.IsOpen() {
+		if err := readHeader(fr, DeltaMagic); err != nil {
+			return noEOF(err)
+		}
+	}
 	b4 := []byte{0, 0, 0, 0}
-	b8 := []byte{0, 0, 0, 0, 0, 0, 0, 0}
-	_, err := buf.Read(b1)
+	if _, err := io.ReadFull(fr, b4); err != nil {
+		return noEOF(err)
+	}
+	size, err := touint32(b4)
 	if err != nil {
 		return err
 	}
-	this.Type = int(uint(b1[0]))
+	if size > MaxFrameSize {
+		return fmt.Errorf("%w: frame size %d", ErrMalformed, size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(fr, body); err != nil {
+		return noEOF(err)
+	}
+	if _, err := io.ReadFull(buf, b4); err != nil {
+		return noEOF(err)
+	}
+	if sum, _ := touint32(b4); sum != crc.Sum32() {
+		return ErrFrameChecksum
+	}
+	r := bytes.NewReader(body)
+	if err := this.readBody(r); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: frame body short", ErrMalformed)
+		}
+		return err
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: frame body has %d extra bytes", ErrMalformed, r.Len())
+	}
+	return nil
+}
+
+// noEOF is for reads after the first frame byte, the stream can't end there
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (this *AnalyseInfo) readBody(r *bytes.Reader) error {
+	var err error
+	b1 := []byte{0}
+	b2 := []byte{0, 0}
+	b4 := []byte{0, 0, 0, 0}
+	b8 := []byte{0, 0, 0, 0, 0, 0, 0, 0}
 	if this.IsOpen() {
-		if _, err := buf.Read(b8); err != nil {
+		if _, err := io.ReadFull(r, b2); err != nil {
+			return err
+		}
+		this.Strong, this.Compress = b2[0], b2[1]
+		if _, err := io.ReadFull(r, b4); err != nil {
+			return err
+		}
+		if this.Seed, err = touint32(b4); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, b8); err != nil {
+			return err
+		}
+		if this.Off, err = toint64(b8); err != nil {
 			return err
 		}
-		this.Off = int64(touint64(b8))
+		if _, err := io.ReadFull(r, b2); err != nil {
+			return err
+		}
+		if this.BlockSize, err = touint16(b2); err != nil {
+			return err
+		}
+		if this.IsMeta() {
+			this.Meta = &FileMeta{}
+			if err := this.Meta.Read(r); err != nil {
+				return err
+			}
+		}
 	}
 	if this.IsData() {
-		if _, err := buf.Read(b2); err != nil {
+		if _, err := io.ReadFull(r, b4); err != nil {
 			return err
 		}
-		len := touint16(b2)
-		this.Data = make([]byte, len)
-		if _, err := buf.Read(this.Data); err != nil {
+		n, err := touint32(b4)
+		if err != nil {
+			return err
+		}
+		if n > MaxLiteralSize || int(n) > r.Len() {
+			return fmt.Errorf("%w: frame data length %d", ErrMalformed, n)
+		}
+		this.Data = make([]byte, n)
+		if _, err := io.ReadFull(r, this.Data); err != nil {
 			return err
 		}
 	}
 	if this.IsIndex() {
-		if _, err := buf.Read(b4); err != nil {
+		if _, err := io.ReadFull(r, b4); err != nil {
+			return err
+		}
+		if this.Index, err = touint32(b4); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, b8); err != nil {
+			return err
+		}
+		if this.Off, err = toint64(b8); err != nil {
+			return err
+		}
+	}
+	if this.IsShort() {
+		if _, err := io.ReadFull(r, b2); err != nil {
+			return err
+		}
+		if this.Len, err = touint16(b2); err != nil {
 			return err
 		}
-		this.Index = touint32(b4)
 	}
 	if this.IsClose() {
-		this.Hash = make([]byte, md5.Size)
-		if _, err := buf.Read(this.Hash); err != nil {
+		if _, err := io.ReadFull(r, b1); err != nil {
+			return err
+		}
+		this.Hash = make([]byte, b1[0])
+		if _, err := io.ReadFull(r, this.Hash); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// Write encodes the frame in one write, see the frame layout in format.go
 func (this *AnalyseInfo) Write(buf io.Writer) error {
-	if _, err := buf.Write([]byte{byte(this.Type)}); err != nil {
-		return err
+	if this.Type == 0 || this.Type > 0xFF {
+		return fmt.Errorf("frame type %d error", this.Type)
+	}
+	if len(this.Data) > MaxLiteralSize {
+		return fmt.Errorf("frame data length %d error", len(this.Data))
 	}
+	if len(this.Hash) > math.MaxUint8 {
+		return fmt.Errorf("frame hash length %d error", len(this.Hash))
+	}
+	hdr := &bytes.Buffer{}
+	hdr.WriteByte(byte(this.Type))
 	if this.IsOpen() {
-		//file length
-		if _, err := buf.Write(tobyte64(uint64(this.Off))); err != nil {
+		if err := writeHeader(hdr, DeltaMagic); err != nil {
 			return err
 		}
 	}
-	if this.IsData() {
-		//data len
-		len := uint16(len(this.Data))
-		if _, err := buf.Write(tobyte16(len)); err != nil {
-			return err
-		}
-		//data body
-		if _, err := buf.Write(this.Data); err != nil {
-			return err
+	body := make([]byte, 0, len(this.Data)+len(this.Hash)+48)
+	if this.IsOpen() {
+		body = append(body, this.Strong, this.Compress)
+		body = append(body, tobyte32(this.Seed)...)
+		//file length
+		body = append(body, tobyte64(uint64(this.Off))...)
+		body = append(body, tobyte16(this.BlockSize)...)
+		if this.IsMeta() {
+			if this.Meta == nil {
+				return errors.New("file meta nil")
+			}
+			mb := &bytes.Buffer{}
+			if err := this.Meta.Write(mb); err != nil {
+				return err
+			}
+			body = append(body, mb.Bytes()...)
 		}
 	}
+	if this.IsData() {
+		body = append(body, tobyte32(uint32(len(this.Data)))...)
+		body = append(body, this.Data...)
+	}
 	if this.IsIndex() {
-		//index 32
-		if _, err := buf.Write(tobyte32(this.Index)); err != nil {
-			return err
-		}
+		body = append(body, tobyte32(this.Index)...)
+		//basis offset
+		body = append(body, tobyte64(uint64(this.Off))...)
+	}
+	if this.IsShort() {
+		body = append(body, tobyte16(this.Len)...)
 	}
 	if this.IsClose() {
-		//hash
-		if _, err := buf.Write(this.Hash); err != nil {
-			return err
-		}
+		body = append(body, byte(len(this.Hash)))
+		body = append(body, this.Hash...)
 	}
-	return nil
+	hdr.Write(tobyte32(uint32(len(body))))
+	hdr.Write(body)
+	hdr.Write(tobyte32(crc32.Checksum(hdr.Bytes(), castagnoli)))
+	_, err := buf.Write(hdr.Bytes())
+	return err
+}
+
+// Clone is a deep copy of the frame that owns its Data, Hash and Meta, for consumers that keep
+// Analyse frames past the callback like channels and goroutines
+func (this *AnalyseInfo) Clone() *AnalyseInfo {
+	ret := *this
+	ret.Data = bytes.Clone(this.Data)
+	ret.Hash = bytes.Clone(this.Hash)
+	if this.Meta != nil {
+		meta := *this.Meta
+		ret.Meta = &meta
+	}
+	return &ret
 }
 
 func (this *AnalyseInfo) IsOpen() bool {
@@ -637,247 +1624,806 @@ func (this *AnalyseInfo) IsClose() bool {
 func (this *AnalyseInfo) IsIndex() bool {
 	return this.Type&AnalyseTypeIndex != 0
 }
+func (this *AnalyseInfo) IsShort() bool {
+	return this.Type&AnalyseTypeShort != 0
+}
+func (this *AnalyseInfo) IsCompressed() bool {
+	return this.Type&AnalyseTypeCompressed != 0
+}
+func (this *AnalyseInfo) IsMeta() bool {
+	return this.Type&AnalyseTypeMeta != 0
+}
+func (this *AnalyseInfo) IsWhole() bool {
+	return this.Type&AnalyseTypeWhole != 0
+}
 
-func (this *FileHashInfo) CheckPass(mp HashMap, buf []byte, hh hash.Hash32) (uint32, bool) {
+func (this *FileHashInfo) CheckPass(mp *HashMap, buf []byte, hh RollingHash) (uint32, bool) {
 	if len(buf) < int(this.BlockSize) {
 		return 0, false
 	}
-	h12 := hh.Sum32()
-	o, b := mp.PassH1(h12)
-	if !b {
-		return 0, false
-	}
-	o, b = mp.PassH2(h12)
-	if !b {
-		return 0, false
-	}
-	h3 := md5.Sum(buf)
-	o, b = mp.PassH3(h12, h3)
+	o, b := mp.Lookup(hh.Sum32(), func() []byte {
+		return strongSum(this.strong(), buf)
+	})
 	if !b {
 		return 0, false
 	}
 	return this.Info.Blocks[o].Idx, true
 }
 
+// Analyse passes the delta frames of the source to fn, the frame Data is only valid during the call,
+// fn keeps a frame with Clone
 func (this *FileHashInfo) Analyse(fn func(info *AnalyseInfo) error) error {
-	if this.Info == nil {
-		return errors.New("info nil")
+	return this.AnalyseContext(context.Background(), fn)
+}
+
+// AnalyseContext is Analyse that stops with ctx.Err() when ctx is done
+func (this *FileHashInfo) AnalyseContext(ctx context.Context, fn func(info *AnalyseInfo) error) error {
+	if this.Reader == nil {
+		return fmt.Errorf("%w: file not open", ErrStateOrder)
+	}
+	if _, err := this.Reader.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return this.analyse(ctx, this.Reader, fn)
+}
+
+// errStopIter ends an analyse when the range loop over its frames breaks
+var errStopIter = errors.New("iteration stopped")
+
+// AnalyseIter ranges over the frames of Analyse, a failure is yielded last with a nil frame
+// and breaking the loop stops the analyse, the frame Data is only valid until the next iteration
+func (this *FileHashInfo) AnalyseIter(ctx context.Context) iter.Seq2[*AnalyseInfo, error] {
+	return analyseIter(func(fn func(info *AnalyseInfo) error) error {
+		return this.AnalyseContext(ctx, fn)
+	})
+}
+
+// analyseIter turns a callback analyse into an iterator
+func analyseIter(analyse func(fn func(info *AnalyseInfo) error) error) iter.Seq2[*AnalyseInfo, error] {
+	return func(yield func(*AnalyseInfo, error) bool) {
+		err := analyse(func(info *AnalyseInfo) error {
+			if !yield(info, nil) {
+				return errStopIter
+			}
+			return nil
+		})
+		if err != nil && err != errStopIter {
+			yield(nil, err)
+		}
 	}
-	if this.File == nil {
-		return errors.New("file not open")
+}
+
+// usableDup finds a usable block equal to block idx, DupKeepAll signatures may hold several
+func (this *FileHashInfo) usableDup(mp *HashMap, idx uint32, off int64) (uint32, bool) {
+	b := &this.Info.Blocks[idx]
+	for _, v := range mp.Get(weakKey(b.H1, b.H2)) {
+		if v.Len == b.Len && bytes.Equal(v.H3, b.H3) && this.usable(v.Idx, off) {
+			return v.Idx, true
+		}
 	}
+	return 0, false
+}
+
+// usable reports whether block idx may be copied to output offset off,
+// in place the blocks before off are already overwritten
+func (this *FileHashInfo) usable(idx uint32, off int64) bool {
+	return !this.Info.InPlace || int64(this.Info.Blocks[idx].Off) >= off
+}
+
+// openFrame is the first frame of a delta
+func (this *FileHashInfo) openFrame(whole bool) *AnalyseInfo {
 	info := &AnalyseInfo{}
 	info.Type = AnalyseTypeOpen
 	info.Off = this.FileSize
-	if err := fn(info); err != nil {
+	info.BlockSize = this.BlockSize
+	info.Strong = this.Hasher.ID()
+	info.Seed = this.Seed
+	if this.Meta != nil {
+		info.Type |= AnalyseTypeMeta
+		info.Meta = this.Meta
+	}
+	if whole {
+		info.Type |= AnalyseTypeWhole
+	}
+	return info
+}
+
+// appendPrefix hashes the basis size prefix of rs, the running hash is returned
+// when it equals the basis hash, else nil and rs is sought back
+func (this *FileHashInfo) appendPrefix(ctx context.Context, rs io.ReadSeeker) (hash.Hash, error) {
+	size := this.Info.Size()
+	if size == 0 || size > this.FileSize {
+		return nil, nil
+	}
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	h := this.strong().New()
+	pb := getBuffer(32 * 1024)
+	defer putBuffer(pb)
+	buf := *pb
+	for left := size; left > 0; {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		num, err := io.ReadFull(rs, buf[:min(left, int64(len(buf)))])
+		if err != nil {
+			return nil, err
+		}
+		h.Write(buf[:num])
+		left -= int64(num)
+	}
+	if bytes.Equal(h.Sum(nil), this.Info.MD5) {
+		return h, nil
+	}
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// analyseAppend sends the basis as sequential index frames and the rest of rs as data,
+// rs is positioned after the basis prefix and h holds its hash
+func (this *FileHashInfo) analyseAppend(ctx context.Context, rs io.Reader, h hash.Hash, fn func(info *AnalyseInfo) error) error {
+	if err := fn(this.openFrame(false)); err != nil {
 		return err
 	}
-	mp := this.Info.GetMap()
-	rbuf := bytes.NewBuffer(nil)
-	wbuf := bytes.NewBuffer(nil)
-	adler := adler32.New()
-	file := NewFileReader(this.File, this.BlockSize)
-	for foff := int64(0); foff < this.FileSize; foff++ {
-		if this.Info.IsEmpty() {
-			buf := make([]byte, this.BlockSize)
-			if _, err := this.File.Seek(foff, io.SeekStart); err != nil {
+	bs := int64(this.BlockSize)
+	size := this.Info.Size()
+	for off, idx := int64(0), uint32(0); off < size; off, idx = off+bs, idx+1 {
+		if idx%1024 == 0 {
+			if err := ctx.Err(); err != nil {
 				return err
 			}
-			num, err := this.File.Read(buf)
+		}
+		info := &AnalyseInfo{Type: AnalyseTypeIndex, Index: idx, Off: off}
+		if left := size - off; left < bs {
+			info.Type |= AnalyseTypeShort
+			info.Len = uint16(left)
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	pb := getBuffer(int(bs))
+	defer putBuffer(pb)
+	buf := *pb
+	for off := size; off < this.FileSize; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		num, err := io.ReadFull(rs, buf[:min(bs, this.FileSize-off)])
+		if err != nil {
+			return err
+		}
+		h.Write(buf[:num])
+		if err := fn(&AnalyseInfo{Type: AnalyseTypeData, Off: off, Data: buf[:num]}); err != nil {
+			return err
+		}
+		off += int64(num)
+	}
+	return fn(&AnalyseInfo{Type: AnalyseTypeClose, Hash: h.Sum(nil)})
+}
+
+// analyse reads rs sequentially from offset 0 to FileSize
+func (this *FileHashInfo) analyse(ctx context.Context, rs io.Reader, fn func(info *AnalyseInfo) error) error {
+	if this.Info == nil {
+		return ErrNoSignature
+	}
+	if this.Hasher == nil {
+		return errors.New("strong hash nil")
+	}
+	if this.Weak == nil {
+		return errors.New("weak hash nil")
+	}
+	if err := this.Info.checkAlgorithms(this.Hasher.ID(), this.Weak.ID()); err != nil {
+		return err
+	}
+	if this.BlockSize == 0 {
+		if !this.Info.IsEmpty() {
+			return fmt.Errorf("%w: zero block size", ErrMalformed)
+		}
+		//nothing to match, any window makes the whole file delta
+		this.BlockSize = DefaultBlockSize
+	}
+	whole := this.WholeFile || this.Info.IsEmpty()
+	fn = this.Hooks.observe(this.Path, fn)
+	if !whole && this.Append {
+		if s, ok := rs.(io.ReadSeeker); ok {
+			h, err := this.appendPrefix(ctx, s)
 			if err != nil {
 				return err
 			}
-			if _, err := file.Hash.Write(buf[:num]); err != nil {
-				return err
+			if h != nil {
+				return this.analyseAppend(ctx, rs, h, fn)
 			}
-			info := &AnalyseInfo{}
-			info.Type = AnalyseTypeData
-			info.Data = buf[:num]
-			foff += int64(num - 1)
-			if err := fn(info); err != nil {
-				return fn(info)
+		}
+	}
+	if !whole && this.WholeFileProbe > 0 && this.FileSize > this.WholeFileProbe*4 {
+		//incompressible or reencrypted sources rarely match past a probe without matches
+		if s, ok := rs.(io.ReadSeeker); ok {
+			matched, err := this.probe(ctx, s)
+			if err != nil {
+				return err
 			}
-		} else if one, err := file.Read(foff); err != nil {
-			return err
-		} else if _, err := rbuf.Write(one); err != nil {
-			return err
-		} else if _, err := adler.Write(one); err != nil {
-			return err
-		} else if idx, ok := this.CheckPass(mp, rbuf.Bytes(), adler); ok {
-			adler.Reset()
-			info := &AnalyseInfo{}
-			info.Type = AnalyseTypeIndex
-			info.Index = idx
-			if wbuf.Len() > 0 {
-				info.Data = wbuf.Bytes()
-				info.Type |= AnalyseTypeData
+			whole = !matched
+		}
+	}
+	if !whole && this.Workers > 1 && this.FileSize >= 2*this.segmentSize() {
+		if ra, ok := rs.(io.ReaderAt); ok {
+			base := int64(0)
+			if s, ok := rs.(io.Seeker); ok {
+				var err error
+				if base, err = s.Seek(0, io.SeekCurrent); err != nil {
+					return err
+				}
 			}
-			info.Off = foff - int64(wbuf.Len()+rbuf.Len()-1)
-			if err := fn(info); err != nil {
+			return this.analyseSegments(ctx, io.NewSectionReader(ra, base, this.FileSize), fn)
+		}
+	}
+	if err := fn(this.openFrame(whole)); err != nil {
+		return err
+	}
+	mp := this.Info.GetMap()
+	bs := int64(this.BlockSize)
+	ml := this.maxLiteral()
+	file, err := NewFileReader(rs, DefaultReadAhead)
+	if err != nil {
+		return err
+	}
+	defer file.Release()
+	file.Hash = this.strong().New()
+	weak := this.weak().New()
+	out := &literals{file: file, fn: fn}
+	//weak hash window start, weak is valid when roll
+	pos := int64(0)
+	roll := false
+	for step := 0; pos+bs <= this.FileSize; step++ {
+		if step%int(this.BlockSize) == 0 {
+			if err := ctx.Err(); err != nil {
 				return err
 			}
-			if err := file.Truncate(wbuf.Len() + rbuf.Len()); err != nil {
+		}
+		win, err := file.Slice(pos, int(bs))
+		if err != nil {
+			return err
+		}
+		if whole {
+			pos += bs
+		} else if !roll {
+			weak.Reset()
+			if _, err := weak.Write(win); err != nil {
 				return err
 			}
-			wbuf.Reset()
-			rbuf.Reset()
-			continue
+			roll = true
 		}
-		if rbuf.Len() >= int(this.BlockSize) {
-			one := []byte{0}
-			adler.Reset()
-			foff -= int64(rbuf.Len() - 1)
-			if _, err := rbuf.Read(one); err != nil {
-				return err
+		if roll {
+			idx, ok := this.CheckPass(mp, win, weak)
+			if ok && !this.usable(idx, pos) {
+				idx, ok = this.usableDup(mp, idx, pos)
 			}
-			if _, err := wbuf.Write(one); err != nil {
-				return err
+			if ok {
+				if err := out.match(pos, bs, this.indexFrame(idx)); err != nil {
+					return err
+				}
+				pos += bs
+				roll = false
+				continue
 			}
-			rbuf.Reset()
-		}
-		if wbuf.Len() >= int(this.BlockSize) {
-			info := &AnalyseInfo{}
-			info.Type = AnalyseTypeData
-			info.Data = wbuf.Bytes()
-			info.Off = foff - int64(wbuf.Len()-1)
-			if err := fn(info); err != nil {
-				return err
+			first := win[0]
+			if pos+bs < this.FileSize {
+				in, err := file.Slice(pos+bs, 1)
+				if err != nil {
+					return err
+				}
+				weak.Roll(first, in[0])
 			}
-			if err := file.Truncate(wbuf.Len()); err != nil {
+			pos++
+		}
+		if pos-out.lit >= ml {
+			if err := out.flush(pos); err != nil {
 				return err
 			}
-			wbuf.Reset()
 		}
 	}
-	if _, err := wbuf.Write(rbuf.Bytes()); err != nil {
+	return this.analyseTail(out, whole)
+}
+
+// indexFrame is the frame of a match of signature block idx
+func (this *FileHashInfo) indexFrame(idx uint32) *AnalyseInfo {
+	info := &AnalyseInfo{}
+	info.Type = AnalyseTypeIndex
+	info.Index = idx
+	info.Off = int64(this.Info.Blocks[idx].Off)
+	return info
+}
+
+// analyseTail sends the data from the literal start to the end of the source, a match of the short
+// basis block and the close frame
+func (this *FileHashInfo) analyseTail(out *literals, whole bool) error {
+	bs := int64(this.BlockSize)
+	ml := this.maxLiteral()
+	//long literal runs of a segmented analyse first
+	for this.FileSize-out.lit > ml+bs {
+		if err := out.flush(out.lit + ml); err != nil {
+			return err
+		}
+	}
+	//tail may hold up to a literal and a block of data
+	tail, err := out.file.Slice(out.lit, int(this.FileSize-out.lit))
+	if err != nil {
 		return err
 	}
-	info = &AnalyseInfo{}
+	end := this.FileSize
+	var short *AnalyseInfo
+	if sb := this.Info.ShortBlock(); sb != nil && !whole && len(tail) >= int(sb.Len) {
+		hb := NewHashBlock(this.weak(), this.strong(), tail[len(tail)-int(sb.Len):], sb.Idx, sb.Off)
+		hb.Len = sb.Len
+		if HashBlockEqual(hb, *sb) && this.usable(sb.Idx, this.FileSize-int64(sb.Len)) {
+			end -= int64(sb.Len)
+			short = &AnalyseInfo{}
+			short.Type = AnalyseTypeIndex | AnalyseTypeShort
+			short.Index = sb.Idx
+			short.Off = int64(sb.Off)
+			short.Len = sb.Len
+		}
+	}
+	for end-out.lit > ml {
+		if err := out.send(out.lit+ml, &AnalyseInfo{}); err != nil {
+			return err
+		}
+		out.lit += ml
+	}
+	if short != nil {
+		if err := out.send(end, short); err != nil {
+			return err
+		}
+		out.lit = this.FileSize
+	}
+	info := &AnalyseInfo{}
 	info.Type = AnalyseTypeClose
-	info.Hash = file.Hash.Sum(nil)
-	if wbuf.Len() > 0 {
+	info.Hash = out.file.Hash.Sum(nil)
+	return out.send(this.FileSize, info)
+}
+
+// literals sends the source data from lit as frame data
+type literals struct {
+	file *FileReader
+	lit  int64 //literal data start
+	fn   func(info *AnalyseInfo) error
+}
+
+// send passes info to fn with the data from lit to end, lit is moved by the caller
+func (this *literals) send(end int64, info *AnalyseInfo) error {
+	if end > this.lit {
+		dat, err := this.file.Slice(this.lit, int(end-this.lit))
+		if err != nil {
+			return err
+		}
 		info.Type |= AnalyseTypeData
-		info.Data = wbuf.Bytes()
-		info.Off = this.FileSize - int64(wbuf.Len())
+		info.Data = dat
+		if !info.IsIndex() {
+			info.Off = this.lit
+		}
 	}
-	return fn(info)
+	return this.fn(info)
+}
+
+// flush sends the data up to end as a data frame
+func (this *literals) flush(end int64) error {
+	if err := this.send(end, &AnalyseInfo{}); err != nil {
+		return err
+	}
+	this.lit = end
+	return this.file.Truncate(int(this.lit - this.file.Off))
+}
+
+// match sends the data up to the block match at pos with its index frame
+func (this *literals) match(pos int64, bs int64, info *AnalyseInfo) error {
+	if err := this.send(pos, info); err != nil {
+		return err
+	}
+	this.lit = pos + bs
+	return this.file.Truncate(int(this.lit - this.file.Off))
 }
 
 func (this *FileHashInfo) Open() error {
 	if this.BlockSize == 0 {
 		return errors.New("block size error")
 	}
+	if this.FS != nil {
+		return this.openFS()
+	}
 	fs, err := os.Stat(this.Path)
 	if err != nil {
 		return nil
 	}
-	this.FileSize = fs.Size()
+	this.setSize(fs.Size())
+	this.Meta = NewFileMeta(fs)
 	if this.FileSize == 0 {
 		return nil
 	}
-	if this.FileSize%int64(this.BlockSize) == 0 {
-		this.Count = (this.FileSize / int64(this.BlockSize))
-	} else {
-		this.Count = (this.FileSize / int64(this.BlockSize)) + 1
-	}
 	fd, err := os.OpenFile(this.Path, os.O_RDONLY, os.ModePerm)
 	if err != nil {
 		return fmt.Errorf("open file error: %v", err)
 	}
 	this.File = fd
+	this.Reader = fd
+	return nil
+}
+
+// openFS is Open for Path in FS, files that can't seek are read into memory
+func (this *FileHashInfo) openFS() error {
+	fi, err := fs.Stat(this.FS, this.Path)
+	if err != nil {
+		return nil
+	}
+	this.setSize(fi.Size())
+	this.Meta = NewFileMeta(fi)
+	if this.FileSize == 0 {
+		return nil
+	}
+	fd, err := this.FS.Open(this.Path)
+	if err != nil {
+		return fmt.Errorf("open file error: %v", err)
+	}
+	if rs, ok := fd.(io.ReadSeeker); ok {
+		this.Reader = rs
+		this.closer = fd
+		return nil
+	}
+	defer fd.Close()
+	dat, err := io.ReadAll(fd)
+	if err != nil {
+		return fmt.Errorf("read file error: %v", err)
+	}
+	this.Reader = bytes.NewReader(dat)
+	this.setSize(int64(len(dat)))
 	return nil
 }
 
+func (this *FileHashInfo) setSize(size int64) {
+	this.FileSize = size
+	if this.BlockSize == 0 {
+		return
+	}
+	if this.FileSize%int64(this.BlockSize) == 0 {
+		this.Count = (this.FileSize / int64(this.BlockSize))
+	} else {
+		this.Count = (this.FileSize / int64(this.BlockSize)) + 1
+	}
+}
+
 func (this *FileHashInfo) FillHashInfo(cb func(info *HashBlock)) error {
+	return this.FillHashInfoContext(context.Background(), cb)
+}
+
+// FillHashInfoContext is FillHashInfo that stops with ctx.Err() when ctx is done
+func (this *FileHashInfo) FillHashInfoContext(ctx context.Context, cb func(info *HashBlock)) error {
 	if this.FileSize == 0 {
 		return nil
 	}
-	if this.File == nil {
-		return errors.New("file not open")
+	if this.Reader == nil {
+		return fmt.Errorf("%w: file not open", ErrStateOrder)
 	}
-	fmd5 := md5.New()
-	buf := make([]byte, this.BlockSize)
-	idx := uint32(0)
-	for i := int64(0); i < this.Count; i++ {
-		off := i * int64(this.BlockSize)
-		hb := HashBlock{}
-		if _, err := this.File.Seek(off, io.SeekStart); err != nil {
-			return fmt.Errorf("seek file error: %v", err)
-		}
-		rsiz, err := this.File.Read(buf)
-		if err != nil {
-			return fmt.Errorf("read file error: %v", err)
+	if this.Checkpoint != "" {
+		return this.fillResumable(ctx, cb)
+	}
+	if _, err := this.Reader.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek file error: %v", err)
+	}
+	return this.fill(ctx, bufio.NewReaderSize(this.Reader, DefaultReadAhead), cb)
+}
+
+// fillState is the position of a fill, blocks before off are in Blocks
+type fillState struct {
+	off  uint64
+	idx  uint32    //next signature index
+	hash hash.Hash //file hash of the data before off, nil when the caller hashes the file
+}
+
+// fill hashes the full blocks read sequentially from r
+func (this *FileHashInfo) fill(ctx context.Context, r io.Reader, cb func(info *HashBlock)) error {
+	if this.Hasher == nil {
+		return errors.New("strong hash nil")
+	}
+	return this.fillFrom(ctx, r, cb, &fillState{hash: this.strong().New()}, nil)
+}
+
+// fillFrom continues the fill of st with the data of r at st.off, save is called after
+// every hashed round, its error stops the fill
+func (this *FileHashInfo) fillFrom(ctx context.Context, r io.Reader, cb func(info *HashBlock), st *fillState, save func(st *fillState) error) error {
+	if this.BlockSize == 0 {
+		return errors.New("block size error")
+	}
+	if this.Hasher == nil {
+		return errors.New("strong hash nil")
+	}
+	if this.Weak == nil {
+		return errors.New("weak hash nil")
+	}
+	sh, wh := this.strong(), this.weak()
+	bs := int(this.BlockSize)
+	workers := max(this.Workers, 1)
+	//blocks read and hashed at once
+	hbs := make([]HashBlock, workers*fillBatch)
+	pb := getBuffer(bs * len(hbs))
+	defer putBuffer(pb)
+	buf := *pb
+	for eof := false; !eof; {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		if rsiz != int(this.BlockSize) {
+		rsiz, err := io.ReadFull(r, buf)
+		if err == io.EOF {
 			break
 		}
+		if err == io.ErrUnexpectedEOF {
+			eof = true
+		} else if err != nil {
+			return fmt.Errorf("read file error: %v", err)
+		}
 		dat := buf[:rsiz]
-		if _, err := fmd5.Write(dat); err != nil {
-			return fmt.Errorf("md5 write error: %v", err)
-		}
-		acs := adler32.Checksum(dat)
-		hb.Idx = idx
-		hb.Off = uint32(i)
-		hb.H1 = uint16((acs & 0xFFFF))
-		hb.H2 = uint16(((acs >> 16) & 0xFFFF))
-		hb.H3 = md5.Sum(dat)
-		ms := hex.EncodeToString(hb.H3[:])
-		if _, ok := this.Blocks[ms]; ok {
-			continue
+		//without a file hash the caller hashes the file
+		if st.hash != nil {
+			if _, err := st.hash.Write(dat); err != nil {
+				return fmt.Errorf("hash write error: %v", err)
+			}
 		}
-		if cb != nil {
-			cb(&hb)
+		num := (rsiz + bs - 1) / bs
+		parallel(workers, num, func(i int) {
+			b := dat[i*bs : min((i+1)*bs, rsiz)]
+			hbs[i] = NewHashBlock(wh, sh, b, 0, st.off+uint64(i*bs))
+			if len(b) < bs {
+				hbs[i].Len = uint16(len(b))
+			}
+		})
+		st.off += uint64(rsiz)
+		for i := range hbs[:num] {
+			hb := hbs[i]
+			hb.Idx = st.idx
+			ms := hex.EncodeToString(hb.H3[:])
+			if dup, ok := this.Blocks[ms]; ok {
+				if this.Dups == DupDedup {
+					this.Remap = append(this.Remap, dup.Idx)
+					continue
+				}
+				ms += "/" + strconv.FormatUint(uint64(st.idx), 10)
+			}
+			if this.Dups == DupDedup {
+				this.Remap = append(this.Remap, st.idx)
+			}
+			if cb != nil {
+				cb(&hb)
+			}
+			this.Blocks[ms] = hb
+			st.idx++
+		}
+		if save != nil {
+			if err := save(st); err != nil {
+				return err
+			}
 		}
-		this.Blocks[ms] = hb
-		idx++
 	}
-	this.MD5 = fmd5.Sum(nil)
+	if st.hash != nil {
+		this.setHash(st.hash, int64(st.off))
+	}
 	return nil
 }
 
+// setHash sets MD5 from the file hash of the first end bytes and keeps its state for ExtendHashInfo
+func (this *FileHashInfo) setHash(h hash.Hash, end int64) {
+	this.MD5 = h.Sum(nil)
+	this.end, this.state = 0, nil
+	if m, ok := h.(encoding.BinaryMarshaler); ok {
+		if state, err := m.MarshalBinary(); err == nil {
+			this.end, this.state = end, state
+		}
+	}
+}
+
+// blocks per worker hashed by one fill round
+const fillBatch = 16
+
+// parallel calls fn for 0 to n-1 on up to workers goroutines
+func parallel(workers int, n int, fn func(i int)) {
+	if workers <= 1 || n <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+	next := atomic.Int64{}
+	wg := sync.WaitGroup{}
+	for w := 0; w < min(workers, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(next.Add(1) - 1); i < n; i = int(next.Add(1) - 1) {
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 func (this *FileHashInfo) Close() {
 	if this.File != nil {
 		this.File.Close()
 		this.File = nil
 	}
+	if this.closer != nil {
+		this.closer.Close()
+		this.closer = nil
+	}
+	this.Reader = nil
 }
 
+// NewFileHashInfo takes Option values, the older blocksize int, *HashInfo, StrongHasher, WeakHasher,
+// *Hooks and DupPolicy args are still accepted, later args override earlier ones
 func NewFileHashInfo(file string, arg ...interface{}) *FileHashInfo {
 	ret := &FileHashInfo{
 		Blocks:    map[string]HashBlock{},
 		BlockSize: DefaultBlockSize,
 		Path:      file,
-	}
-	var iv interface{} = nil
-	if len(arg) == 1 {
-		iv = arg[0]
-	}
-	switch iv.(type) {
-	case int:
-		{
-			ret.BlockSize = uint16(iv.(int))
-		}
-	case *HashInfo:
-		{
-			ret.Info = iv.(*HashInfo)
-			ret.BlockSize = ret.Info.BlockSize
+		Hasher:    MD5Hasher,
+		Weak:      Adler32Hasher,
+
+		WholeFileProbe: DefaultWholeFileProbe,
+	}
+	for _, iv := range arg {
+		switch v := iv.(type) {
+		case Option:
+			ret.apply(newOptions([]Option{v}))
+		case int:
+			ret.apply(newOptions([]Option{WithBlockSize(uint16(v))}))
+		case *HashInfo:
+			ret.apply(newOptions([]Option{WithSignature(v)}))
+		case StrongHasher:
+			ret.apply(newOptions([]Option{WithStrongHash(v)}))
+		case WeakHasher:
+			ret.apply(newOptions([]Option{WithWeakHash(v)}))
+		case *Hooks:
+			ret.apply(newOptions([]Option{WithHooks(v)}))
+		case DupPolicy:
+			ret.apply(newOptions([]Option{WithDups(v)}))
 		}
-	default:
-		return ret
 	}
 	return ret
 }
 
-//file file path
-//args[0] blocksize
+// file file path
+// args Option or blocksize int, StrongHasher, WeakHasher, DupPolicy, without a block size
+// or signature the block size is AutoBlockSize of the file size
 func GetFileHashInfo(file string, cb func(info *HashBlock), args ...interface{}) (*HashInfo, error) {
 	df := NewFileHashInfo(file, args...)
 	if err := df.Open(); err != nil {
 		return nil, err
 	}
 	defer df.Close()
+	if !hasBlockSize(args) {
+		df.BlockSize = AutoBlockSize(df.FileSize)
+		df.setSize(df.FileSize)
+	}
 	if err := df.FillHashInfo(cb); err != nil {
 		return nil, err
 	}
 	return df.GetHashInfo(), nil
 }
+
+// hasBlockSize reports whether the NewFileHashInfo args set the block size
+func hasBlockSize(args []interface{}) bool {
+	for _, iv := range args {
+		switch v := iv.(type) {
+		case int, *HashInfo:
+			return true
+		case Option:
+			if o := newOptions([]Option{v}); o.blockSize > 0 || o.info != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ExtendHashInfo is the signature of r for a source that only grew to size since hi was made from it,
+// only the blocks past the last full block of hi are hashed. Without the file hash state of a signature
+// filled by this process the old data is read once more for the file hash and a changed prefix fails
+// with ErrHashMismatch. opts as for NewFileHashInfo, the hashes and block size of hi are kept
+func ExtendHashInfo(hi *HashInfo, r io.ReaderAt, size int64, opts ...interface{}) (*HashInfo, error) {
+	fh := NewFileHashInfo("", append(opts, WithSignature(hi))...)
+	if fh.Hasher == nil || fh.Weak == nil {
+		return nil, errors.New("signature hash not support")
+	}
+	if fh.BlockSize == 0 {
+		return nil, errors.New("block size error")
+	}
+	old, state := hi.Size(), []byte(nil)
+	if hi.state != nil {
+		old, state = hi.end, hi.state
+	}
+	if size < old {
+		return nil, fmt.Errorf("%w: source shrank from %d to %d", ErrHashMismatch, old, size)
+	}
+	bs := int64(fh.BlockSize)
+	start := old - old%bs
+	fh.Reader = io.NewSectionReader(r, 0, size)
+	fh.setSize(size)
+	st := &fillState{off: uint64(start)}
+	for _, b := range hi.Blocks {
+		if int64(b.Off) >= start {
+			continue
+		}
+		ms := hex.EncodeToString(b.H3)
+		if _, ok := fh.Blocks[ms]; ok {
+			ms += "/" + strconv.FormatUint(uint64(b.Idx), 10)
+		}
+		fh.Blocks[ms] = b
+		st.idx = max(st.idx, b.Idx+1)
+	}
+	fh.Remap = nil
+	file := fh.strong().New()
+	if state != nil {
+		um, ok := file.(encoding.BinaryUnmarshaler)
+		if !ok {
+			return nil, errors.New("hash state not support")
+		}
+		if err := um.UnmarshalBinary(state); err != nil {
+			return nil, err
+		}
+	} else if old > 0 {
+		if _, err := io.Copy(file, io.NewSectionReader(r, 0, old)); err != nil {
+			return nil, fmt.Errorf("read file error: %v", err)
+		}
+		if !bytes.Equal(file.Sum(nil), hi.MD5) {
+			return nil, fmt.Errorf("%w: source changed before offset %d", ErrHashMismatch, old)
+		}
+	}
+	//the blocks from start, the file hash from old
+	tail := io.TeeReader(io.NewSectionReader(r, start, size-start), &skipWriter{n: old - start, w: file})
+	if err := fh.fillFrom(context.Background(), bufio.NewReaderSize(tail, DefaultReadAhead), nil, st, nil); err != nil {
+		return nil, err
+	}
+	fh.setHash(file, size)
+	ret := fh.GetHashInfo()
+	ret.InPlace = hi.InPlace
+	return ret, nil
+}
+
+// skipWriter drops the first n bytes written and passes the rest to w
+type skipWriter struct {
+	n int64
+	w io.Writer
+}
+
+func (this *skipWriter) Write(p []byte) (int, error) {
+	l := len(p)
+	if this.n >= int64(l) {
+		this.n -= int64(l)
+		return l, nil
+	}
+	if _, err := this.w.Write(p[this.n:]); err != nil {
+		return 0, err
+	}
+	this.n = 0
+	return l, nil
+}
+
+// NewReaderHashInfo reads size bytes of source data from r instead of a file path
+func NewReaderHashInfo(r io.ReaderAt, size int64, arg ...interface{}) *FileHashInfo {
+	ret := NewFileHashInfo("", arg...)
+	ret.Reader = io.NewSectionReader(r, 0, size)
+	ret.setSize(size)
+	return ret
+}
+
+// GetReaderHashInfo computes the signature of r read sequentially to EOF
+// args Option or blocksize int, StrongHasher, WeakHasher, DupPolicy
+func GetReaderHashInfo(r io.Reader, cb func(info *HashBlock), args ...interface{}) (*HashInfo, error) {
+	df := NewFileHashInfo("", args...)
+	if err := df.fill(context.Background(), r, cb); err != nil {
+		return nil, err
+	}
+	return df.GetHashInfo(), nil
+}
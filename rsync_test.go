@@ -1,11 +1,21 @@
 package rsync
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
 	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
 
 	"github.com/gofrs/flock"
 )
@@ -25,7 +35,7 @@ func TestHashBlockRW(t *testing.T) {
 	b1.Idx = 1
 	b1.H1 = 140
 	b1.H2 = 277
-	b1.H3 = mv
+	b1.H3 = mv[:]
 	buf := &bytes.Buffer{}
 	if err := b1.Write(buf); err != nil {
 		t.Error(err)
@@ -42,6 +52,19 @@ func TestHashBlockRW(t *testing.T) {
 	}
 }
 
+func TestHashBlockEqual(t *testing.T) {
+	b1 := HashBlock{Idx: 1, H1: 140, H2: 277, H3: []byte{1, 2, 3}, Len: 3}
+	b2 := b1
+	if !HashBlockEqual(b1, b2) {
+		t.Error("equal blocks differ")
+	}
+	//only the second weak sum differs
+	b2.H2++
+	if HashBlockEqual(b1, b2) {
+		t.Error("blocks with another H2 equal")
+	}
+}
+
 func TestAnalyse(t *testing.T) {
 	dst := "dst.txt"
 
@@ -97,3 +120,876 @@ func TestAnalyse(t *testing.T) {
 		panic(err)
 	}
 }
+
+func TestReaderHashInfo(t *testing.T) {
+	dat, err := os.ReadFile("dst.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hf, err := GetFileHashInfo("dst.txt", nil, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hr, err := GetReaderHashInfo(bytes.NewReader(dat), nil, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !HashInfoEqual(hf, hr) {
+		t.Error("HashInfoEqual error")
+	}
+	src, err := os.ReadFile("src.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf := NewReaderHashInfo(bytes.NewReader(src), int64(len(src)), hr)
+	defer sf.Close()
+	out := &bytes.Buffer{}
+	if err := sf.Analyse(func(ai *AnalyseInfo) error {
+		return ai.Write(out)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	res := &bytes.Buffer{}
+	if err := Patch(bytes.NewReader(dat), out, res); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res.Bytes(), src) {
+		t.Error("patch result error")
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	dat := bytes.Repeat([]byte("0123456789"), 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	df := NewReaderHashInfo(bytes.NewReader(dat), int64(len(dat)), 16)
+	if err := df.FillHashInfoContext(ctx, nil); err != context.Canceled {
+		t.Error("FillHashInfoContext not canceled", err)
+	}
+	sf := NewReaderHashInfo(bytes.NewReader(dat), int64(len(dat)), NewHashInfo())
+	sf.BlockSize = 16
+	if err := sf.AnalyseContext(ctx, func(ai *AnalyseInfo) error {
+		return nil
+	}); err != context.Canceled {
+		t.Error("AnalyseContext not canceled", err)
+	}
+}
+
+func TestLargeOffsetRW(t *testing.T) {
+	b1 := HashBlock{Off: 1<<40 + 3, H1: 1, H2: 2, H3: make([]byte, md5.Size)}
+	buf := &bytes.Buffer{}
+	if err := b1.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2 := &HashBlock{}
+	if err := b2.Read(0, buf); err != nil {
+		t.Fatal(err)
+	}
+	if b2.Off != b1.Off {
+		t.Error("block offset error", b2.Off)
+	}
+	a1 := &AnalyseInfo{Type: AnalyseTypeIndex, Off: 1<<42 + 5}
+	if err := a1.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	a2 := &AnalyseInfo{}
+	if err := a2.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if a2.Off != a1.Off {
+		t.Error("index offset error", a2.Off)
+	}
+}
+
+func TestRollingAnalyse(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	basis := make([]byte, 64*20)
+	rnd.Read(basis)
+	sig, err := GetReaderHashInfo(bytes.NewReader(basis), nil, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := 0; k <= 64; k += 7 {
+		src := make([]byte, k)
+		rnd.Read(src)
+		src = append(src, basis...)
+		sf := NewReaderHashInfo(bytes.NewReader(src), int64(len(src)), sig)
+		literal := 0
+		if err := sf.Analyse(func(ai *AnalyseInfo) error {
+			literal += len(ai.Data)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if literal != k {
+			t.Error("literal size error", k, literal)
+		}
+	}
+}
+
+func TestFileReader(t *testing.T) {
+	dat := make([]byte, 1000)
+	rand.New(rand.NewSource(4)).Read(dat)
+	fr, err := NewFileReader(iotest.HalfReader(bytes.NewReader(dat)), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fr.Slice(900, 50); err != nil || !bytes.Equal(b, dat[900:950]) {
+		t.Fatal("slice error", err)
+	}
+	if err := fr.Truncate(500); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fr.Slice(10, 1); err == nil {
+		t.Error("read truncated offset")
+	}
+	if b, err := fr.Slice(500, 500); err != nil || !bytes.Equal(b, dat[500:]) {
+		t.Fatal("slice error", err)
+	}
+	if _, err := fr.Slice(999, 2); err != io.ErrUnexpectedEOF {
+		t.Error("read past end", err)
+	}
+	if !bytes.Equal(fr.Hash.Sum(nil), strongSum(MD5Hasher, dat)) {
+		t.Error("file hash error")
+	}
+}
+
+func TestHashInfoStream(t *testing.T) {
+	dat := make([]byte, 10000)
+	rand.New(rand.NewSource(5)).Read(dat)
+	hi, err := GetReaderHashInfo(bytes.NewReader(dat), nil, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := hi.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	hh := NewHashInfo()
+	num, err := hh.ReadFrom(bufio.NewReader(pr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := hi.ToBuffer()
+	if num != int64(buf.Len()) || !HashInfoEqual(hi, hh) {
+		t.Error("stream signature error", num)
+	}
+}
+
+func TestMergerInPlace(t *testing.T) {
+	dir := t.TempDir()
+	bs := int(DefaultBlockSize)
+	basis := make([]byte, bs*30+100)
+	rand.New(rand.NewSource(4)).Read(basis)
+	//blocks moved both ways
+	src := append(append([]byte{}, basis[bs*10:]...), basis[:bs*10]...)
+	file := filepath.Join(dir, "f.bin")
+	for _, inplace := range []bool{false, true} {
+		if err := os.WriteFile(file, basis, 0644); err != nil {
+			t.Fatal(err)
+		}
+		sig, err := GetFileHashInfo(file, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig.InPlace = inplace
+		delta := &bytes.Buffer{}
+		if err := Delta(sig, bytes.NewReader(src), delta); err != nil {
+			t.Fatal(err)
+		}
+		m := NewFileMerger(file, sig)
+		m.InPlace = true
+		if err := m.Open(); err != nil {
+			t.Fatal(err)
+		}
+		for err == nil {
+			info := &AnalyseInfo{}
+			if err = info.Read(delta); err == nil {
+				err = m.Write(info)
+			}
+			if info.IsClose() {
+				break
+			}
+		}
+		m.Close()
+		if !inplace {
+			if err == nil {
+				t.Fatal("overwritten block error expected")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := os.ReadFile(file); !bytes.Equal(got, src) {
+			t.Error("in place merge error")
+		}
+		if _, err := os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+			t.Error("temp file created")
+		}
+	}
+}
+
+func TestMergerTempDir(t *testing.T) {
+	dir, tmp := t.TempDir(), t.TempDir()
+	file := filepath.Join(dir, "f.txt")
+	src := bytes.Repeat([]byte("temp dir "), 500)
+	sig, err := Signature(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := []*AnalyseInfo{}
+	if err := analyseReader(sig, bytes.NewReader(src), func(info *AnalyseInfo) error {
+		//Data is reused after the call
+		frames = append(frames, info.Clone())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	m := NewFileMerger(file, sig)
+	m.TempDir = tmp
+	if err := m.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(m.TempFile()) != tmp {
+		t.Error("temp file dir error", m.TempFile())
+	}
+	other := NewFileMerger(file, sig)
+	if err := other.Open(); !errors.Is(err, ErrFileLocked) {
+		t.Error("locked error expected", err)
+	}
+	other.Close()
+	for _, info := range frames {
+		if err := m.Write(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Close()
+	if got, _ := os.ReadFile(file); !bytes.Equal(got, src) {
+		t.Error("merge error")
+	}
+	//an unfinished merge leaves nothing behind
+	m = NewFileMerger(file, sig)
+	m.TempDir = tmp
+	if err := m.Open(); err != nil {
+		t.Fatal(err)
+	}
+	m.Write(frames[0])
+	m.Close()
+	if ds, _ := os.ReadDir(tmp); len(ds) != 0 {
+		t.Error("temp file left", ds[0].Name())
+	}
+	if TempPath(file, tmp) == TempPath(filepath.Join(tmp, "f.txt"), tmp) {
+		t.Error("temp path not unique")
+	}
+}
+
+func TestDupPolicy(t *testing.T) {
+	bs := int(DefaultBlockSize)
+	blocks := make([][]byte, 4)
+	r := rand.New(rand.NewSource(5))
+	for i := range blocks {
+		blocks[i] = make([]byte, bs)
+		r.Read(blocks[i])
+	}
+	a, b, c, x := blocks[0], blocks[1], blocks[2], blocks[3]
+	basis := bytes.Join([][]byte{a, b, a, c}, nil)
+	sig, err := GetReaderHashInfo(bytes.NewReader(basis), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh := NewFileHashInfo("", DupDedup)
+	if err := fh.fill(context.Background(), bytes.NewReader(basis), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(sig.Blocks) != 3 || len(fh.Remap) != 4 || fh.Remap[2] != 0 || fh.Remap[3] != 2 {
+		t.Fatalf("dedup blocks %d remap %v", len(sig.Blocks), fh.Remap)
+	}
+	all, err := GetReaderHashInfo(bytes.NewReader(basis), nil, DupKeepAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.Blocks) != 4 || all.Blocks[2].Off != uint64(bs*2) || all.Blocks[2].Idx != 2 {
+		t.Fatalf("keep all blocks %+v", all.Blocks)
+	}
+	//in place the first a is overwritten by x, only the kept copy matches
+	src := bytes.Join([][]byte{x, a, a, c}, nil)
+	for _, v := range []struct {
+		sig     *HashInfo
+		matched int
+	}{{sig, 1}, {all, 3}} {
+		v.sig.InPlace = true
+		rp, err := Compare(v.sig, bytes.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rp.Blocks != v.matched {
+			t.Errorf("%d blocks matched, want %d", rp.Blocks, v.matched)
+		}
+		file := filepath.Join(t.TempDir(), "f.bin")
+		if err := os.WriteFile(file, basis, 0644); err != nil {
+			t.Fatal(err)
+		}
+		delta := &bytes.Buffer{}
+		if err := Delta(v.sig, bytes.NewReader(src), delta); err != nil {
+			t.Fatal(err)
+		}
+		m := NewFileMerger(file, v.sig)
+		m.InPlace = true
+		if err := m.Open(); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			info := &AnalyseInfo{}
+			if err := info.Read(delta); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Write(info); err != nil {
+				t.Fatal(err)
+			}
+			if info.IsClose() {
+				break
+			}
+		}
+		m.Close()
+		if got, _ := os.ReadFile(file); !bytes.Equal(got, src) {
+			t.Error("in place merge error")
+		}
+	}
+}
+
+func TestWholeFile(t *testing.T) {
+	bs := int(DefaultBlockSize)
+	r := rand.New(rand.NewSource(6))
+	basis := make([]byte, bs*40)
+	r.Read(basis)
+	other := make([]byte, bs*40+7)
+	r.Read(other)
+	sig, err := GetReaderHashInfo(bytes.NewReader(basis), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the same data late in the source is missed by the probe
+	late := append(append([]byte{}, other[:bs*10]...), basis...)
+	for _, v := range []struct {
+		name  string
+		src   []byte
+		force bool
+		whole bool
+	}{
+		{"unrelated", other, false, true},
+		{"similar", append([]byte("x"), basis...), false, false},
+		{"late", late, false, true},
+		{"forced", basis, true, true},
+	} {
+		fh := NewFileHashInfo("", sig)
+		fh.WholeFileProbe = int64(bs * 4)
+		fh.WholeFile = v.force
+		fh.Reader = bytes.NewReader(v.src)
+		fh.setSize(int64(len(v.src)))
+		delta := &bytes.Buffer{}
+		whole, index := false, false
+		err := fh.Analyse(func(info *AnalyseInfo) error {
+			whole = whole || info.IsWhole()
+			index = index || info.IsIndex()
+			return info.Write(delta)
+		})
+		if err != nil {
+			t.Fatal(v.name, err)
+		}
+		if whole != v.whole || index == whole {
+			t.Errorf("%s whole %v index %v", v.name, whole, index)
+		}
+		out := &bytes.Buffer{}
+		if err := Patch(bytes.NewReader(basis), delta, out); err != nil || !bytes.Equal(out.Bytes(), v.src) {
+			t.Error(v.name, "patch error", err)
+		}
+	}
+	//a whole file delta can't reference the basis
+	file := filepath.Join(t.TempDir(), "f.bin")
+	if err := os.WriteFile(file, basis, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := NewFileMerger(file, sig)
+	if err := m.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	open := &AnalyseInfo{Type: AnalyseTypeOpen | AnalyseTypeWhole, Off: int64(bs), BlockSize: uint16(bs)}
+	if err := m.Write(open); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Write(&AnalyseInfo{Type: AnalyseTypeIndex}); err == nil {
+		t.Fatal("index frame accepted")
+	}
+}
+
+func TestAppend(t *testing.T) {
+	bs := int(DefaultBlockSize)
+	r := rand.New(rand.NewSource(7))
+	basis := make([]byte, bs*20+100)
+	r.Read(basis)
+	tail := make([]byte, bs*3+5)
+	r.Read(tail)
+	fh := NewFileHashInfo("")
+	fh.Seed = 0x5eed
+	if err := fh.fill(context.Background(), bytes.NewReader(basis), nil); err != nil {
+		t.Fatal(err)
+	}
+	sig := fh.GetHashInfo()
+	if sig.Size() != int64(len(basis)) {
+		t.Fatal("signature size", sig.Size())
+	}
+	grown := append(append([]byte{}, basis...), tail...)
+	changed := append([]byte{}, grown...)
+	changed[10] ^= 1
+	for _, v := range []struct {
+		name   string
+		src    []byte
+		append bool
+	}{
+		{"grown", grown, true},
+		{"changed", changed, false},
+		{"same", basis, true},
+	} {
+		delta := &bytes.Buffer{}
+		blocks, data := 0, 0
+		err := analyseReader(sig, bytes.NewReader(v.src), func(info *AnalyseInfo) error {
+			if info.IsIndex() {
+				blocks++
+			}
+			data += len(info.Data)
+			return info.Write(delta)
+		}, appendOnly)
+		if err != nil {
+			t.Fatal(v.name, err)
+		}
+		if v.append && (blocks != len(sig.Blocks) || data != len(v.src)-len(basis)) {
+			t.Errorf("%s blocks %d data %d", v.name, blocks, data)
+		}
+		if !v.append && data <= len(v.src)-len(basis) {
+			t.Errorf("%s data %d", v.name, data)
+		}
+		out := &bytes.Buffer{}
+		if err := Patch(bytes.NewReader(basis), bytes.NewReader(delta.Bytes()), out); err != nil || !bytes.Equal(out.Bytes(), v.src) {
+			t.Error(v.name, "patch error", err)
+		}
+	}
+	//the tail is appended in place
+	dir := t.TempDir()
+	file := filepath.Join(dir, "f.log")
+	if err := os.WriteFile(file, basis, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ls := NewLocalStore(dir)
+	ls.InPlace = true
+	st, err := PushAppend(context.Background(), ls, bytes.NewReader(grown), "f.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Literal != int64(len(tail)) {
+		t.Error("literal", st.Literal)
+	}
+	if got, err := os.ReadFile(file); err != nil || !bytes.Equal(got, grown) {
+		t.Error("merge error", err)
+	}
+}
+
+func TestHashInfoConcurrent(t *testing.T) {
+	r := rand.New(rand.NewSource(9))
+	basis := make([]byte, 1024*30+10)
+	r.Read(basis)
+	sig, err := Signature(bytes.NewReader(basis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		src := append(bytes.Repeat([]byte{byte(i)}, i*100), basis...)
+		go func() {
+			delta := &bytes.Buffer{}
+			if err := Delta(sig, bytes.NewReader(src), delta); err != nil {
+				errs <- err
+				return
+			}
+			out := &bytes.Buffer{}
+			if err := Patch(bytes.NewReader(basis), delta, out); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(out.Bytes(), src) {
+				errs <- errors.New("patch data error")
+				return
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	c := sig.Clone()
+	if !HashInfoEqual(c, sig) || c.Seed != sig.Seed || len(c.Blocks) != len(sig.Blocks) {
+		t.Fatal("clone differs")
+	}
+	c.Blocks[0].H3[0] ^= 1
+	if bytes.Equal(c.Blocks[0].H3, sig.Blocks[0].H3) {
+		t.Error("clone shares block hashes")
+	}
+	if len(c.GetMap().Get(weakKey(sig.Blocks[0].H1, sig.Blocks[0].H2))) == 0 {
+		t.Error("clone map error")
+	}
+}
+
+func TestHashMapLookup(t *testing.T) {
+	a := []byte("a")
+	mp := NewHashMap([]HashBlock{
+		{Idx: 0, H1: 1, H2: 2, H3: []byte("x")},
+		{Idx: 1, H1: 1, H2: 3, H3: a},
+		{Idx: 2, H1: 1, H2: 3, H3: []byte("b")},
+	})
+	calls := 0
+	strong := func(mv []byte) func() []byte {
+		return func() []byte {
+			calls++
+			return mv
+		}
+	}
+	if _, ok := mp.Lookup(1|9<<16, strong(a)); ok || calls != 0 {
+		t.Error("h2 miss hashed", calls)
+	}
+	if idx, ok := mp.Lookup(1|3<<16, strong([]byte("b"))); !ok || idx != 2 || calls != 1 {
+		t.Error("lookup error", idx, calls)
+	}
+	if _, ok := mp.Lookup(2|3<<16, strong(a)); ok || calls != 1 {
+		t.Error("h1 miss hashed", calls)
+	}
+}
+
+func TestHashMap(t *testing.T) {
+	mp := NewHashMap([]HashBlock{
+		{Idx: 0, H1: 7, H2: 1, H3: []byte("x")},
+		{Idx: 1, H1: 7, H2: 2, H3: []byte("y")},
+		{Idx: 2, H1: 0xFFFF, H2: 2, H3: []byte("z")},
+	})
+	if _, ok := mp.PassH1(7 | 5<<16); !ok {
+		t.Error("low half missed")
+	}
+	if _, ok := mp.PassH1(8); ok {
+		t.Error("low half found")
+	}
+	if hs := mp.Get(7 | 2<<16); len(hs) != 1 || hs[0].Idx != 1 {
+		t.Error("full key error", hs)
+	}
+	if idx, ok := mp.PassH3(0xFFFF|2<<16, []byte("z")); !ok || idx != 2 {
+		t.Error("strong lookup error")
+	}
+	if _, ok := mp.PassH2(7 | 3<<16); ok {
+		t.Error("high half not checked")
+	}
+}
+
+func TestMergerVerify(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "f.bin")
+	r := rand.New(rand.NewSource(10))
+	basis := make([]byte, 1024*10+3)
+	r.Read(basis)
+	if err := os.WriteFile(file, basis, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := GetFileHashInfo(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := &bytes.Buffer{}
+	if err := Delta(sig, bytes.NewReader(append([]byte("new"), basis...)), delta); err != nil {
+		t.Fatal(err)
+	}
+	verify := func(dat []byte) error {
+		m := NewFileMerger(file, sig)
+		m.Verify = true
+		if err := m.Open(); err != nil {
+			return err
+		}
+		defer m.Close()
+		return mergeFrames(m, bytes.NewReader(dat))
+	}
+	if err := verify(delta.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	//the basis changed since the signature
+	bad := append([]byte{}, basis...)
+	bad[5000] ^= 1
+	if err := os.WriteFile(file, bad, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(delta.Bytes()); !errors.Is(err, ErrHashMismatch) {
+		t.Error("mismatch not found", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Error("verify wrote files", entries, err)
+	}
+	if got, err := os.ReadFile(file); err != nil || !bytes.Equal(got, bad) {
+		t.Error("verify changed the basis", err)
+	}
+}
+
+func TestExtendHashInfo(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	src := make([]byte, DefaultBlockSize*40+300)
+	rnd.Read(src)
+	old := src[:DefaultBlockSize*10+100]
+	for _, dups := range []DupPolicy{DupDedup, DupKeepAll} {
+		sig, err := GetReaderHashInfo(bytes.NewReader(old), nil, WithDups(dups), WithStrongHash(SHA256Hasher))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := GetReaderHashInfo(bytes.NewReader(src), nil, WithDups(dups), WithStrongHash(SHA256Hasher))
+		if err != nil {
+			t.Fatal(err)
+		}
+		//with the file hash state and read back without it
+		read := &HashInfo{}
+		buf, _ := sig.ToBuffer()
+		if err := read.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		for _, hi := range []*HashInfo{sig, read} {
+			mid, err := ExtendHashInfo(hi, bytes.NewReader(src), DefaultBlockSize*25+7, WithDups(dups))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ExtendHashInfo(mid, bytes.NewReader(src), int64(len(src)), WithDups(dups))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !HashInfoEqual(got, want) || !bytes.Equal(got.MD5, want.MD5) {
+				t.Fatal("extended signature error", dups)
+			}
+		}
+		changed := bytes.Clone(src)
+		changed[10]++
+		if _, err := ExtendHashInfo(read, bytes.NewReader(changed), int64(len(src))); !errors.Is(err, ErrHashMismatch) {
+			t.Error("changed prefix error", err)
+		}
+		if _, err := ExtendHashInfo(sig, bytes.NewReader(src), 10); !errors.Is(err, ErrHashMismatch) {
+			t.Error("shrank source error", err)
+		}
+	}
+}
+
+// testNoSeekFS hides the Seek of the files it opens
+type testNoSeekFS struct {
+	fs.FS
+}
+
+func (this testNoSeekFS) Open(name string) (fs.File, error) {
+	fd, err := this.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ fs.File }{fd}, nil
+}
+
+func TestFileHashInfoFS(t *testing.T) {
+	dat := make([]byte, DefaultBlockSize*10+5)
+	rand.New(rand.NewSource(6)).Read(dat)
+	want, err := GetReaderHashInfo(bytes.NewReader(dat), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{"dir/a.bin": {Data: dat}}
+	for _, f := range []fs.FS{fsys, testNoSeekFS{fsys}} {
+		got, err := GetFileHashInfo("dir/a.bin", nil, WithFS(f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !HashInfoEqual(got, want) || !bytes.Equal(got.MD5, want.MD5) {
+			t.Error("fs signature error")
+		}
+	}
+	if got, err := GetFileHashInfo("missing", nil, WithFS(fsys)); err != nil || !got.IsEmpty() {
+		t.Error("missing file error", err)
+	}
+}
+
+func TestAutoBlockSize(t *testing.T) {
+	for _, v := range []struct {
+		size int64
+		want uint16
+	}{
+		{0, DefaultBlockSize},
+		{DefaultBlockSize * DefaultBlockSize, DefaultBlockSize},
+		{4 << 20, 2048},
+		{100 << 20, 10240},
+		{1000003 * 1000003, 0xFFF8},
+		{1 << 40, 0xFFF8},
+	} {
+		if got := AutoBlockSize(v.size); got != v.want {
+			t.Errorf("size %d block %d want %d", v.size, got, v.want)
+		}
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.bin")
+	dat := make([]byte, 4<<20)
+	rand.New(rand.NewSource(7)).Read(dat)
+	if err := os.WriteFile(file, dat, 0644); err != nil {
+		t.Fatal(err)
+	}
+	hi, err := GetFileHashInfo(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hi.BlockSize != 2048 || len(hi.Blocks) != len(dat)/2048 || hi.Size() != int64(len(dat)) {
+		t.Error("auto block size error", hi.BlockSize, len(hi.Blocks))
+	}
+	if hi, err = GetFileHashInfo(file, nil, WithBlockSize(512)); err != nil || hi.BlockSize != 512 {
+		t.Error("block size option error", err)
+	}
+	if hi, err = GetFileHashInfo(file, nil, 4096); err != nil || hi.BlockSize != 4096 {
+		t.Error("block size arg error", err)
+	}
+}
+
+func TestMaxLiteral(t *testing.T) {
+	bs := int(DefaultBlockSize)
+	r := rand.New(rand.NewSource(8))
+	basis := make([]byte, bs*40)
+	r.Read(basis)
+	sig, err := GetReaderHashInfo(bytes.NewReader(basis), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := make([]byte, 600<<10)
+	r.Read(other)
+	//new data around the basis and past its end
+	src := append(append(append([]byte{}, other[:400<<10]...), basis...), other[400<<10:]...)
+	for _, v := range []struct {
+		max  int
+		long int
+	}{
+		{0, bs},
+		{16 << 10, 16 << 10},
+		{256 << 10, 256 << 10},
+		{1 << 20, MaxLiteralSize},
+	} {
+		fh := NewFileHashInfo("", sig, WithMaxLiteral(v.max))
+		fh.WholeFileProbe = 0
+		fh.Reader = bytes.NewReader(src)
+		fh.setSize(int64(len(src)))
+		delta := &bytes.Buffer{}
+		frames, long, index := 0, 0, 0
+		err := fh.Analyse(func(info *AnalyseInfo) error {
+			frames++
+			long = max(long, len(info.Data))
+			if info.IsIndex() {
+				index++
+			}
+			return info.Write(delta)
+		})
+		if err != nil {
+			t.Fatal(v.max, err)
+		}
+		if long != v.long || index != 40 {
+			t.Errorf("max %d literal %d index %d", v.max, long, index)
+		}
+		if v.max > 0 && frames > (len(src)-len(basis))/(16<<10)+45 {
+			t.Errorf("max %d frames %d", v.max, frames)
+		}
+		out := &bytes.Buffer{}
+		if err := Patch(bytes.NewReader(basis), delta, out); err != nil || !bytes.Equal(out.Bytes(), src) {
+			t.Error(v.max, "patch error", err)
+		}
+	}
+}
+
+func TestAnalyseInfoClone(t *testing.T) {
+	r := rand.New(rand.NewSource(9))
+	basis := make([]byte, DefaultBlockSize*20)
+	r.Read(basis)
+	src := append(append([]byte{}, basis[:DefaultBlockSize*5]...), make([]byte, DefaultBlockSize*30)...)
+	r.Read(src[DefaultBlockSize*5:])
+	sig, err := GetReaderHashInfo(bytes.NewReader(basis), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//frames written by another goroutine after Analyse moved on
+	ch := make(chan *AnalyseInfo, 1024)
+	delta := &bytes.Buffer{}
+	done := make(chan error)
+	go func() {
+		var err error
+		for v := range ch {
+			if err == nil {
+				err = v.Write(delta)
+			}
+		}
+		done <- err
+	}()
+	err = analyseReader(sig, bytes.NewReader(src), func(info *AnalyseInfo) error {
+		ch <- info.Clone()
+		return nil
+	})
+	close(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if err := Patch(bytes.NewReader(basis), delta, out); err != nil || !bytes.Equal(out.Bytes(), src) {
+		t.Error("patch error", err)
+	}
+	info := &AnalyseInfo{Type: AnalyseTypeOpen | AnalyseTypeMeta, Data: []byte("a"), Hash: []byte("b"), Meta: &FileMeta{Mode: 0644}}
+	c := info.Clone()
+	info.Data[0], info.Hash[0], info.Meta.Mode = 'x', 'y', 0600
+	if string(c.Data) != "a" || string(c.Hash) != "b" || c.Meta.Mode != 0644 || c.Type != info.Type {
+		t.Error("clone shares memory")
+	}
+}
+
+func TestMergerCopyRange(t *testing.T) {
+	r := rand.New(rand.NewSource(13))
+	basis := make([]byte, DefaultBlockSize*64+100)
+	r.Read(basis)
+	src := bytes.Clone(basis)
+	r.Read(src[DefaultBlockSize*20 : DefaultBlockSize*20+10])
+	src = append(src[:DefaultBlockSize*40], append([]byte("moved"), src[DefaultBlockSize*40:]...)...)
+	for _, copyRange := range []bool{false, true} {
+		file := filepath.Join(t.TempDir(), "f.bin")
+		if err := os.WriteFile(file, basis, 0644); err != nil {
+			t.Fatal(err)
+		}
+		sig, err := GetFileHashInfo(file, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewFileMerger(file, sig)
+		m.CopyRange = copyRange
+		if err := m.Open(); err != nil {
+			t.Fatal(err)
+		}
+		pending := int64(0)
+		err = analyseReader(sig, bytes.NewReader(src), func(info *AnalyseInfo) error {
+			err := m.Write(info)
+			pending = max(pending, m.copyLen)
+			return err
+		})
+		m.Close()
+		if err != nil {
+			t.Fatal(copyRange, err)
+		}
+		if got, _ := os.ReadFile(file); !bytes.Equal(got, src) {
+			t.Error(copyRange, "merge error")
+		}
+		//runs of matched blocks are copied at once
+		if copyRange != (pending >= DefaultBlockSize*19) {
+			t.Error(copyRange, "pending copy", pending)
+		}
+	}
+}
@@ -0,0 +1,4 @@
+// Package rsyncpb holds the protobuf messages for signatures and delta frames and the gRPC service.
+package rsyncpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative rsync.proto
@@ -0,0 +1,821 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        v5.28.3
+// source: rsync.proto
+
+package rsyncpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// HashBlock is the signature of one basis block.
+type HashBlock struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// signature index
+	Idx uint32 `protobuf:"varint,1,opt,name=idx,proto3" json:"idx,omitempty"`
+	// basis offset
+	Off uint64 `protobuf:"varint,2,opt,name=off,proto3" json:"off,omitempty"`
+	// weak hash low 16 bits
+	H1 uint32 `protobuf:"varint,3,opt,name=h1,proto3" json:"h1,omitempty"`
+	// weak hash high 16 bits
+	H2 uint32 `protobuf:"varint,4,opt,name=h2,proto3" json:"h2,omitempty"`
+	// strong hash sum
+	H3 []byte `protobuf:"bytes,5,opt,name=h3,proto3" json:"h3,omitempty"`
+	// > 0 trailing short block length
+	Len           uint32 `protobuf:"varint,6,opt,name=len,proto3" json:"len,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HashBlock) Reset() {
+	*x = HashBlock{}
+	mi := &file_rsync_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HashBlock) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HashBlock) ProtoMessage() {}
+
+func (x *HashBlock) ProtoReflect() protoreflect.Message {
+	mi := &file_rsync_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HashBlock.ProtoReflect.Descriptor instead.
+func (*HashBlock) Descriptor() ([]byte, []int) {
+	return file_rsync_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *HashBlock) GetIdx() uint32 {
+	if x != nil {
+		return x.Idx
+	}
+	return 0
+}
+
+func (x *HashBlock) GetOff() uint64 {
+	if x != nil {
+		return x.Off
+	}
+	return 0
+}
+
+func (x *HashBlock) GetH1() uint32 {
+	if x != nil {
+		return x.H1
+	}
+	return 0
+}
+
+func (x *HashBlock) GetH2() uint32 {
+	if x != nil {
+		return x.H2
+	}
+	return 0
+}
+
+func (x *HashBlock) GetH3() []byte {
+	if x != nil {
+		return x.H3
+	}
+	return nil
+}
+
+func (x *HashBlock) GetLen() uint32 {
+	if x != nil {
+		return x.Len
+	}
+	return 0
+}
+
+// HashInfo is the signature of a basis file.
+type HashInfo struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// FormatVersion of the writer
+	Version   uint32 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	BlockSize uint32 `protobuf:"varint,2,opt,name=block_size,json=blockSize,proto3" json:"block_size,omitempty"`
+	// strong hash id, 0 md5 1 sha256 2 blake3
+	Strong uint32 `protobuf:"varint,3,opt,name=strong,proto3" json:"strong,omitempty"`
+	// weak hash id, 0 adler32 1 buzhash 2 rabin
+	Weak uint32 `protobuf:"varint,4,opt,name=weak,proto3" json:"weak,omitempty"`
+	// whole file strong hash
+	Hash   []byte       `protobuf:"bytes,5,opt,name=hash,proto3" json:"hash,omitempty"`
+	Blocks []*HashBlock `protobuf:"bytes,6,rep,name=blocks,proto3" json:"blocks,omitempty"`
+	// the receiver merges in place
+	InPlace bool `protobuf:"varint,7,opt,name=in_place,json=inPlace,proto3" json:"in_place,omitempty"`
+	// checksum seed mixed into the strong and weak sums, 0 none
+	Seed          uint32 `protobuf:"varint,8,opt,name=seed,proto3" json:"seed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HashInfo) Reset() {
+	*x = HashInfo{}
+	mi := &file_rsync_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HashInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HashInfo) ProtoMessage() {}
+
+func (x *HashInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_rsync_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HashInfo.ProtoReflect.Descriptor instead.
+func (*HashInfo) Descriptor() ([]byte, []int) {
+	return file_rsync_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *HashInfo) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *HashInfo) GetBlockSize() uint32 {
+	if x != nil {
+		return x.BlockSize
+	}
+	return 0
+}
+
+func (x *HashInfo) GetStrong() uint32 {
+	if x != nil {
+		return x.Strong
+	}
+	return 0
+}
+
+func (x *HashInfo) GetWeak() uint32 {
+	if x != nil {
+		return x.Weak
+	}
+	return 0
+}
+
+func (x *HashInfo) GetHash() []byte {
+	if x != nil {
+		return x.Hash
+	}
+	return nil
+}
+
+func (x *HashInfo) GetBlocks() []*HashBlock {
+	if x != nil {
+		return x.Blocks
+	}
+	return nil
+}
+
+func (x *HashInfo) GetInPlace() bool {
+	if x != nil {
+		return x.InPlace
+	}
+	return false
+}
+
+func (x *HashInfo) GetSeed() uint32 {
+	if x != nil {
+		return x.Seed
+	}
+	return 0
+}
+
+// FileMeta is the source file metadata sent with the open frame.
+type FileMeta struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// permission bits
+	Mode uint32 `protobuf:"varint,1,opt,name=mode,proto3" json:"mode,omitempty"`
+	// unix nanoseconds
+	Mtime int64 `protobuf:"varint,2,opt,name=mtime,proto3" json:"mtime,omitempty"`
+	// -1 unknown
+	Uid           int32 `protobuf:"varint,3,opt,name=uid,proto3" json:"uid,omitempty"`
+	Gid           int32 `protobuf:"varint,4,opt,name=gid,proto3" json:"gid,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FileMeta) Reset() {
+	*x = FileMeta{}
+	mi := &file_rsync_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FileMeta) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileMeta) ProtoMessage() {}
+
+func (x *FileMeta) ProtoReflect() protoreflect.Message {
+	mi := &file_rsync_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileMeta.ProtoReflect.Descriptor instead.
+func (*FileMeta) Descriptor() ([]byte, []int) {
+	return file_rsync_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *FileMeta) GetMode() uint32 {
+	if x != nil {
+		return x.Mode
+	}
+	return 0
+}
+
+func (x *FileMeta) GetMtime() int64 {
+	if x != nil {
+		return x.Mtime
+	}
+	return 0
+}
+
+func (x *FileMeta) GetUid() int32 {
+	if x != nil {
+		return x.Uid
+	}
+	return 0
+}
+
+func (x *FileMeta) GetGid() int32 {
+	if x != nil {
+		return x.Gid
+	}
+	return 0
+}
+
+// AnalyseInfo is one delta frame, type is a bit set of
+// open 1, data 2, index 4, close 8, short 16, compressed 32, meta 64, whole 128.
+type AnalyseInfo struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Type  uint32                 `protobuf:"varint,1,opt,name=type,proto3" json:"type,omitempty"`
+	// signature index of the matched block
+	Index uint32 `protobuf:"varint,2,opt,name=index,proto3" json:"index,omitempty"`
+	// open: file size, index: basis offset
+	Off int64 `protobuf:"varint,3,opt,name=off,proto3" json:"off,omitempty"`
+	// literal data
+	Data []byte `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+	// close: whole file strong hash
+	Hash []byte `protobuf:"bytes,5,opt,name=hash,proto3" json:"hash,omitempty"`
+	// open: basis block size
+	BlockSize uint32 `protobuf:"varint,6,opt,name=block_size,json=blockSize,proto3" json:"block_size,omitempty"`
+	// short: matched block length
+	Len uint32 `protobuf:"varint,7,opt,name=len,proto3" json:"len,omitempty"`
+	// open: strong hash id
+	Strong uint32 `protobuf:"varint,8,opt,name=strong,proto3" json:"strong,omitempty"`
+	// open: FormatVersion of the writer
+	Version uint32 `protobuf:"varint,9,opt,name=version,proto3" json:"version,omitempty"`
+	// open: literal compress id, 0 none 1 zstd 2 gzip
+	Compress uint32 `protobuf:"varint,10,opt,name=compress,proto3" json:"compress,omitempty"`
+	// open: file metadata, set with the meta type bit
+	Meta *FileMeta `protobuf:"bytes,11,opt,name=meta,proto3" json:"meta,omitempty"`
+	// open: checksum seed of the whole file hash
+	Seed          uint32 `protobuf:"varint,12,opt,name=seed,proto3" json:"seed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AnalyseInfo) Reset() {
+	*x = AnalyseInfo{}
+	mi := &file_rsync_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AnalyseInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AnalyseInfo) ProtoMessage() {}
+
+func (x *AnalyseInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_rsync_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AnalyseInfo.ProtoReflect.Descriptor instead.
+func (*AnalyseInfo) Descriptor() ([]byte, []int) {
+	return file_rsync_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *AnalyseInfo) GetType() uint32 {
+	if x != nil {
+		return x.Type
+	}
+	return 0
+}
+
+func (x *AnalyseInfo) GetIndex() uint32 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *AnalyseInfo) GetOff() int64 {
+	if x != nil {
+		return x.Off
+	}
+	return 0
+}
+
+func (x *AnalyseInfo) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *AnalyseInfo) GetHash() []byte {
+	if x != nil {
+		return x.Hash
+	}
+	return nil
+}
+
+func (x *AnalyseInfo) GetBlockSize() uint32 {
+	if x != nil {
+		return x.BlockSize
+	}
+	return 0
+}
+
+func (x *AnalyseInfo) GetLen() uint32 {
+	if x != nil {
+		return x.Len
+	}
+	return 0
+}
+
+func (x *AnalyseInfo) GetStrong() uint32 {
+	if x != nil {
+		return x.Strong
+	}
+	return 0
+}
+
+func (x *AnalyseInfo) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *AnalyseInfo) GetCompress() uint32 {
+	if x != nil {
+		return x.Compress
+	}
+	return 0
+}
+
+func (x *AnalyseInfo) GetMeta() *FileMeta {
+	if x != nil {
+		return x.Meta
+	}
+	return nil
+}
+
+func (x *AnalyseInfo) GetSeed() uint32 {
+	if x != nil {
+		return x.Seed
+	}
+	return 0
+}
+
+type SignatureRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Path          string                 `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SignatureRequest) Reset() {
+	*x = SignatureRequest{}
+	mi := &file_rsync_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SignatureRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SignatureRequest) ProtoMessage() {}
+
+func (x *SignatureRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_rsync_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SignatureRequest.ProtoReflect.Descriptor instead.
+func (*SignatureRequest) Descriptor() ([]byte, []int) {
+	return file_rsync_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *SignatureRequest) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+type DeltaFrame struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Path          string                 `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	Frame         *AnalyseInfo           `protobuf:"bytes,2,opt,name=frame,proto3" json:"frame,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeltaFrame) Reset() {
+	*x = DeltaFrame{}
+	mi := &file_rsync_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeltaFrame) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeltaFrame) ProtoMessage() {}
+
+func (x *DeltaFrame) ProtoReflect() protoreflect.Message {
+	mi := &file_rsync_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeltaFrame.ProtoReflect.Descriptor instead.
+func (*DeltaFrame) Descriptor() ([]byte, []int) {
+	return file_rsync_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *DeltaFrame) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *DeltaFrame) GetFrame() *AnalyseInfo {
+	if x != nil {
+		return x.Frame
+	}
+	return nil
+}
+
+type ApplyResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ApplyResult) Reset() {
+	*x = ApplyResult{}
+	mi := &file_rsync_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ApplyResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ApplyResult) ProtoMessage() {}
+
+func (x *ApplyResult) ProtoReflect() protoreflect.Message {
+	mi := &file_rsync_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ApplyResult.ProtoReflect.Descriptor instead.
+func (*ApplyResult) Descriptor() ([]byte, []int) {
+	return file_rsync_proto_rawDescGZIP(), []int{6}
+}
+
+type SyncMessage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Msg:
+	//
+	//	*SyncMessage_Path
+	//	*SyncMessage_Signature
+	//	*SyncMessage_Frame
+	//	*SyncMessage_Result
+	Msg           isSyncMessage_Msg `protobuf_oneof:"msg"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SyncMessage) Reset() {
+	*x = SyncMessage{}
+	mi := &file_rsync_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SyncMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SyncMessage) ProtoMessage() {}
+
+func (x *SyncMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_rsync_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SyncMessage.ProtoReflect.Descriptor instead.
+func (*SyncMessage) Descriptor() ([]byte, []int) {
+	return file_rsync_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *SyncMessage) GetMsg() isSyncMessage_Msg {
+	if x != nil {
+		return x.Msg
+	}
+	return nil
+}
+
+func (x *SyncMessage) GetPath() string {
+	if x != nil {
+		if x, ok := x.Msg.(*SyncMessage_Path); ok {
+			return x.Path
+		}
+	}
+	return ""
+}
+
+func (x *SyncMessage) GetSignature() *HashInfo {
+	if x != nil {
+		if x, ok := x.Msg.(*SyncMessage_Signature); ok {
+			return x.Signature
+		}
+	}
+	return nil
+}
+
+func (x *SyncMessage) GetFrame() *AnalyseInfo {
+	if x != nil {
+		if x, ok := x.Msg.(*SyncMessage_Frame); ok {
+			return x.Frame
+		}
+	}
+	return nil
+}
+
+func (x *SyncMessage) GetResult() *ApplyResult {
+	if x != nil {
+		if x, ok := x.Msg.(*SyncMessage_Result); ok {
+			return x.Result
+		}
+	}
+	return nil
+}
+
+type isSyncMessage_Msg interface {
+	isSyncMessage_Msg()
+}
+
+type SyncMessage_Path struct {
+	// client, first message
+	Path string `protobuf:"bytes,1,opt,name=path,proto3,oneof"`
+}
+
+type SyncMessage_Signature struct {
+	// server reply to path
+	Signature *HashInfo `protobuf:"bytes,2,opt,name=signature,proto3,oneof"`
+}
+
+type SyncMessage_Frame struct {
+	// client delta frame
+	Frame *AnalyseInfo `protobuf:"bytes,3,opt,name=frame,proto3,oneof"`
+}
+
+type SyncMessage_Result struct {
+	// server reply after the close frame
+	Result *ApplyResult `protobuf:"bytes,4,opt,name=result,proto3,oneof"`
+}
+
+func (*SyncMessage_Path) isSyncMessage_Msg() {}
+
+func (*SyncMessage_Signature) isSyncMessage_Msg() {}
+
+func (*SyncMessage_Frame) isSyncMessage_Msg() {}
+
+func (*SyncMessage_Result) isSyncMessage_Msg() {}
+
+var File_rsync_proto protoreflect.FileDescriptor
+
+const file_rsync_proto_rawDesc = "" +
+	"\n" +
+	"\vrsync.proto\x12\x05rsync\"q\n" +
+	"\tHashBlock\x12\x10\n" +
+	"\x03idx\x18\x01 \x01(\rR\x03idx\x12\x10\n" +
+	"\x03off\x18\x02 \x01(\x04R\x03off\x12\x0e\n" +
+	"\x02h1\x18\x03 \x01(\rR\x02h1\x12\x0e\n" +
+	"\x02h2\x18\x04 \x01(\rR\x02h2\x12\x0e\n" +
+	"\x02h3\x18\x05 \x01(\fR\x02h3\x12\x10\n" +
+	"\x03len\x18\x06 \x01(\rR\x03len\"\xdc\x01\n" +
+	"\bHashInfo\x12\x18\n" +
+	"\aversion\x18\x01 \x01(\rR\aversion\x12\x1d\n" +
+	"\n" +
+	"block_size\x18\x02 \x01(\rR\tblockSize\x12\x16\n" +
+	"\x06strong\x18\x03 \x01(\rR\x06strong\x12\x12\n" +
+	"\x04weak\x18\x04 \x01(\rR\x04weak\x12\x12\n" +
+	"\x04hash\x18\x05 \x01(\fR\x04hash\x12(\n" +
+	"\x06blocks\x18\x06 \x03(\v2\x10.rsync.HashBlockR\x06blocks\x12\x19\n" +
+	"\bin_place\x18\a \x01(\bR\ainPlace\x12\x12\n" +
+	"\x04seed\x18\b \x01(\rR\x04seed\"X\n" +
+	"\bFileMeta\x12\x12\n" +
+	"\x04mode\x18\x01 \x01(\rR\x04mode\x12\x14\n" +
+	"\x05mtime\x18\x02 \x01(\x03R\x05mtime\x12\x10\n" +
+	"\x03uid\x18\x03 \x01(\x05R\x03uid\x12\x10\n" +
+	"\x03gid\x18\x04 \x01(\x05R\x03gid\"\xa9\x02\n" +
+	"\vAnalyseInfo\x12\x12\n" +
+	"\x04type\x18\x01 \x01(\rR\x04type\x12\x14\n" +
+	"\x05index\x18\x02 \x01(\rR\x05index\x12\x10\n" +
+	"\x03off\x18\x03 \x01(\x03R\x03off\x12\x12\n" +
+	"\x04data\x18\x04 \x01(\fR\x04data\x12\x12\n" +
+	"\x04hash\x18\x05 \x01(\fR\x04hash\x12\x1d\n" +
+	"\n" +
+	"block_size\x18\x06 \x01(\rR\tblockSize\x12\x10\n" +
+	"\x03len\x18\a \x01(\rR\x03len\x12\x16\n" +
+	"\x06strong\x18\b \x01(\rR\x06strong\x12\x18\n" +
+	"\aversion\x18\t \x01(\rR\aversion\x12\x1a\n" +
+	"\bcompress\x18\n" +
+	" \x01(\rR\bcompress\x12#\n" +
+	"\x04meta\x18\v \x01(\v2\x0f.rsync.FileMetaR\x04meta\x12\x12\n" +
+	"\x04seed\x18\f \x01(\rR\x04seed\"&\n" +
+	"\x10SignatureRequest\x12\x12\n" +
+	"\x04path\x18\x01 \x01(\tR\x04path\"J\n" +
+	"\n" +
+	"DeltaFrame\x12\x12\n" +
+	"\x04path\x18\x01 \x01(\tR\x04path\x12(\n" +
+	"\x05frame\x18\x02 \x01(\v2\x12.rsync.AnalyseInfoR\x05frame\"\r\n" +
+	"\vApplyResult\"\xb5\x01\n" +
+	"\vSyncMessage\x12\x14\n" +
+	"\x04path\x18\x01 \x01(\tH\x00R\x04path\x12/\n" +
+	"\tsignature\x18\x02 \x01(\v2\x0f.rsync.HashInfoH\x00R\tsignature\x12*\n" +
+	"\x05frame\x18\x03 \x01(\v2\x12.rsync.AnalyseInfoH\x00R\x05frame\x12,\n" +
+	"\x06result\x18\x04 \x01(\v2\x12.rsync.ApplyResultH\x00R\x06resultB\x05\n" +
+	"\x03msg2\xac\x01\n" +
+	"\x05Rsync\x128\n" +
+	"\fGetSignature\x12\x17.rsync.SignatureRequest\x1a\x0f.rsync.HashInfo\x125\n" +
+	"\n" +
+	"ApplyDelta\x12\x11.rsync.DeltaFrame\x1a\x12.rsync.ApplyResult(\x01\x122\n" +
+	"\x04Sync\x12\x12.rsync.SyncMessage\x1a\x12.rsync.SyncMessage(\x010\x01B\x0fZ\rrsync/rsyncpbb\x06proto3"
+
+var (
+	file_rsync_proto_rawDescOnce sync.Once
+	file_rsync_proto_rawDescData []byte
+)
+
+func file_rsync_proto_rawDescGZIP() []byte {
+	file_rsync_proto_rawDescOnce.Do(func() {
+		file_rsync_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_rsync_proto_rawDesc), len(file_rsync_proto_rawDesc)))
+	})
+	return file_rsync_proto_rawDescData
+}
+
+var file_rsync_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_rsync_proto_goTypes = []any{
+	(*HashBlock)(nil),        // 0: rsync.HashBlock
+	(*HashInfo)(nil),         // 1: rsync.HashInfo
+	(*FileMeta)(nil),         // 2: rsync.FileMeta
+	(*AnalyseInfo)(nil),      // 3: rsync.AnalyseInfo
+	(*SignatureRequest)(nil), // 4: rsync.SignatureRequest
+	(*DeltaFrame)(nil),       // 5: rsync.DeltaFrame
+	(*ApplyResult)(nil),      // 6: rsync.ApplyResult
+	(*SyncMessage)(nil),      // 7: rsync.SyncMessage
+}
+var file_rsync_proto_depIdxs = []int32{
+	0, // 0: rsync.HashInfo.blocks:type_name -> rsync.HashBlock
+	2, // 1: rsync.AnalyseInfo.meta:type_name -> rsync.FileMeta
+	3, // 2: rsync.DeltaFrame.frame:type_name -> rsync.AnalyseInfo
+	1, // 3: rsync.SyncMessage.signature:type_name -> rsync.HashInfo
+	3, // 4: rsync.SyncMessage.frame:type_name -> rsync.AnalyseInfo
+	6, // 5: rsync.SyncMessage.result:type_name -> rsync.ApplyResult
+	4, // 6: rsync.Rsync.GetSignature:input_type -> rsync.SignatureRequest
+	5, // 7: rsync.Rsync.ApplyDelta:input_type -> rsync.DeltaFrame
+	7, // 8: rsync.Rsync.Sync:input_type -> rsync.SyncMessage
+	1, // 9: rsync.Rsync.GetSignature:output_type -> rsync.HashInfo
+	6, // 10: rsync.Rsync.ApplyDelta:output_type -> rsync.ApplyResult
+	7, // 11: rsync.Rsync.Sync:output_type -> rsync.SyncMessage
+	9, // [9:12] is the sub-list for method output_type
+	6, // [6:9] is the sub-list for method input_type
+	6, // [6:6] is the sub-list for extension type_name
+	6, // [6:6] is the sub-list for extension extendee
+	0, // [0:6] is the sub-list for field type_name
+}
+
+func init() { file_rsync_proto_init() }
+func file_rsync_proto_init() {
+	if File_rsync_proto != nil {
+		return
+	}
+	file_rsync_proto_msgTypes[7].OneofWrappers = []any{
+		(*SyncMessage_Path)(nil),
+		(*SyncMessage_Signature)(nil),
+		(*SyncMessage_Frame)(nil),
+		(*SyncMessage_Result)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_rsync_proto_rawDesc), len(file_rsync_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   8,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_rsync_proto_goTypes,
+		DependencyIndexes: file_rsync_proto_depIdxs,
+		MessageInfos:      file_rsync_proto_msgTypes,
+	}.Build()
+	File_rsync_proto = out.File
+	file_rsync_proto_goTypes = nil
+	file_rsync_proto_depIdxs = nil
+}
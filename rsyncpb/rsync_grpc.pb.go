@@ -0,0 +1,195 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.28.3
+// source: rsync.proto
+
+package rsyncpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Rsync_GetSignature_FullMethodName = "/rsync.Rsync/GetSignature"
+	Rsync_ApplyDelta_FullMethodName   = "/rsync.Rsync/ApplyDelta"
+	Rsync_Sync_FullMethodName         = "/rsync.Rsync/Sync"
+)
+
+// RsyncClient is the client API for Rsync service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Rsync rebuilds files on the server from deltas computed by the client.
+type RsyncClient interface {
+	// GetSignature returns the signature of a server file.
+	GetSignature(ctx context.Context, in *SignatureRequest, opts ...grpc.CallOption) (*HashInfo, error)
+	// ApplyDelta streams the frames of one delta, path is set on the first message.
+	ApplyDelta(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[DeltaFrame, ApplyResult], error)
+	// Sync sends path, receives the signature, sends frames and receives the result.
+	Sync(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[SyncMessage, SyncMessage], error)
+}
+
+type rsyncClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRsyncClient(cc grpc.ClientConnInterface) RsyncClient {
+	return &rsyncClient{cc}
+}
+
+func (c *rsyncClient) GetSignature(ctx context.Context, in *SignatureRequest, opts ...grpc.CallOption) (*HashInfo, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(HashInfo)
+	err := c.cc.Invoke(ctx, Rsync_GetSignature_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rsyncClient) ApplyDelta(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[DeltaFrame, ApplyResult], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Rsync_ServiceDesc.Streams[0], Rsync_ApplyDelta_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[DeltaFrame, ApplyResult]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Rsync_ApplyDeltaClient = grpc.ClientStreamingClient[DeltaFrame, ApplyResult]
+
+func (c *rsyncClient) Sync(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[SyncMessage, SyncMessage], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Rsync_ServiceDesc.Streams[1], Rsync_Sync_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SyncMessage, SyncMessage]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Rsync_SyncClient = grpc.BidiStreamingClient[SyncMessage, SyncMessage]
+
+// RsyncServer is the server API for Rsync service.
+// All implementations must embed UnimplementedRsyncServer
+// for forward compatibility.
+//
+// Rsync rebuilds files on the server from deltas computed by the client.
+type RsyncServer interface {
+	// GetSignature returns the signature of a server file.
+	GetSignature(context.Context, *SignatureRequest) (*HashInfo, error)
+	// ApplyDelta streams the frames of one delta, path is set on the first message.
+	ApplyDelta(grpc.ClientStreamingServer[DeltaFrame, ApplyResult]) error
+	// Sync sends path, receives the signature, sends frames and receives the result.
+	Sync(grpc.BidiStreamingServer[SyncMessage, SyncMessage]) error
+	mustEmbedUnimplementedRsyncServer()
+}
+
+// UnimplementedRsyncServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedRsyncServer struct{}
+
+func (UnimplementedRsyncServer) GetSignature(context.Context, *SignatureRequest) (*HashInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetSignature not implemented")
+}
+func (UnimplementedRsyncServer) ApplyDelta(grpc.ClientStreamingServer[DeltaFrame, ApplyResult]) error {
+	return status.Errorf(codes.Unimplemented, "method ApplyDelta not implemented")
+}
+func (UnimplementedRsyncServer) Sync(grpc.BidiStreamingServer[SyncMessage, SyncMessage]) error {
+	return status.Errorf(codes.Unimplemented, "method Sync not implemented")
+}
+func (UnimplementedRsyncServer) mustEmbedUnimplementedRsyncServer() {}
+func (UnimplementedRsyncServer) testEmbeddedByValue()               {}
+
+// UnsafeRsyncServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RsyncServer will
+// result in compilation errors.
+type UnsafeRsyncServer interface {
+	mustEmbedUnimplementedRsyncServer()
+}
+
+func RegisterRsyncServer(s grpc.ServiceRegistrar, srv RsyncServer) {
+	// If the following call pancis, it indicates UnimplementedRsyncServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Rsync_ServiceDesc, srv)
+}
+
+func _Rsync_GetSignature_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SignatureRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RsyncServer).GetSignature(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Rsync_GetSignature_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RsyncServer).GetSignature(ctx, req.(*SignatureRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Rsync_ApplyDelta_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(RsyncServer).ApplyDelta(&grpc.GenericServerStream[DeltaFrame, ApplyResult]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Rsync_ApplyDeltaServer = grpc.ClientStreamingServer[DeltaFrame, ApplyResult]
+
+func _Rsync_Sync_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(RsyncServer).Sync(&grpc.GenericServerStream[SyncMessage, SyncMessage]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Rsync_SyncServer = grpc.BidiStreamingServer[SyncMessage, SyncMessage]
+
+// Rsync_ServiceDesc is the grpc.ServiceDesc for Rsync service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Rsync_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "rsync.Rsync",
+	HandlerType: (*RsyncServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetSignature",
+			Handler:    _Rsync_GetSignature_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ApplyDelta",
+			Handler:       _Rsync_ApplyDelta_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Sync",
+			Handler:       _Rsync_Sync_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "rsync.proto",
+}
@@ -0,0 +1,700 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/md4"
+)
+
+// native rsync daemon protocol, protocol 27 is spoken by every rsync since 2.6
+const (
+	RsyncDefaultPort = 873
+	rsyncProtocol    = 27
+	rsyncMplexBase   = 7
+	rsyncSumLength   = md4.Size
+	rsyncBlockSize   = 700
+)
+
+// multiplexed message codes
+const (
+	rsyncMsgData        = 0
+	rsyncMsgErrorXfer   = 1
+	rsyncMsgInfo        = 2
+	rsyncMsgError       = 3
+	rsyncMsgWarning     = 4
+	rsyncMsgErrorSocket = 5
+	rsyncMsgLog         = 6
+	rsyncMsgErrorUTF8   = 8
+)
+
+// file list flags before protocol 28
+const (
+	rsyncXmitTopDir        = 0x01
+	rsyncXmitSameMode      = 0x02
+	rsyncXmitSameRdevPre28 = 0x04
+	rsyncXmitSameUID       = 0x08
+	rsyncXmitSameGID       = 0x10
+	rsyncXmitSameName      = 0x20
+	rsyncXmitLongName      = 0x40
+	rsyncXmitSameTime      = 0x80
+)
+
+// unix file types on the wire
+const (
+	rsyncIFMT  = 0170000
+	rsyncIFREG = 0100000
+	rsyncIFDIR = 0040000
+	rsyncIFLNK = 0120000
+)
+
+// RsyncFile is one entry of the file list sent by an rsync daemon
+type RsyncFile struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	Mode    uint32 //unix mode with file type bits
+}
+
+func (this RsyncFile) IsRegular() bool {
+	return this.Mode&rsyncIFMT == rsyncIFREG
+}
+
+func (this RsyncFile) IsDir() bool {
+	return this.Mode&rsyncIFMT == rsyncIFDIR
+}
+
+// RsyncClient pulls files from an existing rsync daemon (rsync://) with the rsync wire protocol,
+// unchanged files are skipped by size and mtime and existing files are used as delta basis
+type RsyncClient struct {
+	Addr     string //host:port
+	Module   string //daemon module name
+	Path     string //path inside the module
+	User     string
+	Password string
+	Dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+	Motd     io.Writer //receives motd and server messages when not nil
+}
+
+// NewRsyncClient parses rsync://[user@]host[:port]/module/path
+func NewRsyncClient(s string) (*RsyncClient, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "rsync" {
+		return nil, fmt.Errorf("url scheme %s not support", u.Scheme)
+	}
+	c := &RsyncClient{Addr: u.Host}
+	if u.Port() == "" {
+		c.Addr = net.JoinHostPort(u.Hostname(), strconv.Itoa(RsyncDefaultPort))
+	}
+	if u.User != nil {
+		c.User = u.User.Username()
+		c.Password, _ = u.User.Password()
+	}
+	ps := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	c.Module = ps[0]
+	if len(ps) > 1 {
+		c.Path = ps[1]
+	}
+	if c.Module == "" {
+		return nil, errors.New("rsync module empty")
+	}
+	return c, nil
+}
+
+type rsyncConn struct {
+	conn net.Conn
+	raw  *bufio.Reader
+	r    io.Reader
+	w    *bufio.Writer
+	seed int32
+	motd io.Writer
+	err  error //last error message from server
+}
+
+func (this *rsyncConn) readLine() (string, error) {
+	line, err := this.raw.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (this *rsyncConn) readInt() (int32, error) {
+	b4 := make([]byte, 4)
+	if _, err := io.ReadFull(this.r, b4); err != nil {
+		return 0, err
+	}
+	return int32(binary.LittleEndian.Uint32(b4)), nil
+}
+
+func (this *rsyncConn) readLongint() (int64, error) {
+	v, err := this.readInt()
+	if err != nil || v != -1 {
+		return int64(v), err
+	}
+	b8 := make([]byte, 8)
+	if _, err := io.ReadFull(this.r, b8); err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(b8)), nil
+}
+
+func (this *rsyncConn) readByte() (byte, error) {
+	b1 := []byte{0}
+	_, err := io.ReadFull(this.r, b1)
+	return b1[0], err
+}
+
+func (this *rsyncConn) writeInt(v int32) error {
+	b4 := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b4, uint32(v))
+	_, err := this.w.Write(b4)
+	return err
+}
+
+// rsyncMaxMsg is the most kept of an out of band message, like the buffer of rsync itself
+const rsyncMaxMsg = 4096
+
+// demultiplex server output, only data messages are returned
+type rsyncMuxReader struct {
+	c    *rsyncConn
+	left int
+}
+
+func (this *rsyncMuxReader) Read(p []byte) (int, error) {
+	for this.left == 0 {
+		b4 := make([]byte, 4)
+		if _, err := io.ReadFull(this.c.raw, b4); err != nil {
+			return 0, err
+		}
+		hdr := binary.LittleEndian.Uint32(b4)
+		tag := int(hdr>>24) - rsyncMplexBase
+		size := int(hdr & 0xFFFFFF)
+		if tag == rsyncMsgData {
+			this.left = size
+			continue
+		}
+		//messages past rsyncMaxMsg are cut, the rest is skipped
+		msg := make([]byte, min(size, rsyncMaxMsg))
+		if _, err := io.ReadFull(this.c.raw, msg); err != nil {
+			return 0, err
+		}
+		if _, err := io.CopyN(io.Discard, this.c.raw, int64(size-len(msg))); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		switch tag {
+		case rsyncMsgErrorXfer, rsyncMsgError, rsyncMsgErrorSocket, rsyncMsgErrorUTF8:
+			this.c.err = fmt.Errorf("rsync server: %s", strings.TrimSpace(string(msg)))
+		}
+		if this.c.motd != nil {
+			this.c.motd.Write(msg)
+		}
+	}
+	if len(p) > this.left {
+		p = p[:this.left]
+	}
+	n, err := this.c.raw.Read(p)
+	this.left -= n
+	return n, err
+}
+
+func (this *RsyncClient) handshake(ctx context.Context) (*rsyncConn, error) {
+	dial := this.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", this.Addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &rsyncConn{
+		conn: conn,
+		raw:  bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+		motd: this.Motd,
+	}
+	if err := this.greet(c); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (this *RsyncClient) greet(c *rsyncConn) error {
+	fmt.Fprintf(c.w, "@RSYNCD: %d.0\n", rsyncProtocol)
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	remote := 0
+	if _, err := fmt.Sscanf(line, "@RSYNCD: %d", &remote); err != nil {
+		return fmt.Errorf("rsync greeting error: %q", line)
+	}
+	if remote < rsyncProtocol {
+		return fmt.Errorf("rsync protocol %d not support", remote)
+	}
+	fmt.Fprintf(c.w, "%s\n", this.Module)
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "@RSYNCD: OK":
+			return nil
+		case line == "@RSYNCD: EXIT":
+			return errors.New("rsync server exit")
+		case strings.HasPrefix(line, "@ERROR"):
+			return fmt.Errorf("rsync server: %s", line)
+		case strings.HasPrefix(line, "@RSYNCD: AUTHREQD "):
+			if this.User == "" {
+				return errors.New("rsync module requires auth")
+			}
+			fmt.Fprintf(c.w, "%s %s\n", this.User, rsyncAuthHash(this.Password, line[18:]))
+			if err := c.w.Flush(); err != nil {
+				return err
+			}
+		default:
+			if c.motd != nil {
+				fmt.Fprintln(c.motd, line)
+			}
+		}
+	}
+}
+
+// md4 of a zero seed, password and challenge, base64 without padding
+func rsyncAuthHash(password string, challenge string) string {
+	h := md4.New()
+	h.Write([]byte{0, 0, 0, 0})
+	h.Write([]byte(password))
+	h.Write([]byte(challenge))
+	return base64.RawStdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (this *RsyncClient) start(c *rsyncConn) error {
+	src := this.Module + "/" + this.Path
+	for _, arg := range []string{"--server", "--sender", "-rt", ".", src, ""} {
+		fmt.Fprintf(c.w, "%s\n", arg)
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	c.r = c.raw
+	seed, err := c.readInt()
+	if err != nil {
+		return err
+	}
+	c.seed = seed
+	c.r = &rsyncMuxReader{c: c}
+	//empty filter list
+	if err := c.writeInt(0); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (this *RsyncClient) recvFileList(c *rsyncConn) ([]RsyncFile, error) {
+	files := []RsyncFile{}
+	last := RsyncFile{}
+	for {
+		flags, err := c.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if flags == 0 {
+			break
+		}
+		l1 := 0
+		if flags&rsyncXmitSameName != 0 {
+			b, err := c.readByte()
+			if err != nil {
+				return nil, err
+			}
+			l1 = int(b)
+		}
+		l2 := 0
+		if flags&rsyncXmitLongName != 0 {
+			v, err := c.readInt()
+			if err != nil {
+				return nil, err
+			}
+			l2 = int(v)
+		} else {
+			b, err := c.readByte()
+			if err != nil {
+				return nil, err
+			}
+			l2 = int(b)
+		}
+		if l1 > len(last.Name) || l2 < 0 || l2 > math.MaxUint16 {
+			return nil, errors.New("rsync file list name error")
+		}
+		name := make([]byte, l2)
+		if _, err := io.ReadFull(c.r, name); err != nil {
+			return nil, err
+		}
+		f := RsyncFile{Name: last.Name[:l1] + string(name)}
+		if f.Size, err = c.readLongint(); err != nil {
+			return nil, err
+		}
+		f.ModTime = last.ModTime
+		if flags&rsyncXmitSameTime == 0 {
+			v, err := c.readInt()
+			if err != nil {
+				return nil, err
+			}
+			f.ModTime = time.Unix(int64(uint32(v)), 0)
+		}
+		f.Mode = last.Mode
+		if flags&rsyncXmitSameMode == 0 {
+			v, err := c.readInt()
+			if err != nil {
+				return nil, err
+			}
+			f.Mode = uint32(v)
+		}
+		files = append(files, f)
+		last = f
+	}
+	//io error flag
+	if _, err := c.readInt(); err != nil {
+		return nil, err
+	}
+	//receiver and sender index the list in the same sorted order
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].Name == "." || files[j].Name == "." {
+			return files[i].Name == "." && files[j].Name != "."
+		}
+		return files[i].Name < files[j].Name
+	})
+	return files, nil
+}
+
+// local path for a file list name, names escaping dst are rejected
+func rsyncLocalPath(dst string, name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if clean != "/"+strings.TrimSuffix(name, "/") && name != "." {
+		return "", fmt.Errorf("rsync file name %q error", name)
+	}
+	return filepath.Join(dst, filepath.FromSlash(clean)), nil
+}
+
+// rsync checksum1 uses signed chars
+func rsyncSum1(buf []byte) uint32 {
+	s1, s2 := uint32(0), uint32(0)
+	for _, c := range buf {
+		s1 += uint32(int32(int8(c)))
+		s2 += s1
+	}
+	return (s1 & 0xFFFF) + (s2 << 16)
+}
+
+func rsyncSum2(buf []byte, seed int32) []byte {
+	h := md4.New()
+	h.Write(buf)
+	if seed != 0 {
+		b4 := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b4, uint32(seed))
+		h.Write(b4)
+	}
+	return h.Sum(nil)
+}
+
+type rsyncSumHead struct {
+	Count     int32
+	BlockLen  int32
+	Sum2Len   int32
+	Remainder int32
+}
+
+func rsyncBlockLen(size int64) int32 {
+	if size <= rsyncBlockSize*rsyncBlockSize {
+		return rsyncBlockSize
+	}
+	b := int32(math.Sqrt(float64(size)))
+	return (b + 7) &^ 7
+}
+
+// send index, sum head and block sums of the local basis
+func (this *RsyncClient) sendSums(c *rsyncConn, ndx int, basis string) error {
+	if err := c.writeInt(int32(ndx)); err != nil {
+		return err
+	}
+	fd, err := os.Open(basis)
+	if err != nil {
+		for i := 0; i < 4; i++ {
+			if err := c.writeInt(0); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	defer fd.Close()
+	fs, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	size := fs.Size()
+	sh := rsyncSumHead{BlockLen: rsyncBlockLen(size), Sum2Len: rsyncSumLength}
+	sh.Count = int32((size + int64(sh.BlockLen) - 1) / int64(sh.BlockLen))
+	sh.Remainder = int32(size % int64(sh.BlockLen))
+	if size == 0 {
+		sh.BlockLen = 0
+	}
+	for _, v := range []int32{sh.Count, sh.BlockLen, sh.Sum2Len, sh.Remainder} {
+		if err := c.writeInt(v); err != nil {
+			return err
+		}
+	}
+	br := bufio.NewReaderSize(fd, DefaultReadAhead)
+	buf := make([]byte, sh.BlockLen)
+	for i := int32(0); i < sh.Count; i++ {
+		num, err := io.ReadFull(br, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if err := c.writeInt(int32(rsyncSum1(buf[:num]))); err != nil {
+			return err
+		}
+		if _, err := c.w.Write(rsyncSum2(buf[:num], c.seed)[:sh.Sum2Len]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receive the token stream of one file into a temp file and verify the file checksum
+func (this *RsyncClient) recvFile(c *rsyncConn, f RsyncFile, local string) error {
+	sh := rsyncSumHead{}
+	for _, v := range []*int32{&sh.Count, &sh.BlockLen, &sh.Sum2Len, &sh.Remainder} {
+		x, err := c.readInt()
+		if err != nil {
+			return err
+		}
+		*v = x
+	}
+	var basis *os.File
+	if sh.Count > 0 {
+		fd, err := os.Open(local)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		basis = fd
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(local), "."+filepath.Base(local)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	bw := bufio.NewWriterSize(tmp, DefaultReadAhead)
+	sum := md4.New()
+	b4 := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b4, uint32(c.seed))
+	sum.Write(b4)
+	w := io.MultiWriter(bw, sum)
+	for {
+		token, err := c.readInt()
+		if err != nil {
+			return err
+		}
+		if token == 0 {
+			break
+		}
+		if token > 0 {
+			if _, err := io.CopyN(w, c.r, int64(token)); err != nil {
+				return err
+			}
+			continue
+		}
+		idx := -(token + 1)
+		if basis == nil || idx >= sh.Count {
+			return fmt.Errorf("rsync block %d error", idx)
+		}
+		size := int64(sh.BlockLen)
+		if idx == sh.Count-1 && sh.Remainder != 0 {
+			size = int64(sh.Remainder)
+		}
+		sr := io.NewSectionReader(basis, int64(idx)*int64(sh.BlockLen), size)
+		if num, err := io.Copy(w, sr); err != nil {
+			return err
+		} else if num != size {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	fsum := make([]byte, rsyncSumLength)
+	if _, err := io.ReadFull(c.r, fsum); err != nil {
+		return err
+	}
+	if !bytes.Equal(fsum, sum.Sum(nil)) {
+		return fmt.Errorf("rsync file %s hash error", f.Name)
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(os.FileMode(f.Mode & 0777)); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), local); err != nil {
+		return err
+	}
+	return os.Chtimes(local, f.ModTime, f.ModTime)
+}
+
+// Pull copies the module path into the local directory dst and returns the remote file list
+func (this *RsyncClient) Pull(ctx context.Context, dst string) ([]RsyncFile, error) {
+	c, err := this.handshake(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	files, err := this.pull(c, dst)
+	if err != nil && c.err != nil {
+		err = fmt.Errorf("%v: %w", c.err, err)
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return files, err
+}
+
+func (this *RsyncClient) pull(c *rsyncConn, dst string) ([]RsyncFile, error) {
+	if err := this.start(c); err != nil {
+		return nil, err
+	}
+	files, err := this.recvFileList(c)
+	if err != nil {
+		return nil, err
+	}
+	locals := make([]string, len(files))
+	for i, f := range files {
+		local, err := rsyncLocalPath(dst, f.Name)
+		if err != nil {
+			return nil, err
+		}
+		locals[i] = local
+		if f.IsDir() {
+			if err := os.MkdirAll(local, 0755); err != nil {
+				return nil, err
+			}
+		} else if f.IsRegular() {
+			if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+				return nil, err
+			}
+		}
+	}
+	//generator side, receiving runs at the same time so neither end blocks on a full pipe
+	phase := make(chan struct{}, 1)
+	gen := make(chan error, 1)
+	go func() {
+		gen <- this.generate(c, files, locals, phase)
+	}()
+	if err := this.receive(c, files, locals, phase); err != nil {
+		return nil, err
+	}
+	if err := <-gen; err != nil {
+		return nil, err
+	}
+	//total written, total read, total size
+	for i := 0; i < 3; i++ {
+		if _, err := c.readLongint(); err != nil {
+			return nil, err
+		}
+	}
+	//goodbye
+	if err := c.writeInt(-1); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (this *RsyncClient) generate(c *rsyncConn, files []RsyncFile, locals []string, phase chan struct{}) error {
+	for i, f := range files {
+		if !f.IsRegular() {
+			continue
+		}
+		if fs, err := os.Stat(locals[i]); err == nil && fs.Size() == f.Size && fs.ModTime().Unix() == f.ModTime.Unix() {
+			continue
+		}
+		if err := this.sendSums(c, i, locals[i]); err != nil {
+			return err
+		}
+	}
+	if err := c.writeInt(-1); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	if _, ok := <-phase; !ok {
+		return nil
+	}
+	if err := c.writeInt(-1); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (this *RsyncClient) receive(c *rsyncConn, files []RsyncFile, locals []string, phase chan struct{}) error {
+	defer close(phase)
+	done := false
+	for {
+		ndx, err := c.readInt()
+		if err != nil {
+			return err
+		}
+		if ndx == -1 {
+			if done {
+				return nil
+			}
+			done = true
+			phase <- struct{}{}
+			continue
+		}
+		if ndx < 0 || int(ndx) >= len(files) || !files[ndx].IsRegular() {
+			return fmt.Errorf("rsync file index %d error", ndx)
+		}
+		if err := this.recvFile(c, files[ndx], locals[ndx]); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/md4"
+)
+
+// minimal protocol 27 daemon sender for tests
+type testRsyncd struct {
+	t        *testing.T
+	files    []RsyncFile
+	data     map[string][]byte
+	password string
+	matched  int
+}
+
+type testMuxWriter struct {
+	w *bufio.Writer
+}
+
+func (this *testMuxWriter) Write(p []byte) (int, error) {
+	return this.msg(rsyncMsgData, p)
+}
+
+func (this *testMuxWriter) msg(tag int, p []byte) (int, error) {
+	b4 := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b4, uint32(rsyncMplexBase+tag)<<24|uint32(len(p)))
+	this.w.Write(b4)
+	this.w.Write(p)
+	return len(p), this.w.Flush()
+}
+
+func (this *testRsyncd) serve(conn net.Conn) {
+	defer conn.Close()
+	if err := this.run(conn); err != nil {
+		this.t.Error(err)
+	}
+}
+
+func (this *testRsyncd) run(conn net.Conn) error {
+	raw := bufio.NewReader(conn)
+	bw := bufio.NewWriter(conn)
+	line := func() string {
+		s, _ := raw.ReadString('\n')
+		return strings.TrimSuffix(s, "\n")
+	}
+	//net.Pipe has no buffer, so read the client greeting first
+	if s := line(); s != "@RSYNCD: 27.0" {
+		this.t.Error("greeting error", s)
+	}
+	bw.WriteString("@RSYNCD: 31.0\n")
+	bw.Flush()
+	if s := line(); s != "mod" {
+		this.t.Error("module error", s)
+	}
+	bw.WriteString("welcome\n")
+	if this.password != "" {
+		bw.WriteString("@RSYNCD: AUTHREQD abc\n")
+		bw.Flush()
+		if s := line(); s != "user "+rsyncAuthHash(this.password, "abc") {
+			bw.WriteString("@ERROR: auth failed on module mod\n")
+			return bw.Flush()
+		}
+	}
+	bw.WriteString("@RSYNCD: OK\n")
+	bw.Flush()
+	for line() != "" {
+	}
+	seed := int32(12345)
+	c := &rsyncConn{r: raw}
+	mw := &testMuxWriter{w: bw}
+	w := &bytes.Buffer{}
+	wint := func(v int32) {
+		binary.Write(w, binary.LittleEndian, v)
+	}
+	flush := func() {
+		mw.Write(w.Bytes())
+		w.Reset()
+	}
+	binary.Write(bw, binary.LittleEndian, seed)
+	bw.Flush()
+	if v, _ := c.readInt(); v != 0 {
+		this.t.Error("filter list error")
+	}
+	mw.msg(rsyncMsgInfo, []byte("building file list\n"))
+	last := RsyncFile{}
+	for _, f := range this.files {
+		flags := byte(0)
+		l1 := 0
+		for l1 < len(f.Name) && l1 < len(last.Name) && l1 < 255 && f.Name[l1] == last.Name[l1] {
+			l1++
+		}
+		if l1 > 0 {
+			flags |= rsyncXmitSameName
+		}
+		if f.ModTime.Equal(last.ModTime) {
+			flags |= rsyncXmitSameTime
+		}
+		if f.Mode == last.Mode {
+			flags |= rsyncXmitSameMode
+		}
+		if flags == 0 {
+			flags = rsyncXmitLongName
+		}
+		w.WriteByte(flags)
+		if l1 > 0 {
+			w.WriteByte(byte(l1))
+		}
+		if flags&rsyncXmitLongName != 0 {
+			wint(int32(len(f.Name) - l1))
+		} else {
+			w.WriteByte(byte(len(f.Name) - l1))
+		}
+		w.WriteString(f.Name[l1:])
+		wint(int32(f.Size))
+		if flags&rsyncXmitSameTime == 0 {
+			wint(int32(f.ModTime.Unix()))
+		}
+		if flags&rsyncXmitSameMode == 0 {
+			wint(int32(f.Mode))
+		}
+		last = f
+	}
+	w.WriteByte(0)
+	wint(0)
+	flush()
+	files := append([]RsyncFile{}, this.files...)
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].Name == "." || files[j].Name == "." {
+			return files[i].Name == "." && files[j].Name != "."
+		}
+		return files[i].Name < files[j].Name
+	})
+	phase := 0
+	for {
+		ndx, err := c.readInt()
+		if err != nil {
+			return err
+		}
+		if ndx == -1 {
+			if phase > 0 {
+				break
+			}
+			phase++
+			wint(-1)
+			flush()
+			continue
+		}
+		sh := rsyncSumHead{}
+		for _, v := range []*int32{&sh.Count, &sh.BlockLen, &sh.Sum2Len, &sh.Remainder} {
+			*v, _ = c.readInt()
+		}
+		sums := map[uint32][]int32{}
+		strong := map[int32][]byte{}
+		for i := int32(0); i < sh.Count; i++ {
+			s1, _ := c.readInt()
+			s2 := make([]byte, sh.Sum2Len)
+			io.ReadFull(raw, s2)
+			sums[uint32(s1)] = append(sums[uint32(s1)], i)
+			strong[i] = s2
+		}
+		dat := this.data[files[ndx].Name]
+		wint(ndx)
+		for _, v := range []int32{sh.Count, sh.BlockLen, sh.Sum2Len, sh.Remainder} {
+			wint(v)
+		}
+		lit := []byte{}
+		emit := func() {
+			if len(lit) > 0 {
+				wint(int32(len(lit)))
+				w.Write(lit)
+				lit = lit[:0]
+			}
+		}
+		for p := 0; p < len(dat); {
+			found := false
+			for _, l := range []int32{sh.BlockLen, sh.Remainder} {
+				if l == 0 || p+int(l) > len(dat) {
+					continue
+				}
+				blk := dat[p : p+int(l)]
+				for _, idx := range sums[rsyncSum1(blk)] {
+					size := sh.BlockLen
+					if idx == sh.Count-1 && sh.Remainder != 0 {
+						size = sh.Remainder
+					}
+					if size == l && bytes.Equal(rsyncSum2(blk, seed)[:sh.Sum2Len], strong[idx]) {
+						emit()
+						wint(-(idx + 1))
+						this.matched++
+						p += int(l)
+						found = true
+						break
+					}
+				}
+				if found {
+					break
+				}
+			}
+			if !found {
+				lit = append(lit, dat[p])
+				p++
+			}
+		}
+		emit()
+		wint(0)
+		h := md4.New()
+		binary.Write(h, binary.LittleEndian, seed)
+		h.Write(dat)
+		w.Write(h.Sum(nil))
+		flush()
+	}
+	wint(-1)
+	wint(0)
+	wint(0)
+	wint(0)
+	flush()
+	if v, _ := c.readInt(); v != -1 {
+		this.t.Error("goodbye error", v)
+	}
+	return nil
+}
+
+func newTestRsyncd(t *testing.T) *testRsyncd {
+	rd := rand.New(rand.NewSource(7))
+	mt := time.Unix(1600000000, 0)
+	d := &testRsyncd{t: t, data: map[string][]byte{}}
+	add := func(name string, mode uint32, size int) {
+		dat := make([]byte, size)
+		rd.Read(dat)
+		d.data[name] = dat
+		if mode&rsyncIFMT != rsyncIFREG {
+			size = 0
+		}
+		d.files = append(d.files, RsyncFile{Name: name, Size: int64(size), ModTime: mt, Mode: mode})
+	}
+	add(".", rsyncIFDIR|0755, 0)
+	add("dir", rsyncIFDIR|0755, 0)
+	add("dir/b.txt", rsyncIFREG|0644, 5000)
+	add("a.txt", rsyncIFREG|0600, 3000)
+	add("c.txt", rsyncIFREG|0644, 100)
+	add("dir/empty", rsyncIFREG|0644, 0)
+	return d
+}
+
+func (this *testRsyncd) client() *RsyncClient {
+	c, err := NewRsyncClient("rsync://user@localhost/mod/")
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	c.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		go this.serve(c2)
+		return c1, nil
+	}
+	return c
+}
+
+func TestRsyncClientPull(t *testing.T) {
+	d := newTestRsyncd(t)
+	dst := t.TempDir()
+	//basis with an edit in the middle and an unchanged file
+	old := append([]byte{}, d.data["dir/b.txt"]...)
+	copy(old[2000:], "changed")
+	os.MkdirAll(filepath.Join(dst, "dir"), 0755)
+	os.WriteFile(filepath.Join(dst, "dir", "b.txt"), old, 0644)
+	os.WriteFile(filepath.Join(dst, "c.txt"), []byte("x"), 0644)
+	c := d.client()
+	motd := &bytes.Buffer{}
+	c.Motd = motd
+	files, err := c.Pull(context.Background(), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(d.files) || files[0].Name != "." {
+		t.Fatal("file list error", files)
+	}
+	for _, f := range files {
+		if !f.IsRegular() {
+			continue
+		}
+		dat, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(f.Name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dat, d.data[f.Name]) {
+			t.Error("file content error", f.Name)
+		}
+		fs, _ := os.Stat(filepath.Join(dst, filepath.FromSlash(f.Name)))
+		if !fs.ModTime().Equal(f.ModTime) || uint32(fs.Mode().Perm()) != f.Mode&0777 {
+			t.Error("file attr error", f.Name)
+		}
+	}
+	if d.matched == 0 {
+		t.Error("basis blocks not used")
+	}
+	if !strings.Contains(motd.String(), "welcome") || !strings.Contains(motd.String(), "building file list") {
+		t.Error("motd error", motd.String())
+	}
+	//second pull skips everything by size and mtime
+	d.matched = 0
+	if _, err := c.Pull(context.Background(), dst); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRsyncClientAuth(t *testing.T) {
+	d := newTestRsyncd(t)
+	d.password = "secret"
+	c := d.client()
+	c.Password = "bad"
+	if _, err := c.Pull(context.Background(), t.TempDir()); err == nil || !strings.Contains(err.Error(), "auth failed") {
+		t.Error("auth error expected", err)
+	}
+	c.Password = "secret"
+	if _, err := c.Pull(context.Background(), t.TempDir()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewRsyncClient(t *testing.T) {
+	c, err := NewRsyncClient("rsync://bob:pw@example.com/data/sub/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Addr != "example.com:873" || c.Module != "data" || c.Path != "sub/dir" || c.User != "bob" || c.Password != "pw" {
+		t.Error("parse error", c)
+	}
+	if _, err := NewRsyncClient("http://example.com/data"); err == nil {
+		t.Error("scheme error expected")
+	}
+	if _, err := rsyncLocalPath("/tmp", "../x"); err == nil {
+		t.Error("path error expected")
+	}
+}
+
+func TestRsyncMuxReader(t *testing.T) {
+	msg := func(tag int, body []byte) []byte {
+		b4 := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b4, uint32(rsyncMplexBase+tag)<<24|uint32(len(body)))
+		return append(b4, body...)
+	}
+	//a long error message is cut to rsyncMaxMsg and skipped past
+	stream := append(msg(rsyncMsgError, bytes.Repeat([]byte("e"), 100000)), msg(rsyncMsgData, []byte("hello"))...)
+	c := &rsyncConn{raw: bufio.NewReader(bytes.NewReader(stream))}
+	got, err := io.ReadAll(&rsyncMuxReader{c: c})
+	if err != nil || string(got) != "hello" {
+		t.Fatal("data error", string(got), err)
+	}
+	if c.err == nil || len(c.err.Error()) > rsyncMaxMsg+len("rsync server: ") {
+		t.Error("error message", c.err)
+	}
+	//the header claims more than the server sends
+	c = &rsyncConn{raw: bufio.NewReader(bytes.NewReader(msg(rsyncMsgError, bytes.Repeat([]byte("e"), 5000))[:4500]))}
+	if _, err := (&rsyncMuxReader{c: c}).Read(make([]byte, 10)); err != io.ErrUnexpectedEOF {
+		t.Error("short message", err)
+	}
+	//an oversized frame claiming the largest size costs only rsyncMaxMsg
+	huge := make([]byte, 4)
+	binary.LittleEndian.PutUint32(huge, uint32(rsyncMplexBase+rsyncMsgError)<<24|0xFFFFFF)
+	c = &rsyncConn{raw: bufio.NewReader(io.MultiReader(bytes.NewReader(huge), bytes.NewReader(make([]byte, 10000))))}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := (&rsyncMuxReader{c: c}).Read(make([]byte, 10)); err != io.ErrUnexpectedEOF {
+		t.Error("oversized message", err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Error("oversized message allocated", n)
+	}
+}
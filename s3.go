@@ -0,0 +1,500 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//bytes of an S3Object fetched by one ranged GET
+	DefaultS3ChunkSize = 4 << 20
+	//bytes of a multipart upload part, S3 rejects parts below 5MB but the last
+	DefaultS3PartSize = 8 << 20
+	minS3PartSize     = 5 << 20
+)
+
+// S3Store is the Transport for the objects of an S3 compatible bucket, requests are signed with
+// AWS signature v4 and use path style urls. Signatures are computed from a GET of the object,
+// Apply reads the basis blocks with ranged GETs and uploads the rebuilt object in parts
+type S3Store struct {
+	Endpoint     string //https://s3.region.amazonaws.com or the url of a compatible server
+	Bucket       string
+	Region       string
+	Prefix       string //prepended to the paths to form the object keys
+	AccessKey    string
+	SecretKey    string
+	SessionToken string //temporary credentials only
+	Client       *http.Client
+	ChunkSize    int64 //DefaultS3ChunkSize when 0
+	PartSize     int64 //DefaultS3PartSize when 0, at least 5MB
+	Workers      int   //goroutines hashing signature blocks, see FileHashInfo.Workers
+}
+
+func NewS3Store(endpoint string, bucket string, region string, accessKey string, secretKey string) *S3Store {
+	return &S3Store{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Bucket:    bucket,
+		Region:    region,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Client:    http.DefaultClient,
+	}
+}
+
+// key is the object key of path
+func (this *S3Store) key(path string) string {
+	return this.Prefix + strings.TrimPrefix(path, "/")
+}
+
+// s3Escape is the uri encoding of signature v4, / is kept in paths
+func s3Escape(s string, path bool) string {
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// request builds the signed request for key with the query and extra headers, nil body has the empty payload
+func (this *S3Store) request(ctx context.Context, method string, key string, query url.Values, header http.Header, body []byte) (*http.Request, error) {
+	u, err := url.Parse(this.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + this.Bucket + "/" + key
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = s3Query(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	sum := sha256.Sum256(body)
+	this.sign(req, hex.EncodeToString(sum[:]), time.Now())
+	return req, nil
+}
+
+// s3Query is the canonical query, sorted by key
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ps := []string{}
+	for _, k := range keys {
+		vs := append([]string{}, query[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			ps = append(ps, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(ps, "&")
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// sign adds the signature v4 headers, host, range, content-type and the x-amz- headers are signed
+func (this *S3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if this.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", this.SessionToken)
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "range" || lk == "content-type" || lk == "content-md5" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonical := strings.Builder{}
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	creq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonical.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + this.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(creq))
+	sts := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := hmacSHA256([]byte("AWS4"+this.SecretKey), date)
+	key = hmacSHA256(key, this.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, sts))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+this.AccessKey+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+sig)
+}
+
+// do sends req, a non 2xx response is a HTTPStatusError
+func (this *S3Store) do(req *http.Request) (*http.Response, error) {
+	client := this.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, &HTTPStatusError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	return res, nil
+}
+
+// s3NotFound reports a missing object
+func s3NotFound(err error) bool {
+	var se *HTTPStatusError
+	return errors.As(err, &se) && se.StatusCode == http.StatusNotFound
+}
+
+// S3Object reads an object with ranged GETs of ChunkSize, the last chunk is kept for the
+// next reads. It is not safe for concurrent use
+type S3Object struct {
+	Key   string
+	Size  int64
+	ETag  string
+	store *S3Store
+	ctx   context.Context
+	off   int64 //Read position
+	buf   []byte
+	start int64 //object offset of buf
+}
+
+// Open returns the object of path, a missing object fails with a HTTPStatusError of status 404
+func (this *S3Store) Open(ctx context.Context, path string) (*S3Object, error) {
+	key := this.key(path)
+	req, err := this.request(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := this.do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.ContentLength < 0 {
+		return nil, errors.New("object size unknown")
+	}
+	return &S3Object{Key: key, Size: res.ContentLength, ETag: res.Header.Get("ETag"), store: this, ctx: ctx}, nil
+}
+
+// fetch reads the chunk at off into buf
+func (this *S3Object) fetch(off int64) error {
+	size := this.store.ChunkSize
+	if size <= 0 {
+		size = DefaultS3ChunkSize
+	}
+	end := min(off+size, this.Size)
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, end-1)}}
+	if this.ETag != "" {
+		//a replaced object fails instead of mixing versions
+		header.Set("If-Match", this.ETag)
+	}
+	req, err := this.store.request(this.ctx, http.MethodGet, this.Key, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	res, err := this.store.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent && off > 0 {
+		return fmt.Errorf("range not supported, status %d", res.StatusCode)
+	}
+	if cap(this.buf) < int(end-off) {
+		this.buf = make([]byte, end-off)
+	}
+	this.buf = this.buf[:end-off]
+	this.start = off
+	if _, err := io.ReadFull(res.Body, this.buf); err != nil {
+		this.buf = this.buf[:0]
+		return err
+	}
+	return nil
+}
+
+func (this *S3Object) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= this.Size {
+			return n, io.EOF
+		}
+		if pos < this.start || pos >= this.start+int64(len(this.buf)) {
+			if err := this.fetch(pos); err != nil {
+				return n, err
+			}
+		}
+		n += copy(p[n:], this.buf[pos-this.start:])
+	}
+	return n, nil
+}
+
+func (this *S3Object) Read(p []byte) (int, error) {
+	if this.off >= this.Size {
+		return 0, io.EOF
+	}
+	n, err := this.ReadAt(p[:min(int64(len(p)), this.Size-this.off)], this.off)
+	this.off += int64(n)
+	return n, err
+}
+
+func (this *S3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += this.off
+	case io.SeekEnd:
+		offset += this.Size
+	default:
+		return 0, errors.New("seek whence error")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	this.off = offset
+	return offset, nil
+}
+
+func (this *S3Store) Signature(ctx context.Context, path string) (*HashInfo, error) {
+	fh := NewFileHashInfo("", WithWorkers(this.Workers))
+	var err error
+	if fh.Seed, err = RandomSeed(); err != nil {
+		return nil, err
+	}
+	req, err := this.request(ctx, http.MethodGet, this.key(path), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = bytes.NewReader(nil)
+	res, err := this.do(req)
+	if err == nil {
+		defer res.Body.Close()
+		r = bufio.NewReaderSize(res.Body, DefaultReadAhead)
+	} else if !s3NotFound(err) {
+		return nil, err
+	}
+	if err := fh.fill(ctx, r, nil); err != nil {
+		return nil, err
+	}
+	return fh.GetHashInfo(), nil
+}
+
+// Apply rebuilds the object from the basis object and delta, the new object replaces it only
+// when the delta was merged and checked
+func (this *S3Store) Apply(ctx context.Context, path string, delta io.Reader) error {
+	var basis io.ReaderAt = bytes.NewReader(nil)
+	obj, err := this.Open(ctx, path)
+	if err == nil {
+		basis = obj
+	} else if !s3NotFound(err) {
+		return err
+	}
+	up := &s3Upload{store: this, ctx: ctx, key: this.key(path)}
+	if err := Patch(basis, delta, up); err != nil {
+		up.Abort()
+		return err
+	}
+	return up.Close()
+}
+
+func (this *S3Store) Close() error {
+	return nil
+}
+
+// s3Upload writes an object, small objects are put at once, larger ones in parts of PartSize
+type s3Upload struct {
+	store *S3Store
+	ctx   context.Context
+	key   string
+	id    string   //multipart upload id
+	etags []string //of the uploaded parts
+	buf   bytes.Buffer
+}
+
+func (this *s3Upload) partSize() int {
+	size := this.store.PartSize
+	if size <= 0 {
+		size = DefaultS3PartSize
+	}
+	return int(max(size, minS3PartSize))
+}
+
+func (this *s3Upload) Write(p []byte) (int, error) {
+	this.buf.Write(p)
+	size := this.partSize()
+	for this.buf.Len() >= size {
+		if err := this.part(this.buf.Next(size)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+type s3InitResult struct {
+	UploadId string
+}
+
+type s3CompletePart struct {
+	PartNumber int
+	ETag       string
+}
+
+type s3Complete struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+// part uploads the next part, the upload is started by the first one
+func (this *s3Upload) part(b []byte) error {
+	if this.id == "" {
+		req, err := this.store.request(this.ctx, http.MethodPost, this.key, url.Values{"uploads": {""}}, nil, nil)
+		if err != nil {
+			return err
+		}
+		res, err := this.store.do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		ir := &s3InitResult{}
+		if err := xml.NewDecoder(res.Body).Decode(ir); err != nil {
+			return err
+		}
+		if ir.UploadId == "" {
+			return errors.New("upload id missing")
+		}
+		this.id = ir.UploadId
+	}
+	q := url.Values{"partNumber": {strconv.Itoa(len(this.etags) + 1)}, "uploadId": {this.id}}
+	req, err := this.store.request(this.ctx, http.MethodPut, this.key, q, nil, b)
+	if err != nil {
+		return err
+	}
+	res, err := this.store.do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	this.etags = append(this.etags, res.Header.Get("ETag"))
+	return nil
+}
+
+// Close puts the object or uploads the last part and completes the upload
+func (this *s3Upload) Close() error {
+	if this.id == "" {
+		req, err := this.store.request(this.ctx, http.MethodPut, this.key, nil, nil, this.buf.Bytes())
+		if err != nil {
+			return err
+		}
+		res, err := this.store.do(req)
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+	if this.buf.Len() > 0 {
+		if err := this.part(this.buf.Bytes()); err != nil {
+			this.Abort()
+			return err
+		}
+	}
+	c := &s3Complete{}
+	for i, etag := range this.etags {
+		c.Parts = append(c.Parts, s3CompletePart{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	req, err := this.store.request(this.ctx, http.MethodPost, this.key, url.Values{"uploadId": {this.id}}, nil, body)
+	if err != nil {
+		return err
+	}
+	res, err := this.store.do(req)
+	if err != nil {
+		this.Abort()
+		return err
+	}
+	defer res.Body.Close()
+	//a failed complete may still answer 200 with an error document
+	msg, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(msg, []byte("<Error>")) {
+		this.Abort()
+		return &HTTPStatusError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	return nil
+}
+
+// Abort drops the uploaded parts
+func (this *s3Upload) Abort() {
+	if this.id == "" {
+		return
+	}
+	req, err := this.store.request(context.Background(), http.MethodDelete, this.key, url.Values{"uploadId": {this.id}}, nil, nil)
+	if err != nil {
+		return
+	}
+	if res, err := this.store.do(req); err == nil {
+		res.Body.Close()
+	}
+	this.id = ""
+}
@@ -0,0 +1,129 @@
+package rsync
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// landlock syscalls, the same numbers on every architecture
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+	prSetNoNewPrivs              = 38
+)
+
+// landlock file access rights
+const (
+	landlockReadFile   = 1 << 2
+	landlockWriteFile  = 1 << 1
+	landlockReadDir    = 1 << 3
+	landlockRemoveDir  = 1 << 4
+	landlockRemoveFile = 1 << 5
+	landlockMakeDir    = 1 << 7
+	landlockMakeReg    = 1 << 8
+	landlockMakeSym    = 1 << 12
+	landlockRefer      = 1 << 13 //abi 2, renames and links across dirs
+	landlockTruncate   = 1 << 14 //abi 3
+	landlockIoctlDev   = 1 << 15 //abi 5
+
+	landlockRead  = landlockReadFile | landlockReadDir
+	landlockWrite = landlockRead | landlockWriteFile | landlockRemoveDir | landlockRemoveFile |
+		landlockMakeDir | landlockMakeReg | landlockMakeSym | landlockRefer | landlockTruncate
+)
+
+// landlockPathBeneath is struct landlock_path_beneath_attr, the kernel reads the packed 12 bytes
+type landlockPathBeneath struct {
+	access uint64
+	fd     int32
+}
+
+// landlockRuleset creates a ruleset allowing rw dirs to be changed and ro dirs to be read,
+// everything else is denied once it restricts the process
+func landlockRuleset(rw []string, ro []string) (int, error) {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return -1, fmt.Errorf("landlock: %w", errno)
+	}
+	//every right of the abi, execute and devices included
+	handled := uint64(1<<13 - 1)
+	if abi >= 2 {
+		handled |= landlockRefer
+	}
+	if abi >= 3 {
+		handled |= landlockTruncate
+	}
+	if abi >= 5 {
+		handled |= landlockIoctlDev
+	}
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&handled)), unsafe.Sizeof(handled), 0)
+	if errno != 0 {
+		return -1, fmt.Errorf("landlock: %w", errno)
+	}
+	add := func(dir string, access uint64) error {
+		d, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return &os.PathError{Op: "landlock", Path: dir, Err: err}
+		}
+		defer syscall.Close(d)
+		rule := landlockPathBeneath{access: access & handled, fd: int32(d)}
+		_, _, errno := syscall.Syscall6(sysLandlockAddRule, fd, landlockRulePathBeneath, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		runtime.KeepAlive(&rule)
+		if errno != 0 {
+			return &os.PathError{Op: "landlock", Path: dir, Err: errno}
+		}
+		return nil
+	}
+	for _, dir := range rw {
+		if err := add(dir, landlockWrite); err != nil {
+			syscall.Close(int(fd))
+			return -1, err
+		}
+	}
+	for _, dir := range ro {
+		if err := add(dir, landlockRead); err != nil {
+			syscall.Close(int(fd))
+			return -1, err
+		}
+	}
+	return int(fd), nil
+}
+
+// landlockRestrict applies the ruleset to every thread of the process, builds with cgo can't
+// reach all threads and fail with errors.ErrUnsupported
+func landlockRestrict(fd int) error {
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("landlock no new privs, builds with cgo can't restrict every thread: %w", errno)
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, uintptr(fd), 0, 0); errno != 0 {
+		return fmt.Errorf("landlock restrict: %w", errno)
+	}
+	return nil
+}
+
+// landlockRestrictThread applies the ruleset to the calling thread only, lock the thread first
+func landlockRestrictThread(fd int) error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("landlock no new privs: %w", errno)
+	}
+	if _, _, errno := syscall.RawSyscall(sysLandlockRestrictSelf, uintptr(fd), 0, 0); errno != 0 {
+		return fmt.Errorf("landlock restrict: %w", errno)
+	}
+	return nil
+}
+
+// landlock confines the process to the rw and ro dirs, it can't be undone
+func landlock(rw []string, ro []string) error {
+	fd, err := landlockRuleset(rw, ro)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	return landlockRestrict(fd)
+}
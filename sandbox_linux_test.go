@@ -0,0 +1,61 @@
+package rsync
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestLandlock(t *testing.T) {
+	rw, ro, other := t.TempDir(), t.TempDir(), t.TempDir()
+	for _, dir := range []string{ro, other} {
+		if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fd, err := landlockRuleset([]string{rw}, []string{ro})
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	//only the locked thread is restricted, it ends with the goroutine
+	errs := make(chan []error)
+	go func() {
+		runtime.LockOSThread()
+		if err := landlockRestrictThread(fd); err != nil {
+			errs <- []error{err}
+			return
+		}
+		_, rerr := os.ReadFile(filepath.Join(ro, "a.txt"))
+		_, oerr := os.ReadFile(filepath.Join(other, "a.txt"))
+		errs <- []error{
+			os.WriteFile(filepath.Join(rw, "b.txt"), []byte("b"), 0644),
+			os.Rename(filepath.Join(rw, "b.txt"), filepath.Join(rw, "c.txt")),
+			rerr,
+			os.WriteFile(filepath.Join(ro, "b.txt"), []byte("b"), 0644),
+			oerr,
+		}
+	}()
+	res := <-errs
+	if len(res) == 1 {
+		t.Fatal(res[0])
+	}
+	for i, want := range []bool{true, true, true, false, false} {
+		if (res[i] == nil) != want {
+			t.Error(i, res[i])
+		}
+		if res[i] != nil && !errors.Is(res[i], os.ErrPermission) {
+			t.Error(i, "permission error expected", res[i])
+		}
+	}
+	//the test process is not restricted
+	if _, err := os.ReadFile(filepath.Join(other, "a.txt")); err != nil {
+		t.Error(err)
+	}
+}
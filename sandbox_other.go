@@ -0,0 +1,13 @@
+//go:build !linux
+
+package rsync
+
+import (
+	"errors"
+	"fmt"
+)
+
+// landlock is linux only
+func landlock(rw []string, ro []string) error {
+	return fmt.Errorf("landlock: %w", errors.ErrUnsupported)
+}
@@ -0,0 +1,163 @@
+package rsync
+
+import (
+	"context"
+	"io"
+)
+
+// DefaultSegmentSize is the FileHashInfo.SegmentSize when 0
+const DefaultSegmentSize = 64 << 20
+
+func (this *FileHashInfo) segmentSize() int64 {
+	if this.SegmentSize > 0 {
+		return max(this.SegmentSize, int64(this.BlockSize))
+	}
+	return DefaultSegmentSize
+}
+
+// segMatch is a block match of a segment scan
+type segMatch struct {
+	pos int64 //source offset
+	idx uint32
+}
+
+type segResult struct {
+	matches []segMatch
+	err     error
+}
+
+// analyseSegments is the analyse of large sources, Workers goroutines find the block matches of
+// the source segments and the frames are sent in order while reading the source once more for
+// the literal data and the file hash. Windows crossing a segment end aren't matched, a changed
+// block there costs up to two blocks of literal data
+func (this *FileHashInfo) analyseSegments(ctx context.Context, r *io.SectionReader, fn func(info *AnalyseInfo) error) error {
+	if err := fn(this.openFrame(false)); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	mp := this.Info.GetMap()
+	seg := this.segmentSize()
+	num := int((this.FileSize + seg - 1) / seg)
+	results := make([]chan segResult, num)
+	for i := range results {
+		results[i] = make(chan segResult, 1)
+	}
+	//segments scanned and not sent yet
+	sem := make(chan struct{}, this.Workers)
+	go func() {
+		for i := 0; i < num; i++ {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(i int) {
+				start := int64(i) * seg
+				ms, err := this.scanSegment(ctx, r, start, min(start+seg, this.FileSize), mp)
+				results[i] <- segResult{matches: ms, err: err}
+			}(i)
+		}
+	}()
+	file, err := NewFileReader(io.NewSectionReader(r, 0, this.FileSize), DefaultReadAhead)
+	if err != nil {
+		return err
+	}
+	defer file.Release()
+	file.Hash = this.strong().New()
+	out := &literals{file: file, fn: fn}
+	bs := int64(this.BlockSize)
+	ml := this.maxLiteral()
+	for i := 0; i < num; i++ {
+		var res segResult
+		select {
+		case res = <-results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		<-sem
+		if res.err != nil {
+			return res.err
+		}
+		for _, v := range res.matches {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			for v.pos-out.lit > ml {
+				if err := out.flush(out.lit + ml); err != nil {
+					return err
+				}
+			}
+			//the matched block is hashed too
+			if _, err := file.Slice(v.pos, int(bs)); err != nil {
+				return err
+			}
+			if err := out.match(v.pos, bs, this.indexFrame(v.idx)); err != nil {
+				return err
+			}
+		}
+	}
+	return this.analyseTail(out, false)
+}
+
+// scanSegment finds the block matches of the windows in [start, end) of r
+func (this *FileHashInfo) scanSegment(ctx context.Context, r io.ReaderAt, start int64, end int64, mp *HashMap) ([]segMatch, error) {
+	bs := int64(this.BlockSize)
+	file, err := NewFileReader(io.NewSectionReader(r, start, end-start), DefaultReadAhead)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Release()
+	file.Off = start
+	file.Hash = nil
+	weak := this.weak().New()
+	ret := []segMatch{}
+	roll := false
+	for pos, step := start, 0; pos+bs <= end; step++ {
+		if step%int(this.BlockSize) == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		win, err := file.Slice(pos, int(bs))
+		if err != nil {
+			return nil, err
+		}
+		if !roll {
+			weak.Reset()
+			if _, err := weak.Write(win); err != nil {
+				return nil, err
+			}
+			roll = true
+		}
+		idx, ok := this.CheckPass(mp, win, weak)
+		if ok && !this.usable(idx, pos) {
+			idx, ok = this.usableDup(mp, idx, pos)
+		}
+		if ok {
+			ret = append(ret, segMatch{pos: pos, idx: idx})
+			pos += bs
+			roll = false
+			if err := file.Truncate(int(pos - file.Off)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		first := win[0]
+		if pos+bs < end {
+			in, err := file.Slice(pos+bs, 1)
+			if err != nil {
+				return nil, err
+			}
+			weak.Roll(first, in[0])
+		}
+		pos++
+		//only the window is kept
+		if pos-file.Off >= DefaultReadAhead {
+			if err := file.Truncate(int(pos - file.Off)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,71 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+)
+
+func TestAnalyseSegments(t *testing.T) {
+	bs := int(DefaultBlockSize)
+	r := rand.New(rand.NewSource(10))
+	basis := make([]byte, bs*200+300)
+	r.Read(basis)
+	sig, err := GetReaderHashInfo(bytes.NewReader(basis), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := bytes.Clone(basis)
+	for i := 0; i < 20; i++ {
+		off := r.Intn(len(changed) - 100)
+		r.Read(changed[off : off+100])
+	}
+	shifted := append([]byte("shift"), basis...)
+	other := make([]byte, bs*150+7)
+	r.Read(other)
+	literal := func(fh *FileHashInfo, src []byte) (int, []byte) {
+		fh.WholeFileProbe = 0
+		fh.Reader = bytes.NewReader(src)
+		fh.setSize(int64(len(src)))
+		delta := &bytes.Buffer{}
+		lit := 0
+		err := fh.Analyse(func(info *AnalyseInfo) error {
+			lit += len(info.Data)
+			return info.Write(delta)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := &bytes.Buffer{}
+		if err := Patch(bytes.NewReader(basis), delta, out); err != nil || !bytes.Equal(out.Bytes(), src) {
+			t.Error("patch error", err)
+		}
+		return lit, delta.Bytes()
+	}
+	for name, src := range map[string][]byte{"same": basis, "changed": changed, "shifted": shifted, "other": other} {
+		serial, sdelta := literal(NewFileHashInfo("", sig), src)
+		for _, seg := range []int64{int64(bs * 16), int64(bs*16 + 77), int64(len(src))} {
+			fh := NewFileHashInfo("", sig, WithWorkers(4))
+			fh.SegmentSize = seg
+			lit, delta := literal(fh, src)
+			//a block lost at every segment end at most
+			if n := int(int64(len(src))/seg) * 2 * bs; lit > serial+n {
+				t.Errorf("%s segment %d literal %d serial %d", name, seg, lit, serial)
+			}
+			if seg == int64(len(src)) && !bytes.Equal(delta, sdelta) {
+				t.Error(name, "one segment delta differs")
+			}
+		}
+	}
+	//a cancelled analyse stops
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fh := NewFileHashInfo("", sig, WithWorkers(4))
+	fh.SegmentSize = int64(bs * 8)
+	fh.Reader = bytes.NewReader(changed)
+	fh.setSize(int64(len(changed)))
+	if err := fh.AnalyseContext(ctx, func(info *AnalyseInfo) error { return nil }); err != context.Canceled {
+		t.Error("cancel error", err)
+	}
+}
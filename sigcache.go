@@ -0,0 +1,140 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const SignatureCacheMagic = "RSSC"
+
+// SignatureCache keeps the signatures of files in Dir keyed by path, size and mtime so unchanged
+// files aren't hashed again, a cached signature keeps its checksum seed until the file changes
+type SignatureCache struct {
+	Dir string
+}
+
+func NewSignatureCache(dir string) *SignatureCache {
+	return &SignatureCache{Dir: dir}
+}
+
+// entry is the cache file of file signed with the options of fh
+func (this *SignatureCache) entry(file string, fh *FileHashInfo) string {
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d/%d/%d/%d", file, fh.BlockSize, fh.Hasher.ID(), fh.Weak.ID(), fh.Dups)
+	return filepath.Join(this.Dir, hex.EncodeToString(h.Sum(nil))+".sig")
+}
+
+// get returns the cached signature when fi still matches the cached size and mtime
+func (this *SignatureCache) get(entry string, fi os.FileInfo) *HashInfo {
+	dat, err := os.ReadFile(entry)
+	if err != nil {
+		return nil
+	}
+	r := bytes.NewReader(dat)
+	if readHeader(r, SignatureCacheMagic) != nil {
+		return nil
+	}
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil
+	}
+	size, err := toint64(b[:8])
+	if err != nil {
+		return nil
+	}
+	mtime, err := touint64(b[8:])
+	if err != nil || size != fi.Size() || int64(mtime) != fi.ModTime().UnixNano() {
+		return nil
+	}
+	hi := NewHashInfo()
+	if hi.Read(r) != nil {
+		return nil
+	}
+	return hi
+}
+
+// put writes the entry through a temp file so readers never see half of it
+func (this *SignatureCache) put(entry string, fi os.FileInfo, hi *HashInfo) error {
+	buf := &bytes.Buffer{}
+	if err := writeHeader(buf, SignatureCacheMagic); err != nil {
+		return err
+	}
+	buf.Write(tobyte64(uint64(fi.Size())))
+	buf.Write(tobyte64(uint64(fi.ModTime().UnixNano())))
+	if err := hi.Write(buf); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(this.Dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(this.Dir, ".sig*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), entry)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// fileSignature signs fd with the options of fh, a fh.Seed other than 0 must match the cached seed,
+// 0 takes the cached one or a random seed
+func (this *SignatureCache) fileSignature(ctx context.Context, fd *os.File, fh *FileHashInfo) (*HashInfo, error) {
+	//stat before reading, a file changed while hashed misses next time
+	fi, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	entry := this.entry(fd.Name(), fh)
+	if hi := this.get(entry, fi); hi != nil && (fh.Seed == 0 || fh.Seed == hi.Seed) {
+		return hi, nil
+	}
+	if fh.Seed == 0 {
+		if fh.Seed, err = RandomSeed(); err != nil {
+			return nil, err
+		}
+	}
+	if err := fh.fill(ctx, bufio.NewReaderSize(fd, DefaultReadAhead), nil); err != nil {
+		return nil, err
+	}
+	hi := fh.GetHashInfo()
+	//the cache is best effort, a failed write hashes again next time
+	this.put(entry, fi, hi)
+	return hi, nil
+}
+
+// Signature returns the cached signature of file or hashes and caches it, args are those of NewFileHashInfo
+func (this *SignatureCache) Signature(ctx context.Context, file string, args ...interface{}) (*HashInfo, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return this.fileSignature(ctx, fd, NewFileHashInfo(file, args...))
+}
+
+// Remove drops the cached signatures of file signed with args
+func (this *SignatureCache) Remove(file string, args ...interface{}) error {
+	err := os.Remove(this.entry(file, NewFileHashInfo(file, args...)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,94 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSignatureCache(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "f.bin")
+	dat := make([]byte, DefaultBlockSize*8+3)
+	rand.New(rand.NewSource(8)).Read(dat)
+	if err := os.WriteFile(file, dat, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	c := NewSignatureCache(filepath.Join(dir, "cache"))
+	first, err := c.Signature(ctx, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Seed == 0 {
+		t.Fatal("cached signature unseeded")
+	}
+	//same size and mtime is a hit even with other content
+	other := append([]byte{}, dat...)
+	other[0]++
+	if err := os.WriteFile(file, other, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	hit, err := c.Signature(ctx, file)
+	if err != nil || !HashInfoEqual(hit, first) {
+		t.Fatal("cache miss", err)
+	}
+	//other options have their own entries
+	if sig, err := c.Signature(ctx, file, 1024); err != nil || sig.BlockSize != 1024 {
+		t.Fatal("block size entry error", err)
+	}
+	mtime = mtime.Add(time.Second)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	miss, err := c.Signature(ctx, file)
+	if err != nil || bytes.Equal(miss.MD5, first.MD5) {
+		t.Fatal("changed file hit", err)
+	}
+	if err := c.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := c.Signature(ctx, file); err != nil || again.Seed == miss.Seed {
+		t.Fatal("removed entry hit", err)
+	}
+}
+
+func TestLocalStoreCache(t *testing.T) {
+	root := t.TempDir()
+	s := NewLocalStore(root)
+	s.Cache = NewSignatureCache(t.TempDir())
+	ctx := context.Background()
+	dat := bytes.Repeat([]byte("cached store "), 2000)
+	if err := Push(ctx, s, bytes.NewReader(dat), "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	a, err := s.Signature(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Signature(ctx, "a.txt")
+	if err != nil || !HashInfoEqual(a, b) {
+		t.Fatal("store cache miss", err)
+	}
+	dat = append([]byte("new "), dat...)
+	if err := Push(ctx, s, bytes.NewReader(dat), "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(root, "a.txt")); !bytes.Equal(got, dat) {
+		t.Fatal("push with cache error")
+	}
+	if sig, err := s.Signature(ctx, "missing.txt"); err != nil || !sig.IsEmpty() {
+		t.Fatal("missing file signature error", err)
+	}
+}
@@ -0,0 +1,115 @@
+package rsync
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// pipeConn is the tcp message connection over the stdin/stdout pipes of a helper process
+type pipeConn struct {
+	r   *os.File
+	w   *os.File
+	cmd *exec.Cmd
+}
+
+type pipeAddr string
+
+func (this pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (this pipeAddr) String() string {
+	return string(this)
+}
+
+func (this *pipeConn) Read(p []byte) (int, error) {
+	return this.r.Read(p)
+}
+
+func (this *pipeConn) Write(p []byte) (int, error) {
+	return this.w.Write(p)
+}
+
+func (this *pipeConn) SetDeadline(t time.Time) error {
+	if err := this.r.SetDeadline(t); err != nil {
+		return err
+	}
+	return this.w.SetDeadline(t)
+}
+
+func (this *pipeConn) SetReadDeadline(t time.Time) error {
+	return this.r.SetDeadline(t)
+}
+
+func (this *pipeConn) SetWriteDeadline(t time.Time) error {
+	return this.w.SetDeadline(t)
+}
+
+func (this *pipeConn) LocalAddr() net.Addr {
+	return pipeAddr("local")
+}
+
+func (this *pipeConn) RemoteAddr() net.Addr {
+	return pipeAddr(this.cmd.Path)
+}
+
+// Close ends the helper input and waits for the helper to exit
+func (this *pipeConn) Close() error {
+	this.w.Close()
+	err := this.cmd.Wait()
+	this.r.Close()
+	return err
+}
+
+// CommandClient is the Transport over a helper process that runs ServeStdio
+type CommandClient struct {
+	*TCPClient
+}
+
+// NewCommandClient starts cmd with its stdin and stdout connected to the client
+func NewCommandClient(cmd *exec.Cmd) (*CommandClient, error) {
+	inr, inw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outr, outw, err := os.Pipe()
+	if err != nil {
+		inr.Close()
+		inw.Close()
+		return nil, err
+	}
+	cmd.Stdin = inr
+	cmd.Stdout = outw
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	err = cmd.Start()
+	//the child holds its own copies
+	inr.Close()
+	outw.Close()
+	if err != nil {
+		inw.Close()
+		outr.Close()
+		return nil, err
+	}
+	return &CommandClient{TCPClient: NewTCPClient(&pipeConn{r: outr, w: inw, cmd: cmd})}, nil
+}
+
+// DialSSH runs "ssh [args] host command" like rsync over ssh, command must serve
+// the protocol with ServeStdio on the remote side
+func DialSSH(ctx context.Context, host string, command string, args ...string) (*CommandClient, error) {
+	argv := append(append([]string{}, args...), host, command)
+	return NewCommandClient(exec.CommandContext(ctx, "ssh", argv...))
+}
+
+// ServeStdio is the remote helper, it answers requests for files under root on r and w
+func ServeStdio(root string, r io.Reader, w io.Writer) {
+	serveTCPMessages(context.Background(), NewLocalStore(root), struct {
+		io.Reader
+		io.Writer
+	}{r, w}, nil, Timeouts{})
+}
@@ -0,0 +1,47 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// the test binary acts as remote helper when started by TestCommandTransport
+func TestHelperProcess(t *testing.T) {
+	root := os.Getenv("RSYNC_HELPER_ROOT")
+	if root == "" {
+		return
+	}
+	ServeStdio(root, os.Stdin, os.Stdout)
+	os.Exit(0)
+}
+
+func TestCommandTransport(t *testing.T) {
+	root := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Env = append(os.Environ(), "RSYNC_HELPER_ROOT="+root)
+	c, err := NewCommandClient(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	dat := make([]byte, DefaultBlockSize*7+1)
+	rand.New(rand.NewSource(1)).Read(dat)
+	for i := 0; i < 2; i++ {
+		dat[i*DefaultBlockSize] ^= 1
+		if err := Push(ctx, c, bytes.NewReader(dat), "x/y.bin"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := os.ReadFile(filepath.Join(root, "x", "y.bin"))
+	if err != nil || !bytes.Equal(got, dat) {
+		t.Fatal("remote file error", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Error(err)
+	}
+}
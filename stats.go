@@ -0,0 +1,102 @@
+package rsync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Stats is the transfer summary of a sync
+type Stats struct {
+	Files         int           `json:"files"`          //files pushed
+	Unchanged     int           `json:"unchanged"`      //files found equal by size and mtime or checksum and not pushed
+	TotalSize     int64         `json:"total_size"`     //source bytes
+	Matched       int64         `json:"matched"`        //bytes copied from basis blocks
+	Literal       int64         `json:"literal"`        //bytes sent as literal data
+	Blocks        int64         `json:"blocks"`         //basis blocks reused
+	SignatureSize int64         `json:"signature_size"` //encoded signature bytes received
+	DeltaSize     int64         `json:"delta_size"`     //encoded delta bytes sent
+	Duration      time.Duration `json:"duration_ns"`    //wall time
+}
+
+// Speedup is the rsync speedup, the source size over the bytes exchanged
+func (this *Stats) Speedup() float64 {
+	n := this.SignatureSize + this.DeltaSize
+	if n == 0 {
+		return 0
+	}
+	return float64(this.TotalSize) / float64(n)
+}
+
+// Add sums o into the stats
+func (this *Stats) Add(o *Stats) {
+	this.Files += o.Files
+	this.Unchanged += o.Unchanged
+	this.TotalSize += o.TotalSize
+	this.Matched += o.Matched
+	this.Literal += o.Literal
+	this.Blocks += o.Blocks
+	this.SignatureSize += o.SignatureSize
+	this.DeltaSize += o.DeltaSize
+	this.Duration += o.Duration
+}
+
+func (this *Stats) String() string {
+	return fmt.Sprintf("files %d size %d matched %d literal %d blocks %d sent %d received %d in %v speedup %.2f",
+		this.Files, this.TotalSize, this.Matched, this.Literal, this.Blocks, this.DeltaSize, this.SignatureSize,
+		this.Duration, this.Speedup())
+}
+
+// countFrames returns fn counting the frames it passes on into this
+func (this *Stats) countFrames(fn func(info *AnalyseInfo) error) func(info *AnalyseInfo) error {
+	blockSize := int64(0)
+	return func(info *AnalyseInfo) error {
+		if info.IsOpen() {
+			this.TotalSize += info.Off
+			blockSize = int64(info.BlockSize)
+		}
+		if info.IsData() {
+			this.Literal += int64(len(info.Data))
+		}
+		if info.IsIndex() {
+			if info.IsShort() {
+				this.Matched += int64(info.Len)
+			} else {
+				this.Matched += blockSize
+			}
+			this.Blocks++
+		}
+		return fn(info)
+	}
+}
+
+// signatureSize is the encoded size of sig
+func signatureSize(sig *HashInfo) int64 {
+	n, _ := sig.WriteTo(io.Discard)
+	return n
+}
+
+// PushStats is Push returning the transfer stats
+func PushStats(ctx context.Context, t Transport, src io.Reader, path string) (*Stats, error) {
+	return pushStats(ctx, t, src, path)
+}
+
+// PushAppend is PushStats for growing files, see DeltaAppend
+func PushAppend(ctx context.Context, t Transport, src io.Reader, path string) (*Stats, error) {
+	return pushStats(ctx, t, src, path, appendOnly)
+}
+
+func pushStats(ctx context.Context, t Transport, src io.Reader, path string, setup ...func(fh *FileHashInfo)) (*Stats, error) {
+	now := time.Now()
+	sig, err := t.Signature(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	st := &Stats{SignatureSize: signatureSize(sig)}
+	if err := pushSignature(ctx, t, sig, src, path, st, nil, setup...); err != nil {
+		return nil, err
+	}
+	st.Duration = time.Since(now)
+	return st, nil
+}
@@ -0,0 +1,50 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPushStats(t *testing.T) {
+	root := t.TempDir()
+	old := make([]byte, DefaultBlockSize*100)
+	rand.New(rand.NewSource(5)).Read(old)
+	if err := os.WriteFile(filepath.Join(root, "f.bin"), old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := append([]byte{}, old...)
+	copy(src[DefaultBlockSize*50:], bytes.Repeat([]byte{1}, DefaultBlockSize))
+	st, err := PushStats(context.Background(), NewLocalStore(root), bytes.NewReader(src), "f.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Files != 1 || st.TotalSize != int64(len(src)) || st.Literal != DefaultBlockSize || st.Blocks != 99 ||
+		st.Matched+st.Literal != st.TotalSize || st.SignatureSize == 0 || st.DeltaSize == 0 {
+		t.Error("stats error", st)
+	}
+	if st.Speedup() < 2 {
+		t.Error("speedup error", st.Speedup())
+	}
+	sum := &Stats{}
+	sum.Add(st)
+	sum.Add(st)
+	if sum.Files != 2 || sum.TotalSize != 2*st.TotalSize || sum.Speedup() != st.Speedup() {
+		t.Error("stats add error", sum)
+	}
+}
+
+func TestDirSyncerStats(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	testWriteFiles(t, src, map[string]string{"a.txt": "aaaa", "b/c.txt": "cc"})
+	s := NewDirSyncer(src, NewLocalStore(dst), "")
+	if err := s.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s.Stats.Files != 2 || s.Stats.TotalSize != 6 || s.Stats.Literal != 6 || s.Stats.Duration == 0 {
+		t.Error("dir stats error", s.Stats.String())
+	}
+}
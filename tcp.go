@@ -0,0 +1,993 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// tcp message types, each message is type(1) length(4) payload
+const (
+	tcpGetSignature = 1 //path
+	tcpSignature    = 2 //HashInfo
+	tcpApply        = 3 //path, followed by frames
+	tcpFrame        = 4 //one AnalyseInfo
+	tcpOK           = 5
+	tcpError        = 6 //error text
+	tcpBye          = 7
+	tcpGetResume    = 8  //path
+	tcpResume       = 9  //frames merged(8)
+	tcpGetList      = 10 //dir
+	tcpList         = 11 //file list
+	tcpRemove       = 12 //path
+	tcpSymlink      = 13 //path len(2), path, target
+	tcpLink         = 14 //path len(2), path, target
+	tcpHello        = 15 //Capabilities, the client's before the first request, the negotiated in reply
+	tcpKeepalive    = 16 //heartbeat of version 3 peers, skipped by the reader
+	tcpFail         = 17 //ErrorCode(2), error text, tcpError of version 4 peers
+)
+
+// TCPMaxMessage limits a single tcp message, signatures of very large files are the biggest
+const TCPMaxMessage = 1 << 28
+
+var ErrFrameAuth = errors.New("frame authentication failed")
+
+const (
+	tcpNonceSize = 16
+	tcpMACSize   = sha256.Size
+)
+
+// tcpCodec reads and writes tcp messages, with a secret every message carries an hmac
+// keyed by both connection nonces over its direction and sequence number, so tampered,
+// reordered or replayed messages are rejected
+type tcpCodec struct {
+	r        *bufio.Reader
+	w        *bufio.Writer
+	secret   []byte
+	client   bool
+	key      []byte //session key, nil before the nonce exchange
+	rseq     uint64
+	wseq     uint64
+	conn     deadliner //nil when rw has no deadlines
+	timeouts Timeouts
+	ctx      context.Context //of the running client request, its deadline caps the waits
+	shook    bool            //handshake done
+	wmu      sync.Mutex      //heartbeats write from their own goroutine
+	written  time.Time       //last message write
+	version  uint16          //negotiated protocol version, 0 before the hello
+}
+
+// deadliner is the part of net.Conn bounding the waits
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+func newTCPCodec(rw io.ReadWriter, secret []byte, client bool, timeouts Timeouts) *tcpCodec {
+	c := &tcpCodec{
+		r:        bufio.NewReader(rw),
+		w:        bufio.NewWriter(rw),
+		secret:   secret,
+		client:   client,
+		timeouts: timeouts,
+	}
+	c.conn, _ = rw.(deadliner)
+	return c
+}
+
+// deadline is d from now capped by the request deadline, zero when neither is set
+func (this *tcpCodec) deadline(d time.Duration) time.Time {
+	t := time.Time{}
+	if d > 0 {
+		t = time.Now().Add(d)
+	}
+	if this.ctx != nil {
+		if this.ctx.Err() != nil {
+			return time.Now()
+		}
+		if dl, ok := this.ctx.Deadline(); ok && (t.IsZero() || dl.Before(t)) {
+			t = dl
+		}
+	}
+	return t
+}
+
+// wait sets the read or write deadline d from now, before the handshake both use its timeout
+func (this *tcpCodec) wait(write bool, d time.Duration) {
+	if this.conn == nil {
+		return
+	}
+	if !this.shook {
+		d = this.timeouts.handshake()
+	}
+	set := this.conn.SetReadDeadline
+	if write {
+		set = this.conn.SetWriteDeadline
+	}
+	set(this.deadline(d))
+	//canceled while the deadline was set, the cancel deadline may be overwritten
+	if this.ctx != nil && this.ctx.Err() != nil {
+		set(time.Now())
+	}
+}
+
+// handshake exchanges the nonces once per connection when a secret is set
+func (this *tcpCodec) handshake() error {
+	if this.shook {
+		return nil
+	}
+	if len(this.secret) == 0 || this.key != nil {
+		this.shook = true
+		return nil
+	}
+	this.wait(true, 0)
+	this.wait(false, 0)
+	nonce := make([]byte, tcpNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if _, err := this.w.Write(nonce); err != nil {
+		return err
+	}
+	if err := this.w.Flush(); err != nil {
+		return err
+	}
+	peer := make([]byte, tcpNonceSize)
+	if _, err := io.ReadFull(this.r, peer); err != nil {
+		return err
+	}
+	if !this.client {
+		nonce, peer = peer, nonce
+	}
+	h := hmac.New(sha256.New, this.secret)
+	h.Write([]byte("rsync frame key"))
+	h.Write(nonce)
+	h.Write(peer)
+	this.key = h.Sum(nil)
+	this.shook = true
+	return nil
+}
+
+func (this *tcpCodec) mac(client bool, seq uint64, hdr []byte, payload []byte) []byte {
+	h := hmac.New(sha256.New, this.key)
+	if client {
+		h.Write([]byte{'c'})
+	} else {
+		h.Write([]byte{'s'})
+	}
+	h.Write(tobyte64(seq))
+	h.Write(hdr)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+func (this *tcpCodec) write(typ byte, payload []byte) error {
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+	if err := this.handshake(); err != nil {
+		return err
+	}
+	//a full buffer is written out
+	this.wait(true, this.timeouts.write())
+	return this.put(typ, payload)
+}
+
+// put buffers one message, the caller holds wmu and set the write deadline
+func (this *tcpCodec) put(typ byte, payload []byte) error {
+	hdr := append([]byte{typ}, tobyte32(uint32(len(payload)))...)
+	this.written = time.Now()
+	if _, err := this.w.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := this.w.Write(payload); err != nil {
+		return err
+	}
+	if this.key == nil {
+		return nil
+	}
+	_, err := this.w.Write(this.mac(this.client, this.wseq, hdr, payload))
+	this.wseq++
+	return err
+}
+
+// fail writes err to the peer, with its code to version 4 peers
+func (this *tcpCodec) fail(err error) error {
+	if this.version < 4 {
+		return this.write(tcpError, []byte(err.Error()))
+	}
+	return this.write(tcpFail, append(tobyte16(uint16(ErrorCodeOf(err))), err.Error()...))
+}
+
+func (this *tcpCodec) read() (byte, []byte, error) {
+	return this.readWait(this.timeouts.read())
+}
+
+// readWait reads one message arriving within d, every heartbeat of the peer restarts the wait
+func (this *tcpCodec) readWait(d time.Duration) (byte, []byte, error) {
+	for {
+		typ, payload, err := this.readMessage(d)
+		if err != nil || typ != tcpKeepalive {
+			return typ, payload, err
+		}
+	}
+}
+
+func (this *tcpCodec) readMessage(d time.Duration) (byte, []byte, error) {
+	if err := this.handshake(); err != nil {
+		return 0, nil, err
+	}
+	this.wait(false, d)
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(this.r, hdr); err != nil {
+		return 0, nil, err
+	}
+	size, err := touint32(hdr[1:])
+	if err != nil {
+		return 0, nil, err
+	}
+	if size > TCPMaxMessage {
+		return 0, nil, fmt.Errorf("tcp message size %d error", size)
+	}
+	payload, err := readPayload(this.r, size)
+	if err != nil {
+		return 0, nil, err
+	}
+	if this.key != nil {
+		mv := make([]byte, tcpMACSize)
+		if _, err := io.ReadFull(this.r, mv); err != nil {
+			return 0, nil, err
+		}
+		if !hmac.Equal(mv, this.mac(!this.client, this.rseq, hdr, payload)) {
+			return 0, nil, ErrFrameAuth
+		}
+		this.rseq++
+	}
+	return hdr[0], payload, nil
+}
+
+// tcpReadChunk is the first buffer of a message payload, larger ones grow as their bytes arrive
+const tcpReadChunk = 64 << 10
+
+// readPayload reads the size bytes of a payload, the size comes from the peer before the
+// mac is checked so the buffer only grows with what the peer really sends
+func readPayload(r io.Reader, size uint32) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, min(int(size), tcpReadChunk)))
+	if _, err := buf.ReadFrom(io.LimitReader(r, int64(size))); err != nil {
+		return nil, err
+	}
+	if buf.Len() != int(size) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), nil
+}
+
+func (this *tcpCodec) flush() error {
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+	if err := this.handshake(); err != nil {
+		return err
+	}
+	this.wait(true, this.timeouts.write())
+	return this.w.Flush()
+}
+
+// heartbeat writes a keepalive message when nothing was written for d until stop is called,
+// so the peer and the middleboxes between see traffic while this end computes or idles
+func (this *tcpCodec) heartbeat(d time.Duration) (stop func()) {
+	if d <= 0 {
+		return func() {}
+	}
+	done, exited := make(chan bool), make(chan bool)
+	go func() {
+		defer close(exited)
+		t := time.NewTicker(d / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			if err := this.beat(d); err != nil {
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// beat writes one keepalive when the last write is d ago, the request context is not used
+// since another goroutine may set it
+func (this *tcpCodec) beat(d time.Duration) error {
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+	if time.Since(this.written) < d {
+		return nil
+	}
+	if this.conn != nil {
+		t := time.Time{}
+		if d := this.timeouts.write(); d > 0 {
+			t = time.Now().Add(d)
+		}
+		this.conn.SetWriteDeadline(t)
+	}
+	if err := this.put(tcpKeepalive, nil); err != nil {
+		return err
+	}
+	return this.w.Flush()
+}
+
+// TCPClient is the Transport for a TCPServer, requests on one client run one at a time
+type TCPClient struct {
+	Conn     net.Conn
+	Secret   []byte   //authenticate every message with hmac, set before the first request
+	Limit    *Limiter //throttles literal data
+	Timeouts Timeouts //bound every message wait, set before the first request
+	//offered in the hello, LocalCapabilities when Version is 0, set before the first request
+	Capabilities Capabilities
+	mu           sync.Mutex
+	codec        *tcpCodec
+	negotiated   *Capabilities
+	stopBeat     func() //ends the heartbeats of version 3 servers
+}
+
+func NewTCPClient(conn net.Conn) *TCPClient {
+	return &TCPClient{Conn: conn}
+}
+
+// DialTCP connects within DefaultHandshakeTimeout unless ctx ends earlier
+func DialTCP(ctx context.Context, addr string) (*TCPClient, error) {
+	conn, err := (&net.Dialer{Timeout: DefaultHandshakeTimeout}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPClient(conn), nil
+}
+
+// DialTLS is DialTCP over tls, conf carries the client certificate for mutual tls
+func DialTLS(ctx context.Context, addr string, conf *tls.Config) (*TCPClient, error) {
+	d := &tls.Dialer{Config: conf, NetDialer: &net.Dialer{Timeout: DefaultHandshakeTimeout}}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPClient(conn), nil
+}
+
+// run fn with the message deadlines capped by ctx
+func (this *TCPClient) do(ctx context.Context, fn func() error) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.codec == nil {
+		this.codec = newTCPCodec(this.Conn, this.Secret, true, this.Timeouts)
+	}
+	this.codec.ctx = ctx
+	defer func() {
+		this.codec.ctx = nil
+	}()
+	stop := context.AfterFunc(ctx, func() {
+		this.Conn.SetDeadline(time.Now())
+	})
+	err := this.hello()
+	if err == nil {
+		err = fn()
+	}
+	if !stop() || ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// hello negotiates the capabilities once per connection, servers without the hello message
+// reply an error and speak version 1
+func (this *TCPClient) hello() error {
+	if this.negotiated != nil {
+		return nil
+	}
+	caps := this.Capabilities
+	if caps.Version == 0 {
+		caps = LocalCapabilities()
+	}
+	buf := &bytes.Buffer{}
+	if err := caps.Write(buf); err != nil {
+		return err
+	}
+	if err := this.codec.write(tcpHello, buf.Bytes()); err != nil {
+		return err
+	}
+	if err := this.codec.flush(); err != nil {
+		return err
+	}
+	typ, payload, err := this.codec.read()
+	if err != nil {
+		return err
+	}
+	neg := legacyCapabilities()
+	switch typ {
+	case tcpHello:
+		if err := neg.Read(bytes.NewReader(payload)); err != nil {
+			return err
+		}
+	case tcpError:
+		if neg, err = caps.Negotiate(neg); err != nil {
+			return err
+		}
+	case tcpFail:
+		//refused by the server
+		return remoteError(typ, payload)
+	default:
+		return fmt.Errorf("tcp message type %d error", typ)
+	}
+	this.negotiated = &neg
+	this.codec.version = neg.Version
+	if neg.Version >= 3 {
+		this.stopBeat = this.codec.heartbeat(this.Timeouts.heartbeat())
+	}
+	return nil
+}
+
+// Negotiated are the capabilities both ends support, the hello is sent when no request was yet
+func (this *TCPClient) Negotiated(ctx context.Context) (Capabilities, error) {
+	var caps Capabilities
+	err := this.do(ctx, func() error {
+		caps = *this.negotiated
+		return nil
+	})
+	return caps, err
+}
+
+func (this *TCPClient) reply() (byte, []byte, error) {
+	typ, payload, err := this.codec.read()
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := remoteError(typ, payload); err != nil {
+		return 0, nil, err
+	}
+	return typ, payload, nil
+}
+
+// remoteError is the failure of an error message, nil for other messages
+func remoteError(typ byte, payload []byte) error {
+	switch typ {
+	case tcpError:
+		return &RemoteError{Message: string(payload)}
+	case tcpFail:
+		if len(payload) < 2 {
+			return fmt.Errorf("tcp message type %d error", typ)
+		}
+		code, _ := touint16(payload[:2])
+		return &RemoteError{Code: ErrorCode(code), Message: string(payload[2:])}
+	}
+	return nil
+}
+
+func (this *TCPClient) Signature(ctx context.Context, path string) (*HashInfo, error) {
+	hi := NewHashInfo()
+	err := this.do(ctx, func() error {
+		if err := this.codec.write(tcpGetSignature, []byte(path)); err != nil {
+			return err
+		}
+		if err := this.codec.flush(); err != nil {
+			return err
+		}
+		typ, payload, err := this.reply()
+		if err != nil {
+			return err
+		}
+		if typ != tcpSignature {
+			return fmt.Errorf("tcp message type %d error", typ)
+		}
+		if err := hi.Read(bytes.NewReader(payload)); err != nil {
+			return err
+		}
+		if !hi.IsEmpty() && (!slices.Contains(this.negotiated.Strong, hi.Strong) || !slices.Contains(this.negotiated.Weak, hi.Weak)) {
+			return fmt.Errorf("%w: signature %s/%s not negotiated", ErrAlgorithmMismatch, strongName(hi.Strong), weakName(hi.Weak))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hi, nil
+}
+
+func (this *TCPClient) Resumed(ctx context.Context, path string) (int64, error) {
+	frames := int64(0)
+	err := this.do(ctx, func() error {
+		if err := this.codec.write(tcpGetResume, []byte(path)); err != nil {
+			return err
+		}
+		if err := this.codec.flush(); err != nil {
+			return err
+		}
+		typ, payload, err := this.reply()
+		if err != nil {
+			return err
+		}
+		if typ != tcpResume || len(payload) != 8 {
+			return fmt.Errorf("tcp message type %d error", typ)
+		}
+		frames, err = toint64(payload)
+		return err
+	})
+	return frames, err
+}
+
+func (this *TCPClient) List(ctx context.Context, dir string) ([]FileEntry, error) {
+	var list []FileEntry
+	err := this.do(ctx, func() error {
+		if err := this.codec.write(tcpGetList, []byte(dir)); err != nil {
+			return err
+		}
+		if err := this.codec.flush(); err != nil {
+			return err
+		}
+		typ, payload, err := this.reply()
+		if err != nil {
+			return err
+		}
+		if typ != tcpList {
+			return fmt.Errorf("tcp message type %d error", typ)
+		}
+		list, err = ReadFileList(bytes.NewReader(payload))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (this *TCPClient) Remove(ctx context.Context, path string) error {
+	return this.do(ctx, func() error {
+		if err := this.codec.write(tcpRemove, []byte(path)); err != nil {
+			return err
+		}
+		if err := this.codec.flush(); err != nil {
+			return err
+		}
+		typ, _, err := this.reply()
+		if err != nil {
+			return err
+		}
+		if typ != tcpOK {
+			return fmt.Errorf("tcp message type %d error", typ)
+		}
+		return nil
+	})
+}
+
+func (this *TCPClient) Symlink(ctx context.Context, target string, path string) error {
+	return this.link(ctx, tcpSymlink, target, path)
+}
+
+func (this *TCPClient) Link(ctx context.Context, target string, path string) error {
+	return this.link(ctx, tcpLink, target, path)
+}
+
+func (this *TCPClient) link(ctx context.Context, typ byte, target string, path string) error {
+	if len(path) > 0xFFFF {
+		return fmt.Errorf("file path %q too long", path)
+	}
+	return this.do(ctx, func() error {
+		payload := append(tobyte16(uint16(len(path))), path...)
+		if err := this.codec.write(typ, append(payload, target...)); err != nil {
+			return err
+		}
+		if err := this.codec.flush(); err != nil {
+			return err
+		}
+		typ, _, err := this.reply()
+		if err != nil {
+			return err
+		}
+		if typ != tcpOK {
+			return fmt.Errorf("tcp message type %d error", typ)
+		}
+		return nil
+	})
+}
+
+func (this *TCPClient) Apply(ctx context.Context, path string, delta io.Reader) error {
+	return this.do(ctx, func() error {
+		if err := this.codec.write(tcpApply, []byte(path)); err != nil {
+			return err
+		}
+		buf := &bytes.Buffer{}
+		for {
+			info := &AnalyseInfo{}
+			if err := info.Read(delta); err != nil {
+				return err
+			}
+			if err := this.Limit.waitFrame(ctx, info); err != nil {
+				return err
+			}
+			buf.Reset()
+			if err := info.Write(buf); err != nil {
+				return err
+			}
+			if err := this.codec.write(tcpFrame, buf.Bytes()); err != nil {
+				return err
+			}
+			if info.IsClose() {
+				break
+			}
+		}
+		if err := this.codec.flush(); err != nil {
+			return err
+		}
+		typ, _, err := this.reply()
+		if err != nil {
+			return err
+		}
+		if typ != tcpOK {
+			return fmt.Errorf("tcp message type %d error", typ)
+		}
+		return nil
+	})
+}
+
+// Close says goodbye so the server ends the connection cleanly
+func (this *TCPClient) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.stopBeat != nil {
+		this.stopBeat()
+	}
+	this.Conn.SetDeadline(time.Now().Add(time.Second))
+	if this.codec != nil && this.codec.write(tcpBye, nil) == nil {
+		this.codec.flush()
+	}
+	return this.Conn.Close()
+}
+
+// TCPServer answers TCPClient requests from Store
+type TCPServer struct {
+	Store    *LocalStore
+	Secret   []byte   //require hmac authenticated messages
+	Timeouts Timeouts //bound the waits for requests, frames and reply writes
+	store    tcpStore //answers instead of Store when set
+	//admit checks a new connection, it may wrap it, release is called when it ends
+	admit func(conn net.Conn) (net.Conn, func(), error)
+	//session wraps the context of an admitted connection, end is called when it ends
+	session  func(ctx context.Context) (context.Context, func())
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+	closed   bool
+}
+
+func NewTCPServer(root string) *TCPServer {
+	return &TCPServer{
+		Store: NewLocalStore(root),
+		conns: map[net.Conn]bool{},
+	}
+}
+
+func (this *TCPServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return this.Serve(l)
+}
+
+// ListenAndServeTLS serves tls connections, set conf.ClientAuth to require client certificates
+func (this *TCPServer) ListenAndServeTLS(addr string, conf *tls.Config) error {
+	l, err := tls.Listen("tcp", addr, conf)
+	if err != nil {
+		return err
+	}
+	return this.Serve(l)
+}
+
+// Serve accepts connections until Close, then returns net.ErrClosed
+func (this *TCPServer) Serve(l net.Listener) error {
+	this.mu.Lock()
+	if this.closed {
+		this.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	this.listener = l
+	this.mu.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			this.mu.Lock()
+			closed := this.closed
+			this.mu.Unlock()
+			if closed {
+				return net.ErrClosed
+			}
+			return err
+		}
+		this.mu.Lock()
+		if this.closed {
+			this.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		this.conns[conn] = true
+		this.wg.Add(1)
+		this.mu.Unlock()
+		go func() {
+			defer this.wg.Done()
+			this.ServeConn(conn)
+			this.mu.Lock()
+			delete(this.conns, conn)
+			this.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting, closes open connections and waits for their handlers
+func (this *TCPServer) Close() error {
+	this.mu.Lock()
+	this.closed = true
+	var err error
+	if this.listener != nil {
+		err = this.listener.Close()
+	}
+	for conn := range this.conns {
+		conn.Close()
+	}
+	this.mu.Unlock()
+	this.wg.Wait()
+	return err
+}
+
+// ServeConn handles requests on conn until the client says goodbye
+func (this *TCPServer) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	ctx, err := peerContext(conn, this.Timeouts)
+	if err != nil {
+		return
+	}
+	if this.admit != nil {
+		c, release, err := this.admit(conn)
+		if err != nil {
+			rejectTCP(conn, this.Secret, this.Timeouts, err)
+			return
+		}
+		defer release()
+		conn = c
+	}
+	if this.session != nil {
+		var end func()
+		ctx, end = this.session(ctx)
+		defer end()
+	}
+	if this.store != nil {
+		serveTCPMessages(ctx, this.store, conn, this.Secret, this.Timeouts)
+		return
+	}
+	serveTCPMessages(ctx, this.Store, conn, this.Secret, this.Timeouts)
+}
+
+// tcpStore is the end answering tcp requests, LocalStore or the daemon modules
+type tcpStore interface {
+	Transport
+	Resumer
+	Lister
+	Remover
+	Symlinker
+	HardLinker
+}
+
+// serveTCPMessages answers the requests read from rw until goodbye, a connection error or
+// no request arrived within the idle timeout, ctx carries the Peer to the store
+func serveTCPMessages(ctx context.Context, store tcpStore, rw io.ReadWriter, secret []byte, timeouts Timeouts) {
+	c := newTCPCodec(rw, secret, false, timeouts)
+	stop := func() {}
+	defer func() {
+		stop()
+	}()
+	for {
+		typ, payload, err := c.readWait(timeouts.idle())
+		if err != nil {
+			return
+		}
+		switch typ {
+		case tcpHello:
+			var caps Capabilities
+			caps, err = tcpHelloReply(c, payload)
+			//version 1 clients send no hello
+			if err == nil && caps.Version > 0 {
+				ctx = withCapabilities(ctx, caps)
+				c.version = caps.Version
+			}
+			//keep the connection alive while signatures are hashed, once per connection
+			if err == nil && caps.Version >= 3 {
+				stop()
+				stop = c.heartbeat(timeouts.heartbeat())
+			}
+		case tcpGetSignature:
+			err = tcpSignatureReply(ctx, store, c, string(payload))
+		case tcpApply:
+			err = tcpApplyReply(ctx, store, c, string(payload))
+		case tcpGetResume:
+			err = tcpResumeReply(ctx, store, c, string(payload))
+		case tcpGetList:
+			err = tcpListReply(ctx, store, c, string(payload))
+		case tcpRemove:
+			err = tcpRemoveReply(ctx, store, c, string(payload))
+		case tcpSymlink, tcpLink:
+			err = tcpLinkReply(ctx, store, c, typ, payload)
+		case tcpBye:
+			return
+		default:
+			//newer clients fall back when a request is unknown
+			err = c.fail(fmt.Errorf("tcp message type %d not support", typ))
+		}
+		if err != nil {
+			return
+		}
+		if err := c.flush(); err != nil {
+			return
+		}
+	}
+}
+
+// rejectTCP answers the first message of a refused connection with err
+func rejectTCP(rw io.ReadWriter, secret []byte, timeouts Timeouts, err error) {
+	c := newTCPCodec(rw, secret, false, timeouts)
+	typ, payload, rerr := c.readWait(timeouts.handshake())
+	if rerr != nil {
+		return
+	}
+	//version 4 clients get the code of err
+	var caps Capabilities
+	if typ == tcpHello && caps.Read(bytes.NewReader(payload)) == nil {
+		c.version = caps.Version
+	}
+	if c.fail(err) == nil {
+		c.flush()
+	}
+}
+
+// tcpHelloReply answers the client capabilities with the negotiated ones, in the client preference order
+func tcpHelloReply(c *tcpCodec, payload []byte) (Capabilities, error) {
+	var peer Capabilities
+	if err := peer.Read(bytes.NewReader(payload)); err != nil {
+		return Capabilities{}, c.fail(err)
+	}
+	caps, err := peer.Negotiate(LocalCapabilities())
+	if err != nil {
+		return Capabilities{}, c.fail(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := caps.Write(buf); err != nil {
+		return Capabilities{}, c.fail(err)
+	}
+	return caps, c.write(tcpHello, buf.Bytes())
+}
+
+func tcpSignatureReply(ctx context.Context, store tcpStore, c *tcpCodec, path string) error {
+	hi, err := store.Signature(ctx, path)
+	if err != nil {
+		return c.fail(err)
+	}
+	buf, err := hi.ToBuffer()
+	if err != nil {
+		return c.fail(err)
+	}
+	return c.write(tcpSignature, buf.Bytes())
+}
+
+func tcpResumeReply(ctx context.Context, store tcpStore, c *tcpCodec, path string) error {
+	frames, err := store.Resumed(ctx, path)
+	if err != nil {
+		return c.fail(err)
+	}
+	return c.write(tcpResume, tobyte64(uint64(frames)))
+}
+
+func tcpListReply(ctx context.Context, store tcpStore, c *tcpCodec, dir string) error {
+	list, err := store.List(ctx, dir)
+	if err != nil {
+		return c.fail(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteFileList(buf, list); err != nil {
+		return c.fail(err)
+	}
+	if buf.Len() > TCPMaxMessage {
+		return c.fail(errors.New("file list too large"))
+	}
+	return c.write(tcpList, buf.Bytes())
+}
+
+func tcpRemoveReply(ctx context.Context, store tcpStore, c *tcpCodec, path string) error {
+	if err := store.Remove(ctx, path); err != nil {
+		return c.fail(err)
+	}
+	return c.write(tcpOK, nil)
+}
+
+func tcpLinkReply(ctx context.Context, store tcpStore, c *tcpCodec, typ byte, payload []byte) error {
+	if len(payload) < 2 {
+		return c.fail(errors.New("link message error"))
+	}
+	n16, err := touint16(payload[:2])
+	if err != nil || len(payload) < 2+int(n16) {
+		return c.fail(errors.New("link message error"))
+	}
+	n := 2 + int(n16)
+	link := store.Symlink
+	if typ == tcpLink {
+		link = store.Link
+	}
+	if err := link(ctx, string(payload[n:]), string(payload[2:n])); err != nil {
+		return c.fail(err)
+	}
+	return c.write(tcpOK, nil)
+}
+
+// frameReader turns the following tcp frame messages back into a delta stream
+type frameReader struct {
+	c    *tcpCodec
+	buf  bytes.Buffer
+	done bool
+	err  error //connection or protocol error, the connection can't continue
+}
+
+func (this *frameReader) Read(p []byte) (int, error) {
+	for this.buf.Len() == 0 {
+		if this.done {
+			return 0, io.EOF
+		}
+		typ, payload, err := this.c.read()
+		if err == nil && typ != tcpFrame {
+			err = fmt.Errorf("tcp message type %d error", typ)
+		}
+		if err != nil {
+			this.err = err
+			return 0, err
+		}
+		info := &AnalyseInfo{}
+		if err := info.Read(bytes.NewReader(payload)); err != nil {
+			this.err = err
+			return 0, err
+		}
+		this.done = info.IsClose()
+		this.buf.Write(payload)
+	}
+	return this.buf.Read(p)
+}
+
+func tcpApplyReply(ctx context.Context, store tcpStore, c *tcpCodec, path string) error {
+	fr := &frameReader{c: c}
+	err := store.Apply(ctx, path, fr)
+	if fr.err != nil {
+		//the connection can't continue, the client reads the cause in place of the reply
+		if c.fail(fr.err) == nil {
+			c.flush()
+		}
+		return fr.err
+	}
+	//drain the rest of a failed delta so the connection stays usable
+	if _, derr := io.Copy(io.Discard, fr); derr != nil {
+		return derr
+	}
+	if err != nil {
+		return c.fail(err)
+	}
+	return c.write(tcpOK, nil)
+}
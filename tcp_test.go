@@ -0,0 +1,352 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTCPTransport(t *testing.T) {
+	root := t.TempDir()
+	srv := NewTCPServer(root)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(l)
+	}()
+	ctx := context.Background()
+	c, err := DialTCP(ctx, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := c.Signature(ctx, "a/b.txt")
+	if err != nil || !sig.IsEmpty() {
+		t.Fatal("missing file signature error", err)
+	}
+	dat := make([]byte, DefaultBlockSize*10+33)
+	rand.New(rand.NewSource(1)).Read(dat)
+	if err := Push(ctx, c, bytes.NewReader(dat), "a/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	//update the existing file
+	dat = append(dat[:DefaultBlockSize*4], append([]byte("new"), dat[DefaultBlockSize*4:]...)...)
+	if err := Push(ctx, c, bytes.NewReader(dat), "a/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(root, "a", "b.txt"))
+	if err != nil || !bytes.Equal(got, dat) {
+		t.Fatal("remote file error", err)
+	}
+	if err := Push(ctx, c, bytes.NewReader(dat), "../x"); err == nil || !strings.Contains(err.Error(), "remote error") {
+		t.Error("path error expected", err)
+	}
+	//a failed request leaves the connection usable
+	if _, err := c.Signature(ctx, "a/b.txt"); err != nil {
+		t.Error(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := srv.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := <-done; err != net.ErrClosed {
+		t.Error("serve error", err)
+	}
+}
+
+func TestLocalStorePath(t *testing.T) {
+	s := NewLocalStore("/data")
+	for _, name := range []string{"", "/", "../a", "a/../../b", "a/./b", "a//b"} {
+		if _, err := s.FilePath(name); err == nil {
+			t.Error("path accepted", name)
+		}
+	}
+	if p, err := s.FilePath("a/b"); err != nil || p != filepath.Join("/data", "a", "b") {
+		t.Error("path error", p, err)
+	}
+}
+
+func TestTCPSecret(t *testing.T) {
+	root := t.TempDir()
+	srv := NewTCPServer(root)
+	srv.Secret = []byte("shared secret")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+	ctx := context.Background()
+	c, err := DialTCP(ctx, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Secret = []byte("shared secret")
+	dat := bytes.Repeat([]byte("authenticated "), 500)
+	for i := 0; i < 2; i++ {
+		if err := Push(ctx, c, bytes.NewReader(dat), "a.txt"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Close()
+	c, err = DialTCP(ctx, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Secret = []byte("wrong secret")
+	if _, err := c.Signature(ctx, "a.txt"); err == nil {
+		t.Error("wrong secret accepted")
+	}
+	c.Close()
+}
+
+func TestTCPCodecMAC(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := newTCPCodec(buf, []byte("k"), true, Timeouts{})
+	r := newTCPCodec(buf, []byte("k"), false, Timeouts{})
+	w.key = []byte("session")
+	r.key = []byte("session")
+	w.write(tcpFrame, []byte("frame one"))
+	w.flush()
+	one := append([]byte{}, buf.Bytes()...)
+	if _, p, err := r.read(); err != nil || string(p) != "frame one" {
+		t.Fatal("read error", err)
+	}
+	//replay of the same message
+	buf.Write(one)
+	if _, _, err := r.read(); err != ErrFrameAuth {
+		t.Error("replay accepted", err)
+	}
+	//tampered payload
+	r.rseq = 1
+	w.write(tcpFrame, []byte("frame two"))
+	w.flush()
+	buf.Bytes()[6] ^= 1
+	if _, _, err := r.read(); err != ErrFrameAuth {
+		t.Error("tampered message accepted", err)
+	}
+	//a claimed size costs only the bytes sent
+	buf.Reset()
+	buf.Write(append([]byte{tcpFrame}, tobyte32(TCPMaxMessage)...))
+	buf.WriteString("short")
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, _, err := r.read(); err != io.ErrUnexpectedEOF {
+		t.Error("short message", err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Error("short message allocated", n)
+	}
+}
+
+func TestLocalStoreInPlace(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "f.txt")
+	old := bytes.Repeat([]byte("0123456789abcdef"), 2000)
+	if err := os.WriteFile(file, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	store := NewLocalStore(root)
+	store.InPlace = true
+	src := append(append([]byte{}, old[4096:]...), old[:4096]...)
+	if err := Push(context.Background(), store, bytes.NewReader(src), "f.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(file); !bytes.Equal(got, src) {
+		t.Error("in place push error")
+	}
+}
+
+func TestLocalStoreBackup(t *testing.T) {
+	root, bak := t.TempDir(), t.TempDir()
+	old := bytes.Repeat([]byte("old content "), 1000)
+	testWriteFiles(t, root, map[string]string{"f.txt": string(old), "a/b.txt": string(old)})
+	ctx := context.Background()
+	src := bytes.Repeat([]byte("new content "), 1000)
+	store := NewLocalStore(root)
+	store.BackupSuffix = "~"
+	store.Fsync = true
+	if err := Push(ctx, store, bytes.NewReader(src), "f.txt"); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, root, map[string]string{"f.txt": string(src), "f.txt~": string(old)})
+	store = NewLocalStore(root)
+	store.BackupDir = bak
+	store.InPlace = true
+	if err := Push(ctx, store, bytes.NewReader(src), "a/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	testCheckFiles(t, root, map[string]string{"a/b.txt": string(src)})
+	testCheckFiles(t, bak, map[string]string{"a/b.txt": string(old)})
+}
+
+func TestTCPTimeouts(t *testing.T) {
+	ctx := context.Background()
+	//a peer accepting and never answering
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	c, err := DialTCP(ctx, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Timeouts = Timeouts{Read: 50 * time.Millisecond}
+	now := time.Now()
+	if _, err := c.Signature(ctx, "a.txt"); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("hung peer error", err)
+	}
+	if time.Since(now) > 5*time.Second {
+		t.Error("read timeout ignored")
+	}
+	c.Conn.Close()
+	//the handshake timeout bounds the nonce exchange
+	c, err = DialTCP(ctx, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Secret = []byte("secret")
+	c.Timeouts = Timeouts{Handshake: 50 * time.Millisecond, Read: -1}
+	if _, err := c.Signature(ctx, "a.txt"); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("hung handshake error", err)
+	}
+	c.Conn.Close()
+	//the server drops idle clients
+	srv := NewTCPServer(t.TempDir())
+	srv.Timeouts = Timeouts{Idle: 50 * time.Millisecond}
+	sl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(sl)
+	defer srv.Close()
+	c, err = DialTCP(ctx, sl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Signature(ctx, "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := c.Signature(ctx, "a.txt"); err == nil {
+		t.Error("idle client kept")
+	}
+}
+
+// slowStore hashes signatures for delay
+type slowStore struct {
+	*LocalStore
+	delay time.Duration
+}
+
+func (this *slowStore) Signature(ctx context.Context, name string) (*HashInfo, error) {
+	time.Sleep(this.delay)
+	return this.LocalStore.Signature(ctx, name)
+}
+
+func TestTCPHeartbeat(t *testing.T) {
+	ctx := context.Background()
+	srv := NewTCPServer(t.TempDir())
+	srv.store = &slowStore{LocalStore: srv.Store, delay: 300 * time.Millisecond}
+	srv.Timeouts = Timeouts{Idle: 100 * time.Millisecond, Heartbeat: 20 * time.Millisecond}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+	dial := func(heartbeat time.Duration) *TCPClient {
+		c, err := DialTCP(ctx, l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Timeouts = Timeouts{Read: 100 * time.Millisecond, Heartbeat: heartbeat}
+		return c
+	}
+	//the server heartbeats while it hashes, the client while it idles
+	c := dial(20 * time.Millisecond)
+	defer c.Close()
+	if _, err := c.Signature(ctx, "a.txt"); err != nil {
+		t.Fatal("slow signature", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, err := c.Signature(ctx, "a.txt"); err != nil {
+		t.Error("idle client with heartbeats dropped", err)
+	}
+	//version 2 clients get no heartbeats
+	c2 := dial(-1)
+	defer c2.Close()
+	c2.Capabilities = LocalCapabilities()
+	c2.Capabilities.Version = 2
+	if _, err := c2.Signature(ctx, "a.txt"); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("slow signature without heartbeats", err)
+	}
+}
+
+func TestTCPErrorCodes(t *testing.T) {
+	ctx := context.Background()
+	srv := NewTCPServer(t.TempDir())
+	//a delta whose close frame hash is not the rebuilt one
+	sig, err := Signature(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := &bytes.Buffer{}
+	err = analyseReader(sig, bytes.NewReader([]byte("hello")), func(info *AnalyseInfo) error {
+		if info.IsClose() {
+			info.Hash = bytes.Repeat([]byte{1}, len(info.Hash))
+		}
+		return info.Write(delta)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range []uint16{ProtocolVersion, 3} {
+		cc, sc := net.Pipe()
+		go srv.ServeConn(sc)
+		c := NewTCPClient(cc)
+		c.Capabilities = LocalCapabilities()
+		c.Capabilities.Version = version
+		err := c.Apply(ctx, "a.txt", bytes.NewReader(delta.Bytes()))
+		var re *RemoteError
+		if !errors.As(err, &re) || !strings.Contains(err.Error(), "remote error") {
+			t.Fatal("remote error expected", err)
+		}
+		if version >= 4 && (re.Code != CodeHashMismatch || !errors.Is(err, ErrHashMismatch) || IsRetryable(err)) {
+			t.Error("hash mismatch code", re.Code, err)
+		}
+		if version < 4 && re.Code != CodeUnknown {
+			t.Error("version 3 error code", re.Code)
+		}
+		//the connection stays usable after the error
+		if _, err := c.Signature(ctx, "a.txt"); err != nil {
+			t.Error(err)
+		}
+		c.Close()
+	}
+}
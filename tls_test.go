@@ -0,0 +1,102 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// self signed localhost certificate usable by both ends, written as pem files into dir
+func testCertFiles(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600)
+	return certFile, keyFile
+}
+
+// server config requiring client certificates and a client config presenting one
+func testTLSConfig(t *testing.T) (*tls.Config, *tls.Config) {
+	certFile, keyFile := testCertFiles(t, t.TempDir())
+	sconf, err := ServerTLSConfig(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cconf, err := ClientTLSConfig(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sconf, cconf
+}
+
+func TestTCPMutualTLS(t *testing.T) {
+	root := t.TempDir()
+	sconf, cconf := testTLSConfig(t)
+	srv := NewTCPServer(root)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", sconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+	ctx := context.Background()
+	c, err := DialTLS(ctx, l.Addr().String(), cconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	dat := bytes.Repeat([]byte("tls data "), 1000)
+	if err := Push(ctx, c, bytes.NewReader(dat), "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(root, "a.txt")); err != nil || !bytes.Equal(got, dat) {
+		t.Error("remote file error", err)
+	}
+	//without a client certificate the server rejects the handshake
+	anon := cconf.Clone()
+	anon.Certificates = nil
+	c2, err := DialTLS(ctx, l.Addr().String(), anon)
+	if err == nil {
+		_, err = c2.Signature(ctx, "a.txt")
+		c2.Close()
+	}
+	if err == nil {
+		t.Error("client without certificate accepted")
+	}
+}
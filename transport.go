@@ -1 +1,284 @@
 package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// default waits of Timeouts
+const (
+	DefaultHandshakeTimeout = 30 * time.Second
+	DefaultIOTimeout        = 5 * time.Minute
+	DefaultIdleTimeout      = 15 * time.Minute
+	DefaultHeartbeat        = 30 * time.Second
+)
+
+// Timeouts bound the waits of a transport connection so a hung peer fails the sync instead of
+// stalling it, 0 is the default and < 0 waits forever
+type Timeouts struct {
+	Handshake time.Duration //connect, tls and nonce exchange, DefaultHandshakeTimeout
+	//one message or frame, including the reply wait, DefaultIOTimeout, a heartbeat of the peer
+	//restarts it so long remote hashing doesn't time out
+	Read  time.Duration
+	Write time.Duration //one message or frame, DefaultIOTimeout
+	Idle  time.Duration //servers waiting for the next request, heartbeats of the client restart it, DefaultIdleTimeout
+	//keepalive messages when nothing was sent for this long so nats and load balancers keep
+	//the connection, version 3 peers only, DefaultHeartbeat
+	Heartbeat time.Duration
+}
+
+// timeout is d or def when d is 0, < 0 is no timeout
+func timeout(d time.Duration, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+func (this Timeouts) handshake() time.Duration {
+	return timeout(this.Handshake, DefaultHandshakeTimeout)
+}
+
+func (this Timeouts) read() time.Duration {
+	return timeout(this.Read, DefaultIOTimeout)
+}
+
+func (this Timeouts) write() time.Duration {
+	return timeout(this.Write, DefaultIOTimeout)
+}
+
+func (this Timeouts) idle() time.Duration {
+	return timeout(this.Idle, DefaultIdleTimeout)
+}
+
+func (this Timeouts) heartbeat() time.Duration {
+	return timeout(this.Heartbeat, DefaultHeartbeat)
+}
+
+// Transport exchanges signatures and deltas with the end holding the basis files
+type Transport interface {
+	// Signature returns the signature of path, a missing file has an empty signature
+	Signature(ctx context.Context, path string) (*HashInfo, error)
+	// Apply sends the delta frames that rebuild path
+	Apply(ctx context.Context, path string, delta io.Reader) error
+	Close() error
+}
+
+// Push rebuilds path on the transport end from src
+func Push(ctx context.Context, t Transport, src io.Reader, path string) error {
+	_, err := PushStats(ctx, t, src, path)
+	return err
+}
+
+// pushSignature is Push with the signature of path already known, the sent frames are counted into st
+// and observed by hooks
+func pushSignature(ctx context.Context, t Transport, sig *HashInfo, src io.Reader, path string, st *Stats, hooks *Hooks, setup ...func(fh *FileHashInfo)) error {
+	var err error
+	skip := int64(0)
+	if r, ok := t.(Resumer); ok {
+		if skip, err = r.Resumed(ctx, path); err != nil {
+			return err
+		}
+	}
+	pr, pw := io.Pipe()
+	cw := &countWriter{w: pw}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		pw.CloseWithError(analyseReader(sig, src, ResumeFrames(skip, st.countFrames(hooks.observe(path, func(info *AnalyseInfo) error {
+			return info.Write(cw)
+		}))), setup...))
+	}()
+	err = t.Apply(ctx, path, pr)
+	pr.CloseWithError(errors.New("apply done"))
+	<-done
+	st.DeltaSize += cw.n
+	st.Files++
+	return err
+}
+
+// LocalStore is the Transport end for files under Root, servers use it to answer requests
+type LocalStore struct {
+	Root    string
+	InPlace bool   //merge into the files without temp copies, see FileMerger.InPlace
+	TempDir string //dir of the merge temp files, next to the files when empty
+	//keep replaced files, BackupDir mirrors the tree under Root, see FileMerger.BackupPath
+	BackupDir    string
+	BackupSuffix string
+	Fsync        bool            //see FileMerger.Fsync
+	KeepPartial  bool            //see FileMerger.KeepPartial
+	Hooks        *Hooks          //observe the merged frames
+	Cache        *SignatureCache //reuse the signatures of unchanged files
+	//missing files take a similarly named file of their dir as basis, see FuzzyBasis,
+	//ignored in place
+	Fuzzy   bool
+	Workers int //goroutines hashing signature blocks, see FileHashInfo.Workers, > 1 sets FileMerger.AsyncHash
+	//refuse deltas of files larger than this with ErrTooLarge, 0 no limit
+	MaxFileSize int64
+}
+
+// NewLocalStore serves the files under root, opts may set WithHooks and WithWorkers
+func NewLocalStore(root string, opts ...Option) *LocalStore {
+	o := newOptions(opts)
+	return &LocalStore{Root: root, Hooks: o.hooks, Workers: o.workers}
+}
+
+// FilePath maps a slash separated name into Root, names leaving Root are rejected
+func (this *LocalStore) FilePath(name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" || strings.Contains(name, "\\") || clean != "/"+strings.TrimPrefix(name, "/") {
+		return "", fmt.Errorf("%w: file path %q", os.ErrInvalid, name)
+	}
+	return filepath.Join(this.Root, filepath.FromSlash(clean)), nil
+}
+
+func (this *LocalStore) Signature(ctx context.Context, name string) (*HashInfo, error) {
+	file, err := this.FilePath(name)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = bytes.NewReader(nil)
+	fd, err := os.Open(file)
+	if os.IsNotExist(err) && this.Fuzzy && !this.InPlace {
+		if basis := FuzzyBasis(file); basis != "" {
+			fd, err = os.Open(basis)
+		}
+	}
+	if err == nil {
+		defer fd.Close()
+		r = bufio.NewReaderSize(fd, DefaultReadAhead)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	fh := NewFileHashInfo("", WithWorkers(this.Workers))
+	//the hashes and block size negotiated with the client
+	if caps, ok := capabilitiesFrom(ctx); ok {
+		if err := fh.useCapabilities(caps); err != nil {
+			return nil, err
+		}
+	}
+	if this.InPlace {
+		//later copies of overwritten blocks stay usable
+		fh.Dups = DupKeepAll
+	}
+	//an interrupted merge keeps its seed to resume
+	if seed, ok := resumedSeed(file, TempPath(file, this.TempDir)); ok && !this.InPlace {
+		fh.Seed = seed
+	}
+	var hi *HashInfo
+	if fd != nil && this.Cache != nil {
+		if hi, err = this.Cache.fileSignature(ctx, fd, fh); err != nil {
+			return nil, err
+		}
+	} else {
+		//a random seed per signature
+		if fh.Seed == 0 {
+			if fh.Seed, err = RandomSeed(); err != nil {
+				return nil, err
+			}
+		}
+		if err := fh.fill(ctx, r, nil); err != nil {
+			return nil, err
+		}
+		hi = fh.GetHashInfo()
+	}
+	hi.InPlace = this.InPlace
+	return hi, nil
+}
+
+// Merger opens a FileMerger for name, the caller writes frames and closes it
+func (this *LocalStore) Merger(name string) (*FileMerger, error) {
+	file, err := this.FilePath(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	m := NewFileMerger(file, &HashInfo{})
+	if _, err := os.Lstat(file); os.IsNotExist(err) && this.Fuzzy && !this.InPlace {
+		//the basis Signature picked
+		m.Basis = FuzzyBasis(file)
+	}
+	m.Resume = !this.InPlace
+	m.InPlace = this.InPlace
+	m.TempDir = this.TempDir
+	m.BackupSuffix = this.BackupSuffix
+	m.Fsync = this.Fsync
+	m.KeepPartial = this.KeepPartial
+	m.Hooks = this.Hooks
+	m.AsyncHash = this.Workers > 1
+	if this.BackupDir != "" {
+		rel, err := filepath.Rel(this.Root, filepath.Dir(file))
+		if err != nil {
+			return nil, err
+		}
+		m.BackupDir = filepath.Join(this.BackupDir, rel)
+	}
+	if err := m.Open(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (this *LocalStore) Apply(ctx context.Context, name string, delta io.Reader) error {
+	return this.ApplyFrames(ctx, name, func() (*AnalyseInfo, error) {
+		info := &AnalyseInfo{}
+		if err := info.Read(delta); err != nil {
+			return nil, err
+		}
+		return info, nil
+	})
+}
+
+// ApplyFrames merges the frames returned by next into name until the close frame
+func (this *LocalStore) ApplyFrames(ctx context.Context, name string, next func() (*AnalyseInfo, error)) error {
+	m, err := this.Merger(name)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		info, err := next()
+		if err != nil {
+			return err
+		}
+		if info.IsOpen() && this.MaxFileSize > 0 && info.Off > this.MaxFileSize {
+			return fmt.Errorf("%w: %s %d > %d", ErrTooLarge, name, info.Off, this.MaxFileSize)
+		}
+		if err := m.Write(info); err != nil {
+			return err
+		}
+		if info.IsClose() {
+			return nil
+		}
+	}
+}
+
+func (this *LocalStore) Resumed(ctx context.Context, name string) (int64, error) {
+	file, err := this.FilePath(name)
+	if err != nil {
+		return 0, err
+	}
+	return resumedFrames(file, TempPath(file, this.TempDir)), nil
+}
+
+func (this *LocalStore) Close() error {
+	return nil
+}
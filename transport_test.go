@@ -2,7 +2,7 @@ package rsync
 
 import (
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
 	"testing"
@@ -48,7 +48,7 @@ func TestHttp2(t *testing.T) {
 			if err != nil {
 				panic(err)
 			}
-			x, err := ioutil.ReadAll(res.Body)
+			x, err := io.ReadAll(res.Body)
 			if err != nil {
 				panic(err)
 			}
@@ -0,0 +1,283 @@
+package rsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultDebounce is the quiet time of a Watcher before it syncs the changed files
+const DefaultDebounce = 500 * time.Millisecond
+
+// Watcher keeps the destination of Syncer in sync with its Src, after one full Sync only the paths
+// changed on disk are synced, once no event arrived for Debounce
+type Watcher struct {
+	Syncer   *DirSyncer
+	Debounce time.Duration //DefaultDebounce when 0
+	Logger   Logger        //DefaultLogger when nil
+	//called after every sync of changed paths with the first error, errors are logged and
+	//the watch goes on
+	OnSync  func(paths []string, err error)
+	watcher *fsnotify.Watcher
+	changed map[string]bool
+}
+
+func NewWatcher(s *DirSyncer) *Watcher {
+	return &Watcher{Syncer: s}
+}
+
+// Run syncs Src and then the changes until ctx is done
+func (this *Watcher) Run(ctx context.Context) error {
+	if this.Syncer.FS != nil {
+		return errors.New("watch needs a source on the OS filesystem")
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	this.watcher = w
+	this.changed = map[string]bool{}
+	//watched before the full sync so changes during it are not lost
+	if err := this.add(""); err != nil {
+		return err
+	}
+	clear(this.changed)
+	if err := this.Syncer.Sync(ctx); err != nil {
+		return err
+	}
+	debounce := this.Debounce
+	if debounce <= 0 {
+		debounce = DefaultDebounce
+	}
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-w.Events:
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			if this.event(ev) {
+				timer.Reset(debounce)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			logf(this.Logger, "watch %s: %v", this.Syncer.Src, err)
+		case <-timer.C:
+			if err := this.flush(ctx); err != nil && ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// match reports whether the filter keeps rel and all its parent dirs
+func (this *Watcher) match(rel string, dir bool) bool {
+	f := this.Syncer.Filter
+	for i := 0; i < len(rel); i++ {
+		if rel[i] == '/' && !f.Match(rel[:i], true) {
+			return false
+		}
+	}
+	return f.Match(rel, dir)
+}
+
+// add watches the dir rel and the kept dirs under it, the files found are marked changed
+func (this *Watcher) add(rel string) error {
+	root := filepath.Join(this.Syncer.Src, filepath.FromSlash(rel))
+	return filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			//removed while walked
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		name, err := filepath.Rel(this.Syncer.Src, file)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if name != "." && !this.match(name, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			this.changed[name] = true
+			return nil
+		}
+		return this.watcher.Add(file)
+	})
+}
+
+// event marks the changed path, false when it is not synced
+func (this *Watcher) event(ev fsnotify.Event) bool {
+	rel, err := filepath.Rel(this.Syncer.Src, ev.Name)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	if ev.Has(fsnotify.Create) {
+		if fi, err := os.Lstat(ev.Name); err == nil && fi.IsDir() {
+			if !this.match(rel, true) {
+				return false
+			}
+			//files created before the watch was added
+			if err := this.add(rel); err != nil {
+				logf(this.Logger, "watch %s: %v", ev.Name, err)
+			}
+		}
+	}
+	if ev.Has(fsnotify.Rename) || ev.Has(fsnotify.Remove) {
+		//a moved dir keeps its watch under the old name
+		this.watcher.Remove(ev.Name)
+	}
+	this.changed[rel] = true
+	return true
+}
+
+// flush syncs the changed paths
+func (this *Watcher) flush(ctx context.Context) error {
+	paths := make([]string, 0, len(this.changed))
+	for p := range this.changed {
+		paths = append(paths, p)
+	}
+	clear(this.changed)
+	sort.Strings(paths)
+	err := this.sync(ctx, paths)
+	if err != nil {
+		logf(this.Logger, "watch %s: %v", this.Syncer.Src, err)
+	}
+	if this.OnSync != nil {
+		this.OnSync(paths, err)
+	}
+	return err
+}
+
+// sync pushes the existing paths and removes the missing ones when Delete is set, it goes on
+// after an error and returns the first one
+func (this *Watcher) sync(ctx context.Context, paths []string) error {
+	s := this.Syncer
+	now := time.Now()
+	s.Stats = Stats{}
+	defer func() {
+		s.Stats.Duration = time.Since(now)
+	}()
+	var first error
+	fail := func(p string, err error) {
+		if first == nil {
+			first = fmt.Errorf("sync %s: %w", p, err)
+		}
+	}
+	removed := []string{}
+	for _, p := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		file := filepath.Join(s.Src, filepath.FromSlash(p))
+		fi, err := os.Lstat(file)
+		if errors.Is(err, fs.ErrNotExist) {
+			removed = append(removed, p)
+			continue
+		}
+		if err != nil {
+			fail(p, err)
+			continue
+		}
+		v := FileEntry{Path: p, Size: fi.Size(), ModTime: fi.ModTime(), Mode: fi.Mode()}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			switch s.Symlinks {
+			case SymlinkSkip:
+				continue
+			case SymlinkFollow:
+				if fi, err = os.Stat(file); err != nil {
+					//dangling link
+					continue
+				}
+				v.Mode = fi.Mode()
+			default:
+				if v.Link, err = os.Readlink(file); err != nil {
+					fail(p, err)
+					continue
+				}
+			}
+		}
+		if !this.match(p, fi.IsDir()) {
+			continue
+		}
+		switch {
+		case v.IsSymlink():
+			err = s.syncLink(ctx, v, nil)
+		case v.IsRegular():
+			err = s.syncFile(ctx, v, nil)
+		}
+		if err != nil {
+			fail(p, err)
+		}
+	}
+	if s.Delete && len(removed) > 0 {
+		if err := this.remove(ctx, removed); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// remove deletes the destination paths of the removed source paths with what is under them
+func (this *Watcher) remove(ctx context.Context, removed []string) error {
+	s := this.Syncer
+	r, ok := s.Dst.(Remover)
+	if !ok {
+		return errors.New("delete needs a transport removing files")
+	}
+	del := []string{}
+	for _, p := range removed {
+		if !this.match(p, false) && !this.match(p, true) {
+			continue
+		}
+		del = append(del, p)
+		//a dir moved away has no events for its entries
+		if l, ok := s.Dst.(Lister); ok {
+			//files have no list
+			list, _ := l.List(ctx, s.dstPath(p))
+			for _, v := range list {
+				del = append(del, path.Join(p, v.Path))
+			}
+		}
+	}
+	if s.MaxDelete > 0 && len(del) > s.MaxDelete {
+		return fmt.Errorf("%w: %d > %d", ErrMaxDelete, len(del), s.MaxDelete)
+	}
+	//children before their dir
+	sort.Sort(sort.Reverse(sort.StringSlice(del)))
+	var first error
+	for i, p := range del {
+		if i > 0 && del[i-1] == p {
+			continue
+		}
+		err := r.Remove(ctx, s.dstPath(p))
+		if err == nil {
+			s.item(ItemChange{Path: p, Kind: ItemDeleted})
+		} else if !errors.Is(err, fs.ErrNotExist) && first == nil {
+			first = fmt.Errorf("delete %s: %w", p, err)
+		}
+	}
+	return first
+}
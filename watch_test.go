@@ -0,0 +1,65 @@
+package rsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testWaitFor(t *testing.T, what string, cond func() bool) {
+	for end := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(end) {
+			t.Fatal("timeout waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	testWriteFiles(t, src, map[string]string{
+		"a.txt":     "hello world",
+		"b/c.txt":   "removed later",
+		"skip.tmp":  "excluded",
+		"d/old.txt": "moved away",
+	})
+	s := NewDirSyncer(src, NewLocalStore(dst), "")
+	s.Delete = true
+	s.Filter = NewFilter()
+	s.Filter.Exclude("*.tmp")
+	w := NewWatcher(s)
+	w.Debounce = 20 * time.Millisecond
+	w.Logger = DiscardLogger
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Run(ctx)
+	}()
+	exists := func(name string) bool {
+		_, err := os.Lstat(filepath.Join(dst, filepath.FromSlash(name)))
+		return err == nil
+	}
+	testWaitFor(t, "full sync", func() bool {
+		return exists("a.txt") && exists("b/c.txt") && exists("d/old.txt")
+	})
+	testWriteFiles(t, src, map[string]string{
+		"a.txt":       "hello watch",
+		"new/x/y.txt": "created with its dirs",
+		"more.tmp":    "excluded",
+	})
+	os.Remove(filepath.Join(src, "b", "c.txt"))
+	os.Rename(filepath.Join(src, "d"), filepath.Join(t.TempDir(), "d"))
+	testWaitFor(t, "changes", func() bool {
+		got, _ := os.ReadFile(filepath.Join(dst, "a.txt"))
+		return string(got) == "hello watch" && exists("new/x/y.txt") && !exists("b/c.txt") && !exists("d")
+	})
+	if exists("skip.tmp") || exists("more.tmp") {
+		t.Error("excluded file synced")
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Error("run error", err)
+	}
+}